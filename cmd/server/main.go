@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/joho/godotenv"
@@ -12,6 +13,7 @@ import (
 	"coffedb/internal/api"
 	"coffedb/internal/config"
 	"coffedb/internal/storage"
+	"coffedb/internal/triggers"
 )
 
 func main() {
@@ -57,8 +59,15 @@ func main() {
 	}
 	defer engine.Close()
 
+	// Start delivering webhook triggers
+	triggerManager, err := triggers.NewManager(engine, filepath.Join(cfg.Storage.DataDir, "triggers"), cfg.Triggers)
+	if err != nil {
+		log.Fatalf("Failed to initialize triggers: %v", err)
+	}
+	defer triggerManager.Close()
+
 	// Initialize and start API server
-	server := api.NewServer(engine, cfg)
+	server := api.NewServer(engine, triggerManager, cfg)
 
 	// Start server in goroutine
 	go func() {
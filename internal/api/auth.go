@@ -0,0 +1,409 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"coffedb/internal/config"
+	"coffedb/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrKeyNotFound is returned for operations on a missing API key
+var ErrKeyNotFound = errors.New("API key not found")
+
+// errInvalidCredentials is returned for unknown, expired or malformed keys
+// and tokens. Callers are not told which.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+const (
+	// systemPrefix starts the names of collections reserved for the
+	// server, which only admins can access
+	systemPrefix = "_system."
+
+	// keysCollection holds the API keys, by ID
+	keysCollection = systemPrefix + "keys"
+
+	// keyPrefix starts every API key, which is keyPrefix, the key ID, an
+	// underscore and the secret
+	keyPrefix = "cdb_"
+
+	// principalKey is the context key of the authenticated principal
+	principalKey = "principal"
+)
+
+// Kinds of principals
+const (
+	PrincipalKey       = "key"       // an API key
+	PrincipalToken     = "token"     // a JWT bearer token
+	PrincipalBootstrap = "bootstrap" // the admin key of the config
+)
+
+// Principal is the caller a request is authenticated as
+type Principal struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Admin bool     `json:"admin"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// APIKey describes an API key. Only a hash of the key is stored; the key
+// itself is returned once, when it is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Admin     bool       `json:"admin"`
+	Roles     []string   `json:"roles"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+// Authenticator checks the credentials of requests: API keys, sent in the
+// X-API-Key header or as a bearer token, and JWTs signed with HS256.
+type Authenticator struct {
+	engine       *storage.Engine
+	config       config.AuthConfig
+	adminKeyHash string
+	audit        auditLog
+}
+
+// NewAuthenticator creates an authenticator for the given config
+func NewAuthenticator(engine *storage.Engine, cfg config.AuthConfig) *Authenticator {
+	a := &Authenticator{engine: engine, config: cfg}
+	if cfg.AdminKey != "" {
+		a.adminKeyHash = hashKey(cfg.AdminKey)
+	}
+	if cfg.Enabled && cfg.AdminKey == "" {
+		log.Printf("Authentication is enabled without an admin key; only stored API keys and tokens are accepted")
+	}
+	return a
+}
+
+// middleware authenticates requests, stores their principal in the
+// context and checks their permissions. Requests without valid
+// credentials get 401 and requests beyond the principal's permissions
+// 403; both are audited. With auth disabled every request passes.
+func (a *Authenticator) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.config.Enabled {
+			c.Next()
+			return
+		}
+
+		principal, err := a.authenticate(c.Request)
+		if err != nil {
+			a.deny(c, http.StatusUnauthorized, nil, c.Param("collection"), "", err.Error())
+			return
+		}
+		c.Set(principalKey, principal)
+
+		if !a.authorize(c, principal) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requiresAdmin reports whether a route without a collection is reserved
+// for admins
+func requiresAdmin(c *gin.Context) bool {
+	path := c.FullPath()
+	if path == "/api/v1/admin" || path == "/api/v1/audit" {
+		return true
+	}
+	return strings.HasPrefix(path, "/api/v1/keys") || strings.HasPrefix(path, "/api/v1/roles")
+}
+
+func isSystemCollection(name string) bool {
+	return strings.HasPrefix(name, systemPrefix)
+}
+
+// principal returns the principal a request was authenticated as, or nil
+// with auth disabled
+func principal(c *gin.Context) *Principal {
+	if value, exists := c.Get(principalKey); exists {
+		if p, ok := value.(*Principal); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// authenticate finds the principal of a request's credentials
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return a.verifyKey(key)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, errors.New("missing credentials: send an API key in X-API-Key or a bearer token")
+	}
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+
+	credentials = strings.TrimSpace(credentials)
+	if strings.HasPrefix(credentials, keyPrefix) || a.isAdminKey(credentials) {
+		return a.verifyKey(credentials)
+	}
+	return a.verifyToken(credentials)
+}
+
+func (a *Authenticator) isAdminKey(key string) bool {
+	return a.adminKeyHash != "" && hmac.Equal([]byte(hashKey(key)), []byte(a.adminKeyHash))
+}
+
+// verifyKey checks an API key against the bootstrap key and the stored
+// keys
+func (a *Authenticator) verifyKey(key string) (*Principal, error) {
+	if a.isAdminKey(key) {
+		return &Principal{ID: "admin", Name: "admin", Type: PrincipalBootstrap, Admin: true}, nil
+	}
+
+	id, _, found := strings.Cut(strings.TrimPrefix(key, keyPrefix), "_")
+	if !strings.HasPrefix(key, keyPrefix) || !found || id == "" {
+		return nil, errInvalidCredentials
+	}
+
+	doc, err := a.engine.Get(keysCollection, id)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	hash, _ := doc.Data["hash"].(string)
+	if !hmac.Equal([]byte(hash), []byte(hashKey(key))) {
+		return nil, errInvalidCredentials
+	}
+
+	apiKey := keyFromDocument(doc)
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return nil, errInvalidCredentials
+	}
+
+	return &Principal{ID: apiKey.ID, Name: apiKey.Name, Type: PrincipalKey, Admin: apiKey.Admin, Roles: apiKey.Roles}, nil
+}
+
+// tokenClaims are the JWT claims read from bearer tokens. Tokens must
+// name their subject and expire.
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Name      string   `json:"name"`
+	Issuer    string   `json:"iss"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Admin     bool     `json:"admin"`
+	Roles     []string `json:"roles"`
+}
+
+// verifyToken checks a JWT signed with HS256 and the configured secret
+func (a *Authenticator) verifyToken(token string) (*Principal, error) {
+	if a.config.JWTSecret == "" {
+		return nil, errInvalidCredentials
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidCredentials
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return nil, errInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	mac := hmac.New(sha256.New, []byte(a.config.JWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidCredentials
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	now := float64(time.Now().Unix())
+	switch {
+	case claims.Subject == "", claims.ExpiresAt == nil:
+		return nil, errInvalidCredentials
+	case now >= *claims.ExpiresAt:
+		return nil, errors.New("token has expired")
+	case claims.NotBefore != nil && now < *claims.NotBefore:
+		return nil, errInvalidCredentials
+	case a.config.JWTIssuer != "" && claims.Issuer != a.config.JWTIssuer:
+		return nil, errInvalidCredentials
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Subject
+	}
+	return &Principal{ID: claims.Subject, Name: name, Type: PrincipalToken, Admin: claims.Admin, Roles: claims.Roles}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// CreateKey generates an API key with the given roles. The key is only
+// returned here.
+func (a *Authenticator) CreateKey(name string, admin bool, roles []string, expiresAt *time.Time, createdBy string) (*APIKey, error) {
+	if err := a.checkRoles(roles); err != nil {
+		return nil, err
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+
+	id := randomToken(8)
+	key := keyPrefix + id + "_" + randomToken(32)
+	now := time.Now().UTC()
+
+	data := map[string]interface{}{
+		"name":       name,
+		"admin":      admin,
+		"roles":      interfaceList(roles),
+		"hash":       hashKey(key),
+		"created_at": now.Format(time.RFC3339Nano),
+	}
+	if createdBy != "" {
+		data["created_by"] = createdBy
+	}
+	if expiresAt != nil {
+		data["expires_at"] = expiresAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	if err := a.engine.Put(keysCollection, id, data); err != nil {
+		return nil, fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return &APIKey{
+		ID:        id,
+		Name:      name,
+		Admin:     admin,
+		Roles:     roles,
+		CreatedAt: now,
+		CreatedBy: createdBy,
+		ExpiresAt: expiresAt,
+		Key:       key,
+	}, nil
+}
+
+// ListKeys describes the stored API keys, oldest first
+func (a *Authenticator) ListKeys(ctx context.Context) ([]APIKey, error) {
+	docs, err := a.engine.Query(ctx, keysCollection, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0, len(docs))
+	for _, doc := range docs {
+		keys = append(keys, keyFromDocument(doc))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// GetKey describes a single API key
+func (a *Authenticator) GetKey(id string) (*APIKey, error) {
+	doc, err := a.engine.Get(keysCollection, id)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	key := keyFromDocument(doc)
+	return &key, nil
+}
+
+// SetKeyRoles replaces the roles of an API key
+func (a *Authenticator) SetKeyRoles(id string, roles []string) (*APIKey, error) {
+	if err := a.checkRoles(roles); err != nil {
+		return nil, err
+	}
+
+	doc, err := a.engine.Get(keysCollection, id)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	data := make(map[string]interface{}, len(doc.Data))
+	for field, value := range doc.Data {
+		data[field] = value
+	}
+	data["roles"] = interfaceList(roles)
+	if err := a.engine.Put(keysCollection, id, data); err != nil {
+		return nil, fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return a.GetKey(id)
+}
+
+// RevokeKey deletes an API key; requests using it fail from then on
+func (a *Authenticator) RevokeKey(id string) error {
+	if _, err := a.engine.Get(keysCollection, id); err != nil {
+		return ErrKeyNotFound
+	}
+	return a.engine.Delete(keysCollection, id)
+}
+
+// keyFromDocument reads an API key, without its hash, from its document
+func keyFromDocument(doc *storage.Document) APIKey {
+	key := APIKey{ID: doc.ID}
+	key.Name, _ = doc.Data["name"].(string)
+	key.Admin, _ = doc.Data["admin"].(bool)
+	key.Roles = stringList(doc.Data["roles"])
+	key.CreatedBy, _ = doc.Data["created_by"].(string)
+
+	if created, ok := doc.Data["created_at"].(string); ok {
+		key.CreatedAt, _ = time.Parse(time.RFC3339Nano, created)
+	}
+	if expires, ok := doc.Data["expires_at"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, expires); err == nil {
+			key.ExpiresAt = &t
+		}
+	}
+	return key
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes, hex encoded
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken makes a JWT of the claims signed with HS256 and secret
+func signToken(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+
+	created := s.mustDo(http.StatusCreated, "POST", "/api/v1/keys", `{"name": "ops", "admin": true}`, admin...)
+	key, id := created["key"].(string), created["id"].(string)
+	if !strings.HasPrefix(key, keyPrefix+id+"_") {
+		t.Fatalf("key %q does not carry its ID %s", key, id)
+	}
+	if created["created_by"] != "admin" {
+		t.Errorf("created_by = %v, want admin", created["created_by"])
+	}
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/keys", `{"name": "old", "expires_at": "2000-01-01T00:00:00Z"}`, admin...)
+
+	// The key works in either header, and is never shown again
+	s.mustDo(http.StatusOK, "GET", "/api/v1/stats", "", "X-API-Key", key)
+	s.mustDo(http.StatusOK, "GET", "/api/v1/stats", "", "Authorization", "Bearer "+key)
+	listed := s.mustDo(http.StatusOK, "GET", "/api/v1/keys", "", admin...)
+	for _, k := range listed["keys"].([]interface{}) {
+		if k.(map[string]interface{})["key"] != nil || k.(map[string]interface{})["hash"] != nil {
+			t.Errorf("listed key %v shows its secret", k)
+		}
+	}
+	s.mustDo(http.StatusOK, "GET", "/api/v1/collections/_system.keys/documents/"+id, "", admin...)
+
+	s.mustDo(http.StatusUnauthorized, "GET", "/api/v1/stats", "", "X-API-Key", key[:len(key)-1]+"x")
+	s.mustDo(http.StatusUnauthorized, "GET", "/api/v1/stats", "", "Authorization", "Basic "+key)
+
+	past := time.Now().Add(-time.Minute)
+	expired, err := s.server.auth.CreateKey("expired", true, nil, &past, "")
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	s.mustDo(http.StatusUnauthorized, "GET", "/api/v1/stats", "", "X-API-Key", expired.Key)
+
+	s.mustDo(http.StatusOK, "DELETE", "/api/v1/keys/"+id, "", admin...)
+	s.mustDo(http.StatusUnauthorized, "GET", "/api/v1/stats", "", "X-API-Key", key)
+	s.mustDo(http.StatusNotFound, "DELETE", "/api/v1/keys/"+id, "", admin...)
+}
+
+func TestBearerTokens(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+	s.mustDo(http.StatusOK, "PUT", "/api/v1/roles/analytics", `{"permissions": ["read"], "collections": ["events"]}`, admin...)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1"}`, admin...)
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	bearer := func(secret string, claims map[string]interface{}) []string {
+		return []string{"Authorization", "Bearer " + signToken(t, secret, claims)}
+	}
+
+	reader := bearer("test-jwt-secret", map[string]interface{}{"sub": "svc", "exp": exp, "roles": []string{"analytics"}})
+	s.mustDo(http.StatusOK, "GET", "/api/v1/collections/events/documents/e1", "", reader...)
+	s.mustDo(http.StatusForbidden, "POST", "/api/v1/collections/events/documents", `{}`, reader...)
+	s.mustDo(http.StatusOK, "GET", "/api/v1/stats", "", bearer("test-jwt-secret", map[string]interface{}{"sub": "ops", "exp": exp, "admin": true})...)
+
+	for name, headers := range map[string][]string{
+		"wrong secret": bearer("other-secret", map[string]interface{}{"sub": "ops", "exp": exp, "admin": true}),
+		"expired":      bearer("test-jwt-secret", map[string]interface{}{"sub": "ops", "exp": exp - 7200, "admin": true}),
+		"no expiry":    bearer("test-jwt-secret", map[string]interface{}{"sub": "ops", "admin": true}),
+		"no subject":   bearer("test-jwt-secret", map[string]interface{}{"exp": exp, "admin": true}),
+		"not yet":      bearer("test-jwt-secret", map[string]interface{}{"sub": "ops", "exp": exp, "nbf": exp, "admin": true}),
+		"unsigned": {"Authorization", "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ops","admin":true}`)) + "."},
+	} {
+		if status, body := s.do("GET", "/api/v1/stats", "", headers...); status != http.StatusUnauthorized {
+			t.Errorf("%s token: status %d, want 401: %v", name, status, body)
+		}
+	}
+}
+
+func TestAuthDisabledAcceptsAnonymousRequests(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.mustDo(http.StatusOK, "GET", "/api/v1/stats", "")
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1"}`)
+}
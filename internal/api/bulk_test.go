@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentInsertsGetDistinctIDs(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	const bulks, perBulk, creates = 4, 200, 50
+	ops := make([]string, perBulk)
+	for i := range ops {
+		ops[i] = fmt.Sprintf(`{"op": "insert", "document": {"n": %d}}`, i)
+	}
+	body := "[" + strings.Join(ops, ",") + "]"
+
+	var wg sync.WaitGroup
+	for b := 0; b < bulks; b++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, resp := s.do("POST", "/api/v1/collections/items/bulk", body); status != http.StatusOK {
+				t.Errorf("bulk: status %d: %v", status, resp)
+			}
+		}()
+	}
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, resp := s.do("POST", "/api/v1/collections/items/documents", `{"n": -1}`); status != http.StatusCreated {
+				t.Errorf("create: status %d: %v", status, resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every insert made its own document rather than replacing another's
+	result := s.mustDo(http.StatusOK, "POST", "/api/v1/collections/items/aggregate", `{"pipeline": [{"$count": "n"}]}`)
+	count := result["results"].([]interface{})[0].(map[string]interface{})["n"]
+	if count != float64(bulks*perBulk+creates) {
+		t.Errorf("count = %v, want %d", count, bulks*perBulk+creates)
+	}
+}
+
+func TestBulkReportsEachOperation(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	body := `{"op": "insert", "document": {"id": "a", "n": 1}}
+{"op": "insert", "id": "a", "document": {"n": 2}}
+{"op": "update", "id": "a", "update": {"$inc": {"n": 1}}}
+{"op": "delete", "id": "missing"}
+`
+	result := s.mustDo(http.StatusOK, "POST", "/api/v1/collections/items/bulk?ordered=false", body, "Content-Type", "application/x-ndjson")
+	if result["succeeded"] != 2.0 || result["failed"] != 2.0 {
+		t.Errorf("succeeded %v, failed %v, want 2 and 2", result["succeeded"], result["failed"])
+	}
+	for i, status := range []float64{http.StatusCreated, http.StatusConflict, http.StatusOK, http.StatusNotFound} {
+		op := result["results"].([]interface{})[i].(map[string]interface{})
+		if op["index"] != float64(i) || op["status"] != status {
+			t.Errorf("result %d = %v, want status %v", i, op, status)
+		}
+	}
+
+	// An ordered bulk stops at the duplicate
+	result = s.mustDo(http.StatusOK, "POST", "/api/v1/collections/items/bulk",
+		`[{"op": "insert", "id": "b", "document": {}}, {"op": "insert", "id": "a", "document": {}}, {"op": "insert", "id": "c", "document": {}}]`)
+	if results := result["results"].([]interface{}); len(results) != 2 {
+		t.Errorf("ordered bulk ran %d operations, want 2", len(results))
+	}
+	s.mustDo(http.StatusNotFound, "GET", "/api/v1/collections/items/documents/c", "")
+
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/collections/items/bulk", `{"op": "insert"}`)
+}
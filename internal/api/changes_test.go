@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChangesOverServerSentEvents(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u1", "name": "Ada"}`)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u2", "name": "Bob"}`)
+	first := s.engine.ChangeSeq() - 1
+
+	s.mustDo(http.StatusBadRequest, "GET", "/api/v1/collections/users/changes?ops=merge", "")
+	s.mustDo(http.StatusBadRequest, "GET", "/api/v1/collections/users/changes?after=x", "")
+	s.mustDo(http.StatusBadRequest, "GET", fmt.Sprintf("/api/v1/collections/users/changes?after=%d", first+5), "")
+
+	server := httptest.NewServer(s.server.router)
+	defer server.Close()
+
+	// A reconnecting client resumes after the last event it saw
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/collections/users/changes?ops=insert,delete", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(first))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET changes: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("changes: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	s.mustDo(http.StatusOK, "PUT", "/api/v1/collections/users/documents/u1", `{"name": "Ada Lovelace"}`)
+	s.mustDo(http.StatusOK, "DELETE", "/api/v1/collections/users/documents/u1", "")
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 2 && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		} else if strings.HasPrefix(line, "id: ") && len(events) == 0 && line != fmt.Sprintf("id: %d", first+1) {
+			t.Errorf("first event %q, want id %d", line, first+1)
+		}
+	}
+	if strings.Join(events, ",") != "insert,delete" {
+		t.Errorf("events = %v, want the insert of u2 and the delete of u1", events)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCollectionLifecycle(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	created := s.mustDo(http.StatusCreated, "POST", "/api/v1/collections",
+		`{"name": "users", "indexes": [{"name": "by_email", "fields": ["email"], "unique": true}]}`)
+	if created["documents"] != 0.0 || len(created["indexes"].([]interface{})) != 1 {
+		t.Errorf("created = %v, want an empty collection with one index", created)
+	}
+	s.mustDo(http.StatusConflict, "POST", "/api/v1/collections", `{"name": "users"}`)
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/collections", `{"name": "bad name"}`)
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/collections", `{"name": "_system.keys"}`)
+
+	// A failed index drops the new collection again
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/collections", `{"name": "orders", "indexes": [{"name": "nothing"}]}`)
+	s.mustDo(http.StatusNotFound, "GET", "/api/v1/collections/orders", "")
+
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u1", "email": "a@example.com"}`)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u2", "email": "b@example.com"}`)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1"}`)
+
+	listed := s.mustDo(http.StatusOK, "GET", "/api/v1/collections", "")
+	if listed["count"] != 2.0 {
+		t.Errorf("listed %v collections, want 2", listed["count"])
+	}
+
+	// The documents and the unique index move with the collection
+	renamed := s.mustDo(http.StatusOK, "POST", "/api/v1/collections/users/rename", `{"name": "people"}`)
+	if renamed["name"] != "people" || renamed["documents"] != 2.0 {
+		t.Errorf("renamed = %v, want people with 2 documents", renamed)
+	}
+	s.mustDo(http.StatusNotFound, "GET", "/api/v1/collections/users", "")
+	s.mustDo(http.StatusOK, "GET", "/api/v1/collections/people/documents/u1", "")
+	s.mustDo(http.StatusConflict, "POST", "/api/v1/collections/people/documents", `{"id": "u3", "email": "a@example.com"}`)
+	s.mustDo(http.StatusConflict, "POST", "/api/v1/collections/people/rename", `{"name": "events"}`)
+	s.mustDo(http.StatusNotFound, "POST", "/api/v1/collections/users/rename", `{"name": "others"}`)
+
+	dropped := s.mustDo(http.StatusOK, "DELETE", "/api/v1/collections/people", "")
+	if dropped["deleted"] != 2.0 {
+		t.Errorf("dropped %v documents, want 2", dropped["deleted"])
+	}
+	s.mustDo(http.StatusNotFound, "GET", "/api/v1/collections/people/documents/u1", "")
+	s.mustDo(http.StatusNotFound, "DELETE", "/api/v1/collections/people", "")
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPatchDocument(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u1", "name": "ada", "tags": ["x"]}`)
+	path := "/api/v1/collections/users/documents/u1"
+
+	doc := s.mustDo(http.StatusOK, "PATCH", path, `{"name": null, "age": 36}`, "Content-Type", "application/merge-patch+json")
+	if data := doc["data"].(map[string]interface{}); data["name"] != nil || data["age"] != 36.0 {
+		t.Errorf("merge patched = %v, want age without name", data)
+	}
+
+	doc = s.mustDo(http.StatusOK, "PATCH", path, `[{"op": "add", "path": "/tags/-", "value": "y"}]`, "Content-Type", "application/json-patch+json")
+	if tags := doc["data"].(map[string]interface{})["tags"].([]interface{}); len(tags) != 2 {
+		t.Errorf("json patched tags = %v, want two", tags)
+	}
+
+	// A plain JSON body is told apart by its shape
+	s.mustDo(http.StatusOK, "PATCH", path, `[{"op": "test", "path": "/age", "value": 36}]`)
+
+	s.mustDo(http.StatusConflict, "PATCH", path, `[{"op": "test", "path": "/age", "value": 1}]`, "Content-Type", "application/json-patch+json")
+	s.mustDo(http.StatusBadRequest, "PATCH", path, `[{"op": "jump", "path": "/age"}]`, "Content-Type", "application/json-patch+json")
+	s.mustDo(http.StatusNotFound, "PATCH", "/api/v1/collections/users/documents/missing", `{"age": 1}`)
+
+	got := s.mustDo(http.StatusOK, "GET", path, "")
+	if data := got["data"].(map[string]interface{}); data["age"] != 36.0 {
+		t.Errorf("stored = %v, want age 36 after the failed patches", data)
+	}
+}
@@ -1,27 +1,47 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"coffedb/internal/index"
+	"coffedb/internal/query"
 	"coffedb/internal/storage"
+	"coffedb/internal/triggers"
 )
 
 // Handlers contains all HTTP handlers
 type Handlers struct {
-	engine *storage.Engine
+	engine   *storage.Engine
+	triggers *triggers.Manager
+	auth     *Authenticator
+	done     chan struct{} // closed on shutdown to end long-lived streams
 }
 
 // NewHandlers creates a new handlers instance
-func NewHandlers(engine *storage.Engine) *Handlers {
+func NewHandlers(engine *storage.Engine, triggerManager *triggers.Manager, auth *Authenticator) *Handlers {
 	return &Handlers{
-		engine: engine,
+		engine:   engine,
+		triggers: triggerManager,
+		auth:     auth,
+		done:     make(chan struct{}),
 	}
 }
 
+// shutdown ends the change streams being served
+func (h *Handlers) shutdown() {
+	close(h.done)
+}
+
 // CreateDocument creates a new document in a collection
 func (h *Handlers) CreateDocument(c *gin.Context) {
 	collection := c.Param("collection")
@@ -38,7 +58,7 @@ func (h *Handlers) CreateDocument(c *gin.Context) {
 	// Generate ID if not provided
 	id, exists := requestBody["id"]
 	if !exists {
-		id = generateID()
+		id = h.engine.NewID()
 		requestBody["id"] = id
 	}
 
@@ -46,10 +66,7 @@ func (h *Handlers) CreateDocument(c *gin.Context) {
 	delete(requestBody, "id")
 
 	if err := h.engine.Put(collection, fmt.Sprintf("%v", id), requestBody); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create document",
-			"details": err.Error(),
-		})
+		c.JSON(errorStatus(err), errorResponse("Failed to create document", err))
 		return
 	}
 
@@ -102,10 +119,7 @@ func (h *Handlers) UpdateDocument(c *gin.Context) {
 	}
 
 	if err := h.engine.Put(collection, id, requestBody); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update document",
-			"details": err.Error(),
-		})
+		c.JSON(errorStatus(err), errorResponse("Failed to update document", err))
 		return
 	}
 
@@ -114,6 +128,314 @@ func (h *Handlers) UpdateDocument(c *gin.Context) {
 	})
 }
 
+// PatchDocument applies a partial update to a document and returns the
+// new version. The body is a JSON Merge Patch (RFC 7396), or a JSON Patch
+// (RFC 6902) when sent as application/json-patch+json or as an array of
+// operations.
+func (h *Handlers) PatchDocument(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	patch, err := parsePatch(c.ContentType(), body)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Invalid patch",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	doc, err := h.engine.Patch(collection, id, patch)
+	if err != nil {
+		c.JSON(errorStatus(err), errorResponse("Failed to patch document", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
+
+// ApplyUpdate applies update operators such as $inc and $push to a
+// document and returns the new version. With upsert a missing document is
+// created.
+func (h *Handlers) ApplyUpdate(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	var req struct {
+		Update map[string]interface{} `json:"update"`
+		Upsert bool                   `json:"upsert"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	update, err := query.ParseUpdate(req.Update)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Invalid update",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	doc, err := h.engine.Update(collection, id, update, storage.UpdateOptions{Upsert: req.Upsert})
+	if err != nil {
+		c.JSON(errorStatus(err), errorResponse("Failed to update document", err))
+		return
+	}
+
+	status := http.StatusOK
+	if doc.Version == 1 {
+		status = http.StatusCreated
+	}
+	c.JSON(status, doc)
+}
+
+// UpdateMany applies update operators to every document matching a filter
+func (h *Handlers) UpdateMany(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req struct {
+		Filter map[string]interface{} `json:"filter"`
+		Update map[string]interface{} `json:"update"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if req.Filter == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "filter is required; use {} to update every document",
+		})
+		return
+	}
+
+	update, err := query.ParseUpdate(req.Update)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Invalid update",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	result, err := h.engine.UpdateMany(collection, req.Filter, update)
+	if err != nil {
+		c.JSON(errorStatus(err), errorResponse("Failed to update documents", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteMany removes every document matching a filter
+func (h *Handlers) DeleteMany(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req struct {
+		Filter map[string]interface{} `json:"filter"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if req.Filter == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "filter is required; use {} to delete every document",
+		})
+		return
+	}
+
+	result, err := h.engine.DeleteMany(collection, req.Filter)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to delete documents",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// bulkChunkSize is the number of bulk operations written per WAL batch
+const bulkChunkSize = 1000
+
+// bulkOperation is one operation of a bulk request
+type bulkOperation struct {
+	Op       string                 `json:"op"`
+	ID       json.RawMessage        `json:"id"`
+	Document map[string]interface{} `json:"document"`
+	Update   map[string]interface{} `json:"update"`
+	Upsert   bool                   `json:"upsert"`
+}
+
+// bulkResult is the outcome of one bulk operation, with the HTTP status it
+// would have had as a single request
+type bulkResult struct {
+	Index      int               `json:"index"`
+	Op         string            `json:"op"`
+	ID         string            `json:"id,omitempty"`
+	Status     int               `json:"status"`
+	Result     string            `json:"result,omitempty"`
+	Version    int64             `json:"version,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Violations []query.Violation `json:"violations,omitempty"`
+}
+
+// Bulk runs a list of insert, replace, update and delete operations, sent
+// as a JSON array or as NDJSON with one operation per line. Operations
+// are read as a stream and written in batches. Unless ordered=false the
+// bulk stops at the first failed operation.
+func (h *Handlers) Bulk(c *gin.Context) {
+	collection := c.Param("collection")
+	ordered := c.DefaultQuery("ordered", "true") != "false"
+
+	decoder := json.NewDecoder(c.Request.Body)
+	ndjson := c.ContentType() == "application/x-ndjson"
+	if !ndjson {
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request body",
+				"details": "expected an array of operations",
+			})
+			return
+		}
+	}
+
+	results := make([]bulkResult, 0)
+	failed := 0
+	chunk := make([]storage.BulkOperation, 0, bulkChunkSize)
+
+	// write runs the pending operations and records their results
+	write := func() error {
+		written, err := h.engine.Bulk(collection, chunk, ordered)
+		if err != nil {
+			return err
+		}
+		for i, result := range written {
+			response := bulkResult{Index: len(results), Op: chunk[i].Op, ID: result.ID, Result: result.Result, Version: result.Version, Status: http.StatusOK}
+			if result.Err != nil {
+				response.Status, response.Error = errorStatus(result.Err), result.Err.Error()
+				var invalid *query.ValidationError
+				if errors.As(result.Err, &invalid) {
+					response.Violations = invalid.Violations
+				}
+				failed++
+			} else if result.Result == "inserted" || result.Result == "upserted" {
+				response.Status = http.StatusCreated
+			}
+			results = append(results, response)
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	var readErr, writeErr error
+	for writeErr == nil && !(ordered && failed > 0) {
+		if !ndjson && !decoder.More() {
+			break
+		}
+		var op bulkOperation
+		if err := decoder.Decode(&op); err != nil {
+			if err != io.EOF || !ndjson {
+				readErr = err
+			}
+			break
+		}
+
+		chunk = append(chunk, op.storage(h.engine.NewID))
+		if len(chunk) == bulkChunkSize {
+			writeErr = write()
+		}
+	}
+	if writeErr == nil && len(chunk) > 0 && !(ordered && failed > 0) {
+		writeErr = write()
+	}
+
+	response := gin.H{
+		"results": results,
+		"succeeded": len(results) - failed,
+		"failed": failed,
+	}
+	switch {
+	case writeErr != nil:
+		response["error"] = "Failed to write documents"
+		response["details"] = writeErr.Error()
+		c.JSON(http.StatusInternalServerError, response)
+	case readErr != nil:
+		response["error"] = "Invalid request body"
+		response["details"] = readErr.Error()
+		c.JSON(http.StatusBadRequest, response)
+	default:
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// storage converts a bulk operation for the engine. An inserted document
+// without an ID takes its "id" field, or one from newID.
+func (op bulkOperation) storage(newID func() string) storage.BulkOperation {
+	result := storage.BulkOperation{
+		Op:       op.Op,
+		Document: op.Document,
+		Update:   op.Update,
+		Upsert:   op.Upsert,
+	}
+
+	var id string
+	if len(op.ID) > 0 && string(op.ID) != "null" && json.Unmarshal(op.ID, &id) != nil {
+		id = string(op.ID) // a number
+	}
+	if value, exists := op.Document["id"]; exists {
+		if id == "" {
+			id = fmt.Sprintf("%v", value)
+		}
+		delete(op.Document, "id")
+	}
+	if id == "" && op.Op == storage.BulkInsert {
+		id = newID()
+	}
+
+	result.ID = id
+	return result
+}
+
+// parsePatch parses a patch body by its content type, falling back to its
+// shape for plain JSON
+func parsePatch(contentType string, body []byte) (query.Patch, error) {
+	switch contentType {
+	case "application/json-patch+json":
+		return query.ParseJSONPatch(body)
+	case "application/merge-patch+json":
+		return query.ParseMergePatch(body)
+	}
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		return query.ParseJSONPatch(body)
+	}
+	return query.ParseMergePatch(body)
+}
+
 // DeleteDocument deletes a document by ID
 func (h *Handlers) DeleteDocument(c *gin.Context) {
 	collection := c.Param("collection")
@@ -132,14 +454,18 @@ func (h *Handlers) DeleteDocument(c *gin.Context) {
 	})
 }
 
-// QueryDocuments queries documents in a collection
-func (h *Handlers) QueryDocuments(c *gin.Context) {
-	collection := c.Param("collection")
+// queryParams are the query parameters of QueryDocuments that are not
+// field filters
+var queryParams = map[string]bool{
+	"limit": true, "offset": true, "sort": true, "fields": true, "cursor": true, "timeout_ms": true,
+}
 
-	// Parse query parameters
+// paramFilter builds an equality filter from the query parameters that
+// are not in reserved
+func paramFilter(c *gin.Context, reserved map[string]bool) map[string]interface{} {
 	filter := make(map[string]interface{})
 	for key, values := range c.Request.URL.Query() {
-		if len(values) > 0 && key != "limit" && key != "offset" {
+		if len(values) > 0 && !reserved[key] {
 			// Try to parse as number, fall back to string
 			if num, err := strconv.Atoi(values[0]); err == nil {
 				filter[key] = num
@@ -152,9 +478,19 @@ func (h *Handlers) QueryDocuments(c *gin.Context) {
 			}
 		}
 	}
+	return filter
+}
+
+// QueryDocuments queries documents in a collection
+func (h *Handlers) QueryDocuments(c *gin.Context) {
+	collection := c.Param("collection")
+
+	// Parse query parameters
+	filter := paramFilter(c, queryParams)
 
-	// Parse limit and offset
-	limit := 100 // default limit
+	// Parse limit and offset; without a limit the engine picks the page
+	// size, and streamed results are unlimited
+	limit := 0
 	if limitStr := c.Query("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
 			limit = l
@@ -168,44 +504,182 @@ func (h *Handlers) QueryDocuments(c *gin.Context) {
 		}
 	}
 
-	docs, err := h.engine.Query(collection, filter)
+	timeout, _ := strconv.Atoi(c.Query("timeout_ms"))
+	h.respondQuery(c, collection, filter, c.QueryArray("sort"), c.QueryArray("fields"), timeout, storage.QueryOptions{
+		Limit:  limit,
+		Offset: offset,
+		Cursor: c.Query("cursor"),
+	})
+}
+
+// FilterDocuments queries documents with a JSON filter, which unlike
+// query parameters can use operators such as $gt, $in and $near
+func (h *Handlers) FilterDocuments(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req struct {
+		Filter    map[string]interface{} `json:"filter"`
+		Sort      []string               `json:"sort"`
+		Fields    []string               `json:"fields"`
+		Limit     int                    `json:"limit"`
+		Offset    int                    `json:"offset"`
+		Cursor    string                 `json:"cursor"`
+		TimeoutMs int                    `json:"timeout_ms"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid JSON data",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if req.Filter == nil {
+		req.Filter = make(map[string]interface{})
+	}
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	h.respondQuery(c, collection, req.Filter, req.Sort, req.Fields, req.TimeoutMs, storage.QueryOptions{
+		Limit:  req.Limit,
+		Offset: req.Offset,
+		Cursor: req.Cursor,
+	})
+}
+
+// respondQuery runs a query and writes one page of its results. sort and
+// fields hold comma-separated paths, "-" marking descending order or an
+// excluded field.
+func (h *Handlers) respondQuery(c *gin.Context, collection string, filter map[string]interface{}, sort, fields []string, timeoutMs int, opts storage.QueryOptions) {
+	ctx, cancel := queryContext(c, timeoutMs)
+	defer cancel()
+
+	var err error
+	if opts.Sort, err = query.ParseSort(sort); err == nil {
+		opts.Fields, err = query.ParseProjection(fields)
+	}
+
+	if err == nil && wantsNDJSON(c) {
+		if len(opts.Sort) > 0 || opts.Cursor != "" {
+			err = fmt.Errorf("%w: sort and cursor cannot be used when streaming", query.ErrInvalidOptions)
+		} else {
+			h.streamQuery(c, ctx, collection, storage.ScanOptions{
+				Filter: filter,
+				Fields: opts.Fields,
+				Limit:  opts.Limit,
+				Offset: opts.Offset,
+			})
+			return
+		}
+	}
+
+	var page *storage.QueryPage
+	if err == nil {
+		page, err = h.engine.QueryPage(ctx, collection, filter, opts)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(errorStatus(err), gin.H{
 			"error": "Failed to query documents",
 			"details": err.Error(),
 		})
 		return
 	}
 
-	// Apply pagination
-	total := len(docs)
-	start := offset
-	end := offset + limit
+	response := gin.H{
+		"documents": page.Documents,
+		"limit": page.Limit,
+		"offset": opts.Offset,
+		"count": len(page.Documents),
+	}
+	if page.Total >= 0 {
+		response["total"] = page.Total
+	}
+	if page.NextCursor != "" {
+		response["next_cursor"] = page.NextCursor
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ndjsonFlushEvery is the number of streamed documents written between
+// flushes to the client
+const ndjsonFlushEvery = 100
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON
+func wantsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
+
+// streamQuery writes the matching documents as newline-delimited JSON as
+// they are read. An error after the first document has been sent ends the
+// stream with an {"error": ...} line.
+func (h *Handlers) streamQuery(c *gin.Context, ctx context.Context, collection string, opts storage.ScanOptions) {
+	it := h.engine.Scan(ctx, collection, opts)
+	defer it.Close()
+
+	// Streams outlive the server's read and write timeouts
+	controller := http.NewResponseController(c.Writer)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+
+	started := false
+	encoder := json.NewEncoder(c.Writer)
+	for sent := 1; it.Next(); sent++ {
+		if !started {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			started = true
+		}
+		if err := encoder.Encode(it.Document()); err != nil {
+			return
+		}
+		if sent%ndjsonFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+	}
 
-	if start > total {
-		start = total
+	if err := it.Err(); err != nil {
+		if !started {
+			c.JSON(errorStatus(err), gin.H{
+				"error": "Failed to query documents",
+				"details": err.Error(),
+			})
+			return
+		}
+		encoder.Encode(gin.H{"error": err.Error()})
 	}
-	if end > total {
-		end = total
+	if !started {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
 	}
+	c.Writer.Flush()
+}
 
-	result := docs[start:end]
+// ListCollections lists the collections the caller can read, with their
+// sizes and indexes
+func (h *Handlers) ListCollections(c *gin.Context) {
+	p := principal(c)
+	collections := []storage.CollectionInfo{}
+	for _, info := range h.engine.ListCollections() {
+		if h.auth.allowed(p, info.Name, PermRead) {
+			collections = append(collections, info)
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"documents": result,
-		"total": total,
-		"limit": limit,
-		"offset": offset,
-		"count": len(result),
+		"collections": collections,
+		"count": len(collections),
 	})
 }
 
-// CreateIndex creates a secondary index on a field
-func (h *Handlers) CreateIndex(c *gin.Context) {
-	collection := c.Param("collection")
-
+// CreateCollection creates an empty collection, optionally with indexes
+func (h *Handlers) CreateCollection(c *gin.Context) {
 	var requestBody struct {
-		Field string `json:"field" binding:"required"`
+		Name             string                  `json:"name" binding:"required"`
+		Indexes          []index.IndexDefinition `json:"indexes"`
+		Schema           map[string]interface{}  `json:"schema"`
+		ValidationAction string                  `json:"validationAction"`
 	}
 
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -216,43 +690,1143 @@ func (h *Handlers) CreateIndex(c *gin.Context) {
 		return
 	}
 
-	if err := h.engine.CreateIndex(collection, requestBody.Field); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create index",
+	if err := reservedName(requestBody.Name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create collection",
 			"details": err.Error(),
 		})
 		return
 	}
+	if !h.auth.require(c, principal(c), requestBody.Name, PermAdmin) {
+		return
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message": fmt.Sprintf("Index created on field '%s'", requestBody.Field),
-	})
+	opts := storage.CollectionOptions{Indexes: requestBody.Indexes}
+	if requestBody.Schema != nil {
+		validator, err := storage.NewValidator(requestBody.Schema, requestBody.ValidationAction)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{
+				"error": "Invalid schema",
+				"details": err.Error(),
+			})
+			return
+		}
+		opts.Validator = validator
+	}
+
+	info, err := h.engine.CreateCollection(requestBody.Name, opts)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create collection",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, info)
 }
 
-// HealthCheck returns the health status of the database
-func (h *Handlers) HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status": "healthy",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"version": "1.0.0",
-	})
+// GetCollection describes a single collection
+func (h *Handlers) GetCollection(c *gin.Context) {
+	collection := c.Param("collection")
+
+	info, err := h.engine.GetCollection(collection)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Collection not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
 }
 
-func (h *Handlers) Custom(c *gin.Context){
-	id := c.Param("id")
+// DropCollection removes a collection with its documents and indexes
+func (h *Handlers) DropCollection(c *gin.Context) {
+	collection := c.Param("collection")
+
+	deleted, err := h.engine.DropCollection(collection)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to drop collection",
+			"details": err.Error(),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"your" : id,
+		"message": fmt.Sprintf("Collection '%s' dropped", collection),
+		"deleted": deleted,
 	})
 }
 
-// GetStats returns database statistics
-func (h *Handlers) GetStats(c *gin.Context) {
-	stats := h.engine.Stats()
-	
-	c.JSON(http.StatusOK, gin.H{
-		"database": "CoffeDB",
-		"version": "1.0.0",
-		"uptime": "running", // Would track actual uptime
+// RenameCollection moves a collection to a new name
+func (h *Handlers) RenameCollection(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var requestBody struct {
+		Name string `json:"name" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if err := reservedName(requestBody.Name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to rename collection",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !h.auth.require(c, principal(c), requestBody.Name, PermAdmin) {
+		return
+	}
+
+	if err := h.engine.RenameCollection(collection, requestBody.Name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to rename collection",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	info, err := h.engine.GetCollection(requestBody.Name)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to rename collection",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// GetSchema returns the schema of a collection
+func (h *Handlers) GetSchema(c *gin.Context) {
+	collection := c.Param("collection")
+
+	validator, err := h.engine.GetSchema(collection)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Schema not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, validator)
+}
+
+// SetSchema sets the JSON Schema the documents of a collection are
+// validated against on write. Existing documents are not checked.
+func (h *Handlers) SetSchema(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var requestBody struct {
+		Schema           map[string]interface{} `json:"schema" binding:"required"`
+		ValidationAction string                 `json:"validationAction"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	validator, err := storage.NewValidator(requestBody.Schema, requestBody.ValidationAction)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Invalid schema",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if err := h.engine.SetSchema(collection, validator); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to set schema",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, validator)
+}
+
+// RemoveSchema stops validating the documents of a collection
+func (h *Handlers) RemoveSchema(c *gin.Context) {
+	collection := c.Param("collection")
+
+	if err := h.engine.RemoveSchema(collection); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to remove schema",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Schema of '%s' removed", collection),
+	})
+}
+
+// ValidateCollection checks the existing documents of a collection against
+// its schema, or against the schema in the body before it is set
+func (h *Handlers) ValidateCollection(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var requestBody struct {
+		Schema    map[string]interface{} `json:"schema"`
+		Limit     int                    `json:"limit"`
+		TimeoutMs int                    `json:"timeout_ms"`
+	}
+
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request body",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
+	if requestBody.Limit <= 0 {
+		requestBody.Limit = 100
+	}
+
+	var validator *storage.Validator
+	if requestBody.Schema != nil {
+		var err error
+		if validator, err = storage.NewValidator(requestBody.Schema, ""); err != nil {
+			c.JSON(errorStatus(err), gin.H{
+				"error": "Invalid schema",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
+
+	ctx, cancel := queryContext(c, requestBody.TimeoutMs)
+	defer cancel()
+
+	report, err := h.engine.ValidateCollection(ctx, collection, validator, requestBody.Limit)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to validate collection",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// CreateIndex creates a secondary index on one or more fields
+func (h *Handlers) CreateIndex(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var requestBody struct {
+		Name          string                 `json:"name"`
+		Field         string                 `json:"field"`
+		Type          string                 `json:"type"`
+		Fields        []index.IndexField     `json:"fields"`
+		Unique        bool                   `json:"unique"`
+		Language      string                 `json:"language"`
+		Dimensions    int                    `json:"dimensions"`
+		Metric        string                 `json:"metric"`
+		Sparse        bool                   `json:"sparse"`
+		PartialFilter map[string]interface{} `json:"partialFilter"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// A single "field" is shorthand for an ascending one-field index
+	fields := requestBody.Fields
+	if requestBody.Field != "" {
+		fields = append([]index.IndexField{{Path: requestBody.Field, Order: 1}}, fields...)
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "either field or fields is required",
+		})
+		return
+	}
+
+	def, err := h.engine.CreateIndex(index.IndexDefinition{
+		Name:       requestBody.Name,
+		Collection: collection,
+		Type:       requestBody.Type,
+		Fields:     fields,
+		Unique:     requestBody.Unique,
+		Language:   requestBody.Language,
+		Dimensions: requestBody.Dimensions,
+		Metric:     requestBody.Metric,
+		Sparse:        requestBody.Sparse,
+		PartialFilter: requestBody.PartialFilter,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create index",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Large collections are indexed in the background
+	info, err := h.engine.GetIndex(collection, def.Name)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create index",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	status := http.StatusCreated
+	if info.State == index.IndexBuilding {
+		status = http.StatusAccepted
+	}
+
+	c.JSON(status, gin.H{
+		"message": fmt.Sprintf("Index '%s' created", def.Name),
+		"index": info,
+	})
+}
+
+// SearchDocuments runs a full-text search over a collection's text index
+func (h *Handlers) SearchDocuments(c *gin.Context) {
+	collection := c.Param("collection")
+
+	q := c.Query("q")
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing search query",
+			"details": "the q parameter is required",
+		})
+		return
+	}
+
+	limit := 20 // default limit
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	results, err := h.engine.Search(collection, c.Query("index"), q, limit)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to search documents",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"count": len(results),
+		"query": q,
+	})
+}
+
+// distinctParams are the query parameters of Distinct that are not field
+// filters
+var distinctParams = map[string]bool{"filter": true, "timeout_ms": true}
+
+// Distinct returns the distinct values of a field. Documents are filtered
+// by field=value parameters, or by a JSON filter in the filter parameter.
+func (h *Handlers) Distinct(c *gin.Context) {
+	collection := c.Param("collection")
+	field := c.Param("field")
+
+	filter := paramFilter(c, distinctParams)
+	if raw := c.Query("filter"); raw != "" {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid filter",
+				"details": err.Error(),
+			})
+			return
+		}
+		for key, value := range parsed {
+			filter[key] = value
+		}
+	}
+
+	timeout, _ := strconv.Atoi(c.Query("timeout_ms"))
+	ctx, cancel := queryContext(c, timeout)
+	defer cancel()
+
+	values, err := h.engine.Distinct(ctx, collection, field, filter)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to get distinct values",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"field": field,
+		"values": values,
+		"count": len(values),
+	})
+}
+
+// Facets counts documents per value, or per numeric range, of several
+// fields at once
+func (h *Handlers) Facets(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req struct {
+		Filter    map[string]interface{}       `json:"filter"`
+		Facets    map[string]storage.FacetSpec `json:"facets"`
+		TimeoutMs int                          `json:"timeout_ms"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(req.Facets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "facets is required",
+		})
+		return
+	}
+	if req.Filter == nil {
+		req.Filter = make(map[string]interface{})
+	}
+
+	ctx, cancel := queryContext(c, req.TimeoutMs)
+	defer cancel()
+
+	facets, err := h.engine.Facets(ctx, collection, req.Filter, req.Facets)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to compute facets",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"facets": facets,
+	})
+}
+
+// Aggregate runs an aggregation pipeline over a collection
+func (h *Handlers) Aggregate(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req struct {
+		Pipeline  json.RawMessage `json:"pipeline"`
+		TimeoutMs int             `json:"timeout_ms"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(req.Pipeline) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "pipeline is required",
+		})
+		return
+	}
+
+	pipeline, err := query.ParsePipeline(req.Pipeline)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Invalid pipeline",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Joined collections are read too, so each needs the read permission
+	// the route checked on this one
+	p := principal(c)
+	for _, lookup := range pipeline.Lookups() {
+		if !h.auth.require(c, p, lookup.From, PermRead) {
+			return
+		}
+	}
+
+	ctx, cancel := queryContext(c, req.TimeoutMs)
+	defer cancel()
+
+	results, err := h.engine.Aggregate(ctx, collection, pipeline)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to aggregate documents",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"count": len(results),
+	})
+}
+
+// VectorSearch returns the nearest neighbours of a vector, optionally
+// restricted by a filter
+func (h *Handlers) VectorSearch(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req storage.VectorQuery
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(req.Vector) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "vector is required",
+		})
+		return
+	}
+
+	results, err := h.engine.VectorSearch(collection, req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to search documents",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"count": len(results),
+	})
+}
+
+// ListIndexes lists the indexes of a collection with their build state
+func (h *Handlers) ListIndexes(c *gin.Context) {
+	collection := c.Param("collection")
+	indexes := h.engine.ListIndexes(collection)
+
+	c.JSON(http.StatusOK, gin.H{
+		"indexes": indexes,
+		"count": len(indexes),
+	})
+}
+
+// GetIndex returns a single index with its build state
+func (h *Handlers) GetIndex(c *gin.Context) {
+	collection := c.Param("collection")
+	name := c.Param("name")
+
+	info, err := h.engine.GetIndex(collection, name)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Index not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// DropIndex removes an index
+func (h *Handlers) DropIndex(c *gin.Context) {
+	collection := c.Param("collection")
+	name := c.Param("name")
+
+	if err := h.engine.DropIndex(collection, name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to drop index",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Index '%s' dropped", name),
+	})
+}
+
+// RebuildIndex starts a background rebuild of an index
+func (h *Handlers) RebuildIndex(c *gin.Context) {
+	collection := c.Param("collection")
+	name := c.Param("name")
+
+	if err := h.engine.RebuildIndex(collection, name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to rebuild index",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Unique indexes are rebuilt before RebuildIndex returns
+	if info, err := h.engine.GetIndex(collection, name); err == nil && info.State == index.IndexReady {
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("Index '%s' rebuilt", name),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": fmt.Sprintf("Index '%s' is rebuilding", name),
+	})
+}
+
+// changeHeartbeat is the interval of the comments keeping idle
+// Server-Sent Events connections open
+const changeHeartbeat = 15 * time.Second
+
+// WatchChanges streams the changes to a collection as Server-Sent Events,
+// or over a WebSocket when the request is an upgrade. Events are sent in
+// order with their sequence number, which resumes a stream after it with
+// ?after= or the Last-Event-ID header. ?ops= selects kinds of events and
+// ?filter= a JSON filter on the documents.
+func (h *Handlers) WatchChanges(c *gin.Context) {
+	collection := c.Param("collection")
+
+	opts, err := watchOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid change stream options",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	stream, err := h.engine.Watch(collection, opts)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to watch changes",
+			"details": err.Error(),
+		})
+		return
+	}
+	defer stream.Close()
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		server := websocket.Server{Handler: func(ws *websocket.Conn) {
+			h.sendChanges(ws, stream)
+		}}
+		server.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	// Streams outlive the server's read and write timeouts
+	controller := http.NewResponseController(c.Writer)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case event, ok := <-stream.Events():
+			if !ok {
+				if streamErr := stream.Err(); streamErr != nil {
+					data, _ := json.Marshal(gin.H{"error": streamErr.Error()})
+					fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", data)
+					c.Writer.Flush()
+				}
+				return
+			}
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Op, data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(c.Writer, ": ping\n\n")
+		case <-c.Request.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// sendChanges sends the events of a stream as JSON messages over a
+// WebSocket until the stream ends or the client goes away. Messages from
+// the client are ignored.
+func (h *Handlers) sendChanges(ws *websocket.Conn, stream *storage.ChangeStream) {
+	defer ws.Close()
+	ws.SetDeadline(time.Time{})
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case event, ok := <-stream.Events():
+			if !ok {
+				if err := stream.Err(); err != nil {
+					websocket.JSON.Send(ws, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// watchOptions parses the query parameters of a change stream
+func watchOptions(c *gin.Context) (storage.WatchOptions, error) {
+	var opts storage.WatchOptions
+
+	after := c.GetHeader("Last-Event-ID")
+	if after == "" {
+		after = c.Query("after")
+	}
+	if after != "" {
+		seq, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("after must be a sequence number")
+		}
+		opts.Resume, opts.After = true, seq
+	}
+
+	if ops := c.Query("ops"); ops != "" {
+		for _, op := range strings.Split(ops, ",") {
+			switch op {
+			case storage.ChangeInsert, storage.ChangeUpdate, storage.ChangeDelete, storage.ChangeDrop:
+				opts.Ops = append(opts.Ops, op)
+			default:
+				return opts, fmt.Errorf("unknown op %q", op)
+			}
+		}
+	}
+
+	if filter := c.Query("filter"); filter != "" {
+		if err := json.Unmarshal([]byte(filter), &opts.Filter); err != nil {
+			return opts, fmt.Errorf("filter must be a JSON object: %v", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// CreateTrigger registers a webhook posting the changes to a collection
+// to a URL. The response carries the secret deliveries are signed with,
+// which is not shown again.
+func (h *Handlers) CreateTrigger(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var requestBody struct {
+		URL    string                 `json:"url" binding:"required"`
+		Events []string               `json:"events"`
+		Filter map[string]interface{} `json:"filter"`
+		Secret string                 `json:"secret"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	trigger, err := h.triggers.Create(collection, triggers.Trigger{
+		URL:    requestBody.URL,
+		Events: requestBody.Events,
+		Filter: requestBody.Filter,
+		Secret: requestBody.Secret,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create trigger",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, trigger)
+}
+
+// ListTriggers lists the triggers of a collection with their delivery
+// status
+func (h *Handlers) ListTriggers(c *gin.Context) {
+	collection := c.Param("collection")
+	list := h.triggers.List(collection)
+
+	c.JSON(http.StatusOK, gin.H{
+		"triggers": list,
+		"count": len(list),
+	})
+}
+
+// GetTrigger returns a single trigger with its delivery status
+func (h *Handlers) GetTrigger(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	info, err := h.triggers.Get(collection, id)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Trigger not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// DeleteTrigger removes a trigger and discards its pending deliveries
+func (h *Handlers) DeleteTrigger(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	if err := h.triggers.Delete(collection, id); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to delete trigger",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Trigger '%s' deleted", id),
+	})
+}
+
+// ListDeliveries lists the pending deliveries of a trigger, or with
+// ?status=dead the dead letters
+func (h *Handlers) ListDeliveries(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	status := c.DefaultQuery("status", triggers.DeliveryPending)
+	if status != triggers.DeliveryPending && status != triggers.DeliveryDead {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid status",
+			"details": fmt.Sprintf("status must be %q or %q", triggers.DeliveryPending, triggers.DeliveryDead),
+		})
+		return
+	}
+
+	deliveries, err := h.triggers.Deliveries(collection, id, status)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to list deliveries",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+		"count": len(deliveries),
+	})
+}
+
+// RetryDelivery queues a dead-lettered delivery again
+func (h *Handlers) RetryDelivery(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	delivery, err := h.triggers.Retry(collection, id, c.Param("delivery"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to retry delivery",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// CreateKey generates an API key. The key is in the response only; the
+// server keeps a hash of it.
+func (h *Handlers) CreateKey(c *gin.Context) {
+	var requestBody struct {
+		Name      string     `json:"name" binding:"required"`
+		Admin     bool       `json:"admin"`
+		Roles     []string   `json:"roles"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if requestBody.ExpiresAt != nil && !requestBody.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": "expires_at must be in the future",
+		})
+		return
+	}
+
+	createdBy := ""
+	if p := principal(c); p != nil {
+		createdBy = p.Name
+	}
+
+	key, err := h.auth.CreateKey(requestBody.Name, requestBody.Admin, requestBody.Roles, requestBody.ExpiresAt, createdBy)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to create API key",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, key)
+}
+
+// ListKeys lists the API keys, without the keys themselves
+func (h *Handlers) ListKeys(c *gin.Context) {
+	keys, err := h.auth.ListKeys(c.Request.Context())
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to list API keys",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys": keys,
+		"count": len(keys),
+	})
+}
+
+// GetKey describes a single API key
+func (h *Handlers) GetKey(c *gin.Context) {
+	key, err := h.auth.GetKey(c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "API key not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+// RevokeKey deletes an API key
+func (h *Handlers) RevokeKey(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := h.auth.RevokeKey(id); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to revoke API key",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("API key '%s' revoked", id),
+	})
+}
+
+// SetKeyRoles replaces the roles of an API key
+func (h *Handlers) SetKeyRoles(c *gin.Context) {
+	var requestBody struct {
+		Roles []string `json:"roles" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	key, err := h.auth.SetKeyRoles(c.Param("id"), requestBody.Roles)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to set roles",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+// ListRoles lists the roles
+func (h *Handlers) ListRoles(c *gin.Context) {
+	roles, err := h.auth.ListRoles(c.Request.Context())
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to list roles",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"roles": roles,
+		"count": len(roles),
+	})
+}
+
+// GetRole returns a single role
+func (h *Handlers) GetRole(c *gin.Context) {
+	role, err := h.auth.GetRole(c.Param("name"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Role not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, role)
+}
+
+// PutRole creates or replaces a role. Keys and tokens holding it get the
+// new permissions on their next request.
+func (h *Handlers) PutRole(c *gin.Context) {
+	var requestBody struct {
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions" binding:"required"`
+		Collections []string `json:"collections" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	role, err := h.auth.PutRole(Role{
+		Name:        c.Param("name"),
+		Description: requestBody.Description,
+		Permissions: requestBody.Permissions,
+		Collections: requestBody.Collections,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to save role",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole removes a role
+func (h *Handlers) DeleteRole(c *gin.Context) {
+	name := c.Param("name")
+
+	if err := h.auth.DeleteRole(name); err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": "Failed to delete role",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Role '%s' deleted", name),
+	})
+}
+
+// GetAudit returns the latest requests denied with 401 or 403, newest
+// first, up to ?limit= (100 by default)
+func (h *Handlers) GetAudit(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid limit",
+			"details": "limit must be a positive integer",
+		})
+		return
+	}
+
+	entries := h.auth.Audit(limit)
+	c.JSON(http.StatusOK, gin.H{
+		"denied": entries,
+		"count": len(entries),
+	})
+}
+
+// HealthCheck returns the health status of the database
+func (h *Handlers) HealthCheck(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "healthy",
+		"timestamp": time.Now().Format(time.RFC3339),
+		"version": "1.0.0",
+	})
+}
+
+func (h *Handlers) Custom(c *gin.Context){
+	id := c.Param("id")
+	c.JSON(http.StatusOK, gin.H{
+		"your" : id,
+	})
+}
+
+// GetStats returns database statistics
+func (h *Handlers) GetStats(c *gin.Context) {
+	stats := h.engine.Stats()
+	
+	c.JSON(http.StatusOK, gin.H{
+		"database": "CoffeDB",
+		"version": "1.0.0",
+		"uptime": "running", // Would track actual uptime
 		"statistics": stats,
 		"timestamp": time.Now().Format(time.RFC3339),
 	})
@@ -260,8 +1834,98 @@ func (h *Handlers) GetStats(c *gin.Context) {
 
 // Helper functions
 
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+// queryContext returns the context of a query request, bounded by the
+// timeout_ms the client asked for. The engine applies its own query timeout
+// on top of it.
+func queryContext(c *gin.Context, timeoutMs int) (context.Context, context.CancelFunc) {
+	if timeoutMs > 0 {
+		return context.WithTimeout(c.Request.Context(), time.Duration(timeoutMs)*time.Millisecond)
+	}
+	return context.WithCancel(c.Request.Context())
+}
+
+// errorStatus maps engine errors to HTTP status codes
+func errorStatus(err error) int {
+	var duplicate *index.DuplicateKeyError
+	var aborted *storage.QueryAbortedError
+	var invalid *query.ValidationError
+	switch {
+	case errors.As(err, &aborted):
+		if aborted.Timeout() {
+			return http.StatusRequestTimeout
+		}
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &duplicate):
+		return http.StatusConflict
+	case errors.Is(err, index.ErrInvalidIndex):
+		return http.StatusBadRequest
+	case errors.Is(err, index.ErrIndexNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, index.ErrIndexExists), errors.Is(err, index.ErrIndexBuilding):
+		return http.StatusConflict
+	case errors.Is(err, index.ErrNoTextIndex), errors.Is(err, index.ErrNoVectorIndex), errors.Is(err, index.ErrInvalidVector):
+		return http.StatusBadRequest
+	case errors.Is(err, index.ErrIndexNotReady):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, query.ErrInvalidFilter), errors.Is(err, query.ErrInvalidOptions), errors.Is(err, storage.ErrInvalidCursor),
+		errors.Is(err, query.ErrInvalidPipeline), errors.Is(err, query.ErrInvalidPatch), errors.Is(err, query.ErrInvalidUpdate):
+		return http.StatusBadRequest
+	case errors.Is(err, query.ErrPatchFailed):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrDocumentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrDocumentExists):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrInvalidOperation), errors.Is(err, storage.ErrInvalidCollection):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrCollectionExists):
+		return http.StatusConflict
+	case errors.As(err, &invalid):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, query.ErrInvalidSchema):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrSchemaNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrInvalidResumeToken):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrChangeStreamLagged):
+		return http.StatusGone
+	case errors.Is(err, triggers.ErrTriggerNotFound), errors.Is(err, triggers.ErrDeliveryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, triggers.ErrInvalidTrigger):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrKeyNotFound), errors.Is(err, ErrRoleNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidRole):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// reservedName rejects new collection names in the namespace of system
+// collections
+func reservedName(name string) error {
+	if isSystemCollection(name) {
+		return fmt.Errorf("%w: names starting with %q are reserved", storage.ErrInvalidCollection, systemPrefix)
+	}
+	return nil
+}
+
+// errorResponse is the body of an error response. Documents rejected by
+// a schema come with the list of violations.
+func errorResponse(message string, err error) gin.H {
+	response := gin.H{
+		"error": message,
+		"details": err.Error(),
+	}
+
+	var invalid *query.ValidationError
+	if errors.As(err, &invalid) {
+		response["violations"] = invalid.Violations
+	}
+	return response
 }
 
 func (h *Handlers) Admin(c *gin.Context){
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"coffedb/internal/config"
+	"coffedb/internal/storage"
+)
+
+func TestMain(m *testing.M) {
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// testServer is an API server over an engine in a temporary directory
+type testServer struct {
+	t      *testing.T
+	engine *storage.Engine
+	server *Server
+	cfg    *config.Config
+}
+
+// newTestServer starts a server; configure adjusts the default config
+// before the engine opens
+func newTestServer(t *testing.T, configure func(*config.Config)) *testServer {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Storage.MemtableSize = 64 * 1024 * 1024
+	if configure != nil {
+		configure(cfg)
+	}
+
+	engine, err := storage.NewEngine(cfg.Storage)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+
+	return &testServer{t: t, engine: engine, server: NewServer(engine, nil, cfg), cfg: cfg}
+}
+
+// do sends a request with headers given as name, value pairs and returns
+// the status and decoded JSON body
+func (s *testServer) do(method, path, body string, headers ...string) (int, map[string]interface{}) {
+	s.t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	s.server.router.ServeHTTP(w, req)
+
+	var decoded map[string]interface{}
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+			s.t.Fatalf("%s %s: undecodable body %q", method, path, w.Body.String())
+		}
+	}
+	return w.Code, decoded
+}
+
+// mustDo is do failing the test unless the status is want
+func (s *testServer) mustDo(want int, method, path, body string, headers ...string) map[string]interface{} {
+	s.t.Helper()
+
+	status, decoded := s.do(method, path, body, headers...)
+	if status != want {
+		s.t.Fatalf("%s %s: status %d, want %d: %v", method, path, status, want, decoded)
+	}
+	return decoded
+}
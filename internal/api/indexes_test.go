@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIndexLifecycle(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u1", "email": "a@example.com"}`)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u2", "email": "b@example.com"}`)
+
+	created := s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/indexes", `{"name": "by_email", "field": "email", "unique": true}`)
+	if info := created["index"].(map[string]interface{}); info["state"] != "ready" || info["size"] != 2.0 {
+		t.Errorf("created index = %v, want ready with 2 keys", info)
+	}
+	s.mustDo(http.StatusConflict, "POST", "/api/v1/collections/users/indexes", `{"name": "by_email", "field": "email"}`)
+	s.mustDo(http.StatusBadRequest, "POST", "/api/v1/collections/users/indexes", `{"name": "nothing"}`)
+
+	listed := s.mustDo(http.StatusOK, "GET", "/api/v1/collections/users/indexes", "")
+	if listed["count"] != 1.0 {
+		t.Errorf("listed %v indexes, want 1", listed["count"])
+	}
+
+	info := s.mustDo(http.StatusOK, "GET", "/api/v1/collections/users/indexes/by_email", "")
+	if info["unique"] != true || info["memory_bytes"].(float64) <= 0 {
+		t.Errorf("index = %v, want unique with its memory use", info)
+	}
+
+	// Unique indexes are rebuilt before the response
+	s.mustDo(http.StatusOK, "POST", "/api/v1/collections/users/indexes/by_email/rebuild", "")
+	s.mustDo(http.StatusConflict, "POST", "/api/v1/collections/users/documents", `{"id": "u3", "email": "a@example.com"}`)
+
+	s.mustDo(http.StatusOK, "DELETE", "/api/v1/collections/users/indexes/by_email", "")
+	s.mustDo(http.StatusNotFound, "GET", "/api/v1/collections/users/indexes/by_email", "")
+	s.mustDo(http.StatusNotFound, "DELETE", "/api/v1/collections/users/indexes/by_email", "")
+	s.mustDo(http.StatusNotFound, "POST", "/api/v1/collections/users/indexes/by_email/rebuild", "")
+
+	// Without the index the address can be reused
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u3", "email": "a@example.com"}`)
+}
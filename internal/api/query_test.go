@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"coffedb/internal/config"
+)
+
+// stream sends a query asking for NDJSON and returns the status and the
+// decoded lines
+func (s *testServer) stream(path string) (int, []map[string]interface{}) {
+	s.t.Helper()
+
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	s.server.router.ServeHTTP(w, req)
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			s.t.Fatalf("GET %s: undecodable line %q", path, scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	return w.Code, lines
+}
+
+func TestQueryStreamsNDJSON(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Storage.MaxScanned = 150
+	})
+	for i := 0; i < 120; i++ {
+		s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/items/documents", fmt.Sprintf(`{"id": "i%03d", "n": %d, "secret": "x"}`, i, i))
+	}
+
+	status, lines := s.stream("/api/v1/collections/items/query?fields=n&offset=10")
+	if status != http.StatusOK || len(lines) != 110 {
+		t.Fatalf("stream: status %d, %d lines, want 200 and 110", status, len(lines))
+	}
+	first := lines[0]
+	if first["id"] != "i010" || first["data"].(map[string]interface{})["secret"] != nil {
+		t.Errorf("first line = %v, want i010 without the secret", first)
+	}
+
+	if status, lines := s.stream("/api/v1/collections/items/query?sort=n"); status != http.StatusBadRequest {
+		t.Errorf("sorted stream: status %d, %v, want 400", status, lines)
+	}
+}
+
+func TestQueryStreamReportsErrorsInline(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Storage.MaxScanned = 5
+	})
+	for i := 0; i < 10; i++ {
+		s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/items/documents", fmt.Sprintf(`{"id": "i%03d"}`, i))
+	}
+
+	// Documents sent before the limit is hit are followed by the error
+	status, lines := s.stream("/api/v1/collections/items/query")
+	if status != http.StatusOK || len(lines) != 6 || lines[5]["error"] == nil {
+		t.Errorf("stream over the scan limit: status %d, lines %v, want 5 documents and an error", status, lines)
+	}
+}
+
+func TestAbortedQueryStatus(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Storage.MaxScanned = 5
+	})
+	for i := 0; i < 10; i++ {
+		s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/items/documents", fmt.Sprintf(`{"id": "i%03d", "n": %d}`, i, i))
+	}
+
+	s.mustDo(http.StatusUnprocessableEntity, "POST", "/api/v1/collections/items/query", `{"filter": {"n": {"$gt": 8}}}`)
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrRoleNotFound is returned for operations on a missing role
+var ErrRoleNotFound = errors.New("role not found")
+
+// ErrInvalidRole is returned for malformed role definitions and for
+// assignments of roles that do not exist
+var ErrInvalidRole = errors.New("invalid role")
+
+// Permissions granted by roles on collections. Admin implies the others.
+const (
+	PermRead        = "read"         // read documents, query, watch changes
+	PermWrite       = "write"        // create, update and delete documents
+	PermIndexManage = "index-manage" // create, drop and rebuild indexes
+	PermAdmin       = "admin"        // manage the collection, its schema and triggers
+)
+
+var permissions = map[string]bool{
+	PermRead: true, PermWrite: true, PermIndexManage: true, PermAdmin: true,
+}
+
+// rolesCollection holds the roles, by name
+const rolesCollection = systemPrefix + "roles"
+
+// roleName is the form of role names
+var roleName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// Role grants permissions on the collections whose names match one of its
+// patterns. Patterns use path.Match syntax, so "*" is every collection and
+// "orders-*" a family of them. System collections are never matched.
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Permissions []string  `json:"permissions"`
+	Collections []string  `json:"collections"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// collectionRoute is the route prefix of collection-scoped endpoints
+const collectionRoute = "/api/v1/collections/:collection"
+
+// routePermissions is the permission each collection-scoped route needs
+// on its collection. Routes missing here need PermAdmin.
+var routePermissions = map[string]string{
+	"GET " + collectionRoute:                       PermRead,
+	"GET " + collectionRoute + "/documents/:id":    PermRead,
+	"GET " + collectionRoute + "/query":            PermRead,
+	"POST " + collectionRoute + "/query":           PermRead,
+	"GET " + collectionRoute + "/search":           PermRead,
+	"POST " + collectionRoute + "/vector-search":   PermRead,
+	"POST " + collectionRoute + "/aggregate":       PermRead,
+	"GET " + collectionRoute + "/distinct/:field":  PermRead,
+	"POST " + collectionRoute + "/facets":          PermRead,
+	"GET " + collectionRoute + "/changes":          PermRead,
+	"GET " + collectionRoute + "/schema":           PermRead,
+	"POST " + collectionRoute + "/schema/validate": PermRead,
+	"GET " + collectionRoute + "/indexes":          PermRead,
+	"GET " + collectionRoute + "/indexes/:name":    PermRead,
+
+	"POST " + collectionRoute + "/documents":            PermWrite,
+	"PUT " + collectionRoute + "/documents/:id":         PermWrite,
+	"PATCH " + collectionRoute + "/documents/:id":       PermWrite,
+	"DELETE " + collectionRoute + "/documents/:id":      PermWrite,
+	"POST " + collectionRoute + "/documents/:id/update": PermWrite,
+	"POST " + collectionRoute + "/bulk":                 PermWrite,
+	"POST " + collectionRoute + "/update":               PermWrite,
+	"POST " + collectionRoute + "/delete":               PermWrite,
+
+	"POST " + collectionRoute + "/indexes":               PermIndexManage,
+	"DELETE " + collectionRoute + "/indexes/:name":       PermIndexManage,
+	"POST " + collectionRoute + "/indexes/:name/rebuild": PermIndexManage,
+}
+
+// authorize checks that the principal of a request may make it, aborting
+// it with 403 otherwise. Collection-scoped routes need the permission of
+// routePermissions on their collection; key, role and audit management
+// and the admin endpoint need an admin principal. Other routes are open
+// to every principal, and handlers check what they touch themselves.
+func (a *Authenticator) authorize(c *gin.Context, p *Principal) bool {
+	if collection := c.Param("collection"); collection != "" {
+		permission, listed := routePermissions[c.Request.Method+" "+c.FullPath()]
+		if !listed {
+			permission = PermAdmin
+		}
+		return a.require(c, p, collection, permission)
+	}
+
+	if requiresAdmin(c) && !p.Admin {
+		a.deny(c, http.StatusForbidden, p, "", PermAdmin, fmt.Sprintf("%s %s requires an admin", c.Request.Method, c.FullPath()))
+		return false
+	}
+	return true
+}
+
+// require checks that the principal of a request holds a permission on a
+// collection, aborting the request with 403 otherwise. With auth disabled
+// every request holds every permission.
+func (a *Authenticator) require(c *gin.Context, p *Principal, collection, permission string) bool {
+	if !a.config.Enabled || a.allowed(p, collection, permission) {
+		return true
+	}
+
+	reason := fmt.Sprintf("%s permission on collection %q is required", permission, collection)
+	if isSystemCollection(collection) {
+		reason = fmt.Sprintf("collection %q is reserved for admins", collection)
+	}
+	a.deny(c, http.StatusForbidden, p, collection, permission, reason)
+	return false
+}
+
+// allowed reports whether a principal holds a permission on a collection.
+// Admin principals hold every permission; the others hold those of their
+// roles, and none on system collections.
+func (a *Authenticator) allowed(p *Principal, collection, permission string) bool {
+	if !a.config.Enabled {
+		return true
+	}
+	if p == nil || isSystemCollection(collection) {
+		return p != nil && p.Admin
+	}
+	if p.Admin {
+		return true
+	}
+
+	for _, name := range p.Roles {
+		role, err := a.GetRole(name)
+		if err != nil {
+			continue
+		}
+		if role.grants(collection, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// grants reports whether a role holds a permission on a collection
+func (r *Role) grants(collection, permission string) bool {
+	held := false
+	for _, p := range r.Permissions {
+		if p == permission || p == PermAdmin {
+			held = true
+			break
+		}
+	}
+	if !held {
+		return false
+	}
+
+	for _, pattern := range r.Collections {
+		if matched, _ := path.Match(pattern, collection); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// PutRole creates or replaces a role
+func (a *Authenticator) PutRole(role Role) (*Role, error) {
+	if !roleName.MatchString(role.Name) {
+		return nil, fmt.Errorf("%w: invalid name %q", ErrInvalidRole, role.Name)
+	}
+	if len(role.Permissions) == 0 || len(role.Collections) == 0 {
+		return nil, fmt.Errorf("%w: permissions and collections are required", ErrInvalidRole)
+	}
+	for _, permission := range role.Permissions {
+		if !permissions[permission] {
+			return nil, fmt.Errorf("%w: unknown permission %q", ErrInvalidRole, permission)
+		}
+	}
+	for _, pattern := range role.Collections {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("%w: invalid collection pattern %q", ErrInvalidRole, pattern)
+		}
+	}
+
+	role.UpdatedAt = time.Now().UTC()
+	data := map[string]interface{}{
+		"description": role.Description,
+		"permissions": interfaceList(role.Permissions),
+		"collections": interfaceList(role.Collections),
+		"updated_at":  role.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	if err := a.engine.Put(rolesCollection, role.Name, data); err != nil {
+		return nil, fmt.Errorf("failed to store role: %w", err)
+	}
+	return &role, nil
+}
+
+// GetRole returns a role by name
+func (a *Authenticator) GetRole(name string) (*Role, error) {
+	doc, err := a.engine.Get(rolesCollection, name)
+	if err != nil {
+		return nil, ErrRoleNotFound
+	}
+
+	role := &Role{Name: doc.ID}
+	role.Description, _ = doc.Data["description"].(string)
+	role.Permissions = stringList(doc.Data["permissions"])
+	role.Collections = stringList(doc.Data["collections"])
+	if updated, ok := doc.Data["updated_at"].(string); ok {
+		role.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updated)
+	}
+	return role, nil
+}
+
+// ListRoles returns every role, ordered by name
+func (a *Authenticator) ListRoles(ctx context.Context) ([]Role, error) {
+	docs, err := a.engine.Query(ctx, rolesCollection, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]Role, 0, len(docs))
+	for _, doc := range docs {
+		if role, err := a.GetRole(doc.ID); err == nil {
+			roles = append(roles, *role)
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, nil
+}
+
+// DeleteRole removes a role. Keys and tokens naming it lose its
+// permissions.
+func (a *Authenticator) DeleteRole(name string) error {
+	if _, err := a.engine.Get(rolesCollection, name); err != nil {
+		return ErrRoleNotFound
+	}
+	return a.engine.Delete(rolesCollection, name)
+}
+
+// checkRoles verifies that roles exist before they are assigned
+func (a *Authenticator) checkRoles(names []string) error {
+	for _, name := range names {
+		if _, err := a.GetRole(name); err != nil {
+			return fmt.Errorf("%w: role %q does not exist", ErrInvalidRole, name)
+		}
+	}
+	return nil
+}
+
+func interfaceList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
+
+// stringList reads a list of strings stored in a document
+func stringList(value interface{}) []string {
+	values, _ := value.([]interface{})
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// auditSize is the number of denied requests kept for the audit endpoint
+const auditSize = 1000
+
+// AuditEntry records a request denied with 401 or 403
+type AuditEntry struct {
+	Time       time.Time  `json:"time"`
+	Status     int        `json:"status"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Collection string     `json:"collection,omitempty"`
+	Permission string     `json:"permission,omitempty"`
+	Principal  *Principal `json:"principal,omitempty"`
+	RemoteAddr string     `json:"remote_addr"`
+	Reason     string     `json:"reason"`
+}
+
+// auditLog keeps the latest denied requests in a ring buffer. Every denial
+// is also written to the server log.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	next    int
+}
+
+func (l *auditLog) record(entry AuditEntry) {
+	who := "anonymous"
+	if entry.Principal != nil {
+		who = fmt.Sprintf("%s %s (%s)", entry.Principal.Type, entry.Principal.ID, entry.Principal.Name)
+	}
+	log.Printf("access denied: %d %s %s from %s by %s: %s", entry.Status, entry.Method, entry.Path, entry.RemoteAddr, who, entry.Reason)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < auditSize {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+	}
+	l.next = (l.next + 1) % auditSize
+}
+
+// recent returns up to limit entries, newest first
+func (l *auditLog) recent(limit int) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit <= 0 || limit > len(l.entries) {
+		limit = len(l.entries)
+	}
+	entries := make([]AuditEntry, 0, limit)
+	for i := 1; i <= limit; i++ {
+		entries = append(entries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return entries
+}
+
+// deny aborts a request and records it in the audit log
+func (a *Authenticator) deny(c *gin.Context, status int, p *Principal, collection, permission, reason string) {
+	a.audit.record(AuditEntry{
+		Time:       time.Now().UTC(),
+		Status:     status,
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Collection: collection,
+		Permission: permission,
+		Principal:  p,
+		RemoteAddr: c.ClientIP(),
+		Reason:     reason,
+	})
+
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Bearer realm="coffedb"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":   http.StatusText(status),
+		"details": reason,
+	})
+}
+
+// Audit returns up to limit of the latest denied requests, newest first
+func (a *Authenticator) Audit(limit int) []AuditEntry {
+	return a.audit.recent(limit)
+}
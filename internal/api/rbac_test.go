@@ -0,0 +1,154 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"coffedb/internal/config"
+)
+
+const testAdminKey = "test-admin-key"
+
+func newAuthServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *config.Config) {
+		cfg.Auth = config.AuthConfig{Enabled: true, AdminKey: testAdminKey, JWTSecret: "test-jwt-secret"}
+	})
+}
+
+// keyWithRole creates a role and an API key holding it, returning the key
+func (s *testServer) keyWithRole(role, body string) string {
+	s.t.Helper()
+	admin := []string{"X-API-Key", testAdminKey}
+
+	s.mustDo(http.StatusOK, "PUT", "/api/v1/roles/"+role, body, admin...)
+	created := s.mustDo(http.StatusCreated, "POST", "/api/v1/keys", `{"name": "`+role+`", "roles": ["`+role+`"]}`, admin...)
+	return created["key"].(string)
+}
+
+func TestRoutePermissions(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1", "n": 1}`, admin...)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/orders-eu/documents", `{"id": "o1", "n": 1}`, admin...)
+
+	reader := []string{"X-API-Key", s.keyWithRole("analytics", `{"permissions": ["read"], "collections": ["events"]}`)}
+	service := []string{"X-API-Key", s.keyWithRole("orders", `{"permissions": ["read", "write"], "collections": ["orders-*"]}`)}
+
+	tests := []struct {
+		name    string
+		headers []string
+		method  string
+		path    string
+		body    string
+		want    int
+	}{
+		{"reader reads", reader, "GET", "/api/v1/collections/events/documents/e1", "", http.StatusOK},
+		{"reader queries by POST", reader, "POST", "/api/v1/collections/events/query", `{"filter": {}}`, http.StatusOK},
+		{"reader cannot write", reader, "POST", "/api/v1/collections/events/documents", `{"n": 2}`, http.StatusForbidden},
+		{"reader cannot index", reader, "POST", "/api/v1/collections/events/indexes", `{"name": "n", "fields": ["n"]}`, http.StatusForbidden},
+		{"reader cannot drop", reader, "DELETE", "/api/v1/collections/events", "", http.StatusForbidden},
+		{"reader scoped to pattern", reader, "GET", "/api/v1/collections/orders-eu/documents/o1", "", http.StatusForbidden},
+		{"service writes matching collection", service, "POST", "/api/v1/collections/orders-us/documents", `{"n": 2}`, http.StatusCreated},
+		{"service cannot read other collection", service, "GET", "/api/v1/collections/events/documents/e1", "", http.StatusForbidden},
+		{"system collection reserved", service, "GET", "/api/v1/collections/_system.keys/query", "", http.StatusForbidden},
+		{"role management reserved", service, "GET", "/api/v1/roles", "", http.StatusForbidden},
+		{"unlisted collection route needs admin", service, "PUT", "/api/v1/collections/orders-eu/schema", `{"schema": {}}`, http.StatusForbidden},
+		{"create needs admin on new name", service, "POST", "/api/v1/collections", `{"name": "orders-ca"}`, http.StatusForbidden},
+		{"no credentials", nil, "GET", "/api/v1/collections/events/documents/e1", "", http.StatusUnauthorized},
+		{"bad key", []string{"X-API-Key", "cdb_nope_nope"}, "GET", "/api/v1/stats", "", http.StatusUnauthorized},
+		{"health is open", nil, "GET", "/api/v1/health", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := s.do(tt.method, tt.path, tt.body, tt.headers...); status != tt.want {
+				t.Errorf("%s %s: status %d, want %d: %v", tt.method, tt.path, status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestListCollectionsFiltersByReadPermission(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"n": 1}`, admin...)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/orders/documents", `{"n": 1}`, admin...)
+	reader := s.keyWithRole("analytics", `{"permissions": ["read"], "collections": ["events"]}`)
+
+	body := s.mustDo(http.StatusOK, "GET", "/api/v1/collections", "", "X-API-Key", reader)
+	collections := body["collections"].([]interface{})
+	if len(collections) != 1 || collections[0].(map[string]interface{})["name"] != "events" {
+		t.Fatalf("collections = %v, want only events", collections)
+	}
+}
+
+func TestAggregateLookupNeedsReadOnForeignCollection(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1", "user": "u1"}`, admin...)
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/users/documents", `{"id": "u1", "uid": "u1", "name": "Ada"}`, admin...)
+	reader := []string{"X-API-Key", s.keyWithRole("analytics", `{"permissions": ["read"], "collections": ["events"]}`)}
+
+	lookup := func(from string) string {
+		return `{"pipeline": [{"$lookup": {"from": "` + from + `", "localField": "user", "foreignField": "uid", "as": "joined"}}]}`
+	}
+
+	for _, from := range []string{"_system.keys", "_system.roles", "users"} {
+		status, body := s.do("POST", "/api/v1/collections/events/aggregate", lookup(from), reader...)
+		if status != http.StatusForbidden {
+			t.Errorf("$lookup from %s: status %d, want 403: %v", from, status, body)
+		}
+	}
+
+	// The denials are audited like any other 403
+	audit := s.mustDo(http.StatusOK, "GET", "/api/v1/audit?limit=10", "", admin...)
+	found := false
+	for _, entry := range audit["denied"].([]interface{}) {
+		e := entry.(map[string]interface{})
+		if e["collection"] == "_system.keys" && strings.HasSuffix(e["path"].(string), "/aggregate") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("audit %v has no denial of the _system.keys $lookup", audit["denied"])
+	}
+
+	// Joining a readable collection still works
+	s.mustDo(http.StatusOK, "PUT", "/api/v1/roles/analytics", `{"permissions": ["read"], "collections": ["events", "users"]}`, admin...)
+	body := s.mustDo(http.StatusOK, "POST", "/api/v1/collections/events/aggregate", lookup("users"), reader...)
+	results := body["results"].([]interface{})
+	if joined := results[0].(map[string]interface{})["joined"].([]interface{}); len(joined) != 1 {
+		t.Errorf("joined = %v, want the user", joined)
+	}
+}
+
+func TestRoleValidation(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+
+	for _, body := range []string{
+		`{"permissions": ["fly"], "collections": ["x"]}`,
+		`{"permissions": ["read"], "collections": ["x["]}`,
+		`{"permissions": [], "collections": ["x"]}`,
+	} {
+		if status, resp := s.do("PUT", "/api/v1/roles/bad", body, admin...); status != http.StatusBadRequest {
+			t.Errorf("PUT role %s: status %d, want 400: %v", body, status, resp)
+		}
+	}
+
+	if status, resp := s.do("POST", "/api/v1/keys", `{"name": "k", "roles": ["missing"]}`, admin...); status != http.StatusBadRequest {
+		t.Errorf("key with unknown role: status %d, want 400: %v", status, resp)
+	}
+}
+
+func TestDeletedRoleRevokesPermissions(t *testing.T) {
+	s := newAuthServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+	s.mustDo(http.StatusCreated, "POST", "/api/v1/collections/events/documents", `{"id": "e1"}`, admin...)
+	reader := []string{"X-API-Key", s.keyWithRole("analytics", `{"permissions": ["read"], "collections": ["events"]}`)}
+
+	s.mustDo(http.StatusOK, "GET", "/api/v1/collections/events/documents/e1", "", reader...)
+	s.mustDo(http.StatusOK, "DELETE", "/api/v1/roles/analytics", "", admin...)
+	s.mustDo(http.StatusForbidden, "GET", "/api/v1/collections/events/documents/e1", "", reader...)
+}
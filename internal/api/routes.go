@@ -9,20 +9,23 @@ import (
 	"github.com/gin-gonic/gin"
 	"coffedb/internal/config"
 	"coffedb/internal/storage"
+	"coffedb/internal/triggers"
 )
 
 // Server represents the HTTP server
 type Server struct {
 	engine   *storage.Engine
 	handlers *Handlers
+	auth     *Authenticator
 	router   *gin.Engine
 	server   *http.Server
 	config   *config.Config
 }
 
 // NewServer creates a new HTTP server
-func NewServer(engine *storage.Engine, cfg *config.Config) *Server {
-	handlers := NewHandlers(engine)
+func NewServer(engine *storage.Engine, triggerManager *triggers.Manager, cfg *config.Config) *Server {
+	auth := NewAuthenticator(engine, cfg.Auth)
+	handlers := NewHandlers(engine, triggerManager, auth)
 	
 	// Set gin mode
 	if cfg.Server.Debug {
@@ -42,6 +45,7 @@ func NewServer(engine *storage.Engine, cfg *config.Config) *Server {
 	server := &Server{
 		engine:   engine,
 		handlers: handlers,
+		auth:     auth,
 		router:   router,
 		config:   cfg,
 	}
@@ -55,12 +59,39 @@ func (s *Server) setupRoutes() {
 	// API version 1
 	v1 := s.router.Group("/api/v1")
 	
-	// Health and stats endpoints
-	v1.GET("/:id", s.handlers.Custom)
+	// Health check, open to load balancers
 	v1.GET("/health", s.handlers.HealthCheck)
+
+	// Routes registered from here on require credentials when auth is
+	// enabled
+	v1.Use(s.auth.middleware())
+
+	// Stats endpoints
+	v1.GET("/:id", s.handlers.Custom)
 	v1.GET("/stats", s.handlers.GetStats)
 	v1.GET("/admin", s.handlers.Admin)
+
+	// API key management, for admins
+	v1.POST("/keys", s.handlers.CreateKey)
+	v1.GET("/keys", s.handlers.ListKeys)
+	v1.GET("/keys/:id", s.handlers.GetKey)
+	v1.DELETE("/keys/:id", s.handlers.RevokeKey)
+	v1.PUT("/keys/:id/roles", s.handlers.SetKeyRoles)
+
+	// Roles and the audit of denied requests, for admins
+	v1.GET("/roles", s.handlers.ListRoles)
+	v1.GET("/roles/:name", s.handlers.GetRole)
+	v1.PUT("/roles/:name", s.handlers.PutRole)
+	v1.DELETE("/roles/:name", s.handlers.DeleteRole)
+	v1.GET("/audit", s.handlers.GetAudit)
 	
+	// Collection management
+	v1.GET("/collections", s.handlers.ListCollections)
+	v1.POST("/collections", s.handlers.CreateCollection)
+	v1.GET("/collections/:collection", s.handlers.GetCollection)
+	v1.DELETE("/collections/:collection", s.handlers.DropCollection)
+	v1.POST("/collections/:collection/rename", s.handlers.RenameCollection)
+
 	// Collection routes
 	collections := v1.Group("/collections/:collection")
 	{
@@ -70,14 +101,48 @@ func (s *Server) setupRoutes() {
 			documents.POST("", s.handlers.CreateDocument)
 			documents.GET("/:id", s.handlers.GetDocument)
 			documents.PUT("/:id", s.handlers.UpdateDocument)
+			documents.PATCH("/:id", s.handlers.PatchDocument)
+			documents.POST("/:id/update", s.handlers.ApplyUpdate)
 			documents.DELETE("/:id", s.handlers.DeleteDocument)
 		}
 		
-		// Query endpoint
+		// Query endpoints
 		collections.GET("/query", s.handlers.QueryDocuments)
+		collections.POST("/query", s.handlers.FilterDocuments)
+		collections.GET("/search", s.handlers.SearchDocuments)
+		collections.POST("/vector-search", s.handlers.VectorSearch)
+		collections.POST("/aggregate", s.handlers.Aggregate)
+		collections.GET("/distinct/:field", s.handlers.Distinct)
+		collections.POST("/facets", s.handlers.Facets)
+
+		// Change streams, as Server-Sent Events or over a WebSocket
+		collections.GET("/changes", s.handlers.WatchChanges)
+
+		// Webhook triggers
+		collections.POST("/triggers", s.handlers.CreateTrigger)
+		collections.GET("/triggers", s.handlers.ListTriggers)
+		collections.GET("/triggers/:id", s.handlers.GetTrigger)
+		collections.DELETE("/triggers/:id", s.handlers.DeleteTrigger)
+		collections.GET("/triggers/:id/deliveries", s.handlers.ListDeliveries)
+		collections.POST("/triggers/:id/deliveries/:delivery/retry", s.handlers.RetryDelivery)
+
+		// Schema validation
+		collections.GET("/schema", s.handlers.GetSchema)
+		collections.PUT("/schema", s.handlers.SetSchema)
+		collections.DELETE("/schema", s.handlers.RemoveSchema)
+		collections.POST("/schema/validate", s.handlers.ValidateCollection)
+
+		// Bulk and filtered writes
+		collections.POST("/bulk", s.handlers.Bulk)
+		collections.POST("/update", s.handlers.UpdateMany)
+		collections.POST("/delete", s.handlers.DeleteMany)
 		
 		// Index management
-		collections.POST("/indexes", s.handlers.CreateIndex) 
+		collections.POST("/indexes", s.handlers.CreateIndex)
+		collections.GET("/indexes", s.handlers.ListIndexes)
+		collections.GET("/indexes/:name", s.handlers.GetIndex)
+		collections.DELETE("/indexes/:name", s.handlers.DropIndex)
+		collections.POST("/indexes/:name/rebuild", s.handlers.RebuildIndex)
 		// collections.GET("/admin", s.handlers.Admin)
 	}
 
@@ -118,6 +183,9 @@ func (s *Server) Shutdown() error {
 		return nil
 	}
 
+	// End change streams, which would otherwise hold the shutdown
+	s.handlers.shutdown()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -129,8 +197,8 @@ func (s *Server) Shutdown() error {
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
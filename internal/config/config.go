@@ -7,9 +7,11 @@ import (
 
 // Config represents the application configuration
 type Config struct {
-	Server  ServerConfig  `json:"server"`
-	Storage StorageConfig `json:"storage"`
-	Logging LoggingConfig `json:"logging"`
+	Server   ServerConfig   `json:"server"`
+	Storage  StorageConfig  `json:"storage"`
+	Triggers TriggersConfig `json:"triggers"`
+	Auth     AuthConfig     `json:"auth"`
+	Logging  LoggingConfig  `json:"logging"`
 }
 
 // ServerConfig contains HTTP server configuration
@@ -29,6 +31,28 @@ type StorageConfig struct {
 	WALSyncInterval     int    `json:"wal_sync_interval"`
 	EnableCompression   bool   `json:"enable_compression"`
 	MaxOpenFiles        int    `json:"max_open_files"`
+	QueryTimeout        int    `json:"query_timeout_ms"`       // max execution time of a query, 0 for none
+	MaxScanned          int    `json:"max_documents_scanned"`  // per query, 0 for no limit
+	MaxReturned         int    `json:"max_documents_returned"` // per query, 0 for no limit
+}
+
+// TriggersConfig contains webhook delivery configuration
+type TriggersConfig struct {
+	Workers      int      `json:"workers"`        // concurrent deliveries
+	TimeoutMs    int      `json:"timeout_ms"`     // per delivery attempt
+	MaxAttempts  int      `json:"max_attempts"`   // before a delivery is dead-lettered
+	BackoffMs    int      `json:"backoff_ms"`     // delay after the first failure, doubled after each
+	MaxBackoffMs int      `json:"max_backoff_ms"` // cap on the delay between attempts
+	AllowedHosts []string `json:"allowed_hosts"`  // hosts delivered to on loopback, link-local or private addresses
+}
+
+// AuthConfig contains authentication configuration. With auth enabled
+// every request but the health check needs an API key or a bearer token.
+type AuthConfig struct {
+	Enabled   bool   `json:"enabled"`
+	AdminKey  string `json:"admin_key"`  // bootstrap key with admin rights, empty for none
+	JWTSecret string `json:"jwt_secret"` // HMAC key of bearer tokens, empty to accept API keys only
+	JWTIssuer string `json:"jwt_issuer"` // required "iss" claim of tokens, if set
 }
 
 // LoggingConfig contains logging configuration
@@ -76,6 +100,14 @@ func Default() *Config {
 			WALSyncInterval:    1,                // 1 second
 			EnableCompression:  false,
 			MaxOpenFiles:       1000,
+			QueryTimeout:       30000,            // 30 seconds
+		},
+		Triggers: TriggersConfig{
+			Workers:      4,
+			TimeoutMs:    10000,   // 10 seconds
+			MaxAttempts:  8,
+			BackoffMs:    1000,    // 1 second
+			MaxBackoffMs: 3600000, // 1 hour
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
@@ -105,6 +137,18 @@ func (c *Config) applyEnvOverrides() {
 	if compression := os.Getenv("coffedb_COMPRESSION"); compression == "true" {
 		c.Storage.EnableCompression = true
 	}
+
+	if auth := os.Getenv("coffedb_AUTH"); auth == "true" {
+		c.Auth.Enabled = true
+	}
+
+	if adminKey := os.Getenv("coffedb_ADMIN_KEY"); adminKey != "" {
+		c.Auth.AdminKey = adminKey
+	}
+
+	if jwtSecret := os.Getenv("coffedb_JWT_SECRET"); jwtSecret != "" {
+		c.Auth.JWTSecret = jwtSecret
+	}
 }
 
 // Save saves configuration to file
@@ -0,0 +1,59 @@
+// Package fileutil holds the file handling shared by the packages that
+// persist state in the data directory.
+package fileutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic replaces the file at path with what write produces. The
+// content goes to a temporary file that is synced and renamed over path,
+// and the directory is synced after the rename, so readers never observe
+// a partially written file and a crash leaves either the old or the new
+// file in place.
+func WriteAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// SyncDir makes the creation, removal and renaming of the entries of a
+// directory durable
+func SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
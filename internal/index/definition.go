@@ -0,0 +1,169 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"coffedb/internal/query"
+)
+
+// Index types
+const (
+	IndexTypeOrdered = "ordered"
+	IndexTypeText    = "text"
+	IndexTypeGeo     = "geo"
+	IndexTypeVector  = "vector"
+)
+
+// Vector index metrics
+const (
+	MetricCosine = "cosine"
+	MetricDot    = "dot"
+	MetricL2     = "l2"
+)
+
+// maxVectorDimensions bounds the dimension of a vector index
+const maxVectorDimensions = 4096
+
+// IndexField is one key field of an index. Order is 1 for ascending and
+// -1 for descending.
+type IndexField struct {
+	Path  string `json:"path"`
+	Order int    `json:"order"`
+}
+
+// UnmarshalJSON accepts either an object or a path string, where a
+// leading "-" selects descending order
+func (f *IndexField) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		f.Order = 1
+		if strings.HasPrefix(path, "-") {
+			f.Order = -1
+			path = path[1:]
+		}
+		f.Path = path
+		return nil
+	}
+
+	type plain IndexField
+	var field plain
+	if err := json.Unmarshal(data, &field); err != nil {
+		return err
+	}
+
+	*f = IndexField(field)
+	if f.Order == 0 {
+		f.Order = 1
+	}
+	return nil
+}
+
+// IndexDefinition describes a secondary index as stored in the catalog
+type IndexDefinition struct {
+	Name          string                 `json:"name"`
+	Collection    string                 `json:"collection"`
+	Type          string                 `json:"type"`
+	Fields        []IndexField           `json:"fields"`
+	Unique        bool                   `json:"unique,omitempty"`
+	Language      string                 `json:"language,omitempty"`      // text indexes only
+	Dimensions    int                    `json:"dimensions,omitempty"`    // vector indexes only
+	Metric        string                 `json:"metric,omitempty"`        // vector indexes only
+	Sparse        bool                   `json:"sparse,omitempty"`        // skip documents whose fields are all null
+	PartialFilter map[string]interface{} `json:"partialFilter,omitempty"` // only index documents matching it
+	CreatedAt     time.Time              `json:"created_at"`
+}
+
+// generation identifies this index among those created under its name,
+// by its creation time. It is zero for indexes created before the time
+// was recorded.
+func (d *IndexDefinition) generation() int64 {
+	if d.CreatedAt.IsZero() {
+		return 0
+	}
+	return d.CreatedAt.UnixNano()
+}
+
+// Validate checks the definition and fills in defaults
+func (d *IndexDefinition) Validate() error {
+	if len(d.Fields) == 0 {
+		return fmt.Errorf("%w: index must have at least one field", ErrInvalidIndex)
+	}
+	if d.Type == "" {
+		d.Type = IndexTypeOrdered
+	}
+
+	switch d.Type {
+	case IndexTypeOrdered:
+	case IndexTypeText:
+		if d.Unique {
+			return fmt.Errorf("%w: text indexes cannot be unique", ErrInvalidIndex)
+		}
+		if d.Language == "" {
+			d.Language = "english"
+		}
+		if d.Language != "english" && d.Language != "none" {
+			return fmt.Errorf("%w: unsupported language %q", ErrInvalidIndex, d.Language)
+		}
+	case IndexTypeGeo:
+		if d.Unique {
+			return fmt.Errorf("%w: geo indexes cannot be unique", ErrInvalidIndex)
+		}
+		if len(d.Fields) != 1 {
+			return fmt.Errorf("%w: geo indexes take exactly one field", ErrInvalidIndex)
+		}
+	case IndexTypeVector:
+		if d.Unique {
+			return fmt.Errorf("%w: vector indexes cannot be unique", ErrInvalidIndex)
+		}
+		if len(d.Fields) != 1 {
+			return fmt.Errorf("%w: vector indexes take exactly one field", ErrInvalidIndex)
+		}
+		if d.Dimensions <= 0 || d.Dimensions > maxVectorDimensions {
+			return fmt.Errorf("%w: dimensions must be between 1 and %d", ErrInvalidIndex, maxVectorDimensions)
+		}
+		if d.Metric == "" {
+			d.Metric = MetricCosine
+		}
+		if d.Metric != MetricCosine && d.Metric != MetricDot && d.Metric != MetricL2 {
+			return fmt.Errorf("%w: unsupported metric %q", ErrInvalidIndex, d.Metric)
+		}
+	default:
+		return fmt.Errorf("%w: unknown index type %q", ErrInvalidIndex, d.Type)
+	}
+
+	if d.PartialFilter != nil {
+		if err := query.ValidateFilter(d.PartialFilter); err != nil {
+			return fmt.Errorf("%w: partial filter: %v", ErrInvalidIndex, err)
+		}
+		if _, _, near := query.FindNear(d.PartialFilter); near {
+			return fmt.Errorf("%w: partial filter cannot use $near", ErrInvalidIndex)
+		}
+	}
+
+	names := make([]string, 0, len(d.Fields))
+	for i, field := range d.Fields {
+		if field.Path == "" || strings.HasPrefix(field.Path, ".") || strings.HasSuffix(field.Path, ".") {
+			return fmt.Errorf("%w: invalid field path %q", ErrInvalidIndex, field.Path)
+		}
+		if field.Order != 1 && field.Order != -1 {
+			return fmt.Errorf("%w: invalid order %d for field %q", ErrInvalidIndex, field.Order, field.Path)
+		}
+
+		if d.Type != IndexTypeOrdered {
+			// Only ordered indexes have a key order
+			d.Fields[i].Order = 1
+			names = append(names, field.Path+"_"+d.Type)
+		} else {
+			names = append(names, fmt.Sprintf("%s_%d", field.Path, field.Order))
+		}
+	}
+
+	if d.Name == "" {
+		d.Name = strings.Join(names, "_")
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package index
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+
+	"coffedb/internal/query"
+)
+
+// Type tags of encoded index key parts, in sort order
+const (
+	keyTagNull byte = iota + 1
+	keyTagBool
+	keyTagNumber
+	keyTagString
+	keyTagOther
+)
+
+// encodeKeyPart encodes a value so that byte-wise comparison of the
+// encoding matches the ordering of the values. Encodings are prefix-free,
+// which lets descending parts be produced by complementing every byte.
+func encodeKeyPart(value interface{}, order int) string {
+	var buf []byte
+
+	switch v := value.(type) {
+	case nil:
+		buf = []byte{keyTagNull}
+	case bool:
+		buf = []byte{keyTagBool, 0}
+		if v {
+			buf[1] = 1
+		}
+	case string:
+		buf = appendEscaped([]byte{keyTagString}, v)
+	default:
+		if num, ok := query.ToFloat64(v); ok {
+			bits := math.Float64bits(num)
+			if num < 0 {
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			buf = make([]byte, 9)
+			buf[0] = keyTagNumber
+			binary.BigEndian.PutUint64(buf[1:], bits)
+		} else {
+			raw, _ := json.Marshal(v)
+			buf = appendEscaped([]byte{keyTagOther}, string(raw))
+		}
+	}
+
+	if order < 0 {
+		for i := range buf {
+			buf[i] = ^buf[i]
+		}
+	}
+
+	return string(buf)
+}
+
+// appendEscaped appends s with 0x00 escaped as 0x00 0xFF, terminated by 0x00 0x00
+func appendEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		buf = append(buf, s[i])
+		if s[i] == 0 {
+			buf = append(buf, 0xFF)
+		}
+	}
+	return append(buf, 0, 0)
+}
+
+// isIndexable reports whether an equality predicate on value can be
+// answered from an index
+func isIndexable(value interface{}) bool {
+	return query.IsScalar(value)
+}
+
+// decodeKey splits an encoded index key back into its field values
+func decodeKey(key string, fields []IndexField) []interface{} {
+	values := make([]interface{}, 0, len(fields))
+	data := []byte(key)
+
+	for _, field := range fields {
+		if len(data) == 0 {
+			break
+		}
+
+		// Undo the complement of descending parts up front
+		part := data
+		if field.Order < 0 {
+			part = make([]byte, len(data))
+			for i := range data {
+				part[i] = ^data[i]
+			}
+		}
+
+		value, n := decodeKeyPart(part)
+		values = append(values, value)
+		data = data[n:]
+	}
+
+	return values
+}
+
+// decodeFirst decodes the leading part of a key, for the given field, and
+// returns the value and the length of its encoding
+func decodeFirst(key string, field IndexField) (interface{}, int) {
+	part := []byte(key)
+	if field.Order < 0 {
+		for i := range part {
+			part[i] = ^part[i]
+		}
+	}
+	return decodeKeyPart(part)
+}
+
+// decodeKeyPart decodes the leading part of an ascending key and returns
+// the value and the number of bytes consumed
+func decodeKeyPart(data []byte) (interface{}, int) {
+	switch data[0] {
+	case keyTagNull:
+		return nil, 1
+	case keyTagBool:
+		return data[1] == 1, 2
+	case keyTagNumber:
+		bits := binary.BigEndian.Uint64(data[1:9])
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 9
+	}
+
+	var raw []byte
+	i := 1
+	for ; i+1 < len(data); i++ {
+		if data[i] == 0 {
+			if data[i+1] == 0 {
+				break
+			}
+			i++ // skip escape byte
+			raw = append(raw, 0)
+			continue
+		}
+		raw = append(raw, data[i])
+	}
+
+	if data[0] == keyTagString {
+		return string(raw), i + 2
+	}
+
+	var value interface{}
+	json.Unmarshal(raw, &value)
+	return value, i + 2
+}
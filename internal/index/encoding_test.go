@@ -0,0 +1,34 @@
+package index
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestKeyEncodingKeepsValueOrder(t *testing.T) {
+	// Ascending by type, then by value within a type
+	values := []interface{}{nil, false, true, -1e9, -2.5, 0.0, 3.0, 1e9, "", "a", "a\x00b", "ab", "b"}
+
+	for _, order := range []int{1, -1} {
+		keys := make([]string, len(values))
+		for i, value := range values {
+			keys[i] = encodeKeyPart(value, order)
+		}
+		sorted := sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		reversed := sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] > keys[j] })
+		if order > 0 && !sorted || order < 0 && !reversed {
+			t.Errorf("order %d: encodings do not follow the values", order)
+		}
+	}
+}
+
+func TestDecodeKeyReadsCompoundKeys(t *testing.T) {
+	fields := []IndexField{{Path: "name", Order: 1}, {Path: "age", Order: -1}, {Path: "active", Order: 1}}
+	key := encodeKeyPart("x\x00y", 1) + encodeKeyPart(42, -1) + encodeKeyPart(true, 1)
+
+	want := []interface{}{"x\x00y", 42.0, true}
+	if got := decodeKey(key, fields); !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeKey = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidIndex  = errors.New("invalid index definition")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexNotFound = errors.New("index not found")
+	ErrIndexBuilding = errors.New("index is already building")
+	ErrIndexNotReady = errors.New("index is not ready")
+	ErrNoTextIndex   = errors.New("no text index on collection")
+	ErrNoVectorIndex = errors.New("no vector index on collection")
+	ErrInvalidVector = errors.New("invalid query vector")
+)
+
+// DuplicateKeyError is returned when a write or an index build would
+// violate a unique index
+type DuplicateKeyError struct {
+	Collection string
+	Index      string
+	Fields     []string
+	Values     []interface{}
+	DocID      string // document already holding the key
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key %v on (%s) in unique index %s.%s, held by document %s",
+		e.Values, strings.Join(e.Fields, ", "), e.Collection, e.Index, e.DocID)
+}
+
+// newDuplicateKeyError describes a conflict on an encoded key of an index
+func newDuplicateKeyError(def IndexDefinition, key, docID string) *DuplicateKeyError {
+	fields := make([]string, len(def.Fields))
+	for i, field := range def.Fields {
+		fields[i] = field.Path
+	}
+
+	return &DuplicateKeyError{
+		Collection: def.Collection,
+		Index:      def.Name,
+		Fields:     fields,
+		Values:     decodeKey(key, def.Fields),
+		DocID:      docID,
+	}
+}
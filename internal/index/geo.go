@@ -0,0 +1,141 @@
+package index
+
+import (
+	"math"
+
+	"coffedb/internal/query"
+)
+
+// geohashPrecision is the number of characters of the geohash a geo index
+// stores per location, about 4cm x 2cm
+const geohashPrecision = 12
+
+// maxCoverCells bounds the number of geohash cells a lookup scans
+const maxCoverCells = 64
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a point as a geohash of the given length. Points close
+// to each other share long prefixes, so a geo index is an ordered index
+// over geohash keys and a cell is a prefix scan.
+func geohash(p query.Point, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	hash := make([]byte, 0, precision)
+	bits, ch := 0, 0
+	even := true
+	for len(hash) < precision {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if p.Lng >= mid {
+				ch = ch<<1 | 1
+				minLng = mid
+			} else {
+				ch <<= 1
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.Lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch <<= 1
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+
+	return string(hash)
+}
+
+// geohashCellSize returns the width and height in degrees of the cells of
+// a geohash precision
+func geohashCellSize(precision int) (float64, float64) {
+	lngBits := (5*precision + 1) / 2
+	latBits := 5 * precision / 2
+	return 360 / math.Exp2(float64(lngBits)), 180 / math.Exp2(float64(latBits))
+}
+
+// geoKeys returns the keys a document contributes to a geo index, one per
+// location stored in the indexed field
+func geoKeys(doc *Document, def IndexDefinition) map[string]bool {
+	keys := make(map[string]bool)
+	if doc == nil {
+		return keys
+	}
+
+	for _, point := range query.GeoPoints(doc.Data, def.Fields[0].Path) {
+		keys[geohash(point, geohashPrecision)] = true
+	}
+	return keys
+}
+
+// geoCover returns geohash prefixes whose cells together cover the boxes,
+// using the finest precision that needs at most maxCoverCells cells
+func geoCover(boxes []query.Box) []string {
+	var cover []string
+	for precision := 1; precision <= geohashPrecision; precision++ {
+		cells := coverCells(boxes, precision)
+		if cells == nil {
+			break
+		}
+		cover = cells
+	}
+	return cover
+}
+
+// coverCells lists the cells of one precision covering the boxes, or nil
+// if there are more than maxCoverCells of them
+func coverCells(boxes []query.Box, precision int) []string {
+	width, height := geohashCellSize(precision)
+	columns := int(math.Round(360 / width))
+	rows := int(math.Round(180 / height))
+
+	cell := func(value, origin, size float64, count int) int {
+		i := int(math.Floor((value - origin) / size))
+		if i >= count {
+			i = count - 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		return i
+	}
+
+	seen := make(map[string]bool)
+	var cells []string
+	for _, box := range boxes {
+		x0, x1 := cell(box.MinLng, -180, width, columns), cell(box.MaxLng, -180, width, columns)
+		y0, y1 := cell(box.MinLat, -90, height, rows), cell(box.MaxLat, -90, height, rows)
+		if (x1-x0+1)*(y1-y0+1) > maxCoverCells {
+			return nil
+		}
+
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				center := query.Point{
+					Lng: -180 + (float64(x)+0.5)*width,
+					Lat: -90 + (float64(y)+0.5)*height,
+				}
+				hash := geohash(center, precision)
+				if !seen[hash] {
+					seen[hash] = true
+					cells = append(cells, hash)
+				}
+			}
+		}
+	}
+
+	if len(cells) > maxCoverCells {
+		return nil
+	}
+	return cells
+}
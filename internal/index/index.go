@@ -0,0 +1,374 @@
+package index
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IndexState describes whether an index can serve lookups
+type IndexState string
+
+const (
+	IndexReady    IndexState = "ready"
+	IndexBuilding IndexState = "building"
+	IndexFailed   IndexState = "failed"
+)
+
+// IndexOpType represents the type of an index mutation
+type IndexOpType int
+
+const (
+	IndexOpPut IndexOpType = iota
+	IndexOpDelete
+)
+
+// IndexOp is a single index mutation, logged in the WAL together with the
+// document write it belongs to. Generation tells apart indexes that reuse
+// the name of a dropped one; it is zero in mutations logged before it was
+// recorded.
+type IndexOp struct {
+	Type       IndexOpType `json:"type"`
+	Collection string      `json:"collection"`
+	Index      string      `json:"index"`
+	Generation int64       `json:"generation,omitempty"`
+	Value      string      `json:"value"`
+	DocID      string      `json:"doc_id"`
+}
+
+// Index represents a secondary index
+type Index struct {
+	def      IndexDefinition
+	entries  map[string][]string // value -> []docIDs
+	keys     []string            // entry keys in sorted order
+	state    IndexState
+	err      error     // why the last build failed
+	pending  []IndexOp // mutations received while building
+	building bool      // a build is in progress
+	dropped  bool
+	vectors  *vectorIndex // search structure of vector indexes
+	mu       sync.RWMutex
+}
+
+// NewIndex creates a new index
+func NewIndex(def IndexDefinition) *Index {
+	idx := &Index{
+		def:     def,
+		entries: make(map[string][]string),
+		state:   IndexReady,
+	}
+	if def.Type == IndexTypeVector {
+		idx.vectors = newVectorIndex(def.Metric)
+	}
+	return idx
+}
+
+// Put adds a document ID to the index for a given value
+func (idx *Index) Put(value, docID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.put(value, docID)
+}
+
+func (idx *Index) put(value, docID string) {
+	if _, exists := idx.entries[value]; !exists {
+		idx.entries[value] = []string{}
+		pos := sort.SearchStrings(idx.keys, value)
+		idx.keys = append(idx.keys, "")
+		copy(idx.keys[pos+1:], idx.keys[pos:])
+		idx.keys[pos] = value
+	}
+
+	// Check if docID already exists
+	for _, existingID := range idx.entries[value] {
+		if existingID == docID {
+			return
+		}
+	}
+
+	idx.entries[value] = append(idx.entries[value], docID)
+	if idx.vectors != nil {
+		idx.vectors.add(docID, value)
+	}
+}
+
+// Get returns document IDs for a given value
+func (idx *Index) Get(value string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if docIDs, exists := idx.entries[value]; exists {
+		// Return copy to avoid race conditions
+		result := make([]string, len(docIDs))
+		copy(result, docIDs)
+		return result
+	}
+
+	return []string{}
+}
+
+// Remove removes a document ID from a single value in the index
+func (idx *Index) Remove(value, docID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(value, docID)
+}
+
+func (idx *Index) remove(value, docID string) {
+	docIDs := idx.entries[value]
+	for i, id := range docIDs {
+		if id == docID {
+			idx.entries[value] = append(docIDs[:i], docIDs[i+1:]...)
+			if idx.vectors != nil {
+				idx.vectors.remove(docID)
+			}
+			break
+		}
+	}
+
+	if len(idx.entries[value]) == 0 {
+		idx.deleteKey(value)
+	}
+}
+
+// deleteKey drops an entry and its position in the sorted key list
+func (idx *Index) deleteKey(value string) {
+	delete(idx.entries, value)
+
+	pos := sort.SearchStrings(idx.keys, value)
+	if pos < len(idx.keys) && idx.keys[pos] == value {
+		idx.keys = append(idx.keys[:pos], idx.keys[pos+1:]...)
+	}
+}
+
+// setEntries replaces the contents of the index
+func (idx *Index) setEntries(entries map[string][]string) {
+	idx.entries = entries
+	idx.keys = make([]string, 0, len(entries))
+	for value := range entries {
+		idx.keys = append(idx.keys, value)
+	}
+	sort.Strings(idx.keys)
+}
+
+// Scan returns the document IDs of all entries whose key starts with
+// prefix, in key order and without duplicates
+func (idx *Index) Scan(prefix string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var result []string
+	seen := make(map[string]bool)
+
+	idx.rangeKeys(prefix, func(key string, docIDs []string) bool {
+		for _, docID := range docIDs {
+			if !seen[docID] {
+				seen[docID] = true
+				result = append(result, docID)
+			}
+		}
+		return true
+	})
+
+	return result
+}
+
+// rangeKeys calls fn for every entry whose key starts with prefix, in key
+// order, until fn returns false. The caller holds idx.mu.
+func (idx *Index) rangeKeys(prefix string, fn func(key string, docIDs []string) bool) {
+	for pos := sort.SearchStrings(idx.keys, prefix); pos < len(idx.keys); pos++ {
+		key := idx.keys[pos]
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if !fn(key, idx.entries[key]) {
+			return
+		}
+	}
+}
+
+// walkFirst calls fn with each value of the first field of the index and
+// the documents holding it, in key order or reversed, starting with the
+// entries whose key starts with start, until fn returns false. The caller
+// holds idx.mu.
+func (idx *Index) walkFirst(start string, reverse bool, fn func(value interface{}, docIDs []string) bool) {
+	field := idx.def.Fields[0]
+
+	pos := sort.SearchStrings(idx.keys, start)
+	if reverse {
+		pos = len(idx.keys)
+		if start != "" {
+			pos = sort.Search(len(idx.keys), func(i int) bool {
+				return idx.keys[i] > start && !strings.HasPrefix(idx.keys[i], start)
+			})
+		}
+		pos--
+	}
+
+	for pos >= 0 && pos < len(idx.keys) {
+		// The entries sharing the value of the first field are adjacent;
+		// a compound index can hold a document under several of them
+		value, n := decodeFirst(idx.keys[pos], field)
+		part := idx.keys[pos][:n]
+
+		var docIDs []string
+		seen := make(map[string]bool)
+		for pos >= 0 && pos < len(idx.keys) && strings.HasPrefix(idx.keys[pos], part) {
+			for _, docID := range idx.entries[idx.keys[pos]] {
+				if !seen[docID] {
+					seen[docID] = true
+					docIDs = append(docIDs, docID)
+				}
+			}
+			if reverse {
+				pos--
+			} else {
+				pos++
+			}
+		}
+
+		if !fn(value, docIDs) {
+			return
+		}
+	}
+}
+
+// Delete removes a document ID from all values in the index
+func (idx *Index) Delete(docID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.vectors != nil {
+		idx.vectors.remove(docID)
+	}
+
+	for value, docIDs := range idx.entries {
+		for i, id := range docIDs {
+			if id == docID {
+				// Remove docID from slice
+				idx.entries[value] = append(docIDs[:i], docIDs[i+1:]...)
+				break
+			}
+		}
+
+		// Remove empty entries
+		if len(idx.entries[value]) == 0 {
+			idx.deleteKey(value)
+		}
+	}
+}
+
+// Apply applies a logged mutation. While the index is building the
+// mutation is queued and replayed once the build completes.
+func (idx *Index) Apply(op IndexOp) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	switch idx.state {
+	case IndexBuilding:
+		idx.pending = append(idx.pending, op)
+	case IndexReady:
+		idx.apply(op)
+	}
+}
+
+func (idx *Index) apply(op IndexOp) {
+	switch op.Type {
+	case IndexOpPut:
+		idx.put(op.Value, op.DocID)
+	case IndexOpDelete:
+		idx.remove(op.Value, op.DocID)
+	}
+}
+
+// conflict returns a document other than docID already holding key
+func (idx *Index) conflict(key, docID string) (string, bool) {
+	for _, id := range idx.entries[key] {
+		if id != docID {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// checkUnique reports the first key held by more than one document
+func (idx *Index) checkUnique() error {
+	for _, key := range idx.keys {
+		if docIDs := idx.entries[key]; len(docIDs) > 1 {
+			return newDuplicateKeyError(idx.def, key, docIDs[0])
+		}
+	}
+	return nil
+}
+
+// Definition returns the catalog definition of the index
+func (idx *Index) Definition() IndexDefinition {
+	return idx.def
+}
+
+// State returns the build state of the index
+func (idx *Index) State() IndexState {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.state
+}
+
+// Size returns the number of unique values in the index
+func (idx *Index) Size() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries)
+}
+
+// IndexInfo describes an index and its current state
+type IndexInfo struct {
+	IndexDefinition
+	State       IndexState `json:"state"`
+	Size        int        `json:"size"`
+	MemoryBytes int64      `json:"memory_bytes"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Info returns a description of the index
+func (idx *Index) Info() IndexInfo {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	info := IndexInfo{
+		IndexDefinition: idx.def,
+		State:           idx.state,
+		Size:            len(idx.entries),
+		MemoryBytes:     idx.memoryUsage(),
+	}
+	if idx.err != nil {
+		info.Error = idx.err.Error()
+	}
+
+	return info
+}
+
+// memoryUsage estimates the bytes held by the index entries
+func (idx *Index) memoryUsage() int64 {
+	const (
+		stringHeader = 16
+		sliceHeader  = 24
+		mapEntry     = 48
+	)
+
+	var total int64
+	for key, docIDs := range idx.entries {
+		total += mapEntry + stringHeader*2 + int64(len(key))*2 + sliceHeader
+		for _, docID := range docIDs {
+			total += stringHeader + int64(len(docID))
+		}
+	}
+
+	if idx.vectors != nil {
+		total += int64(len(idx.vectors.vectors)) * int64(mapEntry+stringHeader+sliceHeader+4*idx.def.Dimensions)
+		total += int64(len(idx.vectors.centroids)) * int64(sliceHeader+4*idx.def.Dimensions)
+	}
+
+	return total
+}
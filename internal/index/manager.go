@@ -1,87 +1,603 @@
-package storage
+package index
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"coffedb/internal/query"
 )
 
-// Index represents a secondary index
-type Index struct {
-	field   string
-	entries map[string][]string // value -> []docIDs
+// Document is the view of a stored document the index subsystem works on
+type Document struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// IndexManager owns the secondary indexes of a database. It registers
+// indexes, computes and applies their maintenance on document writes and
+// deletes, and answers lookups for the query path.
+type IndexManager struct {
+	dir     string // directory holding index snapshots
+	indexes map[string]*Index
 	mu      sync.RWMutex
 }
 
-// NewIndex creates a new index
-func NewIndex(field string) *Index {
-	return &Index{
-		field:   field,
-		entries: make(map[string][]string),
+// NewIndexManager creates an index manager persisting snapshots in dir
+func NewIndexManager(dir string) *IndexManager {
+	return &IndexManager{
+		dir:     dir,
+		indexes: make(map[string]*Index),
+	}
+}
+
+// indexKey returns the key of an index in the manager's index map
+func indexKey(collection, name string) string {
+	return collection + "." + name
+}
+
+// Load registers indexes from the catalog and restores their snapshots.
+// It returns the indexes without a usable snapshot, which are left in the
+// building state and must be rebuilt.
+func (m *IndexManager) Load(defs []IndexDefinition) []*Index {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rebuild []*Index
+	for _, def := range defs {
+		if def.Type == "" {
+			def.Type = IndexTypeOrdered
+		}
+
+		idx := NewIndex(def)
+		if !m.loadSnapshot(idx) {
+			idx.state = IndexBuilding
+			rebuild = append(rebuild, idx)
+		}
+		m.indexes[indexKey(def.Collection, def.Name)] = idx
+	}
+
+	return rebuild
+}
+
+// Register validates a definition and adds an empty index for it in the
+// building state
+func (m *IndexManager) Register(def IndexDefinition) (*Index, error) {
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	def.CreatedAt = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := indexKey(def.Collection, def.Name)
+	if _, exists := m.indexes[key]; exists {
+		return nil, ErrIndexExists
+	}
+
+	idx := NewIndex(def)
+	idx.state = IndexBuilding
+	m.indexes[key] = idx
+
+	return idx, nil
+}
+
+// Unregister removes an index and deletes its snapshot. A build in
+// progress is abandoned.
+func (m *IndexManager) Unregister(collection, name string) (*Index, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := indexKey(collection, name)
+	idx, exists := m.indexes[key]
+	if !exists {
+		return nil, ErrIndexNotFound
+	}
+	delete(m.indexes, key)
+
+	idx.mu.Lock()
+	idx.dropped = true
+	idx.state = IndexFailed
+	idx.entries = make(map[string][]string)
+	idx.keys = nil
+	idx.pending = nil
+	if idx.vectors != nil {
+		idx.vectors = newVectorIndex(idx.def.Metric)
+	}
+	idx.mu.Unlock()
+	os.Remove(m.snapshotPath(idx.def))
+	os.Remove(m.vectorStatePath(idx.def))
+
+	return idx, nil
+}
+
+// Get returns an index by collection and name
+func (m *IndexManager) Get(collection, name string) (*Index, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	idx, exists := m.indexes[indexKey(collection, name)]
+	if !exists {
+		return nil, ErrIndexNotFound
+	}
+	return idx, nil
+}
+
+// List describes the indexes of a collection, ordered by name
+func (m *IndexManager) List(collection string) []IndexInfo {
+	infos := []IndexInfo{}
+	for _, idx := range m.collectionIndexes(collection) {
+		infos = append(infos, idx.Info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Count returns the number of registered indexes
+func (m *IndexManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.indexes)
+}
+
+// collectionIndexes returns the indexes registered on a collection
+func (m *IndexManager) collectionIndexes(collection string) []*Index {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var indexes []*Index
+	for _, idx := range m.indexes {
+		if idx.def.Collection == collection {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// OnPut computes the mutations that replace oldDoc with newDoc in the
+// collection's indexes; oldDoc is nil for inserts. It fails with a
+// DuplicateKeyError if a ready unique index would be violated. Callers
+// must serialize OnPut and Apply so the check stays valid, and must build
+// unique indexes with writers excluded: a write made while one is building
+// is not checked, and is only caught if the build still sees it.
+func (m *IndexManager) OnPut(collection string, oldDoc, newDoc *Document) ([]IndexOp, error) {
+	ops := m.diff(collection, oldDoc, newDoc)
+
+	for _, op := range ops {
+		if op.Type != IndexOpPut {
+			continue
+		}
+
+		idx, err := m.Get(op.Collection, op.Index)
+		if err != nil || !idx.def.Unique {
+			continue
+		}
+
+		idx.mu.RLock()
+		holder, conflict := "", false
+		if idx.state == IndexReady {
+			holder, conflict = idx.conflict(op.Value, op.DocID)
+		}
+		idx.mu.RUnlock()
+
+		if conflict {
+			return nil, newDuplicateKeyError(idx.def, op.Value, holder)
+		}
+	}
+
+	return ops, nil
+}
+
+// OnDelete computes the mutations that remove doc from the collection's
+// indexes
+func (m *IndexManager) OnDelete(collection string, doc *Document) []IndexOp {
+	return m.diff(collection, doc, nil)
+}
+
+// diff computes the index mutations that replace oldDoc with newDoc.
+// Either document may be nil.
+func (m *IndexManager) diff(collection string, oldDoc, newDoc *Document) []IndexOp {
+	var ops []IndexOp
+
+	for _, idx := range m.collectionIndexes(collection) {
+		oldKeys := idx.keysFor(oldDoc)
+		newKeys := idx.keysFor(newDoc)
+
+		for _, key := range sortedKeys(oldKeys) {
+			if !newKeys[key] {
+				ops = append(ops, IndexOp{
+					Type:       IndexOpDelete,
+					Collection: collection,
+					Index:      idx.def.Name,
+					Generation: idx.def.generation(),
+					Value:      key,
+					DocID:      oldDoc.ID,
+				})
+			}
+		}
+		for _, key := range sortedKeys(newKeys) {
+			if !oldKeys[key] {
+				ops = append(ops, IndexOp{
+					Type:       IndexOpPut,
+					Collection: collection,
+					Index:      idx.def.Name,
+					Generation: idx.def.generation(),
+					Value:      key,
+					DocID:      newDoc.ID,
+				})
+			}
+		}
+	}
+
+	// Keep the logged order deterministic across indexes
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Index < ops[j].Index
+	})
+
+	return ops
+}
+
+// Apply applies logged mutations to the affected indexes. Mutations for
+// dropped indexes are ignored, including those of a dropped index whose
+// name was reused, and replaying mutations over a snapshot converges to
+// the same state.
+func (m *IndexManager) Apply(ops []IndexOp) {
+	for _, op := range ops {
+		idx, err := m.Get(op.Collection, op.Index)
+		if err != nil {
+			continue
+		}
+		if generation := idx.def.generation(); op.Generation != 0 && generation != 0 && op.Generation != generation {
+			continue
+		}
+		idx.Apply(op)
+	}
+}
+
+// Lookup answers an equality filter from the ready index whose leading
+// fields are covered by the most predicates. It returns the candidate
+// document IDs in index order, and false if no index applies. Candidates
+// must still be checked against the full filter.
+func (m *IndexManager) Lookup(collection string, filter map[string]interface{}) ([]string, bool) {
+	var best *Index
+	var bestPrefix string
+	bestCovered := 0
+
+	for _, idx := range m.collectionIndexes(collection) {
+		if idx.def.Type != IndexTypeOrdered || idx.State() != IndexReady || !idx.covers(filter) {
+			continue
+		}
+
+		prefix := ""
+		covered := 0
+		nonNull := false
+		for _, field := range idx.def.Fields {
+			value, exists := filter[field.Path]
+			if !exists || !isIndexable(value) {
+				break
+			}
+			prefix += encodeKeyPart(value, field.Order)
+			covered++
+			nonNull = nonNull || value != nil
+		}
+
+		// A sparse index lacks the documents whose fields are all null
+		if idx.def.Sparse && !nonNull {
+			continue
+		}
+
+		if covered > bestCovered || (covered == bestCovered && best != nil && idx.def.Name < best.def.Name) {
+			best, bestPrefix, bestCovered = idx, prefix, covered
+		}
+	}
+
+	if best == nil {
+		return nil, false
+	}
+
+	return best.Scan(bestPrefix), true
+}
+
+// FieldEntries calls fn with every value of a field and the documents
+// holding it, read from a ready single-field ordered index on the field.
+// Only an index that is neither sparse nor partial holds every document
+// with the field, so it returns false if there is no such index.
+func (m *IndexManager) FieldEntries(collection, path string, fn func(value interface{}, docIDs []string)) bool {
+	for _, idx := range m.collectionIndexes(collection) {
+		def := idx.def
+		if def.Type != IndexTypeOrdered || len(def.Fields) != 1 || def.Fields[0].Path != path ||
+			def.Sparse || def.PartialFilter != nil || idx.State() != IndexReady {
+			continue
+		}
+
+		idx.mu.RLock()
+		idx.rangeKeys("", func(key string, docIDs []string) bool {
+			fn(decodeKey(key, def.Fields)[0], docIDs)
+			return true
+		})
+		idx.mu.RUnlock()
+		return true
+	}
+	return false
+}
+
+// SortedEntries walks a ready ordered index whose first field is path
+// and which holds every document matching filter, calling fn with each
+// value of the field and the documents holding it until fn returns false.
+// Values come in ascending order, or descending if desc, starting with
+// from when seek is set. It returns false if there is no such index.
+func (m *IndexManager) SortedEntries(collection string, filter map[string]interface{}, path string, desc, seek bool, from interface{}, fn func(value interface{}, docIDs []string) bool) bool {
+	if seek && !isIndexable(from) {
+		return false
 	}
+
+	for _, idx := range m.collectionIndexes(collection) {
+		def := idx.def
+		if def.Type != IndexTypeOrdered || def.Fields[0].Path != path || def.Sparse ||
+			idx.State() != IndexReady || !idx.covers(filter) {
+			continue
+		}
+
+		field := def.Fields[0]
+		start := ""
+		if seek {
+			start = encodeKeyPart(from, field.Order)
+		}
+
+		idx.mu.RLock()
+		idx.walkFirst(start, desc != (field.Order < 0), fn)
+		idx.mu.RUnlock()
+		return true
+	}
+	return false
+}
+
+// GeoLookup answers a $geoWithin or bounded $near predicate from a ready
+// geo index on the queried field, by scanning the geohash cells covering
+// the query region. It returns the candidate document IDs, and false if
+// no index applies. Candidates must still be checked against the filter.
+func (m *IndexManager) GeoLookup(collection string, filter map[string]interface{}) ([]string, bool) {
+	for _, idx := range m.collectionIndexes(collection) {
+		if idx.def.Type != IndexTypeGeo || idx.State() != IndexReady || !idx.covers(filter) {
+			continue
+		}
+
+		boxes, ok := query.GeoBounds(filter[idx.def.Fields[0].Path])
+		if !ok {
+			continue
+		}
+
+		seen := make(map[string]bool)
+		var ids []string
+		for _, prefix := range geoCover(boxes) {
+			for _, id := range idx.Scan(prefix) {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		return ids, true
+	}
+
+	return nil, false
+}
+
+// TextIndex returns the ready text index of a collection to search, by
+// name or, if name is empty, the collection's only text index
+func (m *IndexManager) TextIndex(collection, name string) (*Index, error) {
+	return m.searchIndex(collection, name, IndexTypeText, ErrNoTextIndex)
+}
+
+// VectorIndex returns the ready vector index of a collection to search,
+// by name or, if name is empty, the collection's only vector index
+func (m *IndexManager) VectorIndex(collection, name string) (*Index, error) {
+	return m.searchIndex(collection, name, IndexTypeVector, ErrNoVectorIndex)
+}
+
+// searchIndex finds the ready index of a type to search, failing with
+// errNone if the collection has no such index
+func (m *IndexManager) searchIndex(collection, name, indexType string, errNone error) (*Index, error) {
+	var found *Index
+	for _, idx := range m.collectionIndexes(collection) {
+		if idx.def.Type != indexType || (name != "" && idx.def.Name != name) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: collection has several %s indexes, choose one by name", errNone, indexType)
+		}
+		found = idx
+	}
+
+	if found == nil {
+		return nil, errNone
+	}
+	if found.State() != IndexReady {
+		return nil, fmt.Errorf("%w: %s index %s is %s", ErrIndexNotReady, indexType, found.def.Name, found.State())
+	}
+
+	return found, nil
 }
 
-// Put adds a document ID to the index for a given value
-func (idx *Index) Put(value, docID string) {
+// StartBuild marks an index as building. Writes applied from then on are
+// queued and replayed by FinishBuild, so the caller must take its
+// snapshot of the collection atomically with this call.
+func (m *IndexManager) StartBuild(idx *Index) error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	if _, exists := idx.entries[value]; !exists {
-		idx.entries[value] = []string{}
+	if idx.dropped {
+		return ErrIndexNotFound
 	}
-	
-	// Check if docID already exists
-	for _, existingID := range idx.entries[value] {
-		if existingID == docID {
-			return
+	if idx.building {
+		return ErrIndexBuilding
+	}
+
+	idx.building = true
+	idx.state = IndexBuilding
+	idx.pending = nil
+	return nil
+}
+
+// Build indexes a snapshot of documents into a detached copy of idx.
+// It takes no locks and may run concurrently with writers.
+func (m *IndexManager) Build(idx *Index, docs []*Document) *Index {
+	built := NewIndex(idx.def)
+	for _, doc := range docs {
+		for key := range built.keysFor(doc) {
+			built.put(key, doc.ID)
 		}
 	}
-	
-	idx.entries[value] = append(idx.entries[value], docID)
+	return built
 }
 
-// Get returns document IDs for a given value
-func (idx *Index) Get(value string) []string {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
+// FinishBuild replays the writes queued since StartBuild onto built and
+// swaps it into idx. Unique violations can only be detected at this
+// point, in which case the index is marked failed. Callers must exclude
+// writers while it runs.
+func (m *IndexManager) FinishBuild(idx, built *Index) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 
-	if docIDs, exists := idx.entries[value]; exists {
-		// Return copy to avoid race conditions
-		result := make([]string, len(docIDs))
-		copy(result, docIDs)
-		return result
+	if idx.dropped {
+		return nil
 	}
-	
-	return []string{}
+
+	for _, op := range idx.pending {
+		built.apply(op)
+	}
+	idx.pending = nil
+	idx.building = false
+
+	var buildErr error
+	if idx.def.Unique {
+		buildErr = built.checkUnique()
+	}
+
+	if buildErr != nil {
+		idx.state = IndexFailed
+		idx.err = buildErr
+		return buildErr
+	}
+
+	idx.entries = built.entries
+	idx.keys = built.keys
+	idx.vectors = built.vectors
+	idx.state = IndexReady
+	idx.err = nil
+	return nil
 }
 
-// Delete removes a document ID from all values in the index
-func (idx *Index) Delete(docID string) {
+// FailBuild marks a build as failed
+func (m *IndexManager) FailBuild(idx *Index, err error) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	for value, docIDs := range idx.entries {
-		for i, id := range docIDs {
-			if id == docID {
-				// Remove docID from slice
-				idx.entries[value] = append(docIDs[:i], docIDs[i+1:]...)
-				break
-			}
+	idx.building = false
+	idx.state = IndexFailed
+	idx.err = err
+}
+
+// SaveSnapshots persists every ready index
+func (m *IndexManager) SaveSnapshots() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, idx := range m.indexes {
+		if idx.State() != IndexReady {
+			continue
 		}
-		
-		// Remove empty entries
-		if len(idx.entries[value]) == 0 {
-			delete(idx.entries, value)
+		if err := m.SaveSnapshot(idx); err != nil {
+			return fmt.Errorf("failed to save index %s: %w", idx.def.Name, err)
 		}
 	}
+
+	return nil
+}
+
+// snapshotPath returns the file holding the persisted entries of an index
+func (m *IndexManager) snapshotPath(def IndexDefinition) string {
+	return filepath.Join(m.dir, snapshotName(def))
 }
 
-// Field returns the field name this index is for
-func (idx *Index) Field() string {
-	return idx.field
+// covers reports whether an index holds every document matching filter,
+// which for a partial index requires the filter to imply its partial
+// filter
+func (idx *Index) covers(filter map[string]interface{}) bool {
+	return idx.def.PartialFilter == nil || query.Implies(filter, idx.def.PartialFilter)
 }
 
-// Size returns the number of unique values in the index
-func (idx *Index) Size() int {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
-	return len(idx.entries)
+// keysFor returns the encoded keys a document contributes to the index.
+// Array fields contribute one key per element; a compound index gets the
+// cross product of its fields' values. Documents missing every indexed
+// field, or for a sparse index holding only nulls, are left out, as are
+// documents not matching a partial filter.
+func (idx *Index) keysFor(doc *Document) map[string]bool {
+	if doc != nil && idx.def.PartialFilter != nil && !query.MatchFilter(doc.Data, idx.def.PartialFilter) {
+		return make(map[string]bool)
+	}
+
+	switch idx.def.Type {
+	case IndexTypeText:
+		return textKeys(doc, idx.def)
+	case IndexTypeGeo:
+		return geoKeys(doc, idx.def)
+	case IndexTypeVector:
+		return vectorKeys(doc, idx.def)
+	}
+
+	keys := make(map[string]bool)
+	if doc == nil {
+		return keys
+	}
+
+	prefixes := []string{""}
+	found := false
+
+	for _, field := range idx.def.Fields {
+		values := query.PathValues(doc.Data, field.Path)
+		for _, value := range values {
+			if value != nil || !idx.def.Sparse {
+				found = true
+			}
+		}
+		if len(values) == 0 {
+			values = []interface{}{nil}
+		}
+
+		next := make([]string, 0, len(prefixes)*len(values))
+		for _, prefix := range prefixes {
+			for _, value := range values {
+				next = append(next, prefix+encodeKeyPart(value, field.Order))
+			}
+		}
+		prefixes = next
+	}
+
+	if !found {
+		return keys
+	}
+
+	for _, key := range prefixes {
+		keys[key] = true
+	}
+	return keys
+}
+
+// sortedKeys returns the members of a key set in a deterministic order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,204 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+// readyIndex registers an index and builds it over docs
+func readyIndex(t *testing.T, m *IndexManager, def IndexDefinition, docs ...*Document) *Index {
+	t.Helper()
+
+	idx, err := m.Register(def)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := m.StartBuild(idx); err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	if err := m.FinishBuild(idx, m.Build(idx, docs)); err != nil {
+		t.Fatalf("FinishBuild: %v", err)
+	}
+	return idx
+}
+
+func doc(id string, data map[string]interface{}) *Document {
+	return &Document{ID: id, Data: data}
+}
+
+func lookup(t *testing.T, m *IndexManager, filter map[string]interface{}) []string {
+	t.Helper()
+
+	ids, ok := m.Lookup("users", filter)
+	if !ok {
+		t.Fatalf("no index answers %v", filter)
+	}
+	return ids
+}
+
+func TestApplySkipsOpsOfDroppedIndexWithSameName(t *testing.T) {
+	dir := t.TempDir()
+	def := IndexDefinition{Name: "by_email", Collection: "users", Fields: []IndexField{{Path: "email", Order: 1}}}
+
+	// Writes logged against the first index of the name
+	m := NewIndexManager(dir)
+	readyIndex(t, m, def)
+	old, err := m.OnPut("users", nil, doc("u1", map[string]interface{}{"email": "a@example.com"}))
+	if err != nil {
+		t.Fatalf("OnPut: %v", err)
+	}
+	m.Apply(old)
+
+	// The index is dropped and a new one takes its name, built over a
+	// collection where u1 has another address
+	if _, err := m.Unregister("users", "by_email"); err != nil {
+		t.Fatalf("Unregister: %v", err)
+	}
+	current := doc("u1", map[string]interface{}{"email": "b@example.com"})
+	idx := readyIndex(t, m, def, current)
+	if err := m.SaveSnapshot(idx); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	// On restart the whole log is replayed over the new snapshot
+	restarted := NewIndexManager(dir)
+	if rebuild := restarted.Load([]IndexDefinition{idx.Definition()}); len(rebuild) != 0 {
+		t.Fatalf("snapshot not restored")
+	}
+	restarted.Apply(old)
+
+	if ids := lookup(t, restarted, map[string]interface{}{"email": "a@example.com"}); len(ids) != 0 {
+		t.Errorf("a@example.com -> %v, want nothing: replayed ops of the dropped index", ids)
+	}
+	if ids := lookup(t, restarted, map[string]interface{}{"email": "b@example.com"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("b@example.com -> %v, want [u1]", ids)
+	}
+
+	// Ops of the current index still apply
+	ops, err := restarted.OnPut("users", current, doc("u1", map[string]interface{}{"email": "c@example.com"}))
+	if err != nil {
+		t.Fatalf("OnPut: %v", err)
+	}
+	restarted.Apply(ops)
+	if ids := lookup(t, restarted, map[string]interface{}{"email": "c@example.com"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("c@example.com -> %v, want [u1]", ids)
+	}
+}
+
+func TestApplyAcceptsOpsWithoutGeneration(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	readyIndex(t, m, IndexDefinition{Name: "by_email", Collection: "users", Fields: []IndexField{{Path: "email", Order: 1}}})
+
+	// Logs written before ops were stamped keep replaying
+	m.Apply([]IndexOp{{Type: IndexOpPut, Collection: "users", Index: "by_email", Value: encodeKeyPart("a@example.com", 1), DocID: "u1"}})
+
+	if ids := lookup(t, m, map[string]interface{}{"email": "a@example.com"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("a@example.com -> %v, want [u1]", ids)
+	}
+}
+
+func TestLookupUsesCompoundIndexPrefix(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	readyIndex(t, m, IndexDefinition{Name: "by_city_age", Collection: "users", Fields: []IndexField{{Path: "city", Order: 1}, {Path: "age", Order: -1}}},
+		doc("u1", map[string]interface{}{"city": "Oslo", "age": 30.0}),
+		doc("u2", map[string]interface{}{"city": "Oslo", "age": 40.0}),
+		doc("u3", map[string]interface{}{"city": "Rome", "age": 30.0}),
+	)
+
+	// The leading field alone is answered in index order, descending by age
+	if ids := lookup(t, m, map[string]interface{}{"city": "Oslo"}); !reflect.DeepEqual(ids, []string{"u2", "u1"}) {
+		t.Errorf("city Oslo -> %v, want [u2 u1]", ids)
+	}
+	if ids := lookup(t, m, map[string]interface{}{"city": "Oslo", "age": 30.0}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("city Oslo age 30 -> %v, want [u1]", ids)
+	}
+
+	// A filter without the leading field cannot use the index
+	if _, ok := m.Lookup("users", map[string]interface{}{"age": 30.0}); ok {
+		t.Errorf("age alone answered from a compound index led by city")
+	}
+}
+
+func TestMultikeyIndexHoldsEveryArrayElement(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	def := IndexDefinition{Name: "by_tag", Collection: "users", Fields: []IndexField{{Path: "profile.tags", Order: 1}}}
+	readyIndex(t, m, def,
+		doc("u1", map[string]interface{}{"profile": map[string]interface{}{"tags": []interface{}{"go", "db"}}}),
+		doc("u2", map[string]interface{}{"profile": map[string]interface{}{"tags": []interface{}{"db"}}}),
+	)
+
+	if ids := lookup(t, m, map[string]interface{}{"profile.tags": "db"}); !reflect.DeepEqual(ids, []string{"u1", "u2"}) {
+		t.Errorf("tag db -> %v, want [u1 u2]", ids)
+	}
+
+	// Dropping an element from the array removes only its entry
+	old := doc("u1", map[string]interface{}{"profile": map[string]interface{}{"tags": []interface{}{"go", "db"}}})
+	ops, err := m.OnPut("users", old, doc("u1", map[string]interface{}{"profile": map[string]interface{}{"tags": []interface{}{"go"}}}))
+	if err != nil {
+		t.Fatalf("OnPut: %v", err)
+	}
+	m.Apply(ops)
+
+	if ids := lookup(t, m, map[string]interface{}{"profile.tags": "db"}); !reflect.DeepEqual(ids, []string{"u2"}) {
+		t.Errorf("tag db after update -> %v, want [u2]", ids)
+	}
+	if ids := lookup(t, m, map[string]interface{}{"profile.tags": "go"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("tag go after update -> %v, want [u1]", ids)
+	}
+}
+
+func TestPartialIndexAnswersOnlyImpliedFilters(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	idx := readyIndex(t, m, IndexDefinition{Name: "active_by_city", Collection: "users", Fields: []IndexField{{Path: "city", Order: 1}},
+		PartialFilter: map[string]interface{}{"status": "active"}},
+		doc("u1", map[string]interface{}{"city": "Oslo", "status": "active"}),
+		doc("u2", map[string]interface{}{"city": "Oslo", "status": "deleted"}),
+	)
+	if idx.Size() != 1 {
+		t.Errorf("partial index holds %d keys, want 1", idx.Size())
+	}
+
+	if ids := lookup(t, m, map[string]interface{}{"city": "Oslo", "status": "active"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("active in Oslo -> %v, want [u1]", ids)
+	}
+	if _, ok := m.Lookup("users", map[string]interface{}{"city": "Oslo"}); ok {
+		t.Errorf("filter not implying the partial filter answered from the index")
+	}
+
+	// A document leaving the partial filter leaves the index
+	ops, err := m.OnPut("users", doc("u1", map[string]interface{}{"city": "Oslo", "status": "active"}), doc("u1", map[string]interface{}{"city": "Oslo", "status": "deleted"}))
+	if err != nil {
+		t.Fatalf("OnPut: %v", err)
+	}
+	m.Apply(ops)
+	if ids := lookup(t, m, map[string]interface{}{"city": "Oslo", "status": "active"}); len(ids) != 0 {
+		t.Errorf("active in Oslo after update -> %v, want nothing", ids)
+	}
+}
+
+func TestSparseIndexSkipsMissingFields(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	readyIndex(t, m, IndexDefinition{Name: "by_email", Collection: "users", Fields: []IndexField{{Path: "email", Order: 1}}, Unique: true, Sparse: true},
+		doc("u1", map[string]interface{}{"email": "a@example.com"}),
+		doc("u2", map[string]interface{}{}),
+		doc("u3", map[string]interface{}{"email": nil}),
+	)
+
+	// Documents without an address do not collide in a sparse unique index
+	ops, err := m.OnPut("users", nil, doc("u4", map[string]interface{}{"name": "no email"}))
+	if err != nil {
+		t.Fatalf("OnPut without the field: %v", err)
+	}
+	m.Apply(ops)
+	if _, err := m.OnPut("users", nil, doc("u5", map[string]interface{}{"email": "a@example.com"})); err == nil {
+		t.Errorf("duplicate address accepted")
+	}
+
+	// Null lookups would miss the skipped documents
+	if _, ok := m.Lookup("users", map[string]interface{}{"email": nil}); ok {
+		t.Errorf("null answered from a sparse index")
+	}
+	if ids := lookup(t, m, map[string]interface{}{"email": "a@example.com"}); !reflect.DeepEqual(ids, []string{"u1"}) {
+		t.Errorf("a@example.com -> %v, want [u1]", ids)
+	}
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"coffedb/internal/fileutil"
+)
+
+// snapshotName returns the file name of an index snapshot
+func snapshotName(def IndexDefinition) string {
+	return url.PathEscape(def.Collection) + "." + url.PathEscape(def.Name) + ".idx"
+}
+
+// vectorStatePath returns the file holding the clustering of a vector
+// index, next to its snapshot
+func (m *IndexManager) vectorStatePath(def IndexDefinition) string {
+	return m.snapshotPath(def) + ".ivf"
+}
+
+// SaveSnapshot persists the entries of a ready index, and the clustering
+// of a vector index
+func (m *IndexManager) SaveSnapshot(idx *Index) error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// A dropped index must not leave a snapshot behind
+	if idx.dropped {
+		return nil
+	}
+
+	if err := writeGobFile(m.snapshotPath(idx.def), idx.entries); err != nil {
+		return err
+	}
+
+	if idx.vectors == nil {
+		return nil
+	}
+	if idx.vectors.centroids == nil {
+		os.Remove(m.vectorStatePath(idx.def))
+		return nil
+	}
+	return writeGobFile(m.vectorStatePath(idx.def), vectorState{
+		Centroids:   idx.vectors.centroids,
+		TrainedSize: idx.vectors.trainedSize,
+	})
+}
+
+// writeGobFile atomically replaces path with the gob encoding of value
+func writeGobFile(path string, value interface{}) error {
+	return fileutil.WriteAtomic(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(value)
+	})
+}
+
+// loadSnapshot reads the persisted entries of an index. It returns false
+// if no usable snapshot exists and the index must be rebuilt.
+func (m *IndexManager) loadSnapshot(idx *Index) bool {
+	file, err := os.Open(m.snapshotPath(idx.def))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	entries := make(map[string][]string)
+	if err := gob.NewDecoder(file).Decode(&entries); err != nil {
+		return false
+	}
+
+	idx.mu.Lock()
+	idx.setEntries(entries)
+	if idx.vectors != nil {
+		idx.vectors.load(entries, m.loadVectorState(idx.def))
+	}
+	idx.mu.Unlock()
+
+	return true
+}
+
+// loadVectorState reads the persisted clustering of a vector index, or
+// returns nil if there is none matching the index dimension
+func (m *IndexManager) loadVectorState(def IndexDefinition) *vectorState {
+	file, err := os.Open(m.vectorStatePath(def))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var state vectorState
+	if err := gob.NewDecoder(file).Decode(&state); err != nil {
+		return nil
+	}
+	for _, centroid := range state.Centroids {
+		if len(centroid) != def.Dimensions {
+			return nil
+		}
+	}
+
+	return &state
+}
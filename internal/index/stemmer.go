@@ -0,0 +1,234 @@
+package index
+
+import "strings"
+
+// stem reduces an English word to its stem using the Porter algorithm.
+// Words containing anything other than lowercase ASCII letters are
+// returned unchanged.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	w := []byte(word)
+	w = stemStep1a(w)
+	w = stemStep1b(w)
+	w = stemStep1c(w)
+	w = stemStep2(w)
+	w = stemStep3(w)
+	w = stemStep4(w)
+	w = stemStep5(w)
+	return string(w)
+}
+
+// isConsonant reports whether w[i] is a consonant. Y is a consonant at the
+// start of a word or after a vowel.
+func isConsonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in w
+func measure(w []byte) int {
+	m := 0
+	i := 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i >= len(w) {
+			break
+		}
+		m++
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+	}
+	return m
+}
+
+// hasVowel reports whether w contains a vowel
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsDoubleConsonant reports whether w ends with two equal consonants
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether w ends consonant-vowel-consonant, where the
+// final consonant is not w, x or y
+func endsCVC(w []byte) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	switch w[n-1] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// replaceSuffix swaps suffix for replacement if the remaining stem
+// satisfies cond. It reports whether w ended with suffix at all.
+func replaceSuffix(w []byte, suffix, replacement string, cond func(stem []byte) bool) ([]byte, bool) {
+	if !strings.HasSuffix(string(w), suffix) {
+		return w, false
+	}
+	stem := w[:len(w)-len(suffix)]
+	if cond != nil && !cond(stem) {
+		return w, true
+	}
+	return append(stem[:len(stem):len(stem)], replacement...), true
+}
+
+func measureAbove(n int) func([]byte) bool {
+	return func(stem []byte) bool { return measure(stem) > n }
+}
+
+func stemStep1a(w []byte) []byte {
+	for _, rule := range [][2]string{{"sses", "ss"}, {"ies", "i"}, {"ss", "ss"}, {"s", ""}} {
+		if result, matched := replaceSuffix(w, rule[0], rule[1], nil); matched {
+			return result
+		}
+	}
+	return w
+}
+
+func stemStep1b(w []byte) []byte {
+	if result, matched := replaceSuffix(w, "eed", "ee", measureAbove(0)); matched {
+		return result
+	}
+
+	var stem []byte
+	for _, suffix := range []string{"ed", "ing"} {
+		if strings.HasSuffix(string(w), suffix) {
+			candidate := w[:len(w)-len(suffix)]
+			if !hasVowel(candidate) {
+				return w
+			}
+			stem = candidate
+			break
+		}
+	}
+	if stem == nil {
+		return w
+	}
+
+	w = append([]byte(nil), stem...)
+	for _, suffix := range []string{"at", "bl", "iz"} {
+		if strings.HasSuffix(string(w), suffix) {
+			return append(w, 'e')
+		}
+	}
+	if endsDoubleConsonant(w) {
+		switch w[len(w)-1] {
+		case 'l', 's', 'z':
+			return w
+		}
+		return w[:len(w)-1]
+	}
+	if measure(w) == 1 && endsCVC(w) {
+		return append(w, 'e')
+	}
+	return w
+}
+
+func stemStep1c(w []byte) []byte {
+	result, _ := replaceSuffix(w, "y", "i", hasVowel)
+	return result
+}
+
+var step2Rules = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+func stemStep2(w []byte) []byte {
+	for _, rule := range step2Rules {
+		if result, matched := replaceSuffix(w, rule[0], rule[1], measureAbove(0)); matched {
+			return result
+		}
+	}
+	return w
+}
+
+var step3Rules = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+func stemStep3(w []byte) []byte {
+	for _, rule := range step3Rules {
+		if result, matched := replaceSuffix(w, rule[0], rule[1], measureAbove(0)); matched {
+			return result
+		}
+	}
+	return w
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func stemStep4(w []byte) []byte {
+	// Longer suffixes sharing an ending must be tried first
+	best := ""
+	for _, suffix := range step4Suffixes {
+		if strings.HasSuffix(string(w), suffix) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best == "" {
+		return w
+	}
+
+	stem := w[:len(w)-len(best)]
+	if measure(stem) <= 1 {
+		return w
+	}
+	if best == "ion" && (len(stem) == 0 || (stem[len(stem)-1] != 's' && stem[len(stem)-1] != 't')) {
+		return w
+	}
+	return stem
+}
+
+func stemStep5(w []byte) []byte {
+	if w[len(w)-1] == 'e' {
+		stem := w[:len(w)-1]
+		if m := measure(stem); m > 1 || (m == 1 && !endsCVC(stem)) {
+			w = stem
+		}
+	}
+
+	if measure(w) > 1 && endsDoubleConsonant(w) && w[len(w)-1] == 'l' {
+		w = w[:len(w)-1]
+	}
+	return w
+}
@@ -0,0 +1,446 @@
+package index
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"coffedb/internal/query"
+)
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Key prefixes of a text index. Postings are stored under
+// "t" + term + 0x00 + tf + doc length, and every indexed document under
+// "l" + doc length, so BM25 can be scored from the index alone.
+const (
+	textTermPrefix   = "t"
+	textLengthPrefix = "l"
+)
+
+// snippetRadius is the number of bytes of context kept on each side of
+// the first match in a highlight
+const snippetRadius = 60
+
+var englishStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "if": true, "in": true,
+	"into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// Token is a term produced by text analysis, with the byte offsets of the
+// word it came from
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// Analyze splits text into lowercase words, drops stop words and stems
+// the rest. Language "none" disables stop words and stemming.
+func Analyze(text, language string) []Token {
+	var tokens []Token
+
+	start := -1
+	for i := 0; i <= len(text); {
+		r, size := utf8.RuneError, 1
+		if i < len(text) {
+			r, size = utf8.DecodeRuneInString(text[i:])
+		}
+
+		if i < len(text) && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			if term := analyzeWord(text[start:i], language); term != "" {
+				tokens = append(tokens, Token{Term: term, Start: start, End: i})
+			}
+			start = -1
+		}
+
+		i += size
+	}
+
+	return tokens
+}
+
+// analyzeWord normalizes a single word, returning "" for stop words
+func analyzeWord(word, language string) string {
+	word = strings.ToLower(word)
+	if language == "none" {
+		return word
+	}
+	if englishStopWords[word] {
+		return ""
+	}
+	return stem(word)
+}
+
+// textValues returns the strings a document holds in the fields of a text
+// index, keyed by field path
+func textValues(data map[string]interface{}, def IndexDefinition) map[string][]string {
+	values := make(map[string][]string)
+	for _, field := range def.Fields {
+		for _, value := range query.PathValues(data, field.Path) {
+			if text, ok := value.(string); ok {
+				values[field.Path] = append(values[field.Path], text)
+			}
+		}
+	}
+	return values
+}
+
+// textKeys returns the keys a document contributes to a text index
+func textKeys(doc *Document, def IndexDefinition) map[string]bool {
+	keys := make(map[string]bool)
+	if doc == nil {
+		return keys
+	}
+
+	frequencies := make(map[string]int)
+	length := 0
+	for _, texts := range textValues(doc.Data, def) {
+		for _, text := range texts {
+			for _, token := range Analyze(text, def.Language) {
+				frequencies[token.Term]++
+				length++
+			}
+		}
+	}
+
+	if length == 0 {
+		return keys
+	}
+
+	for term, tf := range frequencies {
+		keys[textTermKey(term, tf, length)] = true
+	}
+	keys[textLengthPrefix+encodeUint32(length)] = true
+
+	return keys
+}
+
+func textTermKey(term string, tf, length int) string {
+	return textTermPrefix + term + "\x00" + encodeUint32(tf) + encodeUint32(length)
+}
+
+func encodeUint32(n int) string {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(n))
+	return string(buf[:])
+}
+
+// TextQuery is a parsed full-text search. Terms and prefixes are optional
+// and rank results; every phrase must occur in a matching document.
+type TextQuery struct {
+	Terms    []string
+	Prefixes []string
+	Phrases  [][]string
+}
+
+// Empty reports whether the query has nothing to search for
+func (q TextQuery) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Prefixes) == 0 && len(q.Phrases) == 0
+}
+
+// ParseTextQuery parses a search string. Quoted text is a phrase, and a
+// word ending in "*" matches every term starting with it.
+func ParseTextQuery(q, language string) TextQuery {
+	var parsed TextQuery
+
+	for i, part := range strings.Split(q, "\"") {
+		if i%2 == 1 {
+			var phrase []string
+			for _, token := range Analyze(part, language) {
+				phrase = append(phrase, token.Term)
+			}
+			if len(phrase) > 0 {
+				parsed.Phrases = append(parsed.Phrases, phrase)
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			if strings.HasSuffix(word, "*") {
+				// Prefixes are lowercased but not stemmed
+				for _, token := range Analyze(strings.TrimSuffix(word, "*"), "none") {
+					parsed.Prefixes = append(parsed.Prefixes, token.Term)
+				}
+				continue
+			}
+			for _, token := range Analyze(word, language) {
+				parsed.Terms = append(parsed.Terms, token.Term)
+			}
+		}
+	}
+
+	return parsed
+}
+
+// TextHit is a document matched by a text search with its BM25 score
+type TextHit struct {
+	DocID string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// textPosting is one document in a term's posting list
+type textPosting struct {
+	tf     int
+	length int
+}
+
+// SearchText scores the documents of a text index against a query with
+// BM25 and returns them best first. Documents must contain every phrase
+// term; phrase order is checked by the caller with MatchPhrases.
+func (idx *Index) SearchText(q TextQuery) []TextHit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Corpus statistics
+	docCount, totalLength := 0, 0
+	idx.rangeKeys(textLengthPrefix, func(key string, docIDs []string) bool {
+		length := int(binary.BigEndian.Uint32([]byte(key[len(textLengthPrefix):])))
+		docCount += len(docIDs)
+		totalLength += length * len(docIDs)
+		return true
+	})
+	if docCount == 0 {
+		return nil
+	}
+	avgLength := float64(totalLength) / float64(docCount)
+
+	// Phrase terms restrict the candidates
+	var required map[string]bool
+	for _, phrase := range q.Phrases {
+		for _, term := range phrase {
+			docs := make(map[string]bool)
+			for docID := range idx.postings(term, false) {
+				if required == nil || required[docID] {
+					docs[docID] = true
+				}
+			}
+			required = docs
+		}
+	}
+
+	// Every query term and phrase term contributes to the score
+	var terms []string
+	terms = append(terms, q.Terms...)
+	for _, phrase := range q.Phrases {
+		terms = append(terms, phrase...)
+	}
+
+	scores := make(map[string]float64)
+	score := func(postings map[string]textPosting) {
+		idf := math.Log(1 + (float64(docCount)-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for docID, posting := range postings {
+			if required != nil && !required[docID] {
+				continue
+			}
+			tf := float64(posting.tf)
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(posting.length)/avgLength)
+			scores[docID] += idf * tf * (bm25K1 + 1) / (tf + norm)
+		}
+	}
+
+	for _, term := range terms {
+		score(idx.postings(term, false))
+	}
+	for _, prefix := range q.Prefixes {
+		score(idx.postings(prefix, true))
+	}
+
+	// A phrase-only query matches its candidates even if nothing scored
+	for docID := range required {
+		if _, exists := scores[docID]; !exists {
+			scores[docID] = 0
+		}
+	}
+
+	hits := make([]TextHit, 0, len(scores))
+	for docID, s := range scores {
+		hits = append(hits, TextHit{DocID: docID, Score: s})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].DocID < hits[j].DocID
+	})
+
+	return hits
+}
+
+// postings collects the posting list of a term, or of every term starting
+// with it when prefix is set. Prefix matches keep the best tf per document.
+func (idx *Index) postings(term string, prefix bool) map[string]textPosting {
+	keyPrefix := textTermPrefix + term
+	if !prefix {
+		keyPrefix += "\x00"
+	}
+
+	postings := make(map[string]textPosting)
+	idx.rangeKeys(keyPrefix, func(key string, docIDs []string) bool {
+		sep := strings.IndexByte(key, 0)
+		if sep < 0 || len(key) < sep+9 {
+			return true
+		}
+		posting := textPosting{
+			tf:     int(binary.BigEndian.Uint32([]byte(key[sep+1 : sep+5]))),
+			length: int(binary.BigEndian.Uint32([]byte(key[sep+5 : sep+9]))),
+		}
+		for _, docID := range docIDs {
+			if existing, ok := postings[docID]; !ok || posting.tf > existing.tf {
+				postings[docID] = posting
+			}
+		}
+		return true
+	})
+
+	return postings
+}
+
+// MatchPhrases reports whether a document contains every phrase of the
+// query as consecutive terms within one of the indexed strings
+func MatchPhrases(data map[string]interface{}, def IndexDefinition, phrases [][]string) bool {
+	var texts [][]Token
+	for _, values := range textValues(data, def) {
+		for _, text := range values {
+			texts = append(texts, Analyze(text, def.Language))
+		}
+	}
+
+	for _, phrase := range phrases {
+		found := false
+		for _, tokens := range texts {
+			if containsPhrase(tokens, phrase) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsPhrase(tokens []Token, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		match := true
+		for j, term := range phrase {
+			if tokens[i+j].Term != term {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Highlight returns, per indexed field, a snippet around the first match
+// of the query with every matching word wrapped in <em> tags
+func Highlight(data map[string]interface{}, def IndexDefinition, q TextQuery) map[string]string {
+	terms := make(map[string]bool)
+	for _, term := range q.Terms {
+		terms[term] = true
+	}
+	for _, phrase := range q.Phrases {
+		for _, term := range phrase {
+			terms[term] = true
+		}
+	}
+
+	matches := func(token Token, text string) bool {
+		if terms[token.Term] {
+			return true
+		}
+		word := strings.ToLower(text[token.Start:token.End])
+		for _, prefix := range q.Prefixes {
+			if strings.HasPrefix(word, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	highlights := make(map[string]string)
+	for path, values := range textValues(data, def) {
+		for _, text := range values {
+			var hits []Token
+			for _, token := range Analyze(text, def.Language) {
+				if matches(token, text) {
+					hits = append(hits, token)
+				}
+			}
+			if len(hits) == 0 {
+				continue
+			}
+
+			highlights[path] = snippet(text, hits)
+			break
+		}
+	}
+
+	return highlights
+}
+
+// snippet cuts a window of text around the first hit and marks the hits
+// inside it
+func snippet(text string, hits []Token) string {
+	start := hits[0].Start - snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := hits[0].End + snippetRadius
+	if end > len(text) {
+		end = len(text)
+	}
+
+	// Keep the window on rune boundaries
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+
+	pos := start
+	for _, hit := range hits {
+		if hit.Start < start || hit.End > end {
+			continue
+		}
+		b.WriteString(text[pos:hit.Start])
+		b.WriteString("<em>")
+		b.WriteString(text[hit.Start:hit.End])
+		b.WriteString("</em>")
+		pos = hit.End
+	}
+	b.WriteString(text[pos:end])
+
+	if end < len(text) {
+		b.WriteString("...")
+	}
+
+	return b.String()
+}
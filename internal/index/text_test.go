@@ -0,0 +1,65 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func terms(tokens []Token) []string {
+	var result []string
+	for _, token := range tokens {
+		result = append(result, token.Term)
+	}
+	return result
+}
+
+func TestAnalyzeStemsAndDropsStopWords(t *testing.T) {
+	text := "The Runners are running to Oslo"
+	tokens := Analyze(text, "english")
+
+	if got, want := terms(tokens), []string{"runner", "run", "oslo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("terms = %v, want %v", got, want)
+	}
+	if last := tokens[len(tokens)-1]; text[last.Start:last.End] != "Oslo" {
+		t.Errorf("last token spans %q, want Oslo", text[last.Start:last.End])
+	}
+
+	if got, want := terms(Analyze("The Runners", "none")), []string{"the", "runners"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("terms without a language = %v, want %v", got, want)
+	}
+}
+
+func TestParseTextQuery(t *testing.T) {
+	q := ParseTextQuery(`running "the quick foxes" data*`, "english")
+
+	want := TextQuery{
+		Terms:    []string{"run"},
+		Prefixes: []string{"data"},
+		Phrases:  [][]string{{"quick", "fox"}},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("query = %+v, want %+v", q, want)
+	}
+	if !ParseTextQuery(`the "and" *`, "english").Empty() {
+		t.Errorf("query of stop words is not empty")
+	}
+}
+
+func TestSearchTextRanksByBM25(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+	idx := readyIndex(t, m, IndexDefinition{Name: "text", Collection: "users", Type: IndexTypeText, Fields: []IndexField{{Path: "bio", Order: 1}}},
+		doc("u1", map[string]interface{}{"bio": "databases and more databases"}),
+		doc("u2", map[string]interface{}{"bio": "a database engineer who also writes about gardens, cooking and travel"}),
+		doc("u3", map[string]interface{}{"bio": "gardens"}),
+	)
+
+	hits := idx.SearchText(ParseTextQuery("database", "english"))
+	if len(hits) != 2 || hits[0].DocID != "u1" || hits[1].DocID != "u2" || hits[0].Score <= hits[1].Score {
+		t.Errorf("hits = %+v, want u1 then u2", hits)
+	}
+
+	hits = idx.SearchText(ParseTextQuery("garde*", "english"))
+	if len(hits) != 2 || hits[0].DocID != "u3" {
+		t.Errorf("prefix hits = %+v, want u3 first of two", hits)
+	}
+}
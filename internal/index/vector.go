@@ -0,0 +1,376 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"coffedb/internal/query"
+)
+
+// IVF parameters. Below vectorIVFThreshold vectors a search compares
+// every vector; above it vectors are clustered with k-means and a search
+// only scans the lists of the centroids closest to the query.
+const (
+	vectorIVFThreshold    = 1000
+	vectorMaxLists        = 256
+	vectorTrainSample     = 4096
+	vectorTrainIterations = 8
+)
+
+// vectorIndex is the in-memory search structure of a vector index, kept
+// in step with the index entries
+type vectorIndex struct {
+	metric      string
+	vectors     map[string][]float32 // docID -> vector
+	centroids   [][]float32
+	lists       []map[string]bool // docIDs per centroid
+	assigned    map[string]int    // docID -> list
+	trainedSize int               // vectors present at the last training
+}
+
+func newVectorIndex(metric string) *vectorIndex {
+	return &vectorIndex{
+		metric:   metric,
+		vectors:  make(map[string][]float32),
+		assigned: make(map[string]int),
+	}
+}
+
+// vectorKeys returns the key a document contributes to a vector index.
+// Documents whose field is not a numeric array of the index dimension are
+// left out.
+func vectorKeys(doc *Document, def IndexDefinition) map[string]bool {
+	keys := make(map[string]bool)
+	if doc == nil {
+		return keys
+	}
+
+	value, _ := query.LookupPath(doc.Data, def.Fields[0].Path)
+	if vector, ok := ParseVector(value, def.Dimensions); ok {
+		keys[encodeVector(vector)] = true
+	}
+	return keys
+}
+
+// ParseVector reads a numeric array of the given dimension
+func ParseVector(value interface{}, dimensions int) ([]float32, bool) {
+	var vector []float32
+	switch v := value.(type) {
+	case []interface{}:
+		vector = make([]float32, 0, len(v))
+		for _, element := range v {
+			f, ok := query.ToFloat64(element)
+			if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, false
+			}
+			vector = append(vector, float32(f))
+		}
+	case []float64:
+		vector = make([]float32, 0, len(v))
+		for _, f := range v {
+			vector = append(vector, float32(f))
+		}
+	default:
+		return nil, false
+	}
+
+	if len(vector) != dimensions {
+		return nil, false
+	}
+	return vector, true
+}
+
+func encodeVector(vector []float32) string {
+	buf := make([]byte, 4*len(vector))
+	for i, f := range vector {
+		binary.BigEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return string(buf)
+}
+
+func decodeVector(key string) []float32 {
+	vector := make([]float32, len(key)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.BigEndian.Uint32([]byte(key[4*i : 4*i+4])))
+	}
+	return vector
+}
+
+// distance compares two vectors under the metric; lower is closer
+func (v *vectorIndex) distance(a, b []float32) float64 {
+	switch v.metric {
+	case MetricL2:
+		return l2Distance(a, b)
+	case MetricDot:
+		return -dotProduct(a, b)
+	}
+
+	norm := math.Sqrt(dotProduct(a, a) * dotProduct(b, b))
+	if norm == 0 {
+		return 1
+	}
+	return 1 - dotProduct(a, b)/norm
+}
+
+// clusterDistance assigns vectors to lists. Inner products are not a
+// metric, so dot indexes cluster by Euclidean distance.
+func (v *vectorIndex) clusterDistance(a, b []float32) float64 {
+	if v.metric == MetricDot {
+		return l2Distance(a, b)
+	}
+	return v.distance(a, b)
+}
+
+// score turns a distance into the value reported to clients: the cosine
+// similarity, the inner product or the Euclidean distance
+func (v *vectorIndex) score(distance float64) float64 {
+	switch v.metric {
+	case MetricL2:
+		return distance
+	case MetricDot:
+		return -distance
+	}
+	return 1 - distance
+}
+
+func dotProduct(a, b []float32) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+func l2Distance(a, b []float32) float64 {
+	sum := 0.0
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// add records the vector of a document, retraining the lists once the
+// index has doubled since the last training
+func (v *vectorIndex) add(docID, key string) {
+	v.remove(docID)
+	vector := decodeVector(key)
+	v.vectors[docID] = vector
+
+	if len(v.vectors) >= vectorIVFThreshold && len(v.vectors) >= 2*v.trainedSize {
+		v.train()
+		return
+	}
+	if v.centroids != nil {
+		v.assign(docID, vector)
+	}
+}
+
+// remove forgets the vector of a document
+func (v *vectorIndex) remove(docID string) {
+	if _, exists := v.vectors[docID]; !exists {
+		return
+	}
+	delete(v.vectors, docID)
+
+	if list, ok := v.assigned[docID]; ok {
+		delete(v.lists[list], docID)
+		delete(v.assigned, docID)
+	}
+}
+
+// load replaces the vectors with the contents of index entries and
+// restores the persisted clustering, retraining if there is none
+func (v *vectorIndex) load(entries map[string][]string, state *vectorState) {
+	v.vectors = make(map[string][]float32)
+	for key, docIDs := range entries {
+		vector := decodeVector(key)
+		for _, docID := range docIDs {
+			v.vectors[docID] = vector
+		}
+	}
+
+	v.centroids = nil
+	v.lists = nil
+	v.assigned = make(map[string]int)
+	v.trainedSize = 0
+
+	switch {
+	case state != nil && len(state.Centroids) > 0:
+		v.setCentroids(state.Centroids, state.TrainedSize)
+	case len(v.vectors) >= vectorIVFThreshold:
+		v.train()
+	}
+}
+
+// setCentroids installs persisted centroids and assigns every vector
+func (v *vectorIndex) setCentroids(centroids [][]float32, trainedSize int) {
+	v.centroids = centroids
+	v.trainedSize = trainedSize
+	v.assignAll()
+}
+
+func (v *vectorIndex) assign(docID string, vector []float32) {
+	best, bestDistance := 0, math.Inf(1)
+	for i, centroid := range v.centroids {
+		if d := v.clusterDistance(vector, centroid); d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	v.lists[best][docID] = true
+	v.assigned[docID] = best
+}
+
+func (v *vectorIndex) assignAll() {
+	v.lists = make([]map[string]bool, len(v.centroids))
+	for i := range v.lists {
+		v.lists[i] = make(map[string]bool)
+	}
+	v.assigned = make(map[string]int)
+	for docID, vector := range v.vectors {
+		v.assign(docID, vector)
+	}
+}
+
+// train clusters a deterministic sample of the vectors with k-means into
+// about sqrt(n) lists
+func (v *vectorIndex) train() {
+	docIDs := make([]string, 0, len(v.vectors))
+	for docID := range v.vectors {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Strings(docIDs)
+
+	nlist := int(math.Sqrt(float64(len(docIDs))))
+	if nlist > vectorMaxLists {
+		nlist = vectorMaxLists
+	}
+	if nlist < 1 {
+		nlist = 1
+	}
+
+	// Take an evenly spaced sample and seed the centroids from it
+	sampleSize := len(docIDs)
+	if sampleSize > vectorTrainSample {
+		sampleSize = vectorTrainSample
+	}
+	sample := make([][]float32, sampleSize)
+	for i := range sample {
+		sample[i] = v.vectors[docIDs[i*len(docIDs)/sampleSize]]
+	}
+
+	centroids := make([][]float32, nlist)
+	for i := range centroids {
+		centroids[i] = append([]float32(nil), sample[i*sampleSize/nlist]...)
+	}
+
+	for iteration := 0; iteration < vectorTrainIterations; iteration++ {
+		sums := make([][]float64, nlist)
+		counts := make([]int, nlist)
+		for _, vector := range sample {
+			best, bestDistance := 0, math.Inf(1)
+			for i, centroid := range centroids {
+				if d := v.clusterDistance(vector, centroid); d < bestDistance {
+					best, bestDistance = i, d
+				}
+			}
+			if sums[best] == nil {
+				sums[best] = make([]float64, len(vector))
+			}
+			for j, f := range vector {
+				sums[best][j] += float64(f)
+			}
+			counts[best]++
+		}
+
+		// Empty clusters keep their previous centroid
+		for i := range centroids {
+			if counts[i] == 0 {
+				continue
+			}
+			for j := range centroids[i] {
+				centroids[i][j] = float32(sums[i][j] / float64(counts[i]))
+			}
+		}
+	}
+
+	v.setCentroids(centroids, len(v.vectors))
+}
+
+// VectorHit is a document matched by a vector search. Score is the cosine
+// similarity or inner product (higher is closer), or the Euclidean
+// distance for l2 indexes (lower is closer).
+type VectorHit struct {
+	DocID    string  `json:"id"`
+	Score    float64 `json:"score"`
+	distance float64
+}
+
+// SearchVector returns up to k documents closest to the query vector,
+// closest first; k <= 0 returns every document. probes is the number of
+// lists scanned once the index is clustered; probes <= 0 picks a default
+// and exact forces a comparison with every vector.
+func (idx *Index) SearchVector(vector []float32, k, probes int, exact bool) ([]VectorHit, error) {
+	if len(vector) != idx.def.Dimensions {
+		return nil, fmt.Errorf("%w: expected %d dimensions, got %d", ErrInvalidVector, idx.def.Dimensions, len(vector))
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	v := idx.vectors
+	var hits []VectorHit
+	consider := func(docID string) {
+		d := v.distance(vector, v.vectors[docID])
+		hits = append(hits, VectorHit{DocID: docID, Score: v.score(d), distance: d})
+	}
+
+	if exact || v.centroids == nil {
+		for docID := range v.vectors {
+			consider(docID)
+		}
+	} else {
+		if probes <= 0 {
+			probes = int(math.Ceil(math.Sqrt(float64(len(v.centroids)))))
+		}
+
+		order := make([]int, len(v.centroids))
+		distances := make([]float64, len(v.centroids))
+		for i, centroid := range v.centroids {
+			order[i] = i
+			distances[i] = v.clusterDistance(vector, centroid)
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return distances[order[i]] < distances[order[j]]
+		})
+
+		if probes > len(order) {
+			probes = len(order)
+		}
+		for _, list := range order[:probes] {
+			for docID := range v.lists[list] {
+				consider(docID)
+			}
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].distance != hits[j].distance {
+			return hits[i].distance < hits[j].distance
+		}
+		return hits[i].DocID < hits[j].DocID
+	})
+	if k > 0 && len(hits) > k {
+		hits = hits[:k]
+	}
+
+	return hits, nil
+}
+
+// vectorState is the persisted clustering of a vector index
+type vectorState struct {
+	Centroids   [][]float32
+	TrainedSize int
+}
@@ -0,0 +1,111 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func vectorDef(metric string, dimensions int) IndexDefinition {
+	return IndexDefinition{Name: "embedding", Collection: "items", Type: IndexTypeVector, Fields: []IndexField{{Path: "embedding", Order: 1}}, Dimensions: dimensions, Metric: metric}
+}
+
+func vectorDoc(id string, vector ...float64) *Document {
+	values := make([]interface{}, len(vector))
+	for i, f := range vector {
+		values[i] = f
+	}
+	return doc(id, map[string]interface{}{"embedding": values})
+}
+
+func hitIDs(hits []VectorHit) []string {
+	var ids []string
+	for _, hit := range hits {
+		ids = append(ids, hit.DocID)
+	}
+	return ids
+}
+
+func TestSearchVectorMetrics(t *testing.T) {
+	docs := []*Document{vectorDoc("long", 2, 0), vectorDoc("diagonal", 0.5, 0.5), vectorDoc("opposite", -1, 0)}
+	tests := []struct {
+		metric string
+		want   []string
+		best   float64
+	}{
+		{MetricCosine, []string{"long", "diagonal", "opposite"}, 1},
+		{MetricDot, []string{"long", "diagonal", "opposite"}, 2},
+		{MetricL2, []string{"diagonal", "long", "opposite"}, 0.7071},
+	}
+
+	for _, tt := range tests {
+		idx := readyIndex(t, NewIndexManager(t.TempDir()), vectorDef(tt.metric, 2), docs...)
+		hits, err := idx.SearchVector([]float32{1, 0}, 0, 0, false)
+		if err != nil {
+			t.Fatalf("%s: SearchVector: %v", tt.metric, err)
+		}
+		if ids := hitIDs(hits); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: hits = %v, want %v", tt.metric, ids, tt.want)
+		}
+		if d := hits[0].Score - tt.best; d > 1e-4 || d < -1e-4 {
+			t.Errorf("%s: best score = %v, want %v", tt.metric, hits[0].Score, tt.best)
+		}
+	}
+}
+
+func TestSearchVectorRejectsWrongDimensions(t *testing.T) {
+	idx := readyIndex(t, NewIndexManager(t.TempDir()), vectorDef(MetricCosine, 3), vectorDoc("a", 1, 2, 3), vectorDoc("short", 1, 2))
+
+	if _, err := idx.SearchVector([]float32{1, 2}, 1, 0, false); !errors.Is(err, ErrInvalidVector) {
+		t.Errorf("search with 2 dimensions: %v, want ErrInvalidVector", err)
+	}
+	if hits, _ := idx.SearchVector([]float32{1, 2, 3}, 0, 0, false); !reflect.DeepEqual(hitIDs(hits), []string{"a"}) {
+		t.Errorf("hits = %v, want only the document of the right dimension", hitIDs(hits))
+	}
+}
+
+func TestSearchVectorClustersLargeIndexes(t *testing.T) {
+	// Points scattered around a few well separated centers
+	random := rand.New(rand.NewSource(1))
+	centers := [][2]float64{{0, 0}, {100, 0}, {0, 100}, {100, 100}}
+	var docs []*Document
+	for i := 0; i < 2*vectorIVFThreshold; i++ {
+		center := centers[i%len(centers)]
+		docs = append(docs, vectorDoc(fmt.Sprintf("d%04d", i), center[0]+random.Float64()*10, center[1]+random.Float64()*10))
+	}
+
+	dir := t.TempDir()
+	m := NewIndexManager(dir)
+	idx := readyIndex(t, m, vectorDef(MetricL2, 2), docs...)
+	if idx.vectors.centroids == nil {
+		t.Fatalf("index of %d vectors is not clustered", len(docs))
+	}
+
+	query := []float32{103, 98}
+	exact, _ := idx.SearchVector(query, 10, 0, true)
+	approximate, _ := idx.SearchVector(query, 10, 0, false)
+	if !reflect.DeepEqual(hitIDs(approximate), hitIDs(exact)) {
+		t.Errorf("approximate hits = %v, want %v", hitIDs(approximate), hitIDs(exact))
+	}
+
+	// The clustering is restored with the snapshot
+	if err := m.SaveSnapshot(idx); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	restarted := NewIndexManager(dir)
+	if rebuild := restarted.Load([]IndexDefinition{idx.Definition()}); len(rebuild) != 0 {
+		t.Fatalf("snapshot not restored")
+	}
+	loaded, err := restarted.VectorIndex("items", "embedding")
+	if err != nil {
+		t.Fatalf("VectorIndex: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.vectors.centroids, idx.vectors.centroids) {
+		t.Errorf("centroids differ after loading the snapshot")
+	}
+	if restored, _ := loaded.SearchVector(query, 10, 0, false); !reflect.DeepEqual(hitIDs(restored), hitIDs(exact)) {
+		t.Errorf("hits after restart = %v, want %v", hitIDs(restored), hitIDs(exact))
+	}
+}
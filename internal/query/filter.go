@@ -0,0 +1,413 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrInvalidFilter is returned for filters with malformed operators
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// MatchFilter reports whether a document satisfies a filter. Filter keys
+// are dotted paths, or $and and $or with a list of filters. A plain value
+// matches by equality, where a field holding an array matches if the
+// array itself or any element is equal. An object whose keys are
+// operators matches if every operator does: $eq, $ne, $gt, $gte, $lt,
+// $lte, $in, $nin, $exists, $near and $geoWithin. Filters should be
+// checked with ValidateFilter first; malformed operators never match.
+func MatchFilter(data map[string]interface{}, filter map[string]interface{}) bool {
+	for key, value := range filter {
+		switch key {
+		case "$and":
+			clauses, _ := filterList(value)
+			for _, clause := range clauses {
+				if !MatchFilter(data, clause) {
+					return false
+				}
+			}
+			continue
+		case "$or":
+			clauses, _ := filterList(value)
+			matched := false
+			for _, clause := range clauses {
+				if MatchFilter(data, clause) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+
+		if operators, ok := OperatorObject(value); ok {
+			if !matchOperators(data, key, operators) {
+				return false
+			}
+			continue
+		}
+		if !fieldEquals(data, key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateFilter checks the operators used in a filter
+func ValidateFilter(filter map[string]interface{}) error {
+	nears := 0
+	if err := validateFilter(filter, true, &nears); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	if nears > 1 {
+		return fmt.Errorf("%w: only one $near is allowed per query", ErrInvalidFilter)
+	}
+	return nil
+}
+
+// validateFilter checks a filter or a clause of $and/$or; $near is only
+// allowed at the top level
+func validateFilter(filter map[string]interface{}, top bool, nears *int) error {
+	for path, value := range filter {
+		switch path {
+		case "$and", "$or":
+			clauses, ok := filterList(value)
+			if !ok || len(clauses) == 0 {
+				return fmt.Errorf("%s requires a non-empty list of filters", path)
+			}
+			for _, clause := range clauses {
+				if err := validateFilter(clause, false, nears); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(path, "$") {
+			return fmt.Errorf("unknown operator %s", path)
+		}
+
+		operators, ok := OperatorObject(value)
+		if !ok {
+			continue
+		}
+
+		for name, arg := range operators {
+			var err error
+			switch name {
+			case "$eq", "$ne":
+			case "$gt", "$gte", "$lt", "$lte":
+				if arg == nil || !IsScalar(arg) {
+					err = fmt.Errorf("%s requires a number, string or boolean", name)
+				}
+			case "$in", "$nin":
+				if _, ok := arg.([]interface{}); !ok {
+					err = fmt.Errorf("%s requires an array", name)
+				}
+			case "$exists":
+				if _, ok := arg.(bool); !ok {
+					err = fmt.Errorf("$exists requires a boolean")
+				}
+			case "$near":
+				if !top {
+					err = fmt.Errorf("$near cannot be used inside $and or $or")
+					break
+				}
+				*nears++
+				_, err = ParseNear(arg, operators)
+			case "$geoWithin":
+				_, err = ParseGeoWithin(arg)
+			case "$maxDistance", "$minDistance":
+				if _, ok := operators["$near"]; !ok {
+					err = fmt.Errorf("%s requires $near", name)
+				}
+			default:
+				err = fmt.Errorf("unknown operator %s", name)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterList reads the list of filters given to $and or $or
+func filterList(value interface{}) ([]map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		return v, true
+	case []interface{}:
+		clauses := make([]map[string]interface{}, 0, len(v))
+		for _, element := range v {
+			clause, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			clauses = append(clauses, clause)
+		}
+		return clauses, true
+	}
+	return nil, false
+}
+
+// OperatorObject returns a filter value as a map of operators if it is
+// one, that is an object whose keys all start with "$"
+func OperatorObject(value interface{}) (map[string]interface{}, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) == 0 {
+		return nil, false
+	}
+	for key := range object {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return object, true
+}
+
+// matchOperators evaluates the operators applied to one field
+func matchOperators(data map[string]interface{}, path string, operators map[string]interface{}) bool {
+	for name, arg := range operators {
+		switch name {
+		case "$eq":
+			if !fieldEquals(data, path, arg) {
+				return false
+			}
+		case "$ne":
+			if fieldEquals(data, path, arg) {
+				return false
+			}
+		case "$in", "$nin":
+			values, _ := arg.([]interface{})
+			found := false
+			for _, value := range values {
+				if fieldEquals(data, path, value) {
+					found = true
+					break
+				}
+			}
+			if found != (name == "$in") {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !fieldCompares(data, path, name, arg) {
+				return false
+			}
+		case "$exists":
+			want, _ := arg.(bool)
+			if fieldExists(data, path) != want {
+				return false
+			}
+		case "$near":
+			near, err := ParseNear(arg, operators)
+			if err != nil {
+				return false
+			}
+			if _, ok := nearestDistance(GeoPoints(data, path), near); !ok {
+				return false
+			}
+		case "$geoWithin":
+			shape, err := ParseGeoWithin(arg)
+			if err != nil || !anyPointIn(GeoPoints(data, path), shape) {
+				return false
+			}
+		case "$maxDistance", "$minDistance":
+			// Options of $near
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fieldExists reports whether a document has a value at a dotted path
+func fieldExists(data map[string]interface{}, path string) bool {
+	if _, exists := LookupPath(data, path); exists {
+		return true
+	}
+	return len(PathValues(data, path)) > 0
+}
+
+// fieldCompares reports whether the value at a dotted path, or any
+// element of it, satisfies a comparison operator
+func fieldCompares(data map[string]interface{}, path, operator string, bound interface{}) bool {
+	for _, value := range PathValues(data, path) {
+		if cmp, ok := CompareValues(value, bound); ok && compareSatisfies(cmp, operator) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareSatisfies(cmp int, operator string) bool {
+	switch operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// CompareValues orders two numbers, two strings or two booleans. It
+// returns false for values of different kinds, which never compare.
+func CompareValues(a, b interface{}) (int, bool) {
+	if aFloat, ok := ToFloat64(a); ok {
+		bFloat, ok := ToFloat64(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case aFloat < bFloat:
+			return -1, true
+		case aFloat > bFloat:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch aValue := a.(type) {
+	case string:
+		if bValue, ok := b.(string); ok {
+			return strings.Compare(aValue, bValue), true
+		}
+	case bool:
+		if bValue, ok := b.(bool); ok {
+			switch {
+			case aValue == bValue:
+				return 0, true
+			case bValue:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// FindNear returns the field path and parsed operator of the $near
+// predicate of a filter, if it has one
+func FindNear(filter map[string]interface{}) (string, Near, bool) {
+	for path, value := range filter {
+		operators, ok := OperatorObject(value)
+		if !ok {
+			continue
+		}
+		if arg, exists := operators["$near"]; exists {
+			if near, err := ParseNear(arg, operators); err == nil {
+				return path, near, true
+			}
+		}
+	}
+	return "", Near{}, false
+}
+
+// NearDistance returns the distance in meters from the $near point to the
+// closest location a document holds at path, and false if it has none in
+// range
+func NearDistance(data map[string]interface{}, path string, near Near) (float64, bool) {
+	return nearestDistance(GeoPoints(data, path), near)
+}
+
+func nearestDistance(points []Point, near Near) (float64, bool) {
+	best, found := 0.0, false
+	for _, point := range points {
+		if !near.Matches(point) {
+			continue
+		}
+		if d := Distance(near.Point, point); !found || d < best {
+			best, found = d, true
+		}
+	}
+	return best, found
+}
+
+func anyPointIn(points []Point, shape Shape) bool {
+	for _, point := range points {
+		if shape.Contains(point) {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoBounds returns boxes covering every location the geo operators of a
+// filter value can match. It returns false if the value has no geo
+// operator or, for an unbounded $near, no finite bounds.
+func GeoBounds(value interface{}) ([]Box, bool) {
+	operators, ok := OperatorObject(value)
+	if !ok {
+		return nil, false
+	}
+
+	if arg, exists := operators["$geoWithin"]; exists {
+		if shape, err := ParseGeoWithin(arg); err == nil {
+			return shape.Bounds(), true
+		}
+	}
+	if arg, exists := operators["$near"]; exists {
+		if near, err := ParseNear(arg, operators); err == nil && near.MaxDistance > 0 {
+			return near.Bounds(), true
+		}
+	}
+
+	return nil, false
+}
+
+// GeoPoints returns the locations stored at a dotted path. The value may
+// be a single point or an array of points.
+func GeoPoints(data map[string]interface{}, path string) []Point {
+	if value, exists := LookupPath(data, path); exists {
+		if point, ok := ParsePoint(value); ok {
+			return []Point{point}
+		}
+	}
+
+	var points []Point
+	for _, value := range PathValues(data, path) {
+		if point, ok := ParsePoint(value); ok {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// fieldEquals checks a dotted path against an expected value
+func fieldEquals(data map[string]interface{}, path string, value interface{}) bool {
+	if docValue, exists := LookupPath(data, path); exists && ValuesEqual(docValue, value) {
+		return true
+	}
+
+	for _, docValue := range PathValues(data, path) {
+		if ValuesEqual(docValue, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValuesEqual compares two document values. Numbers of different types
+// are equal if they have the same value; objects and arrays compare
+// structurally.
+func ValuesEqual(a, b interface{}) bool {
+	if !IsScalar(a) || !IsScalar(b) {
+		return reflect.DeepEqual(a, b)
+	}
+	if a == b {
+		return true
+	}
+
+	aFloat, aIsNum := ToFloat64(a)
+	bFloat, bIsNum := ToFloat64(b)
+	return aIsNum && bIsNum && aFloat == bFloat
+}
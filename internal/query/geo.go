@@ -0,0 +1,306 @@
+package query
+
+import (
+	"fmt"
+	"math"
+)
+
+// earthRadius is the mean radius of the Earth in meters
+const earthRadius = 6371008.8
+
+// Point is a geographic position in degrees
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Box is a latitude/longitude rectangle. MinLng > MaxLng denotes a box
+// crossing the antimeridian.
+type Box struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+// Contains reports whether p lies in the box
+func (b Box) Contains(p Point) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return p.Lng >= b.MinLng && p.Lng <= b.MaxLng
+	}
+	return p.Lng >= b.MinLng || p.Lng <= b.MaxLng
+}
+
+// Split returns the box as one or two boxes that do not cross the
+// antimeridian
+func (b Box) Split() []Box {
+	if b.MinLng <= b.MaxLng {
+		return []Box{b}
+	}
+	return []Box{
+		{MinLat: b.MinLat, MinLng: b.MinLng, MaxLat: b.MaxLat, MaxLng: 180},
+		{MinLat: b.MinLat, MinLng: -180, MaxLat: b.MaxLat, MaxLng: b.MaxLng},
+	}
+}
+
+// Shape is a region a $geoWithin query selects
+type Shape interface {
+	Contains(p Point) bool
+	// Bounds returns boxes covering the shape
+	Bounds() []Box
+}
+
+// Circle is a spherical cap around a center, with a radius in meters
+type Circle struct {
+	Center Point
+	Radius float64
+}
+
+// Contains reports whether p lies within the circle
+func (c Circle) Contains(p Point) bool {
+	return Distance(c.Center, p) <= c.Radius
+}
+
+// Bounds returns the bounding boxes of the circle
+func (c Circle) Bounds() []Box {
+	return circleBounds(c.Center, c.Radius)
+}
+
+// Polygon is a simple polygon given by its outer ring
+type Polygon struct {
+	Ring []Point
+}
+
+// Contains reports whether p lies inside the polygon, treating latitude
+// and longitude as planar coordinates
+func (pg Polygon) Contains(p Point) bool {
+	inside := false
+	for i, j := 0, len(pg.Ring)-1; i < len(pg.Ring); j, i = i, i+1 {
+		a, b := pg.Ring[i], pg.Ring[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Bounds returns the bounding box of the polygon
+func (pg Polygon) Bounds() []Box {
+	box := Box{MinLat: 90, MinLng: 180, MaxLat: -90, MaxLng: -180}
+	for _, p := range pg.Ring {
+		box.MinLat = math.Min(box.MinLat, p.Lat)
+		box.MaxLat = math.Max(box.MaxLat, p.Lat)
+		box.MinLng = math.Min(box.MinLng, p.Lng)
+		box.MaxLng = math.Max(box.MaxLng, p.Lng)
+	}
+	return []Box{box}
+}
+
+// boxShape adapts a Box to the Shape interface
+type boxShape struct{ Box }
+
+func (b boxShape) Bounds() []Box { return b.Split() }
+
+// Near is a parsed $near operator
+type Near struct {
+	Point       Point
+	MaxDistance float64 // meters; 0 means unbounded
+	MinDistance float64
+}
+
+// Bounds returns boxes covering the area a bounded $near can match, or
+// nil if it is unbounded
+func (n Near) Bounds() []Box {
+	if n.MaxDistance <= 0 {
+		return nil
+	}
+	return circleBounds(n.Point, n.MaxDistance)
+}
+
+// Matches reports whether p is within the distance limits
+func (n Near) Matches(p Point) bool {
+	d := Distance(n.Point, p)
+	return d >= n.MinDistance && (n.MaxDistance <= 0 || d <= n.MaxDistance)
+}
+
+// Distance returns the great-circle distance between two points in meters
+func Distance(a, b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// circleBounds returns boxes covering a circle of radius meters
+func circleBounds(center Point, radius float64) []Box {
+	dLat := radius / earthRadius * 180 / math.Pi
+	box := Box{
+		MinLat: math.Max(-90, center.Lat-dLat),
+		MaxLat: math.Min(90, center.Lat+dLat),
+	}
+
+	// Near the poles the circle spans every longitude
+	cos := math.Cos(center.Lat * math.Pi / 180)
+	if box.MinLat <= -90 || box.MaxLat >= 90 || cos < 1e-9 || dLat/cos >= 180 {
+		box.MinLng, box.MaxLng = -180, 180
+		return []Box{box}
+	}
+
+	dLng := dLat / cos
+	box.MinLng = normalizeLng(center.Lng - dLng)
+	box.MaxLng = normalizeLng(center.Lng + dLng)
+	return box.Split()
+}
+
+func normalizeLng(lng float64) float64 {
+	for lng < -180 {
+		lng += 360
+	}
+	for lng > 180 {
+		lng -= 360
+	}
+	return lng
+}
+
+// ParsePoint reads a location from a document or query value. It accepts
+// {"lat": .., "lng": ..} objects ("lon" also works), GeoJSON points and
+// [lng, lat] pairs.
+func ParsePoint(value interface{}) (Point, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v["type"] == "Point" {
+			return ParsePoint(v["coordinates"])
+		}
+		lat, latOK := ToFloat64(v["lat"])
+		lng, lngOK := ToFloat64(v["lng"])
+		if !lngOK {
+			lng, lngOK = ToFloat64(v["lon"])
+		}
+		if latOK && lngOK && validPoint(lat, lng) {
+			return Point{Lat: lat, Lng: lng}, true
+		}
+	case []interface{}:
+		if len(v) == 2 {
+			lng, lngOK := ToFloat64(v[0])
+			lat, latOK := ToFloat64(v[1])
+			if latOK && lngOK && validPoint(lat, lng) {
+				return Point{Lat: lat, Lng: lng}, true
+			}
+		}
+	}
+	return Point{}, false
+}
+
+func validPoint(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// ParseNear parses the value of a $near operator. siblings holds the other
+// operators of the same field, where $maxDistance may also be given.
+func ParseNear(value interface{}, siblings map[string]interface{}) (Near, error) {
+	var near Near
+	spec := siblings
+
+	if object, ok := value.(map[string]interface{}); ok && object["$geometry"] != nil {
+		spec = object
+		value = object["$geometry"]
+	}
+
+	point, ok := ParsePoint(value)
+	if !ok {
+		return near, fmt.Errorf("$near requires a point")
+	}
+	near.Point = point
+
+	for key, target := range map[string]*float64{"$maxDistance": &near.MaxDistance, "$minDistance": &near.MinDistance} {
+		if raw, exists := spec[key]; exists {
+			distance, ok := ToFloat64(raw)
+			if !ok || distance < 0 {
+				return near, fmt.Errorf("%s must be a non-negative number of meters", key)
+			}
+			*target = distance
+		}
+	}
+
+	return near, nil
+}
+
+// ParseGeoWithin parses the value of a $geoWithin operator: a $box, a
+// $centerSphere (radius in radians), a $polygon or a GeoJSON Polygon
+// $geometry
+func ParseGeoWithin(value interface{}) (Shape, error) {
+	spec, ok := value.(map[string]interface{})
+	if !ok || len(spec) != 1 {
+		return nil, fmt.Errorf("$geoWithin requires exactly one shape")
+	}
+
+	for kind, raw := range spec {
+		switch kind {
+		case "$box":
+			corners, ok := raw.([]interface{})
+			if !ok || len(corners) != 2 {
+				return nil, fmt.Errorf("$box requires two corners")
+			}
+			a, okA := ParsePoint(corners[0])
+			b, okB := ParsePoint(corners[1])
+			if !okA || !okB {
+				return nil, fmt.Errorf("$box corners must be points")
+			}
+			return boxShape{Box{
+				MinLat: math.Min(a.Lat, b.Lat), MaxLat: math.Max(a.Lat, b.Lat),
+				MinLng: a.Lng, MaxLng: b.Lng,
+			}}, nil
+
+		case "$centerSphere":
+			args, ok := raw.([]interface{})
+			if !ok || len(args) != 2 {
+				return nil, fmt.Errorf("$centerSphere requires a center and a radius")
+			}
+			center, okCenter := ParsePoint(args[0])
+			radians, okRadius := ToFloat64(args[1])
+			if !okCenter || !okRadius || radians < 0 {
+				return nil, fmt.Errorf("$centerSphere requires a point and a radius in radians")
+			}
+			return Circle{Center: center, Radius: radians * earthRadius}, nil
+
+		case "$polygon":
+			return parseRing(raw)
+
+		case "$geometry":
+			geometry, ok := raw.(map[string]interface{})
+			if !ok || geometry["type"] != "Polygon" {
+				return nil, fmt.Errorf("$geometry must be a GeoJSON Polygon")
+			}
+			rings, ok := geometry["coordinates"].([]interface{})
+			if !ok || len(rings) == 0 {
+				return nil, fmt.Errorf("polygon requires coordinates")
+			}
+			return parseRing(rings[0])
+		}
+
+		return nil, fmt.Errorf("unknown $geoWithin shape %s", kind)
+	}
+
+	return nil, fmt.Errorf("$geoWithin requires exactly one shape")
+}
+
+func parseRing(raw interface{}) (Shape, error) {
+	vertices, ok := raw.([]interface{})
+	if !ok || len(vertices) < 3 {
+		return nil, fmt.Errorf("polygon requires at least three points")
+	}
+
+	polygon := Polygon{}
+	for _, vertex := range vertices {
+		point, ok := ParsePoint(vertex)
+		if !ok {
+			return nil, fmt.Errorf("polygon vertices must be points")
+		}
+		polygon.Ring = append(polygon.Ring, point)
+	}
+
+	return polygon, nil
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	oslo  = Point{Lat: 59.9139, Lng: 10.7522}
+	paris = Point{Lat: 48.8566, Lng: 2.3522}
+)
+
+func TestDistance(t *testing.T) {
+	if d := Distance(oslo, paris); math.Abs(d-1342e3) > 5e3 {
+		t.Errorf("Oslo to Paris = %.0f m, want about 1342 km", d)
+	}
+	if d := Distance(Point{Lat: 0, Lng: 179.5}, Point{Lat: 0, Lng: -179.5}); math.Abs(d-111.2e3) > 1e3 {
+		t.Errorf("across the antimeridian = %.0f m, want about 111 km", d)
+	}
+}
+
+func TestParsePointFormats(t *testing.T) {
+	for _, value := range []interface{}{
+		map[string]interface{}{"lat": oslo.Lat, "lng": oslo.Lng},
+		map[string]interface{}{"lat": oslo.Lat, "lon": oslo.Lng},
+		map[string]interface{}{"type": "Point", "coordinates": []interface{}{oslo.Lng, oslo.Lat}},
+		[]interface{}{oslo.Lng, oslo.Lat},
+	} {
+		if p, ok := ParsePoint(value); !ok || p != oslo {
+			t.Errorf("ParsePoint(%v) = %v, %v, want Oslo", value, p, ok)
+		}
+	}
+	if _, ok := ParsePoint([]interface{}{10.0, 95.0}); ok {
+		t.Errorf("latitude 95 parsed as a point")
+	}
+}
+
+func TestBoxCrossingAntimeridian(t *testing.T) {
+	box := Box{MinLat: -10, MinLng: 170, MaxLat: 10, MaxLng: -170}
+	if !box.Contains(Point{Lat: 0, Lng: 179}) || !box.Contains(Point{Lat: 0, Lng: -175}) {
+		t.Errorf("box misses points on either side of the antimeridian")
+	}
+	if box.Contains(Point{Lat: 0, Lng: 0}) {
+		t.Errorf("box holds a point on the other side of the globe")
+	}
+	if parts := box.Split(); len(parts) != 2 {
+		t.Errorf("split into %d boxes, want 2", len(parts))
+	}
+}
+
+func TestMatchFilterGeoOperators(t *testing.T) {
+	doc := map[string]interface{}{"place": map[string]interface{}{"lat": oslo.Lat, "lng": oslo.Lng}}
+	tests := []struct {
+		name   string
+		filter map[string]interface{}
+		want   bool
+	}{
+		{"near within range", map[string]interface{}{"place": map[string]interface{}{"$near": []interface{}{paris.Lng, paris.Lat}, "$maxDistance": 1400e3}}, true},
+		{"near out of range", map[string]interface{}{"place": map[string]interface{}{"$near": []interface{}{paris.Lng, paris.Lat}, "$maxDistance": 1000e3}}, false},
+		{"near geometry", map[string]interface{}{"place": map[string]interface{}{"$near": map[string]interface{}{
+			"$geometry": map[string]interface{}{"type": "Point", "coordinates": []interface{}{paris.Lng, paris.Lat}}, "$minDistance": 1400e3}}}, false},
+		{"within box", map[string]interface{}{"place": map[string]interface{}{"$geoWithin": map[string]interface{}{
+			"$box": []interface{}{[]interface{}{5.0, 55.0}, []interface{}{15.0, 65.0}}}}}, true},
+		{"within polygon", map[string]interface{}{"place": map[string]interface{}{"$geoWithin": map[string]interface{}{
+			"$polygon": []interface{}{[]interface{}{0.0, 40.0}, []interface{}{5.0, 50.0}, []interface{}{10.0, 40.0}}}}}, false},
+		{"within sphere", map[string]interface{}{"place": map[string]interface{}{"$geoWithin": map[string]interface{}{
+			"$centerSphere": []interface{}{[]interface{}{paris.Lng, paris.Lat}, 0.25}}}}, true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateFilter(tt.filter); err != nil {
+			t.Errorf("%s: ValidateFilter: %v", tt.name, err)
+			continue
+		}
+		if got := MatchFilter(doc, tt.filter); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
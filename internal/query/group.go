@@ -0,0 +1,264 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// groupStage groups documents by the value of an expression and computes
+// accumulators per group. Groups are output in order of first appearance.
+type groupStage struct {
+	key          interface{}
+	accumulators map[string]accumulatorSpec
+	groups       map[string]*group
+	order        []string
+}
+
+// accumulatorSpec is an output field of $group: an accumulator operator
+// and the expression it is applied to
+type accumulatorSpec struct {
+	operator string
+	expr     interface{}
+}
+
+type group struct {
+	key    interface{}
+	states map[string]accumulator
+}
+
+// accumulator folds the values of a group into a result
+type accumulator interface {
+	add(value interface{})
+	result() interface{}
+}
+
+func parseGroup(arg json.RawMessage) (stage, error) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(arg, &spec); err != nil {
+		return nil, fmt.Errorf("expects an object")
+	}
+
+	key, exists := spec["_id"]
+	if !exists {
+		return nil, fmt.Errorf("requires an _id expression")
+	}
+
+	s := &groupStage{
+		key:          key,
+		accumulators: make(map[string]accumulatorSpec),
+		groups:       make(map[string]*group),
+	}
+
+	for field, value := range spec {
+		if field == "_id" {
+			continue
+		}
+		if strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, fmt.Errorf("invalid output field %q", field)
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			return nil, fmt.Errorf("field %q must be an accumulator object", field)
+		}
+		for operator, expr := range object {
+			if newAccumulator(operator) == nil {
+				return nil, fmt.Errorf("unknown accumulator %s", operator)
+			}
+			s.accumulators[field] = accumulatorSpec{operator: operator, expr: expr}
+		}
+	}
+
+	return s, nil
+}
+
+func newAccumulator(operator string) accumulator {
+	switch operator {
+	case "$sum":
+		return &sumAccumulator{}
+	case "$count":
+		return &countAccumulator{}
+	case "$avg":
+		return &avgAccumulator{}
+	case "$min":
+		return &extremeAccumulator{sign: -1}
+	case "$max":
+		return &extremeAccumulator{sign: 1}
+	case "$first":
+		return &firstAccumulator{}
+	case "$last":
+		return &lastAccumulator{}
+	case "$push":
+		return &pushAccumulator{values: []interface{}{}}
+	case "$addToSet":
+		return &addToSetAccumulator{values: []interface{}{}, seen: make(map[string]bool)}
+	}
+	return nil
+}
+
+func (s *groupStage) process(doc map[string]interface{}, next emitFunc) bool {
+	key := Evaluate(s.key, doc)
+	id := ValueKey(key)
+
+	g, exists := s.groups[id]
+	if !exists {
+		g = &group{key: key, states: make(map[string]accumulator)}
+		for field, spec := range s.accumulators {
+			g.states[field] = newAccumulator(spec.operator)
+		}
+		s.groups[id] = g
+		s.order = append(s.order, id)
+	}
+
+	for field, spec := range s.accumulators {
+		g.states[field].add(Evaluate(spec.expr, doc))
+	}
+	return true
+}
+
+func (s *groupStage) flush(next emitFunc) {
+	for _, id := range s.order {
+		g := s.groups[id]
+		out := map[string]interface{}{"_id": g.key}
+		for field, state := range g.states {
+			out[field] = state.result()
+		}
+		if !next(out) {
+			break
+		}
+	}
+	s.groups = make(map[string]*group)
+	s.order = nil
+}
+
+// ValueKey returns a string identifying a value, for grouping and hash
+// joins. Numbers are normalized so 1 and 1.0 share a key.
+func ValueKey(key interface{}) string {
+	encoded, _ := json.Marshal(normalizeNumbers(key))
+	return string(encoded)
+}
+
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, member := range v {
+			result[key] = normalizeNumbers(member)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, element := range v {
+			result[i] = normalizeNumbers(element)
+		}
+		return result
+	}
+	if f, ok := ToFloat64(value); ok {
+		return f
+	}
+	return value
+}
+
+// sumAccumulator adds up numbers of any type; a constant expression such
+// as 1 counts documents
+type sumAccumulator struct {
+	sum float64
+}
+
+func (a *sumAccumulator) add(value interface{}) {
+	if f, ok := ToFloat64(value); ok {
+		a.sum += f
+	}
+}
+
+func (a *sumAccumulator) result() interface{} { return a.sum }
+
+type countAccumulator struct {
+	count int
+}
+
+func (a *countAccumulator) add(value interface{}) { a.count++ }
+func (a *countAccumulator) result() interface{}   { return a.count }
+
+// avgAccumulator averages the numeric values, returning null if there
+// are none
+type avgAccumulator struct {
+	sum   float64
+	count int
+}
+
+func (a *avgAccumulator) add(value interface{}) {
+	if f, ok := ToFloat64(value); ok {
+		a.sum += f
+		a.count++
+	}
+}
+
+func (a *avgAccumulator) result() interface{} {
+	if a.count == 0 {
+		return nil
+	}
+	return a.sum / float64(a.count)
+}
+
+// extremeAccumulator keeps the smallest (sign -1) or largest (sign 1)
+// value, ignoring nulls and missing fields
+type extremeAccumulator struct {
+	sign  int
+	value interface{}
+	set   bool
+}
+
+func (a *extremeAccumulator) add(value interface{}) {
+	if value == nil {
+		return
+	}
+	if !a.set || CompareAny(value, a.value)*a.sign > 0 {
+		a.value, a.set = value, true
+	}
+}
+
+func (a *extremeAccumulator) result() interface{} { return a.value }
+
+type firstAccumulator struct {
+	value interface{}
+	set   bool
+}
+
+func (a *firstAccumulator) add(value interface{}) {
+	if !a.set {
+		a.value, a.set = value, true
+	}
+}
+
+func (a *firstAccumulator) result() interface{} { return a.value }
+
+type lastAccumulator struct {
+	value interface{}
+}
+
+func (a *lastAccumulator) add(value interface{}) { a.value = value }
+func (a *lastAccumulator) result() interface{}   { return a.value }
+
+type pushAccumulator struct {
+	values []interface{}
+}
+
+func (a *pushAccumulator) add(value interface{}) { a.values = append(a.values, value) }
+func (a *pushAccumulator) result() interface{}   { return a.values }
+
+type addToSetAccumulator struct {
+	values []interface{}
+	seen   map[string]bool
+}
+
+func (a *addToSetAccumulator) add(value interface{}) {
+	id := ValueKey(value)
+	if !a.seen[id] {
+		a.seen[id] = true
+		a.values = append(a.values, value)
+	}
+}
+
+func (a *addToSetAccumulator) result() interface{} { return a.values }
@@ -0,0 +1,203 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+)
+
+// condition is one operator a filter applies to a field; equality is $eq
+type condition struct {
+	operator string
+	value    interface{}
+}
+
+// Implies reports whether every document matching filter also matches
+// partial. The check is conservative: it looks at the conditions filter
+// places on each field (including inside $and) and returns false when it
+// cannot show the implication.
+func Implies(filter, partial map[string]interface{}) bool {
+	conditions := make(map[string][]condition)
+	collectConditions(filter, conditions)
+	return impliesFilter(conditions, partial)
+}
+
+// collectConditions gathers the conditions a document must meet per
+// field. $or branches guarantee nothing and are skipped.
+func collectConditions(filter map[string]interface{}, conditions map[string][]condition) {
+	for path, value := range filter {
+		if path == "$and" {
+			clauses, _ := filterList(value)
+			for _, clause := range clauses {
+				collectConditions(clause, conditions)
+			}
+			continue
+		}
+		if strings.HasPrefix(path, "$") {
+			continue
+		}
+
+		if operators, ok := OperatorObject(value); ok {
+			for operator, arg := range operators {
+				conditions[path] = append(conditions[path], condition{operator, arg})
+			}
+			continue
+		}
+		conditions[path] = append(conditions[path], condition{"$eq", value})
+	}
+}
+
+func impliesFilter(conditions map[string][]condition, partial map[string]interface{}) bool {
+	for path, value := range partial {
+		switch path {
+		case "$and":
+			clauses, _ := filterList(value)
+			for _, clause := range clauses {
+				if !impliesFilter(conditions, clause) {
+					return false
+				}
+			}
+			continue
+		case "$or":
+			clauses, _ := filterList(value)
+			implied := false
+			for _, clause := range clauses {
+				if impliesFilter(conditions, clause) {
+					implied = true
+					break
+				}
+			}
+			if !implied {
+				return false
+			}
+			continue
+		}
+
+		required := []condition{{"$eq", value}}
+		if operators, ok := OperatorObject(value); ok {
+			required = required[:0]
+			for operator, arg := range operators {
+				required = append(required, condition{operator, arg})
+			}
+		}
+
+		for _, want := range required {
+			implied := false
+			for _, have := range conditions[path] {
+				if conditionImplies(have, want) {
+					implied = true
+					break
+				}
+			}
+			if !implied {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// conditionImplies reports whether a field meeting have always meets want.
+// Array fields match a condition through any element, so negations are
+// only implied by the identical condition.
+func conditionImplies(have, want condition) bool {
+	if have.operator == want.operator && reflect.DeepEqual(have.value, want.value) {
+		return true
+	}
+
+	switch want.operator {
+	case "$eq":
+		return have.operator == "$eq" && ValuesEqual(have.value, want.value) ||
+			have.operator == "$in" && allValues(have.value, func(v interface{}) bool {
+				return ValuesEqual(v, want.value)
+			})
+
+	case "$in":
+		wanted, _ := want.value.([]interface{})
+		inWanted := func(v interface{}) bool {
+			for _, w := range wanted {
+				if ValuesEqual(v, w) {
+					return true
+				}
+			}
+			return false
+		}
+		switch have.operator {
+		case "$eq":
+			return inWanted(have.value)
+		case "$in":
+			return allValues(have.value, inWanted)
+		}
+
+	case "$exists":
+		if exists, _ := want.value.(bool); !exists {
+			return false
+		}
+		switch have.operator {
+		case "$eq":
+			return have.value != nil
+		case "$gt", "$gte", "$lt", "$lte", "$near", "$geoWithin":
+			return true
+		case "$exists":
+			exists, _ := have.value.(bool)
+			return exists
+		case "$in":
+			return allValues(have.value, func(v interface{}) bool { return v != nil })
+		}
+
+	case "$gt", "$gte", "$lt", "$lte":
+		satisfies := func(v interface{}) bool {
+			cmp, ok := CompareValues(v, want.value)
+			return ok && compareSatisfies(cmp, want.operator)
+		}
+		switch have.operator {
+		case "$eq":
+			return satisfies(have.value)
+		case "$in":
+			return allValues(have.value, satisfies)
+		case "$gt", "$gte", "$lt", "$lte":
+			return boundImplies(have, want)
+		}
+	}
+
+	return false
+}
+
+// boundImplies reports whether a range bound lies within another one on
+// the same side
+func boundImplies(have, want condition) bool {
+	lower := func(op string) bool { return op == "$gt" || op == "$gte" }
+	if lower(have.operator) != lower(want.operator) {
+		return false
+	}
+
+	cmp, ok := CompareValues(have.value, want.value)
+	if !ok {
+		return false
+	}
+
+	// A bound at the same value implies the other unless it is looser
+	strict := have.operator == "$gt" || have.operator == "$lt"
+	wantStrict := want.operator == "$gt" || want.operator == "$lt"
+	if cmp == 0 {
+		return strict || !wantStrict
+	}
+	if lower(have.operator) {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// allValues reports whether every element of a non-empty array satisfies fn
+func allValues(value interface{}, fn func(interface{}) bool) bool {
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return false
+	}
+	for _, v := range values {
+		if !fn(v) {
+			return false
+		}
+	}
+	return true
+}
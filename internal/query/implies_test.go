@@ -0,0 +1,64 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func parseFilter(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+
+	var filter map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &filter); err != nil {
+		t.Fatalf("bad filter %s: %v", s, err)
+	}
+	return filter
+}
+
+func TestImplies(t *testing.T) {
+	tests := []struct {
+		filter  string
+		partial string
+		want    bool
+	}{
+		{`{"status": "active"}`, `{"status": "active"}`, true},
+		{`{"status": "active", "age": 30}`, `{"status": "active"}`, true},
+		{`{"status": "deleted"}`, `{"status": "active"}`, false},
+		{`{"age": 30}`, `{"status": "active"}`, false},
+		{`{}`, `{"status": "active"}`, false},
+
+		// Ranges
+		{`{"age": {"$gt": 30}}`, `{"age": {"$gte": 18}}`, true},
+		{`{"age": {"$gte": 18}}`, `{"age": {"$gte": 18}}`, true},
+		{`{"age": {"$gte": 18}}`, `{"age": {"$gt": 18}}`, false},
+		{`{"age": {"$gt": 18}}`, `{"age": {"$gte": 18}}`, true},
+		{`{"age": {"$lt": 10}}`, `{"age": {"$gte": 18}}`, false},
+		{`{"age": 40}`, `{"age": {"$gt": 18}}`, true},
+		{`{"age": {"$in": [20, 30]}}`, `{"age": {"$gt": 18}}`, true},
+		{`{"age": {"$in": [10, 30]}}`, `{"age": {"$gt": 18}}`, false},
+
+		// Sets and existence
+		{`{"status": "a"}`, `{"status": {"$in": ["a", "b"]}}`, true},
+		{`{"status": {"$in": ["a", "b"]}}`, `{"status": {"$in": ["a", "b", "c"]}}`, true},
+		{`{"status": {"$in": ["a", "d"]}}`, `{"status": {"$in": ["a", "b", "c"]}}`, false},
+		{`{"email": "x@example.com"}`, `{"email": {"$exists": true}}`, true},
+		{`{"email": null}`, `{"email": {"$exists": true}}`, false},
+		{`{"email": {"$exists": true}}`, `{"email": {"$exists": false}}`, false},
+
+		// Logical operators
+		{`{"$and": [{"status": "active"}, {"age": {"$gt": 30}}]}`, `{"status": "active", "age": {"$gt": 18}}`, true},
+		{`{"$or": [{"status": "active"}, {"status": "new"}]}`, `{"status": "active"}`, false},
+		{`{"status": "new"}`, `{"$or": [{"status": "active"}, {"status": "new"}]}`, true},
+		{`{"status": "old"}`, `{"$or": [{"status": "active"}, {"status": "new"}]}`, false},
+
+		// Negations only imply themselves
+		{`{"status": {"$ne": "deleted"}}`, `{"status": {"$ne": "deleted"}}`, true},
+		{`{"status": "active"}`, `{"status": {"$ne": "deleted"}}`, false},
+	}
+
+	for _, tt := range tests {
+		if got := Implies(parseFilter(t, tt.filter), parseFilter(t, tt.partial)); got != tt.want {
+			t.Errorf("Implies(%s, %s) = %v, want %v", tt.filter, tt.partial, got, tt.want)
+		}
+	}
+}
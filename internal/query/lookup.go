@@ -0,0 +1,95 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Lookup is a $lookup stage: it adds to each document an array of the
+// documents of another collection whose foreign field equals its local
+// field. A local array matches through any of its elements, and documents
+// without the local field get an empty array.
+type Lookup struct {
+	From         string `json:"from"`
+	LocalField   string `json:"localField"`
+	ForeignField string `json:"foreignField"`
+	As           string `json:"as"`
+
+	// Join returns the documents of From whose ForeignField equals a
+	// value. The storage engine sets it before the pipeline runs.
+	Join func(value interface{}) ([]map[string]interface{}, error)
+
+	err error
+}
+
+func parseLookup(arg json.RawMessage) (stage, error) {
+	l := &Lookup{}
+	if err := json.Unmarshal(arg, l); err != nil {
+		return nil, fmt.Errorf("expects an object with from, localField, foreignField and as")
+	}
+
+	for name, value := range map[string]string{"from": l.From, "localField": l.LocalField, "foreignField": l.ForeignField, "as": l.As} {
+		if value == "" {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+		if name != "from" && strings.HasPrefix(value, "$") {
+			return nil, fmt.Errorf("%s must be a field path without $", name)
+		}
+	}
+
+	return l, nil
+}
+
+// Lookups returns every $lookup stage the pipeline runs. The API checks
+// read access to each foreign collection through it, so a stage nesting
+// sub-pipelines must report their lookups here as well.
+func (p *Pipeline) Lookups() []*Lookup {
+	var lookups []*Lookup
+	for _, st := range p.stages {
+		if l, ok := st.(*Lookup); ok {
+			lookups = append(lookups, l)
+		}
+	}
+	return lookups
+}
+
+func (l *Lookup) process(doc map[string]interface{}, next emitFunc) bool {
+	if l.Join == nil {
+		l.err = fmt.Errorf("$lookup from %s has no join", l.From)
+		return false
+	}
+
+	value, _ := LookupPath(doc, l.LocalField)
+	values := []interface{}{value}
+	if array, ok := value.([]interface{}); ok {
+		values = array
+	}
+
+	matched := []interface{}{}
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+
+		foreign, err := l.Join(v)
+		if err != nil {
+			l.err = err
+			return false
+		}
+
+		// An array may hit the same document through several elements
+		for _, f := range foreign {
+			id := ValueKey(f["_id"])
+			if !seen[id] {
+				seen[id] = true
+				matched = append(matched, f)
+			}
+		}
+	}
+
+	return next(withPath(doc, strings.Split(l.As, "."), matched))
+}
+
+func (l *Lookup) flush(next emitFunc) {}
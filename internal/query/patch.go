@@ -0,0 +1,375 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPatch is returned for malformed patches
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrPatchFailed is returned when a patch or an update does not apply to a
+// document: a test operation does not hold, a path does not exist or a
+// field has the wrong type for an operator
+var ErrPatchFailed = errors.New("patch failed")
+
+// Patch is a partial update of a document
+type Patch interface {
+	// Apply returns the patched data, leaving data unchanged
+	Apply(data map[string]interface{}) (map[string]interface{}, error)
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396): objects are merged
+// recursively, null removes a field and any other value replaces it
+type MergePatch map[string]interface{}
+
+// ParseMergePatch parses a JSON Merge Patch. The patch must be an object
+// since documents are objects.
+func ParseMergePatch(data []byte) (MergePatch, error) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if patch == nil {
+		return nil, fmt.Errorf("%w: merge patch must be an object", ErrInvalidPatch)
+	}
+	return MergePatch(patch), nil
+}
+
+func (p MergePatch) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	return mergeValue(copyValue(data), map[string]interface{}(p)).(map[string]interface{}), nil
+}
+
+// mergeValue merges a patch into a target it may modify
+func mergeValue(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return copyValue(patch)
+	}
+
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = make(map[string]interface{}, len(fields))
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergeValue(result[key], value)
+		}
+	}
+	return result
+}
+
+// PatchOperation is one operation of a JSON Patch. Paths are JSON Pointers
+// (RFC 6901).
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+
+	path, from []string
+}
+
+// JSONPatch is a JSON Patch (RFC 6902): a list of operations applied in
+// order, all or none
+type JSONPatch []PatchOperation
+
+// ParseJSONPatch parses and validates a JSON Patch document
+func ParseJSONPatch(data []byte) (JSONPatch, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	patch := make(JSONPatch, 0, len(raw))
+	for i, fields := range raw {
+		op, err := parseOperation(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+		}
+		patch = append(patch, op)
+	}
+	return patch, nil
+}
+
+func parseOperation(fields map[string]json.RawMessage) (PatchOperation, error) {
+	var op PatchOperation
+	for name, target := range map[string]*string{"op": &op.Op, "path": &op.Path, "from": &op.From} {
+		if raw, exists := fields[name]; exists {
+			if err := json.Unmarshal(raw, target); err != nil {
+				return op, fmt.Errorf("%s must be a string", name)
+			}
+		}
+	}
+
+	var err error
+	if _, exists := fields["path"]; !exists {
+		return op, fmt.Errorf("path is required")
+	}
+	if op.path, err = parsePointer(op.Path); err != nil {
+		return op, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		raw, exists := fields["value"]
+		if !exists {
+			return op, fmt.Errorf("%s needs a value", op.Op)
+		}
+		if err := json.Unmarshal(raw, &op.Value); err != nil {
+			return op, err
+		}
+	case "move", "copy":
+		if _, exists := fields["from"]; !exists {
+			return op, fmt.Errorf("%s needs from", op.Op)
+		}
+		if op.from, err = parsePointer(op.From); err != nil {
+			return op, err
+		}
+		if op.Op == "move" && isPrefix(op.from, op.path) && len(op.from) < len(op.path) {
+			return op, fmt.Errorf("cannot move %q into itself", op.From)
+		}
+	case "remove":
+	default:
+		return op, fmt.Errorf("unknown op %q", op.Op)
+	}
+
+	if len(op.path) == 0 {
+		if op.Op == "remove" || op.Op == "move" {
+			return op, fmt.Errorf("cannot %s the document", op.Op)
+		}
+		if _, ok := op.Value.(map[string]interface{}); !ok && op.Op != "test" && op.Op != "copy" {
+			return op, fmt.Errorf("the document must be an object")
+		}
+	}
+	return op, nil
+}
+
+// parsePointer splits a JSON Pointer into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p JSONPatch) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	var doc interface{} = copyValue(data)
+	for i, op := range p {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("%w: operation %d (%s %s): %v", ErrPatchFailed, i, op.Op, op.Path, err)
+		}
+	}
+
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: the document must be an object", ErrPatchFailed)
+	}
+	return result, nil
+}
+
+// apply runs the operation on a document it may modify
+func (op PatchOperation) apply(doc interface{}) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		return addPointer(doc, op.path, copyValue(op.Value))
+	case "remove":
+		doc, _, err := removePointer(doc, op.path)
+		return doc, err
+	case "replace":
+		if _, err := getPointer(doc, op.path); err != nil {
+			return nil, err
+		}
+		return setPointer(doc, op.path, copyValue(op.Value))
+	case "move":
+		doc, value, err := removePointer(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return addPointer(doc, op.path, value)
+	case "copy":
+		value, err := getPointer(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return addPointer(doc, op.path, copyValue(value))
+	case "test":
+		value, err := getPointer(doc, op.path)
+		if err != nil {
+			return nil, err
+		}
+		if ValueKey(value) != ValueKey(op.Value) {
+			return nil, fmt.Errorf("value differs")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// getPointer returns the value a pointer refers to
+func getPointer(doc interface{}, tokens []string) (interface{}, error) {
+	for i, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, exists := node[token]
+			if !exists {
+				return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens[:i+1]))
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// setPointer replaces the value a pointer refers to, or stores a new
+// member of an object
+func setPointer(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return updatePointer(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens))
+	})
+}
+
+// addPointer adds a value: a new object member, or an array element
+// inserted before the index ("-" appends)
+func addPointer(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return updatePointer(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index := len(node)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens))
+	})
+}
+
+// removePointer removes the value a pointer refers to and returns it
+func removePointer(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	var removed interface{}
+	doc, err := updatePointer(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, exists := node[token]
+			if !exists {
+				return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens))
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("path %s does not exist", formatPointer(tokens))
+	})
+	return doc, removed, err
+}
+
+// updatePointer walks to the parent of the last token and replaces it with
+// the result of fn, storing each rebuilt node back into its own parent
+// since adding to or removing from an array makes a new slice. A pointer
+// to the whole document replaces it.
+func updatePointer(doc interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		root := map[string]interface{}{"": doc}
+		if _, err := fn(root, ""); err != nil {
+			return nil, err
+		}
+		return root[""], nil
+	}
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	child, err := getPointer(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updatePointer(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	return setPointer(doc, tokens[:1], child)
+}
+
+// arrayIndex parses an array index no greater than max
+func arrayIndex(token string, max int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
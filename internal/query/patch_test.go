@@ -0,0 +1,108 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func parseObject(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &object); err != nil {
+		t.Fatalf("bad JSON object %s: %v", s, err)
+	}
+	return object
+}
+
+func TestMergePatch(t *testing.T) {
+	data := parseObject(t, `{"name": "ada", "address": {"city": "Oslo", "zip": "0150"}, "tags": ["a", "b"]}`)
+	patch, err := ParseMergePatch([]byte(`{"address": {"zip": null, "street": "Main"}, "tags": ["c"], "age": 36, "name": null}`))
+	if err != nil {
+		t.Fatalf("ParseMergePatch: %v", err)
+	}
+
+	got, err := patch.Apply(data)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	want := parseObject(t, `{"address": {"city": "Oslo", "street": "Main"}, "tags": ["c"], "age": 36}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("patched = %v, want %v", got, want)
+	}
+	if data["name"] != "ada" || len(data["address"].(map[string]interface{})) != 2 {
+		t.Errorf("patch modified the document: %v", data)
+	}
+
+	for _, body := range []string{`[1]`, `null`, `{`} {
+		if _, err := ParseMergePatch([]byte(body)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("ParseMergePatch(%s): %v, want ErrInvalidPatch", body, err)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	data := parseObject(t, `{"name": "ada", "a/b": 1, "tags": ["x", "y"], "address": {"city": "Oslo"}}`)
+	patch, err := ParseJSONPatch([]byte(`[
+		{"op": "test", "path": "/name", "value": "ada"},
+		{"op": "replace", "path": "/name", "value": "Ada"},
+		{"op": "add", "path": "/tags/1", "value": "w"},
+		{"op": "add", "path": "/tags/-", "value": "z"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "move", "from": "/address/city", "path": "/city"},
+		{"op": "copy", "from": "/a~1b", "path": "/address/n"}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseJSONPatch: %v", err)
+	}
+
+	got, err := patch.Apply(data)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	want := parseObject(t, `{"name": "Ada", "a/b": 1, "tags": ["w", "y", "z"], "address": {"n": 1}, "city": "Oslo"}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("patched = %v, want %v", got, want)
+	}
+	if data["name"] != "ada" {
+		t.Errorf("patch modified the document: %v", data)
+	}
+}
+
+func TestJSONPatchAppliesAllOrNothing(t *testing.T) {
+	data := parseObject(t, `{"n": 1, "tags": ["x"]}`)
+	for _, body := range []string{
+		`[{"op": "replace", "path": "/n", "value": 2}, {"op": "test", "path": "/n", "value": 1}]`,
+		`[{"op": "remove", "path": "/missing"}]`,
+		`[{"op": "replace", "path": "/missing", "value": 1}]`,
+		`[{"op": "add", "path": "/tags/5", "value": 1}]`,
+		`[{"op": "add", "path": "/a/b", "value": 1}]`,
+	} {
+		patch, err := ParseJSONPatch([]byte(body))
+		if err != nil {
+			t.Fatalf("ParseJSONPatch(%s): %v", body, err)
+		}
+		if _, err := patch.Apply(data); !errors.Is(err, ErrPatchFailed) {
+			t.Errorf("Apply(%s): %v, want ErrPatchFailed", body, err)
+		}
+	}
+	if data["n"] != 1.0 {
+		t.Errorf("failed patch modified the document: %v", data)
+	}
+
+	for _, body := range []string{
+		`{"op": "add"}`,
+		`[{"op": "add", "path": "/a"}]`,
+		`[{"op": "jump", "path": "/a"}]`,
+		`[{"op": "remove", "path": "a"}]`,
+		`[{"op": "move", "from": "/a", "path": "/a/b"}]`,
+		`[{"op": "remove", "path": ""}]`,
+		`[{"op": "replace", "path": "", "value": 1}]`,
+	} {
+		if _, err := ParseJSONPatch([]byte(body)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("ParseJSONPatch(%s): %v, want ErrInvalidPatch", body, err)
+		}
+	}
+}
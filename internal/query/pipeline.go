@@ -0,0 +1,531 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidPipeline is returned for malformed aggregation pipelines
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// emitFunc passes a document to the next stage. It returns false once no
+// more documents are wanted.
+type emitFunc func(doc map[string]interface{}) bool
+
+// stage is one step of an aggregation pipeline. Streaming stages pass
+// documents on as they arrive; blocking stages buffer them and emit their
+// output when flushed at the end of the input.
+type stage interface {
+	process(doc map[string]interface{}, next emitFunc) bool
+	flush(next emitFunc)
+}
+
+// Pipeline is a parsed aggregation pipeline
+type Pipeline struct {
+	stages []stage
+	match  map[string]interface{} // leading $match, if any
+}
+
+// ParsePipeline parses a JSON array of stages: $match, $group, $project,
+// $sort, $limit, $skip, $unwind, $count and $lookup
+func ParsePipeline(data []byte) (*Pipeline, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: pipeline must be an array of stages", ErrInvalidPipeline)
+	}
+
+	pipeline := &Pipeline{}
+	for i, rawStage := range raw {
+		var spec map[string]json.RawMessage
+		if err := json.Unmarshal(rawStage, &spec); err != nil || len(spec) != 1 {
+			return nil, fmt.Errorf("%w: stage %d must be an object with one operator", ErrInvalidPipeline, i)
+		}
+
+		for name, arg := range spec {
+			st, err := parseStage(name, arg)
+			if err != nil {
+				return nil, fmt.Errorf("%w: stage %d (%s): %v", ErrInvalidPipeline, i, name, err)
+			}
+
+			// A leading $match on stored fields can be served by the
+			// storage engine
+			if m, ok := st.(*matchStage); ok && len(pipeline.stages) == 0 && pipeline.match == nil && !referencesID(m.filter) {
+				pipeline.match = m.filter
+				continue
+			}
+			pipeline.stages = append(pipeline.stages, st)
+		}
+	}
+
+	// A $sort followed by a $limit only needs to keep the top documents
+	for i := 0; i+1 < len(pipeline.stages); i++ {
+		if s, ok := pipeline.stages[i].(*sortStage); ok {
+			if l, ok := pipeline.stages[i+1].(*limitStage); ok {
+				s.keep = l.n
+			}
+		}
+	}
+
+	return pipeline, nil
+}
+
+func parseStage(name string, arg json.RawMessage) (stage, error) {
+	switch name {
+	case "$match":
+		var filter map[string]interface{}
+		if err := json.Unmarshal(arg, &filter); err != nil {
+			return nil, fmt.Errorf("expects a filter object")
+		}
+		if err := ValidateFilter(filter); err != nil {
+			return nil, err
+		}
+		if _, _, near := FindNear(filter); near {
+			return nil, fmt.Errorf("$near is not supported in pipelines")
+		}
+		return &matchStage{filter: filter}, nil
+
+	case "$group":
+		return parseGroup(arg)
+
+	case "$project":
+		return parseProject(arg)
+
+	case "$sort":
+		return parseSortStage(arg)
+
+	case "$limit", "$skip":
+		var n int
+		if err := json.Unmarshal(arg, &n); err != nil || n < 0 || (name == "$limit" && n == 0) {
+			return nil, fmt.Errorf("expects a positive integer")
+		}
+		if name == "$limit" {
+			return &limitStage{n: n}, nil
+		}
+		return &skipStage{n: n}, nil
+
+	case "$unwind":
+		return parseUnwind(arg)
+
+	case "$lookup":
+		return parseLookup(arg)
+
+	case "$count":
+		var field string
+		if err := json.Unmarshal(arg, &field); err != nil || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, fmt.Errorf("expects a field name")
+		}
+		return &countStage{field: field}, nil
+	}
+
+	return nil, fmt.Errorf("unknown stage")
+}
+
+// referencesID reports whether a filter tests _id, which is added to
+// documents as they enter the pipeline
+func referencesID(filter map[string]interface{}) bool {
+	for path, value := range filter {
+		if path == "$and" || path == "$or" {
+			clauses, _ := filterList(value)
+			for _, clause := range clauses {
+				if referencesID(clause) {
+					return true
+				}
+			}
+			continue
+		}
+		if path == "_id" || strings.HasPrefix(path, "_id.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the filter of a leading $match stage, to be applied by
+// the document source, or nil if the pipeline does not start with one
+func (p *Pipeline) Match() map[string]interface{} {
+	return p.match
+}
+
+// Run feeds the documents produced by source through the pipeline and
+// returns its output. source must stop when emit returns false. Stages
+// keep state, so a pipeline is run once. Run returns the context error
+// once ctx ends.
+func (p *Pipeline) Run(ctx context.Context, source func(emit func(doc map[string]interface{}) bool) error) ([]map[string]interface{}, error) {
+	results := []map[string]interface{}{}
+
+	emitters := make([]emitFunc, len(p.stages)+1)
+	emitters[len(p.stages)] = func(doc map[string]interface{}) bool {
+		results = append(results, doc)
+		return len(results)%64 != 0 || ctx.Err() == nil
+	}
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		st, next := p.stages[i], emitters[i+1]
+		emitters[i] = func(doc map[string]interface{}) bool {
+			return st.process(doc, next)
+		}
+	}
+
+	if err := source(emitters[0]); err != nil {
+		return nil, err
+	}
+
+	// Blocking stages release their output in pipeline order
+	for i, st := range p.stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		st.flush(emitters[i+1])
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range p.Lookups() {
+		if l.err != nil {
+			return nil, l.err
+		}
+	}
+
+	return results, nil
+}
+
+// Evaluate computes an expression against a document: a "$path" string
+// refers to a field, objects are evaluated member by member, and anything
+// else is a literal
+func Evaluate(expr interface{}, doc map[string]interface{}) interface{} {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			value, _ := LookupPath(doc, e[1:])
+			return value
+		}
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(e))
+		for key, member := range e {
+			result[key] = Evaluate(member, doc)
+		}
+		return result
+	}
+	return expr
+}
+
+// matchStage keeps the documents matching a filter
+type matchStage struct {
+	filter map[string]interface{}
+}
+
+func (s *matchStage) process(doc map[string]interface{}, next emitFunc) bool {
+	if !MatchFilter(doc, s.filter) {
+		return true
+	}
+	return next(doc)
+}
+
+func (s *matchStage) flush(next emitFunc) {}
+
+// limitStage passes on the first n documents
+type limitStage struct {
+	n, seen int
+}
+
+func (s *limitStage) process(doc map[string]interface{}, next emitFunc) bool {
+	if s.seen >= s.n {
+		return false
+	}
+	s.seen++
+	return next(doc) && s.seen < s.n
+}
+
+func (s *limitStage) flush(next emitFunc) {}
+
+// skipStage drops the first n documents
+type skipStage struct {
+	n, seen int
+}
+
+func (s *skipStage) process(doc map[string]interface{}, next emitFunc) bool {
+	if s.seen < s.n {
+		s.seen++
+		return true
+	}
+	return next(doc)
+}
+
+func (s *skipStage) flush(next emitFunc) {}
+
+// countStage outputs the number of input documents
+type countStage struct {
+	field string
+	count int
+}
+
+func (s *countStage) process(doc map[string]interface{}, next emitFunc) bool {
+	s.count++
+	return true
+}
+
+func (s *countStage) flush(next emitFunc) {
+	next(map[string]interface{}{s.field: s.count})
+}
+
+// projectStage reshapes documents: it keeps the fields set to 1 or
+// removes those set to 0, and computes fields given as expressions. _id
+// is kept unless excluded.
+type projectStage struct {
+	include  []string
+	exclude  []string
+	computed map[string]interface{}
+}
+
+func parseProject(arg json.RawMessage) (stage, error) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(arg, &spec); err != nil || len(spec) == 0 {
+		return nil, fmt.Errorf("expects a non-empty object")
+	}
+
+	s := &projectStage{computed: make(map[string]interface{})}
+	for path, value := range spec {
+		if path == "" || strings.HasPrefix(path, "$") || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+			return nil, fmt.Errorf("invalid field %q", path)
+		}
+
+		switch flag := projectionFlag(value); flag {
+		case 1:
+			s.include = append(s.include, path)
+		case 0:
+			s.exclude = append(s.exclude, path)
+		default:
+			s.computed[path] = value
+		}
+	}
+
+	// Only _id may be excluded alongside included or computed fields
+	for _, path := range s.exclude {
+		if path != "_id" && (len(s.include) > 0 || len(s.computed) > 0) {
+			return nil, fmt.Errorf("cannot mix included and excluded fields")
+		}
+	}
+
+	return s, nil
+}
+
+// projectionFlag reads 1/true as include and 0/false as exclude; it
+// returns -1 for expressions
+func projectionFlag(value interface{}) int {
+	if b, ok := value.(bool); ok {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	if n, ok := ToFloat64(value); ok {
+		if n == 0 {
+			return 0
+		}
+		return 1
+	}
+	return -1
+}
+
+func (s *projectStage) process(doc map[string]interface{}, next emitFunc) bool {
+	var result map[string]interface{}
+
+	if len(s.include) == 0 && len(s.computed) == 0 {
+		result = copyValue(doc).(map[string]interface{})
+		for _, path := range s.exclude {
+			removePath(result, strings.Split(path, "."))
+		}
+		return next(result)
+	}
+
+	result = make(map[string]interface{})
+	if id, exists := doc["_id"]; exists {
+		result["_id"] = id
+	}
+	for _, path := range s.include {
+		if value, exists := LookupPath(doc, path); exists {
+			setPath(result, strings.Split(path, "."), copyValue(value))
+		}
+	}
+	for path, expr := range s.computed {
+		setPath(result, strings.Split(path, "."), copyValue(Evaluate(expr, doc)))
+	}
+	for _, path := range s.exclude {
+		removePath(result, strings.Split(path, "."))
+	}
+
+	return next(result)
+}
+
+func (s *projectStage) flush(next emitFunc) {}
+
+// sortStage orders documents by one or more fields. keep, when set by a
+// following $limit, bounds how many documents it holds.
+type sortStage struct {
+	fields []SortField
+	keep   int
+	docs   []map[string]interface{}
+}
+
+// parseSortStage reads {"field": 1, "other": -1} keeping the order of
+// the keys, or a sort spec string such as "-age,name"
+func parseSortStage(arg json.RawMessage) (stage, error) {
+	var spec string
+	if err := json.Unmarshal(arg, &spec); err == nil {
+		fields, err := ParseSort([]string{spec})
+		if err != nil || len(fields) == 0 {
+			return nil, fmt.Errorf("invalid sort spec %q", spec)
+		}
+		return &sortStage{fields: fields}, nil
+	}
+
+	keys, values, err := orderedObject(arg)
+	if err != nil || len(keys) == 0 {
+		return nil, fmt.Errorf("expects an object of fields and directions")
+	}
+
+	s := &sortStage{}
+	for _, key := range keys {
+		var direction int
+		if err := json.Unmarshal(values[key], &direction); err != nil || (direction != 1 && direction != -1) {
+			return nil, fmt.Errorf("direction of %q must be 1 or -1", key)
+		}
+		s.fields = append(s.fields, SortField{Path: key, Desc: direction == -1})
+	}
+	return s, nil
+}
+
+// orderedObject decodes a JSON object, returning its keys in order
+func orderedObject(data json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, nil, fmt.Errorf("expected an object")
+	}
+
+	var keys []string
+	values := make(map[string]json.RawMessage)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := token.(string)
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, exists := values[key]; !exists {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	return keys, values, nil
+}
+
+func (s *sortStage) less(a, b map[string]interface{}) bool {
+	for _, field := range s.fields {
+		aValue, _ := LookupPath(a, field.Path)
+		bValue, _ := LookupPath(b, field.Path)
+		if cmp := CompareAny(aValue, bValue); cmp != 0 {
+			return (cmp < 0) != field.Desc
+		}
+	}
+	return false
+}
+
+func (s *sortStage) process(doc map[string]interface{}, next emitFunc) bool {
+	s.docs = append(s.docs, doc)
+
+	// Trim to the top documents once the buffer doubles
+	if s.keep > 0 && len(s.docs) >= 2*s.keep {
+		sort.SliceStable(s.docs, func(i, j int) bool { return s.less(s.docs[i], s.docs[j]) })
+		s.docs = s.docs[:s.keep]
+	}
+	return true
+}
+
+func (s *sortStage) flush(next emitFunc) {
+	sort.SliceStable(s.docs, func(i, j int) bool { return s.less(s.docs[i], s.docs[j]) })
+	for _, doc := range s.docs {
+		if !next(doc) {
+			break
+		}
+	}
+	s.docs = nil
+}
+
+// unwindStage outputs one document per element of an array field
+type unwindStage struct {
+	path         []string
+	preserveNull bool
+}
+
+func parseUnwind(arg json.RawMessage) (stage, error) {
+	var spec struct {
+		Path         string `json:"path"`
+		PreserveNull bool   `json:"preserveNullAndEmptyArrays"`
+	}
+	if err := json.Unmarshal(arg, &spec.Path); err != nil {
+		if err := json.Unmarshal(arg, &spec); err != nil {
+			return nil, fmt.Errorf("expects a field path or an object with a path")
+		}
+	}
+
+	if !strings.HasPrefix(spec.Path, "$") || len(spec.Path) < 2 {
+		return nil, fmt.Errorf("path must start with $")
+	}
+	return &unwindStage{path: strings.Split(spec.Path[1:], "."), preserveNull: spec.PreserveNull}, nil
+}
+
+func (s *unwindStage) process(doc map[string]interface{}, next emitFunc) bool {
+	value, exists := LookupPath(doc, strings.Join(s.path, "."))
+	array, isArray := value.([]interface{})
+
+	switch {
+	case isArray && len(array) > 0:
+		for _, element := range array {
+			if !next(withPath(doc, s.path, element)) {
+				return false
+			}
+		}
+		return true
+	case isArray || !exists || value == nil:
+		if !s.preserveNull {
+			return true
+		}
+		if isArray {
+			return next(withPath(doc, s.path, nil))
+		}
+		return next(doc)
+	}
+
+	// Non-array values pass through unchanged
+	return next(doc)
+}
+
+func (s *unwindStage) flush(next emitFunc) {}
+
+// withPath returns a copy of doc with value stored at path, copying only
+// the objects along the path
+func withPath(doc map[string]interface{}, path []string, value interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(doc))
+	for key, member := range doc {
+		result[key] = member
+	}
+
+	if len(path) == 1 {
+		result[path[0]] = value
+		return result
+	}
+
+	child, _ := doc[path[0]].(map[string]interface{})
+	result[path[0]] = withPath(child, path[1:], value)
+	return result
+}
@@ -0,0 +1,122 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var orders = []map[string]interface{}{
+	{"_id": "o1", "customer": "ada", "total": 10.0, "items": []interface{}{"pen", "ink"}},
+	{"_id": "o2", "customer": "bob", "total": 5.0, "items": []interface{}{"pad"}},
+	{"_id": "o3", "customer": "ada", "total": 30.0, "items": []interface{}{}},
+	{"_id": "o4", "customer": "cy", "total": 7.0},
+}
+
+// runPipeline parses a pipeline and runs it over docs
+func runPipeline(t *testing.T, spec string, docs []map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+
+	pipeline, err := ParsePipeline([]byte(spec))
+	if err != nil {
+		t.Fatalf("ParsePipeline(%s): %v", spec, err)
+	}
+	results, err := pipeline.Run(context.Background(), func(emit func(doc map[string]interface{}) bool) error {
+		for _, doc := range docs {
+			if pipeline.Match() != nil && !MatchFilter(doc, pipeline.Match()) {
+				continue
+			}
+			if !emit(doc) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run(%s): %v", spec, err)
+	}
+	return results
+}
+
+func TestPipelineGroupsAndSorts(t *testing.T) {
+	results := runPipeline(t, `[
+		{"$group": {"_id": "$customer", "spent": {"$sum": "$total"}, "orders": {"$count": {}}, "average": {"$avg": "$total"},
+			"largest": {"$max": "$total"}, "first": {"$first": "$_id"}, "ids": {"$push": "$_id"}}},
+		{"$sort": {"spent": -1}},
+		{"$limit": 2}
+	]`, orders)
+
+	want := []map[string]interface{}{
+		{"_id": "ada", "spent": 40.0, "orders": 2, "average": 20.0, "largest": 30.0, "first": "o1", "ids": []interface{}{"o1", "o3"}},
+		{"_id": "cy", "spent": 7.0, "orders": 1, "average": 7.0, "largest": 7.0, "first": "o4", "ids": []interface{}{"o4"}},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+}
+
+func TestPipelineUnwindsArrays(t *testing.T) {
+	results := runPipeline(t, `[{"$unwind": "$items"}, {"$count": "n"}]`, orders)
+	if !reflect.DeepEqual(results, []map[string]interface{}{{"n": 3}}) {
+		t.Errorf("unwound count = %v, want 3", results)
+	}
+
+	results = runPipeline(t, `[{"$unwind": {"path": "$items", "preserveNullAndEmptyArrays": true}}, {"$project": {"_id": 0, "items": 1}}]`, orders)
+	if len(results) != 5 || results[3]["items"] != nil {
+		t.Errorf("unwound with nulls = %v, want 5 documents with a null for o3", results)
+	}
+}
+
+func TestPipelineProjectsAndMatches(t *testing.T) {
+	results := runPipeline(t, `[
+		{"$match": {"total": {"$gte": 7}}},
+		{"$project": {"_id": 0, "who": "$customer", "order": {"id": "$_id"}}},
+		{"$sort": "who,-order.id"},
+		{"$skip": 1}
+	]`, orders)
+
+	want := []map[string]interface{}{
+		{"who": "ada", "order": map[string]interface{}{"id": "o1"}},
+		{"who": "cy", "order": map[string]interface{}{"id": "o4"}},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+}
+
+func TestPipelineSortLimitKeepsTopDocuments(t *testing.T) {
+	var docs []map[string]interface{}
+	for i := 0; i < 100; i++ {
+		docs = append(docs, map[string]interface{}{"n": float64((i * 37) % 100)})
+	}
+
+	results := runPipeline(t, `[{"$sort": {"n": -1}}, {"$limit": 3}]`, docs)
+	var got []interface{}
+	for _, doc := range results {
+		got = append(got, doc["n"])
+	}
+	if want := []interface{}{99.0, 98.0, 97.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("top three = %v, want %v", got, want)
+	}
+}
+
+func TestParsePipelineRejectsInvalidStages(t *testing.T) {
+	for _, spec := range []string{
+		`{"$match": {}}`,
+		`[{"$match": {}, "$limit": 1}]`,
+		`[{"$frobnicate": {}}]`,
+		`[{"$limit": 0}]`,
+		`[{"$group": {"total": {"$sum": 1}}}]`,
+		`[{"$group": {"_id": null, "total": {"$median": "$n"}}}]`,
+		`[{"$project": {"a": 1, "b": 0}}]`,
+		`[{"$sort": {"a": 2}}]`,
+		`[{"$unwind": "items"}]`,
+		`[{"$count": "a.b"}]`,
+		`[{"$match": {"loc": {"$near": [0, 0]}}}]`,
+	} {
+		if _, err := ParsePipeline([]byte(spec)); !errors.Is(err, ErrInvalidPipeline) {
+			t.Errorf("ParsePipeline(%s): %v, want ErrInvalidPipeline", spec, err)
+		}
+	}
+}
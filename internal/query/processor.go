@@ -3,7 +3,6 @@ package query
 import (
 	"fmt"
 	"reflect"
-	"strings"
 )
 
 // Processor handles query processing and filtering
@@ -32,22 +31,8 @@ func (p *Processor) matchField(doc map[string]interface{}, fieldPath string, exp
 
 // getNestedValue retrieves a value from a nested object using dot notation
 func (p *Processor) getNestedValue(doc map[string]interface{}, fieldPath string) interface{} {
-	parts := strings.Split(fieldPath, ".")
-	current := doc
-	
-	for i, part := range parts {
-		if i == len(parts)-1 {
-			return current[part]
-		}
-		
-		if next, ok := current[part].(map[string]interface{}); ok {
-			current = next
-		} else {
-			return nil
-		}
-	}
-	
-	return nil
+	value, _ := LookupPath(doc, fieldPath)
+	return value
 }
 
 // compareValues compares two values for equality
@@ -177,10 +162,8 @@ func (p *Processor) sum(docs []map[string]interface{}, field string) (float64, e
 	sum := 0.0
 	for _, doc := range docs {
 		value := p.getNestedValue(doc, field)
-		if num, ok := value.(float64); ok {
+		if num, ok := ToFloat64(value); ok {
 			sum += num
-		} else if num, ok := value.(int); ok {
-			sum += float64(num)
 		}
 	}
 	return sum, nil
@@ -0,0 +1,110 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Projection selects the fields of documents returned by a query: either
+// only the listed paths, or everything except them
+type Projection struct {
+	Paths   []string
+	Exclude bool
+}
+
+// ParseProjection parses field specs given as paths, where a leading "-"
+// excludes the path. Each spec may hold several comma-separated paths.
+// Included and excluded paths cannot be mixed. It returns nil if no
+// fields are given.
+func ParseProjection(specs []string) (*Projection, error) {
+	var projection *Projection
+	for _, spec := range specs {
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			exclude := strings.HasPrefix(part, "-")
+			path := strings.TrimPrefix(part, "-")
+			if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+				return nil, fmt.Errorf("%w: invalid field %q", ErrInvalidOptions, part)
+			}
+
+			if projection == nil {
+				projection = &Projection{Exclude: exclude}
+			} else if projection.Exclude != exclude {
+				return nil, fmt.Errorf("%w: cannot mix included and excluded fields", ErrInvalidOptions)
+			}
+			projection.Paths = append(projection.Paths, path)
+		}
+	}
+	return projection, nil
+}
+
+// Apply returns a projected copy of a document; data is not modified
+func (p *Projection) Apply(data map[string]interface{}) map[string]interface{} {
+	if p == nil {
+		return data
+	}
+
+	if p.Exclude {
+		result := copyValue(data).(map[string]interface{})
+		for _, path := range p.Paths {
+			removePath(result, strings.Split(path, "."))
+		}
+		return result
+	}
+
+	result := make(map[string]interface{})
+	for _, path := range p.Paths {
+		if value, exists := LookupPath(data, path); exists {
+			setPath(result, strings.Split(path, "."), copyValue(value))
+		}
+	}
+	return result
+}
+
+// setPath stores a value at a path, creating intermediate objects
+func setPath(data map[string]interface{}, parts []string, value interface{}) {
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := data[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			data[part] = next
+		}
+		data = next
+	}
+	data[parts[len(parts)-1]] = value
+}
+
+// removePath deletes the value at a path if it exists
+func removePath(data map[string]interface{}, parts []string) {
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := data[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		data = next
+	}
+	delete(data, parts[len(parts)-1])
+}
+
+// copyValue deep-copies the objects and arrays of a document value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			result[key] = copyValue(element)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, element := range v {
+			result[i] = copyValue(element)
+		}
+		return result
+	}
+	return value
+}
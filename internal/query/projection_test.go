@@ -0,0 +1,47 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	data := map[string]interface{}{
+		"name":    "ada",
+		"email":   "ada@example.com",
+		"address": map[string]interface{}{"city": "Oslo", "zip": "0150"},
+	}
+
+	include, err := ParseProjection([]string{"name,address.city", "missing"})
+	if err != nil {
+		t.Fatalf("ParseProjection: %v", err)
+	}
+	want := map[string]interface{}{"name": "ada", "address": map[string]interface{}{"city": "Oslo"}}
+	if got := include.Apply(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("included = %v, want %v", got, want)
+	}
+
+	exclude, err := ParseProjection([]string{"-email", "-address.zip"})
+	if err != nil {
+		t.Fatalf("ParseProjection: %v", err)
+	}
+	want = map[string]interface{}{"name": "ada", "address": map[string]interface{}{"city": "Oslo"}}
+	if got := exclude.Apply(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("excluded = %v, want %v", got, want)
+	}
+
+	// The document itself is left alone
+	if len(data) != 3 || len(data["address"].(map[string]interface{})) != 2 {
+		t.Errorf("projection modified the document: %v", data)
+	}
+}
+
+func TestParseProjectionRejectsMixedFields(t *testing.T) {
+	if _, err := ParseProjection([]string{"name,-email"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("mixed fields: %v, want ErrInvalidOptions", err)
+	}
+	if projection, err := ParseProjection(nil); projection != nil || err != nil {
+		t.Errorf("no fields = %v, %v, want nil", projection, err)
+	}
+}
@@ -0,0 +1,397 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSchema is returned for malformed or unsupported schemas
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// schemaTypes are the JSON Schema type names
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// schemaAnnotations are keywords that do not constrain documents
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+// Schema is a compiled JSON Schema. The supported subset of draft 2020-12
+// is type, enum, const, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, minLength, maxLength, pattern, properties, required,
+// additionalProperties, items, minItems, maxItems and uniqueItems, with
+// true and false as schemas accepting anything and nothing. Other
+// keywords are rejected rather than ignored.
+type Schema struct {
+	never bool // the false schema
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	properties map[string]*Schema
+	required   []string
+	additional *Schema
+
+	items       *Schema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+}
+
+// Violation is one way a document fails a schema. Path is the dotted path
+// of the offending value, empty for the document itself.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned for documents that do not match the schema
+// of their collection
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		if v.Path == "" {
+			messages = append(messages, v.Message)
+		} else {
+			messages = append(messages, v.Path+": "+v.Message)
+		}
+	}
+	return "document does not match schema: " + strings.Join(messages, "; ")
+}
+
+// ParseSchema compiles the schema of a collection's documents
+func ParseSchema(spec map[string]interface{}) (*Schema, error) {
+	schema, err := parseSchema(spec, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return schema, nil
+}
+
+func parseSchema(raw interface{}, path string) (*Schema, error) {
+	switch value := raw.(type) {
+	case bool:
+		return &Schema{never: !value}, nil
+	case map[string]interface{}:
+		schema := &Schema{}
+		for _, keyword := range sortedKeys(value) {
+			if err := schema.parseKeyword(keyword, value[keyword], path); err != nil {
+				return nil, err
+			}
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("%s: schema must be an object or a boolean", schemaLocation(path))
+}
+
+func (s *Schema) parseKeyword(keyword string, value interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s: %s %s", schemaLocation(path), keyword, fmt.Sprintf(format, args...))
+	}
+
+	var err error
+	switch keyword {
+	case "type":
+		names, ok := stringList(value)
+		if !ok || len(names) == 0 {
+			return fail("must be a type name or a list of them")
+		}
+		for _, name := range names {
+			if !schemaTypes[name] {
+				return fail("has unknown type %q", name)
+			}
+		}
+		s.types = names
+	case "enum":
+		values, ok := value.([]interface{})
+		if !ok || len(values) == 0 {
+			return fail("must be a non-empty array")
+		}
+		s.enum = values
+	case "const":
+		s.constant, s.hasConst = value, true
+	case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+		num, ok := ToFloat64(value)
+		if !ok {
+			return fail("must be a number")
+		}
+		*s.bound(keyword) = &num
+	case "minLength", "maxLength", "minItems", "maxItems":
+		num, ok := ToFloat64(value)
+		if !ok || num < 0 || num != math.Trunc(num) {
+			return fail("must be a non-negative integer")
+		}
+		count := int(num)
+		*s.count(keyword) = &count
+	case "pattern":
+		pattern, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return fail("is not a valid regular expression")
+		}
+	case "uniqueItems":
+		unique, ok := value.(bool)
+		if !ok {
+			return fail("must be a boolean")
+		}
+		s.uniqueItems = unique
+	case "required":
+		names, ok := stringList(value)
+		if _, single := value.(string); !ok || single {
+			return fail("must be an array of property names")
+		}
+		s.required = names
+	case "properties":
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			return fail("must be an object of schemas")
+		}
+		s.properties = make(map[string]*Schema, len(properties))
+		for _, name := range sortedKeys(properties) {
+			if s.properties[name], err = parseSchema(properties[name], joinPath(path, name)); err != nil {
+				return err
+			}
+		}
+	case "additionalProperties":
+		s.additional, err = parseSchema(value, joinPath(path, "*"))
+	case "items":
+		s.items, err = parseSchema(value, joinPath(path, "*"))
+	default:
+		if !schemaAnnotations[keyword] {
+			return fmt.Errorf("%s: unsupported keyword %q", schemaLocation(path), keyword)
+		}
+	}
+	return err
+}
+
+// bound returns the field holding a numeric bound keyword
+func (s *Schema) bound(keyword string) **float64 {
+	switch keyword {
+	case "minimum":
+		return &s.minimum
+	case "maximum":
+		return &s.maximum
+	case "exclusiveMinimum":
+		return &s.exclusiveMinimum
+	}
+	return &s.exclusiveMaximum
+}
+
+// count returns the field holding a length or size keyword
+func (s *Schema) count(keyword string) **int {
+	switch keyword {
+	case "minLength":
+		return &s.minLength
+	case "maxLength":
+		return &s.maxLength
+	case "minItems":
+		return &s.minItems
+	}
+	return &s.maxItems
+}
+
+// stringList accepts a string or an array of strings
+func stringList(value interface{}) ([]string, bool) {
+	if s, ok := value.(string); ok {
+		return []string{s}, true
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+func schemaLocation(path string) string {
+	if path == "" {
+		return "schema"
+	}
+	return "schema of " + path
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Validate checks a document against the schema and returns every
+// violation found, or nil if the document matches
+func (s *Schema) Validate(data map[string]interface{}) []Violation {
+	var violations []Violation
+	s.validate(data, "", &violations)
+	return violations
+}
+
+func (s *Schema) validate(value interface{}, path string, violations *[]Violation) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.never {
+		report("is not allowed")
+		return
+	}
+
+	if len(s.types) > 0 && !s.matchesType(value) {
+		report("must be of type %s, not %s", strings.Join(s.types, " or "), typeName(value))
+		return
+	}
+
+	if s.hasConst && !ValuesEqual(value, s.constant) {
+		report("must be equal to %v", s.constant)
+	}
+	if s.enum != nil && !containsValue(s.enum, value) {
+		report("must be one of %v", s.enum)
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(v, report)
+	case map[string]interface{}:
+		s.validateObject(v, path, violations)
+	case []interface{}:
+		s.validateArray(v, path, violations, report)
+	default:
+		if num, ok := ToFloat64(value); ok {
+			s.validateNumber(num, report)
+		}
+	}
+}
+
+func (s *Schema) validateNumber(num float64, report func(string, ...interface{})) {
+	if s.minimum != nil && num < *s.minimum {
+		report("must be at least %v", *s.minimum)
+	}
+	if s.maximum != nil && num > *s.maximum {
+		report("must be at most %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && num <= *s.exclusiveMinimum {
+		report("must be greater than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && num >= *s.exclusiveMaximum {
+		report("must be less than %v", *s.exclusiveMaximum)
+	}
+}
+
+func (s *Schema) validateString(str string, report func(string, ...interface{})) {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		report("must be at least %d characters long", *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		report("must be at most %d characters long", *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		report("must match pattern %s", s.pattern)
+	}
+}
+
+func (s *Schema) validateObject(object map[string]interface{}, path string, violations *[]Violation) {
+	for _, name := range s.required {
+		if _, exists := object[name]; !exists {
+			*violations = append(*violations, Violation{Path: joinPath(path, name), Message: "is required"})
+		}
+	}
+
+	for _, name := range sortedKeys(object) {
+		if property, exists := s.properties[name]; exists {
+			property.validate(object[name], joinPath(path, name), violations)
+		} else if s.additional != nil {
+			s.additional.validate(object[name], joinPath(path, name), violations)
+		}
+	}
+}
+
+func (s *Schema) validateArray(elements []interface{}, path string, violations *[]Violation, report func(string, ...interface{})) {
+	if s.minItems != nil && len(elements) < *s.minItems {
+		report("must have at least %d items", *s.minItems)
+	}
+	if s.maxItems != nil && len(elements) > *s.maxItems {
+		report("must have at most %d items", *s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := 1; i < len(elements); i++ {
+			if containsValue(elements[:i], elements[i]) {
+				report("must not contain duplicate items")
+				break
+			}
+		}
+	}
+
+	if s.items != nil {
+		for i, element := range elements {
+			s.items.validate(element, joinPath(path, strconv.Itoa(i)), violations)
+		}
+	}
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	name := typeName(value)
+	for _, t := range s.types {
+		if t == name || (t == "number" && name == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName returns the JSON Schema type of a value. Numbers without a
+// fractional part are integers.
+func typeName(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		if num, ok := ToFloat64(v); ok {
+			if num == math.Trunc(num) && !math.IsInf(num, 0) {
+				return "integer"
+			}
+			return "number"
+		}
+	}
+	return fmt.Sprintf("%T", value)
+}
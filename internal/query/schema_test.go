@@ -0,0 +1,83 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 20},
+		"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3, "uniqueItems": true},
+		"address": {
+			"type": "object",
+			"properties": {"zip": {"type": ["string", "null"]}},
+			"additionalProperties": false
+		}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema(parseObject(t, userSchema))
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+
+	tests := []struct {
+		doc  string
+		want []Violation
+	}{
+		{`{"name": "Ada", "age": 36}`, nil},
+		{`{"name": "Ada", "age": 36, "tags": ["a", "b"], "address": {"zip": null}, "other": 1}`, nil},
+		{`{"name": "Ada"}`, []Violation{{"age", "is required"}}},
+		{`{"name": "", "age": 36.5}`, []Violation{
+			{"age", "must be of type integer, not number"},
+			{"name", "must be at least 1 characters long"},
+		}},
+		{`{"name": "Ada", "age": 150}`, []Violation{{"age", "must be less than 150"}}},
+		{`{"name": "Ada", "age": -1}`, []Violation{{"age", "must be at least 0"}}},
+		{`{"name": "Ada", "age": 36, "email": "nobody"}`, []Violation{{"email", "must match pattern ^[^@]+@[^@]+$"}}},
+		{`{"name": "Ada", "age": 36, "role": "root"}`, []Violation{{"role", "must be one of [admin user]"}}},
+		{`{"name": "Ada", "age": 36, "tags": ["a", "a", 3]}`, []Violation{
+			{"tags", "must not contain duplicate items"},
+			{"tags.2", "must be of type string, not integer"},
+		}},
+		{`{"name": "Ada", "age": 36, "address": {"zip": 1, "city": "x"}}`, []Violation{
+			{"address.city", "is not allowed"},
+			{"address.zip", "must be of type string or null, not integer"},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got := schema.Validate(parseObject(t, tt.doc)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Validate(%s) = %v, want %v", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchemaRejectsUnsupported(t *testing.T) {
+	for _, spec := range []string{
+		`{"type": "decimal"}`,
+		`{"type": []}`,
+		`{"minimum": "1"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"required": [1]}`,
+		`{"properties": {"a": 1}}`,
+		`{"oneOf": [{"type": "string"}]}`,
+	} {
+		if _, err := ParseSchema(parseObject(t, spec)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("ParseSchema(%s) = %v, want ErrInvalidSchema", spec, err)
+		}
+	}
+
+	if _, err := ParseSchema(parseObject(t, `{"title": "Users", "$comment": "annotations are ignored"}`)); err != nil {
+		t.Errorf("ParseSchema with annotations: %v", err)
+	}
+}
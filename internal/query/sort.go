@@ -0,0 +1,94 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidOptions is returned for malformed sort or projection specs
+var ErrInvalidOptions = errors.New("invalid query options")
+
+// SortField is one key of a sort order
+type SortField struct {
+	Path string `json:"path"`
+	Desc bool   `json:"desc,omitempty"`
+}
+
+// ParseSort parses sort keys given as paths, where a leading "-" sorts
+// descending. Each spec may hold several comma-separated keys.
+func ParseSort(specs []string) ([]SortField, error) {
+	var fields []SortField
+	for _, spec := range specs {
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			field := SortField{Path: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+			if field.Path == "" || strings.HasPrefix(field.Path, ".") || strings.HasSuffix(field.Path, ".") {
+				return nil, fmt.Errorf("%w: invalid sort field %q", ErrInvalidOptions, part)
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// SortKey returns the values of a document at the sort paths; missing
+// fields sort as null
+func SortKey(data map[string]interface{}, fields []SortField) []interface{} {
+	key := make([]interface{}, len(fields))
+	for i, field := range fields {
+		key[i], _ = LookupPath(data, field.Path)
+	}
+	return key
+}
+
+// CompareAny orders any two document values: null, then booleans,
+// numbers, strings, and finally objects and arrays compared by their JSON
+// encoding
+func CompareAny(a, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+
+	if cmp, ok := CompareValues(a, b); ok {
+		return cmp
+	}
+	if rankA == rankOther {
+		aJSON, _ := json.Marshal(a)
+		bJSON, _ := json.Marshal(b)
+		return strings.Compare(string(aJSON), string(bJSON))
+	}
+	return 0
+}
+
+const (
+	rankNull = iota
+	rankBool
+	rankNumber
+	rankString
+	rankOther
+)
+
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return rankNull
+	case bool:
+		return rankBool
+	case string:
+		return rankString
+	}
+	if _, ok := ToFloat64(value); ok {
+		return rankNumber
+	}
+	return rankOther
+}
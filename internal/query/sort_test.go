@@ -0,0 +1,50 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	fields, err := ParseSort([]string{"-age, name", "address.city"})
+	if err != nil {
+		t.Fatalf("ParseSort: %v", err)
+	}
+	want := []SortField{{Path: "age", Desc: true}, {Path: "name"}, {Path: "address.city"}}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+
+	for _, spec := range []string{"-", "a.", ".a"} {
+		if _, err := ParseSort([]string{spec}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("ParseSort(%q): %v, want ErrInvalidOptions", spec, err)
+		}
+	}
+}
+
+func TestCompareAnyOrdersAcrossTypes(t *testing.T) {
+	values := []interface{}{nil, false, true, -1.0, 2, 10.5, "10", "b", []interface{}{1.0}, map[string]interface{}{"a": 1.0}}
+	for i := range values {
+		for j := range values {
+			got := CompareAny(values[i], values[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got != want {
+				t.Errorf("CompareAny(%v, %v) = %d, want %d", values[i], values[j], got, want)
+			}
+		}
+	}
+}
+
+func TestSortKeyTreatsMissingFieldsAsNull(t *testing.T) {
+	data := map[string]interface{}{"name": "ada", "address": map[string]interface{}{"city": "Oslo"}}
+	fields := []SortField{{Path: "address.city"}, {Path: "age"}}
+	if key := SortKey(data, fields); !reflect.DeepEqual(key, []interface{}{"Oslo", nil}) {
+		t.Errorf("key = %v, want [Oslo <nil>]", key)
+	}
+}
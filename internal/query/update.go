@@ -0,0 +1,357 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidUpdate is returned for malformed update operators
+var ErrInvalidUpdate = errors.New("invalid update")
+
+// updateOperators are the operators of an update, in the order they apply
+var updateOperators = []string{
+	"$set", "$unset", "$inc", "$mul", "$min", "$max", "$push", "$addToSet", "$pull", "$rename",
+}
+
+// Update changes fields of a document with update operators:
+//
+//	{"$inc": {"stats.views": 1}, "$push": {"tags": "new"}, "$unset": {"draft": ""}}
+//
+// Paths are dotted and may go through array indexes. An Update is a Patch.
+type Update struct {
+	ops []updateOp
+}
+
+type updateOp struct {
+	operator string
+	path     []string
+	arg      interface{}
+}
+
+// ParseUpdate parses and validates update operators. A path can only be
+// changed by one operator.
+func ParseUpdate(spec map[string]interface{}) (*Update, error) {
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("%w: no operators", ErrInvalidUpdate)
+	}
+
+	for key := range spec {
+		if !isUpdateOperator(key) {
+			return nil, fmt.Errorf("%w: unknown operator %q", ErrInvalidUpdate, key)
+		}
+	}
+
+	update := &Update{}
+	var paths []string
+	for _, operator := range updateOperators {
+		raw, exists := spec[operator]
+		if !exists {
+			continue
+		}
+		fields, ok := raw.(map[string]interface{})
+		if !ok || len(fields) == 0 {
+			return nil, fmt.Errorf("%w: %s needs an object of fields", ErrInvalidUpdate, operator)
+		}
+
+		for _, path := range sortedKeys(fields) {
+			arg, err := parseUpdateArg(operator, path, fields[path])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s %s: %v", ErrInvalidUpdate, operator, path, err)
+			}
+			update.ops = append(update.ops, updateOp{operator: operator, path: strings.Split(path, "."), arg: arg})
+			paths = append(paths, path)
+			if operator == "$rename" {
+				paths = append(paths, arg.(string))
+			}
+		}
+	}
+
+	// Two operators on one path, or on a path and its parent, conflict
+	sort.Strings(paths)
+	for i := 1; i < len(paths); i++ {
+		if paths[i] == paths[i-1] || strings.HasPrefix(paths[i], paths[i-1]+".") {
+			return nil, fmt.Errorf("%w: conflicting changes to %s", ErrInvalidUpdate, paths[i])
+		}
+	}
+
+	return update, nil
+}
+
+func isUpdateOperator(key string) bool {
+	for _, operator := range updateOperators {
+		if key == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUpdateArg validates the argument of an operator for one path
+func parseUpdateArg(operator, path string, arg interface{}) (interface{}, error) {
+	if !validUpdatePath(path) {
+		return nil, fmt.Errorf("invalid path")
+	}
+
+	switch operator {
+	case "$inc", "$mul":
+		num, ok := ToFloat64(arg)
+		if !ok {
+			return nil, fmt.Errorf("needs a number")
+		}
+		return num, nil
+	case "$rename":
+		target, ok := arg.(string)
+		if !ok || !validUpdatePath(target) {
+			return nil, fmt.Errorf("needs a path to rename to")
+		}
+		return target, nil
+	case "$push", "$addToSet":
+		if object, ok := arg.(map[string]interface{}); ok {
+			if each, exists := object["$each"]; exists {
+				values, ok := each.([]interface{})
+				if !ok || len(object) != 1 {
+					return nil, fmt.Errorf("$each needs an array and no other fields")
+				}
+				return values, nil
+			}
+		}
+		return []interface{}{arg}, nil
+	case "$pull":
+		if operators, ok := OperatorObject(arg); ok {
+			if err := ValidateFilter(map[string]interface{}{"value": operators}); err != nil {
+				return nil, err
+			}
+		} else if filter, ok := arg.(map[string]interface{}); ok {
+			if err := ValidateFilter(filter); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return arg, nil
+}
+
+func validUpdatePath(path string) bool {
+	if path == "" || strings.HasPrefix(path, "$") {
+		return false
+	}
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Apply returns the updated data, leaving data unchanged
+func (u *Update) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	result := copyValue(data).(map[string]interface{})
+
+	for _, op := range u.ops {
+		if err := op.apply(result); err != nil {
+			return nil, fmt.Errorf("%w: %s %s: %v", ErrPatchFailed, op.operator, strings.Join(op.path, "."), err)
+		}
+	}
+	return result, nil
+}
+
+func (op updateOp) apply(data map[string]interface{}) error {
+	switch op.operator {
+	case "$unset":
+		field, err := resolveField(data, op.path, false)
+		if field != nil {
+			field.remove()
+		}
+		return err
+	case "$rename":
+		field, err := resolveField(data, op.path, false)
+		if field == nil || err != nil {
+			return err
+		}
+		value, exists := field.get()
+		if !exists {
+			return nil
+		}
+		field.remove()
+		target, err := resolveField(data, strings.Split(op.arg.(string), "."), true)
+		if err != nil {
+			return err
+		}
+		return target.set(value)
+	}
+
+	field, err := resolveField(data, op.path, true)
+	if err != nil {
+		return err
+	}
+	current, exists := field.get()
+
+	switch op.operator {
+	case "$set":
+		return field.set(copyValue(op.arg))
+	case "$inc", "$mul":
+		num, ok := ToFloat64(current)
+		if !exists {
+			num, ok = 0, true
+		}
+		if !ok {
+			return fmt.Errorf("field is not a number")
+		}
+		if op.operator == "$inc" {
+			return field.set(num + op.arg.(float64))
+		}
+		return field.set(num * op.arg.(float64))
+	case "$min", "$max":
+		cmp := CompareAny(op.arg, current)
+		if !exists || (op.operator == "$min" && cmp < 0) || (op.operator == "$max" && cmp > 0) {
+			return field.set(copyValue(op.arg))
+		}
+		return nil
+	case "$push", "$addToSet":
+		elements, ok := current.([]interface{})
+		if exists && !ok {
+			return fmt.Errorf("field is not an array")
+		}
+		for _, value := range op.arg.([]interface{}) {
+			if op.operator == "$addToSet" && containsValue(elements, value) {
+				continue
+			}
+			elements = append(elements, copyValue(value))
+		}
+		if elements == nil {
+			elements = []interface{}{}
+		}
+		return field.set(elements)
+	case "$pull":
+		if !exists {
+			return nil
+		}
+		elements, ok := current.([]interface{})
+		if !ok {
+			return fmt.Errorf("field is not an array")
+		}
+		kept := make([]interface{}, 0, len(elements))
+		for _, element := range elements {
+			if !pullMatches(element, op.arg) {
+				kept = append(kept, element)
+			}
+		}
+		return field.set(kept)
+	}
+	return fmt.Errorf("unknown operator")
+}
+
+func containsValue(elements []interface{}, value interface{}) bool {
+	for _, element := range elements {
+		if ValuesEqual(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullMatches reports whether $pull removes an array element: one
+// matching an operator condition, an object matching a filter, or an
+// equal value
+func pullMatches(element, condition interface{}) bool {
+	if operators, ok := OperatorObject(condition); ok {
+		return matchOperators(map[string]interface{}{"value": element}, "value", operators)
+	}
+	if filter, ok := condition.(map[string]interface{}); ok {
+		if object, ok := element.(map[string]interface{}); ok {
+			return MatchFilter(object, filter)
+		}
+	}
+	return ValuesEqual(element, condition)
+}
+
+// field is a slot of a document: a member of an object or an element of
+// an array
+type field struct {
+	object map[string]interface{}
+	key    string
+	array  []interface{}
+	index  int
+}
+
+// resolveField finds the slot a path refers to. With create, missing
+// objects along the path are created; otherwise a missing path resolves
+// to nil. Paths cannot go through scalars, or create array elements.
+func resolveField(data map[string]interface{}, path []string, create bool) (*field, error) {
+	var node interface{} = data
+	for i, part := range path {
+		last := i == len(path)-1
+
+		switch current := node.(type) {
+		case map[string]interface{}:
+			if last {
+				return &field{object: current, key: part}, nil
+			}
+			child, exists := current[part]
+			if !exists || child == nil {
+				if !create {
+					return nil, nil
+				}
+				child = make(map[string]interface{})
+				current[part] = child
+			}
+			node = child
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(current) {
+				if !create {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("%s is not an element of an array", strings.Join(path[:i+1], "."))
+			}
+			if last {
+				return &field{array: current, index: index}, nil
+			}
+			node = current[index]
+		default:
+			if !create {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+	}
+	return nil, fmt.Errorf("empty path")
+}
+
+func (f *field) get() (interface{}, bool) {
+	if f.object != nil {
+		value, exists := f.object[f.key]
+		return value, exists
+	}
+	return f.array[f.index], true
+}
+
+func (f *field) set(value interface{}) error {
+	if f.object != nil {
+		f.object[f.key] = value
+	} else {
+		f.array[f.index] = value
+	}
+	return nil
+}
+
+// remove deletes an object member; array elements are set to null so the
+// indexes of the others do not move
+func (f *field) remove() {
+	if f.object != nil {
+		delete(f.object, f.key)
+	} else {
+		f.array[f.index] = nil
+	}
+}
@@ -0,0 +1,83 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func applyUpdate(t *testing.T, spec, data string) (map[string]interface{}, error) {
+	t.Helper()
+
+	update, err := ParseUpdate(parseObject(t, spec))
+	if err != nil {
+		t.Fatalf("ParseUpdate(%s): %v", spec, err)
+	}
+	return update.Apply(parseObject(t, data))
+}
+
+func TestUpdateOperators(t *testing.T) {
+	tests := []struct {
+		update string
+		data   string
+		want   string
+	}{
+		{`{"$set": {"a.b": 1, "c": [1]}}`, `{}`, `{"a": {"b": 1}, "c": [1]}`},
+		{`{"$unset": {"a.b": "", "missing.x": ""}}`, `{"a": {"b": 1, "c": 2}}`, `{"a": {"c": 2}}`},
+		{`{"$inc": {"views": 2, "stats.likes": -1}}`, `{"views": 1}`, `{"views": 3, "stats": {"likes": -1}}`},
+		{`{"$mul": {"price": 1.5, "missing": 2}}`, `{"price": 10}`, `{"price": 15, "missing": 0}`},
+		{`{"$min": {"low": 3, "new": 1}, "$max": {"high": 3}}`, `{"low": 5, "high": 5}`, `{"low": 3, "new": 1, "high": 5}`},
+		{`{"$push": {"tags": "c", "list": {"$each": [1, 2]}}}`, `{"tags": ["a"]}`, `{"tags": ["a", "c"], "list": [1, 2]}`},
+		{`{"$addToSet": {"tags": {"$each": ["a", "b", "b"]}}}`, `{"tags": ["a"]}`, `{"tags": ["a", "b"]}`},
+		{`{"$pull": {"tags": "a", "scores": {"$gte": 5}, "items": {"qty": 0}}}`,
+			`{"tags": ["a", "b", "a"], "scores": [1, 5, 9], "items": [{"qty": 0}, {"qty": 2}]}`,
+			`{"tags": ["b"], "scores": [1], "items": [{"qty": 2}]}`},
+		{`{"$rename": {"name": "profile.name", "missing": "other"}}`, `{"name": "ada"}`, `{"profile": {"name": "ada"}}`},
+		{`{"$set": {"items.1.qty": 5}}`, `{"items": [{"qty": 1}, {"qty": 2}]}`, `{"items": [{"qty": 1}, {"qty": 5}]}`},
+	}
+
+	for _, tt := range tests {
+		got, err := applyUpdate(t, tt.update, tt.data)
+		if err != nil {
+			t.Errorf("%s on %s: %v", tt.update, tt.data, err)
+			continue
+		}
+		if want := parseObject(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s on %s = %v, want %v", tt.update, tt.data, got, want)
+		}
+	}
+}
+
+func TestUpdateFailsOnWrongTypes(t *testing.T) {
+	for _, tt := range []struct{ update, data string }{
+		{`{"$inc": {"name": 1}}`, `{"name": "ada"}`},
+		{`{"$push": {"name": 1}}`, `{"name": "ada"}`},
+		{`{"$pull": {"name": 1}}`, `{"name": "ada"}`},
+		{`{"$set": {"name.first": "a"}}`, `{"name": "ada"}`},
+		{`{"$set": {"items.5": 1}}`, `{"items": [1]}`},
+	} {
+		if _, err := applyUpdate(t, tt.update, tt.data); !errors.Is(err, ErrPatchFailed) {
+			t.Errorf("%s on %s: %v, want ErrPatchFailed", tt.update, tt.data, err)
+		}
+	}
+}
+
+func TestParseUpdateRejectsInvalidOperators(t *testing.T) {
+	for _, spec := range []string{
+		`{}`,
+		`{"name": "ada"}`,
+		`{"$set": {}}`,
+		`{"$set": 1}`,
+		`{"$inc": {"n": "one"}}`,
+		`{"$set": {"a": 1}, "$inc": {"a": 1}}`,
+		`{"$set": {"a": 1, "a.b": 2}}`,
+		`{"$rename": {"a": "b"}, "$set": {"b": 1}}`,
+		`{"$set": {"a..b": 1}}`,
+		`{"$push": {"a": {"$each": 1}}}`,
+		`{"$pull": {"a": {"$bogus": 1}}}`,
+	} {
+		if _, err := ParseUpdate(parseObject(t, spec)); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("ParseUpdate(%s): %v, want ErrInvalidUpdate", spec, err)
+		}
+	}
+}
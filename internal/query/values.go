@@ -0,0 +1,97 @@
+package query
+
+import "strings"
+
+// ToFloat64 converts the numeric types that appear in documents to float64
+func ToFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int8:
+		return float64(val), true
+	case int16:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint:
+		return float64(val), true
+	case uint8:
+		return float64(val), true
+	case uint16:
+		return float64(val), true
+	case uint32:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	default:
+		return 0, false
+	}
+}
+
+// IsScalar reports whether a value is null, a boolean, a number or a string
+func IsScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, bool, string:
+		return true
+	}
+	_, ok := ToFloat64(value)
+	return ok
+}
+
+// PathValues resolves a dotted path in a document. Arrays met along the
+// way or at the end of the path are expanded into their elements, so a
+// document yields one value per array element.
+func PathValues(data map[string]interface{}, path string) []interface{} {
+	var values []interface{}
+	collectPath(data, strings.Split(path, "."), &values)
+	return values
+}
+
+func collectPath(current interface{}, parts []string, values *[]interface{}) {
+	if array, ok := current.([]interface{}); ok {
+		for _, element := range array {
+			collectPath(element, parts, values)
+		}
+		return
+	}
+
+	if len(parts) == 0 {
+		*values = append(*values, current)
+		return
+	}
+
+	object, ok := current.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	next, exists := object[parts[0]]
+	if !exists {
+		return
+	}
+
+	collectPath(next, parts[1:], values)
+}
+
+// LookupPath returns the raw value at a dotted path without expanding arrays
+func LookupPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = data
+
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
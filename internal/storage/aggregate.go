@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+
+	"coffedb/internal/query"
+)
+
+// Aggregate runs an aggregation pipeline over the documents of a
+// collection. Documents stream into the pipeline as they are scanned,
+// each holding its stored fields and its ID as _id. A leading $match
+// selects the documents scanned, so it can use an index, and $lookup
+// joins through an index on the foreign field when there is one.
+// Documents read by $lookup count against the query limits, and an
+// output larger than max_documents_returned is refused.
+func (e *Engine) Aggregate(ctx context.Context, collection string, pipeline *query.Pipeline) ([]map[string]interface{}, error) {
+	filter := pipeline.Match()
+	if filter == nil {
+		filter = map[string]interface{}{}
+	}
+
+	// Blocking stages pass documents on after the scan, and $lookup reads
+	// other collections, so the lock is held until the pipeline finishes
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	x, cancel := e.begin(ctx)
+	defer cancel()
+
+	e.bindLookups(x, pipeline)
+	results, err := pipeline.Run(x.ctx, func(emit func(doc map[string]interface{}) bool) error {
+		return e.scanLocked(x, collection, filter, func(doc *Document) bool {
+			return emit(pipelineDocument(doc))
+		})
+	})
+	if err != nil {
+		return nil, abortError(err)
+	}
+	if err := x.returned(len(results)); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// pipelineDocument returns the fields of a document with its ID as _id.
+// The stored data is shared, so stages copy before modifying.
+func pipelineDocument(doc *Document) map[string]interface{} {
+	data := make(map[string]interface{}, len(doc.Data)+1)
+	for key, value := range doc.Data {
+		data[key] = value
+	}
+	if _, exists := data["_id"]; !exists {
+		data["_id"] = doc.ID
+	}
+	return data
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/config"
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+func aggregate(t *testing.T, e *Engine, spec string) ([]map[string]interface{}, error) {
+	t.Helper()
+
+	pipeline, err := query.ParsePipeline([]byte(spec))
+	if err != nil {
+		t.Fatalf("ParsePipeline: %v", err)
+	}
+	return e.Aggregate(context.Background(), "items", pipeline)
+}
+
+func TestAggregateServesLeadingMatchFromIndex(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxScanned = 10
+	})
+	putItems(t, e, 50)
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "rank", Collection: "items", Fields: []index.IndexField{{Path: "rank", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	// Seven items have rank 3, so the index keeps the scan under the limit
+	results, err := aggregate(t, e, `[
+		{"$match": {"rank": 3}},
+		{"$group": {"_id": "$even", "ids": {"$push": "$_id"}}},
+		{"$sort": {"_id": 1}}
+	]`)
+	if err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"_id": false, "ids": []interface{}{"i003", "i017", "i031", "i045"}},
+		{"_id": true, "ids": []interface{}{"i010", "i024", "i038"}},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+
+	// Without the index the same pipeline goes over the scan limit
+	if err := e.DropIndex("items", "rank"); err != nil {
+		t.Fatalf("DropIndex: %v", err)
+	}
+	if _, err := aggregate(t, e, `[{"$match": {"rank": 3}}]`); !errors.Is(err, ErrQueryAborted) {
+		t.Errorf("unindexed aggregate: %v, want ErrQueryAborted", err)
+	}
+}
+
+func TestAggregateRefusesLargeOutput(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxReturned = 5
+	})
+	putItems(t, e, 20)
+
+	var aborted *QueryAbortedError
+	if _, err := aggregate(t, e, `[{"$project": {"n": 1}}]`); !errors.As(err, &aborted) || aborted.Reason != AbortMaxReturned {
+		t.Errorf("aggregate of 20 documents: %v, want max_documents_returned", err)
+	}
+	if results, err := aggregate(t, e, `[{"$group": {"_id": "$even", "n": {"$count": {}}}}]`); err != nil || len(results) != 2 {
+		t.Errorf("grouped aggregate = %v, %v, want two groups", results, err)
+	}
+}
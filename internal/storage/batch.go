@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"coffedb/internal/index"
+)
+
+// batch collects document writes that reach the WAL together, with one
+// sync. Index mutations are applied as writes are added, so unique
+// constraints see the earlier writes of the batch, and are undone if the
+// batch is abandoned. The caller holds the write lock from the first write
+// to commit or rollback.
+type batch struct {
+	engine  *Engine
+	entries []WALEntry
+	pending map[string]*Document // documents written so far, nil once deleted
+	applied [][]index.IndexOp
+	written map[string]bool // collections written to
+}
+
+func (e *Engine) newBatch() *batch {
+	return &batch{engine: e, pending: make(map[string]*Document), written: make(map[string]bool)}
+}
+
+// get returns the current version of a document, including the writes of
+// the batch
+func (b *batch) get(key string) *Document {
+	if doc, exists := b.pending[key]; exists {
+		return doc
+	}
+	return b.engine.getDocument(key)
+}
+
+// put adds a document write, bumping the version of the one it replaces
+func (b *batch) put(collection, id string, data map[string]interface{}) (*Document, error) {
+	key := fmt.Sprintf("%s:%s", collection, id)
+	now := time.Now()
+	doc := &Document{
+		ID:        id,
+		Data:      data,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+		Size:      encodedSize(data),
+	}
+
+	if err := b.engine.validate(collection, id, data); err != nil {
+		return nil, err
+	}
+
+	existing := b.get(key)
+	if existing != nil {
+		doc.CreatedAt = existing.CreatedAt
+		doc.Version = existing.Version + 1
+	}
+
+	indexOps, err := b.engine.indexes.OnPut(collection, indexDocument(existing), indexDocument(doc))
+	if err != nil {
+		return nil, err
+	}
+	b.apply(indexOps)
+
+	b.entries = append(b.entries, WALEntry{
+		Type:      WALPut,
+		Key:       key,
+		Value:     doc,
+		Previous:  existing,
+		Timestamp: now,
+		IndexOps:  indexOps,
+	})
+	b.pending[key] = doc
+	b.written[collection] = true
+	return doc, nil
+}
+
+// delete adds a document removal and reports whether the document existed
+func (b *batch) delete(collection, id string) bool {
+	key := fmt.Sprintf("%s:%s", collection, id)
+	existing := b.get(key)
+	if existing == nil {
+		return false
+	}
+
+	indexOps := b.engine.indexes.OnDelete(collection, indexDocument(existing))
+	b.apply(indexOps)
+
+	b.entries = append(b.entries, WALEntry{
+		Type:      WALDelete,
+		Key:       key,
+		Previous:  existing,
+		Timestamp: time.Now(),
+		IndexOps:  indexOps,
+	})
+	b.pending[key] = nil
+	return true
+}
+
+func (b *batch) apply(ops []index.IndexOp) {
+	b.engine.indexes.Apply(ops)
+	b.applied = append(b.applied, ops)
+}
+
+// len returns the number of writes in the batch
+func (b *batch) len() int {
+	return len(b.entries)
+}
+
+// commit logs the batch, applies it to the memtable and disk and
+// publishes its changes
+func (b *batch) commit() error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	e := b.engine
+	if err := e.wal.WriteBatch(b.entries); err != nil {
+		b.rollback()
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for _, entry := range b.entries {
+		if entry.Type == WALDelete {
+			e.memtable.Delete(entry.Key)
+			e.btree.Delete(entry.Key)
+		} else {
+			e.memtable.Put(entry.Key, entry.Value)
+		}
+	}
+
+	e.registerCollections(b.written)
+	for _, entry := range b.entries {
+		doc, _ := entry.Value.(*Document)
+		e.catalog.count(entry.Key, entry.Previous, doc)
+	}
+	e.changes.publish(b.entries)
+
+	if e.memtable.Size() >= e.config.MemtableSize {
+		go e.flushMemtable()
+	}
+	return nil
+}
+
+// rollback undoes the index mutations of an abandoned batch
+func (b *batch) rollback() {
+	for i := len(b.applied) - 1; i >= 0; i-- {
+		ops := b.applied[i]
+		undo := make([]index.IndexOp, len(ops))
+		for j, op := range ops {
+			if op.Type == index.IndexOpPut {
+				op.Type = index.IndexOpDelete
+			} else {
+				op.Type = index.IndexOpPut
+			}
+			undo[len(ops)-1-j] = op
+		}
+		b.engine.indexes.Apply(undo)
+	}
+	b.applied = nil
+}
@@ -6,13 +6,15 @@ func NewBTree(filename string) (*BTree, error)
 func (bt *BTree) Put(key string, value interface{}) error
 func (bt *BTree) Get(key string) (interface{}, error)
 func (bt *BTree) Delete(key string) error
+func (bt *BTree) DeleteRange(prefix string) int
 func (bt *BTree) Range(prefix string) ([]interface{}, error) 
+func (bt *BTree) Ascend(prefix, after string, fn func(key string, value interface{}) bool)
 func (bt *BTree) insert(node *BTreeNode, key string, value interface{}) error
 func (bt *BTree) insertIntoLeaf(node *BTreeNode, key string, value interface{}) error
 func (bt *BTree) search(node *BTreeNode, key string) (interface{}, error)
 func (bt *BTree) delete(node *BTreeNode, key string) error
 func (bt *BTree) deleteFromInternal(node *BTreeNode, pos int) error
-func (bt *BTree) rangeSearch(node *BTreeNode, prefix string, results *[]interface{}) 
+func (bt *BTree) ascend(node *BTreeNode, prefix, after string, fn func(key string, value interface{}) bool) bool
 func (bt *BTree) findChildIndex(node *BTreeNode, key string) int
 func (bt *BTree) splitChild(parent *BTreeNode, childIndex int) error
 func (bt *BTree) loadRoot() error
@@ -25,6 +27,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -112,15 +115,60 @@ func (bt *BTree) Delete(key string) error {
 	return bt.delete(bt.root, key)
 }
 
+// DeleteRange removes every key having the given prefix and returns how
+// many were removed. A leaf root is filtered in one pass.
+func (bt *BTree) DeleteRange(prefix string) int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.root == nil {
+		return 0
+	}
+
+	if bt.root.IsLeaf {
+		node := bt.root
+		start := sort.SearchStrings(node.Keys, prefix)
+		end := start
+		for end < len(node.Keys) && strings.HasPrefix(node.Keys[end], prefix) {
+			end++
+		}
+		if end > start {
+			node.Keys = append(node.Keys[:start], node.Keys[end:]...)
+			node.Values = append(node.Values[:start], node.Values[end:]...)
+			node.Modified = true
+		}
+		return end - start
+	}
+
+	var keys []string
+	bt.ascend(bt.root, prefix, "", func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		bt.delete(bt.root, key)
+	}
+	return len(keys)
+}
+
 // Range returns all values with keys having the given prefix
 func (bt *BTree) Range(prefix string) ([]interface{}, error) {
-	bt.mu.RLock()
-	defer bt.mu.RUnlock()
 	var results []interface{}
-	bt.rangeSearch(bt.root, prefix, &results)
+	bt.Ascend(prefix, "", func(key string, value interface{}) bool {
+		results = append(results, value)
+		return true
+	})
 	return results, nil
 }
 
+// Ascend calls fn in key order for the keys having the given prefix that
+// sort after the given key, until fn returns false
+func (bt *BTree) Ascend(prefix, after string, fn func(key string, value interface{}) bool) {
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+	bt.ascend(bt.root, prefix, after, fn)
+}
+
 // Internal methods
 
 func (bt *BTree) insert(node *BTreeNode, key string, value interface{}) error {
@@ -226,31 +274,39 @@ func (bt *BTree) deleteFromInternal(node *BTreeNode, pos int) error {
 	return bt.delete(pred, predKey)
 }
 
-func (bt *BTree) rangeSearch(node *BTreeNode, prefix string, results *[]interface{}) {
+// ascend walks a subtree in order. Keys of child i sort before Keys[i],
+// so children entirely before the range are skipped. It returns false
+// once the walk is over, either because fn asked to stop or because the
+// keys went past the prefix.
+func (bt *BTree) ascend(node *BTreeNode, prefix, after string, fn func(key string, value interface{}) bool) bool {
 	if node == nil {
-		return
+		return true
 	}
-	
-	if node.IsLeaf {
-		for i, key := range node.Keys {
-			if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
-				*results = append(*results, node.Values[i])
+
+	start := sort.SearchStrings(node.Keys, prefix)
+	if after > prefix {
+		start = sort.SearchStrings(node.Keys, after)
+	}
+
+	for i := start; i < len(node.Keys); i++ {
+		key := node.Keys[i]
+		if !node.IsLeaf && i < len(node.Children) {
+			if !bt.ascend(node.Children[i], prefix, after, fn) {
+				return false
 			}
 		}
-		return
-	}
-	
-	// Search all children that might contain keys with prefix
-	for i, key := range node.Keys {
-		if key >= prefix {
-			bt.rangeSearch(node.Children[i], prefix, results)
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if key > after && !fn(key, node.Values[i]) {
+			return false
 		}
 	}
-	
-	// Check last child
-	if len(node.Children) > 0 {
-		bt.rangeSearch(node.Children[len(node.Children)-1], prefix, results)
+
+	if !node.IsLeaf && len(node.Children) > len(node.Keys) {
+		return bt.ascend(node.Children[len(node.Keys)], prefix, after, fn)
 	}
+	return true
 }
 
 func (bt *BTree) findChildIndex(node *BTreeNode, key string) int {
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"coffedb/internal/query"
+)
+
+// ErrInvalidOperation is returned for malformed bulk operations
+var ErrInvalidOperation = errors.New("invalid bulk operation")
+
+// ErrDocumentExists is returned when inserting a document whose ID is taken
+var ErrDocumentExists = errors.New("document already exists")
+
+// Kinds of bulk operations
+const (
+	BulkInsert  = "insert"
+	BulkReplace = "replace"
+	BulkUpdate  = "update"
+	BulkDelete  = "delete"
+)
+
+// BulkOperation is one write of a bulk request. Insert and replace take a
+// Document, update takes update operators; replace and update can create
+// a missing document with Upsert.
+type BulkOperation struct {
+	Op       string
+	ID       string
+	Document map[string]interface{}
+	Update   map[string]interface{}
+	Upsert   bool
+}
+
+// BulkResult is the outcome of one bulk operation. Result is what the
+// operation did: inserted, replaced, updated, upserted or deleted.
+type BulkResult struct {
+	ID      string
+	Result  string
+	Version int64
+	Err     error
+}
+
+// Bulk runs a list of writes on a collection under one lock, logging them
+// as a single WAL batch. An ordered bulk stops at the first failed
+// operation and returns the results up to it; otherwise every operation is
+// attempted. Writes that succeeded are kept either way. The error is only
+// set when the batch cannot be logged, in which case nothing is written.
+// Large loads are sent in several calls.
+func (e *Engine) Bulk(collection string, ops []BulkOperation, ordered bool) ([]BulkResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b := e.newBatch()
+	results := make([]BulkResult, 0, len(ops))
+	for _, op := range ops {
+		result := b.run(collection, op)
+		results = append(results, result)
+		if result.Err != nil && ordered {
+			break
+		}
+	}
+
+	if err := b.commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// run adds one bulk operation to the batch
+func (b *batch) run(collection string, op BulkOperation) BulkResult {
+	result := BulkResult{ID: op.ID}
+	if op.ID == "" {
+		result.Err = fmt.Errorf("%w: id is required", ErrInvalidOperation)
+		return result
+	}
+
+	existing := b.get(fmt.Sprintf("%s:%s", collection, op.ID))
+	var data map[string]interface{}
+
+	switch op.Op {
+	case BulkInsert, BulkReplace:
+		if op.Document == nil {
+			result.Err = fmt.Errorf("%w: %s needs a document", ErrInvalidOperation, op.Op)
+			return result
+		}
+		if op.Op == BulkInsert && existing != nil {
+			result.Err = ErrDocumentExists
+			return result
+		}
+		data = op.Document
+	case BulkUpdate:
+		update, err := query.ParseUpdate(op.Update)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		base := map[string]interface{}{}
+		if existing != nil {
+			base = existing.Data
+		}
+		if data, err = update.Apply(base); err != nil {
+			result.Err = err
+			return result
+		}
+	case BulkDelete:
+		if !b.delete(collection, op.ID) {
+			result.Err = ErrDocumentNotFound
+			return result
+		}
+		result.Result = "deleted"
+		return result
+	default:
+		result.Err = fmt.Errorf("%w: unknown op %q", ErrInvalidOperation, op.Op)
+		return result
+	}
+
+	if existing == nil && op.Op != BulkInsert && !op.Upsert {
+		result.Err = ErrDocumentNotFound
+		return result
+	}
+
+	doc, err := b.put(collection, op.ID, data)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Version = doc.Version
+	switch {
+	case op.Op == BulkInsert:
+		result.Result = "inserted"
+	case existing == nil:
+		result.Result = "upserted"
+	case op.Op == BulkReplace:
+		result.Result = "replaced"
+	default:
+		result.Result = "updated"
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func bulkOps() []BulkOperation {
+	return []BulkOperation{
+		{Op: BulkInsert, ID: "a", Document: map[string]interface{}{"n": 1.0}},
+		{Op: BulkInsert, ID: "a", Document: map[string]interface{}{"n": 2.0}},
+		{Op: BulkUpdate, ID: "a", Update: map[string]interface{}{"$inc": map[string]interface{}{"n": 10.0}}},
+		{Op: BulkUpdate, ID: "b", Update: map[string]interface{}{"$set": map[string]interface{}{"n": 5.0}}, Upsert: true},
+		{Op: BulkReplace, ID: "c", Document: map[string]interface{}{"n": 3.0}},
+		{Op: BulkDelete, ID: "b"},
+		{Op: "merge", ID: "d"},
+	}
+}
+
+func TestBulkUnorderedAttemptsEveryOperation(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	results, err := e.Bulk("items", bulkOps(), false)
+	if err != nil {
+		t.Fatalf("Bulk: %v", err)
+	}
+	want := []struct {
+		result string
+		err    error
+	}{
+		{"inserted", nil},
+		{"", ErrDocumentExists},
+		{"updated", nil},
+		{"upserted", nil},
+		{"", ErrDocumentNotFound},
+		{"deleted", nil},
+		{"", ErrInvalidOperation},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		if results[i].Result != w.result || !errors.Is(results[i].Err, w.err) {
+			t.Errorf("op %d = %q, %v, want %q, %v", i, results[i].Result, results[i].Err, w.result, w.err)
+		}
+	}
+
+	// Later operations see the writes made earlier in the same bulk
+	doc, err := e.Get("items", "a")
+	if err != nil || doc.Data["n"] != 11.0 || doc.Version != 2 {
+		t.Errorf("a = %+v, %v, want n 11 at version 2", doc, err)
+	}
+	if doc, err := e.Get("items", "b"); err == nil {
+		t.Errorf("b was deleted in the bulk, got %v", doc)
+	}
+}
+
+func TestBulkOrderedStopsAtFirstFailure(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	results, err := e.Bulk("items", bulkOps(), true)
+	if err != nil {
+		t.Fatalf("Bulk: %v", err)
+	}
+	if len(results) != 2 || !errors.Is(results[1].Err, ErrDocumentExists) {
+		t.Fatalf("results = %+v, want the insert and the duplicate", results)
+	}
+
+	// The write before the failure is kept, and it survives a restart
+	e = reopen(t, e)
+	doc, err := e.Get("items", "a")
+	if err != nil || doc.Data["n"] != 1.0 {
+		t.Errorf("a after reopen = %+v, %v, want n 1", doc, err)
+	}
+	if doc, err := e.Get("items", "b"); err == nil {
+		t.Errorf("b was never reached, got %v", doc)
+	}
+}
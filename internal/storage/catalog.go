@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"coffedb/internal/fileutil"
+	"coffedb/internal/index"
+)
+
+const catalogFile = "catalog.json"
+
+// Catalog holds the persisted metadata of the database
+type Catalog struct {
+	Collections []CollectionDefinition  `json:"collections"`
+	Indexes     []index.IndexDefinition `json:"indexes"`
+	Seq         uint64                  `json:"seq,omitempty"` // WAL entry of the last rename saved
+
+	path string
+}
+
+// CollectionDefinition is the catalog entry of a collection. Documents and
+// Size are not persisted: they are counted when the engine opens and kept
+// up to date by every write.
+type CollectionDefinition struct {
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	Validator *Validator `json:"validator,omitempty"`
+	Documents int        `json:"-"`
+	Size      int64      `json:"-"` // JSON size of the documents' data
+}
+
+// loadCatalog reads the catalog from the data directory, returning an
+// empty catalog if none has been written yet
+func loadCatalog(dataDir string) (*Catalog, error) {
+	catalog := &Catalog{path: filepath.Join(dataDir, catalogFile)}
+
+	file, err := os.Open(catalog.path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog: %w", err)
+	}
+
+	for _, def := range catalog.Collections {
+		if def.Validator == nil {
+			continue
+		}
+		if err := def.Validator.compile(); err != nil {
+			return nil, fmt.Errorf("failed to load schema of %s: %w", def.Name, err)
+		}
+	}
+
+	return catalog, nil
+}
+
+// save atomically writes the catalog to disk
+func (c *Catalog) save() error {
+	return fileutil.WriteAtomic(c.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(c)
+	})
+}
+
+// addIndex records a new index definition
+func (c *Catalog) addIndex(def index.IndexDefinition) {
+	c.Indexes = append(c.Indexes, def)
+}
+
+// removeIndex drops an index definition
+func (c *Catalog) removeIndex(collection, name string) {
+	for i, def := range c.Indexes {
+		if def.Collection == collection && def.Name == name {
+			c.Indexes = append(c.Indexes[:i], c.Indexes[i+1:]...)
+			return
+		}
+	}
+}
+
+// collection returns the definition of a collection, or nil
+func (c *Catalog) collection(name string) *CollectionDefinition {
+	for i := range c.Collections {
+		if c.Collections[i].Name == name {
+			return &c.Collections[i]
+		}
+	}
+	return nil
+}
+
+// addCollection records a new collection
+func (c *Catalog) addCollection(def CollectionDefinition) {
+	c.Collections = append(c.Collections, def)
+}
+
+// removeCollection drops a collection and its index definitions
+func (c *Catalog) removeCollection(name string) {
+	for i, def := range c.Collections {
+		if def.Name == name {
+			c.Collections = append(c.Collections[:i], c.Collections[i+1:]...)
+			break
+		}
+	}
+
+	indexes := c.Indexes[:0]
+	for _, def := range c.Indexes {
+		if def.Collection != name {
+			indexes = append(indexes, def)
+		}
+	}
+	c.Indexes = indexes
+}
+
+// count updates the document count and size of the collection holding a
+// key for a write replacing previous with doc; either may be nil
+func (c *Catalog) count(key string, previous, doc *Document) {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return
+	}
+	def := c.collection(key[:i])
+	if def == nil {
+		return
+	}
+
+	if previous != nil {
+		def.Documents--
+		def.Size -= documentSize(previous)
+	}
+	if doc != nil {
+		def.Documents++
+		def.Size += documentSize(doc)
+	}
+}
+
+// documentSize is the size a document adds to its collection. Documents
+// written before sizes were stored with them are measured again.
+func documentSize(doc *Document) int64 {
+	if doc.Size > 0 {
+		return doc.Size
+	}
+	return encodedSize(doc.Data)
+}
+
+// encodedSize is the size of document data encoded as JSON
+func encodedSize(data map[string]interface{}) int64 {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return 0
+	}
+	return int64(len(encoded))
+}
+
+// collectionIndexes returns the index definitions of a collection
+func (c *Catalog) collectionIndexes(name string) []index.IndexDefinition {
+	var defs []index.IndexDefinition
+	for _, def := range c.Indexes {
+		if def.Collection == name {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
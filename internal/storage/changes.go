@@ -0,0 +1,482 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"coffedb/internal/query"
+)
+
+// ErrChangeStreamLagged ends a change stream whose consumer fell too far
+// behind; it can resume after the last event it received
+var ErrChangeStreamLagged = errors.New("change stream fell behind")
+
+// ErrInvalidResumeToken is returned when resuming after a sequence number
+// that has not been written
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// Kinds of change events
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+	ChangeDrop   = "drop" // the collection was dropped or renamed
+)
+
+const (
+	// changeBufferSize is the number of recent events kept in memory for
+	// resuming streams; older ones are read back from the WAL
+	changeBufferSize = 10000
+
+	// maxPendingChanges is the number of events a stream can hold for a
+	// slow consumer before it is ended with ErrChangeStreamLagged
+	maxPendingChanges = 10000
+
+	// replayChunkSize is about the number of WAL entries a resumed stream
+	// reads at a time, once it has handed out the ones read before
+	replayChunkSize = 1000
+)
+
+// ChangeEvent is a committed write. Seq orders the events and is the
+// token to resume a stream after. Before is the document replaced by an
+// update or removed by a delete, After the document written.
+type ChangeEvent struct {
+	Seq        uint64    `json:"seq"`
+	Op         string    `json:"op"`
+	Collection string    `json:"collection"`
+	ID         string    `json:"id,omitempty"`
+	Before     *Document `json:"before,omitempty"`
+	After      *Document `json:"after,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// WatchOptions selects the events of a change stream. Without Resume the
+// stream starts with the next write; with it, after the event numbered
+// After. Ops restricts the kinds of events, Filter the documents, matched
+// against the after image or, for deletes, the before image.
+type WatchOptions struct {
+	Resume bool
+	After  uint64
+	Ops    []string
+	Filter map[string]interface{}
+}
+
+// changeEvent derives the change event of a WAL entry
+func changeEvent(entry WALEntry) (ChangeEvent, bool) {
+	event := ChangeEvent{Seq: entry.Seq, Timestamp: entry.Timestamp, Before: entry.Previous}
+
+	switch entry.Type {
+	case WALPut:
+		doc, ok := entry.Value.(*Document)
+		if !ok {
+			return event, false
+		}
+		event.After = doc
+		event.Op = ChangeUpdate
+		if entry.Previous == nil {
+			event.Op = ChangeInsert
+		}
+	case WALDelete:
+		event.Op = ChangeDelete
+	case WALDeleteRange, WALRenameCollection:
+		event.Op = ChangeDrop
+		event.Collection = entry.Key
+		return event, true
+	default:
+		return event, false
+	}
+
+	i := strings.Index(entry.Key, ":")
+	if i < 0 {
+		return event, false
+	}
+	event.Collection, event.ID = entry.Key[:i], entry.Key[i+1:]
+	return event, true
+}
+
+// changeFeed fans committed writes out to change streams. It keeps the
+// latest events so that streams can resume without reading the WAL.
+type changeFeed struct {
+	wal     *WAL
+	recent  []ChangeEvent // ring buffer of the latest events
+	next    int           // position of the next event in recent
+	last    uint64        // sequence number of the last event
+	streams map[*ChangeStream]bool
+	closed  bool
+	mu      sync.Mutex
+}
+
+func newChangeFeed(wal *WAL) *changeFeed {
+	return &changeFeed{
+		wal:     wal,
+		recent:  make([]ChangeEvent, 0, changeBufferSize),
+		streams: make(map[*ChangeStream]bool),
+	}
+}
+
+// publish records the events of committed WAL entries and hands them to
+// the streams. Callers hold the engine's write lock, so events are
+// published in sequence order.
+func (f *changeFeed) publish(entries []WALEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, entry := range entries {
+		if entry.Seq > f.last {
+			f.last = entry.Seq
+		}
+		event, ok := changeEvent(entry)
+		if !ok {
+			continue
+		}
+
+		if len(f.recent) < changeBufferSize {
+			f.recent = append(f.recent, event)
+		} else {
+			f.recent[f.next] = event
+		}
+		f.next = (f.next + 1) % changeBufferSize
+
+		for stream := range f.streams {
+			if !stream.push(event) {
+				delete(f.streams, stream)
+			}
+		}
+	}
+}
+
+// close ends every stream
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for stream := range f.streams {
+		stream.end(nil)
+		delete(f.streams, stream)
+	}
+}
+
+// since returns the buffered events after seq, and false if some of them
+// are no longer buffered
+func (f *changeFeed) since(seq uint64) ([]ChangeEvent, bool) {
+	var events []ChangeEvent
+	oldest := f.last + 1
+	for i := range f.recent {
+		event := f.recent[(f.next+i)%len(f.recent)]
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+		if event.Seq < oldest {
+			oldest = event.Seq
+		}
+	}
+
+	// Sequence numbers without events (e.g. index-only entries) leave
+	// gaps, so only a full buffer can be missing events
+	complete := len(f.recent) < changeBufferSize || seq+1 >= oldest
+	return events, complete
+}
+
+// Watch opens a stream of the changes to a collection, or to every
+// collection when collection is empty. A resumed stream first replays the
+// events after the resume token, from memory or else from the WAL a chunk
+// at a time, then continues with new writes without gaps.
+func (e *Engine) Watch(collection string, opts WatchOptions) (*ChangeStream, error) {
+	if err := query.ValidateFilter(opts.Filter); err != nil {
+		return nil, err
+	}
+	f := e.changes
+	stream := newChangeStream(f, collection, opts)
+
+	f.mu.Lock()
+	if opts.Resume {
+		if opts.After > f.last {
+			f.mu.Unlock()
+			return nil, fmt.Errorf("%w: %d has not been written", ErrInvalidResumeToken, opts.After)
+		}
+
+		backlog, complete := f.since(opts.After)
+		if !complete {
+			f.mu.Unlock()
+
+			// The stream joins the feed once it has caught up
+			events, read, err := f.replay(opts.After)
+			if err != nil {
+				return nil, err
+			}
+			stream.queueBacklog(events, read)
+			stream.replaying = true
+			go stream.pump()
+			return stream, nil
+		}
+		stream.queueBacklog(backlog, opts.After)
+	}
+
+	f.streams[stream] = true
+	f.mu.Unlock()
+
+	go stream.pump()
+	return stream, nil
+}
+
+// ChangeSeq returns the sequence number of the last write; a stream
+// resumed after it starts with the next one
+func (e *Engine) ChangeSeq() uint64 {
+	e.changes.mu.Lock()
+	defer e.changes.mu.Unlock()
+	return e.changes.last
+}
+
+// replay reads a chunk of the events after seq from the WAL, returning
+// them with the sequence number of the last entry read
+func (f *changeFeed) replay(seq uint64) ([]ChangeEvent, uint64, error) {
+	entries, err := f.wal.ReadEntriesAfter(seq, replayChunkSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var events []ChangeEvent
+	read := seq
+	for _, entry := range entries {
+		if entry.Seq <= seq {
+			continue
+		}
+		if event, ok := changeEvent(entry); ok {
+			events = append(events, event)
+		}
+		read = entry.Seq
+	}
+	return events, read, nil
+}
+
+// ChangeStream delivers the change events matching a watch, in order.
+// Events are queued for the consumer so that writers never wait on it.
+type ChangeStream struct {
+	feed       *changeFeed
+	collection string
+	ops        map[string]bool
+	filter     map[string]interface{}
+
+	events chan ChangeEvent
+	notify chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu        sync.Mutex
+	queue     []ChangeEvent
+	seq       uint64 // sequence number of the last event queued or entry replayed
+	backlog   int    // replayed events still queued
+	replaying bool   // still reading the WAL, before joining the feed
+	err       error
+}
+
+func newChangeStream(feed *changeFeed, collection string, opts WatchOptions) *ChangeStream {
+	stream := &ChangeStream{
+		feed:       feed,
+		collection: collection,
+		filter:     opts.Filter,
+		events:     make(chan ChangeEvent),
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if len(opts.Ops) > 0 {
+		stream.ops = make(map[string]bool, len(opts.Ops))
+		for _, op := range opts.Ops {
+			stream.ops[op] = true
+		}
+	}
+	return stream
+}
+
+// Events returns the channel of events, closed when the stream ends
+func (s *ChangeStream) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Err returns why the stream ended, or nil if it was closed
+func (s *ChangeStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the stream
+func (s *ChangeStream) Close() {
+	s.end(nil)
+
+	s.feed.mu.Lock()
+	delete(s.feed.streams, s)
+	s.feed.mu.Unlock()
+}
+
+func (s *ChangeStream) end(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.queue = nil
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// matches reports whether an event is selected by the stream
+func (s *ChangeStream) matches(event ChangeEvent) bool {
+	if s.collection != "" && event.Collection != s.collection {
+		return false
+	}
+	if s.ops != nil && !s.ops[event.Op] {
+		return false
+	}
+	if len(s.filter) == 0 || event.Op == ChangeDrop {
+		return true
+	}
+
+	doc := event.After
+	if doc == nil {
+		doc = event.Before
+	}
+	return doc != nil && query.MatchFilter(doc.Data, s.filter)
+}
+
+// push queues an event for the consumer. It returns false once the
+// stream has ended, ending it first if the consumer fell behind.
+func (s *ChangeStream) push(event ChangeEvent) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if !s.matches(event) {
+		return true
+	}
+
+	s.mu.Lock()
+	if event.Seq <= s.seq {
+		// Already replayed when resuming
+		s.mu.Unlock()
+		return true
+	}
+	lagged := len(s.queue)-s.backlog >= maxPendingChanges
+	if !lagged {
+		s.queue = append(s.queue, event)
+		s.seq = event.Seq
+	}
+	s.mu.Unlock()
+
+	if lagged {
+		s.end(ErrChangeStreamLagged)
+		return false
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// queueBacklog queues the events replayed for a resumed stream, up to the
+// entry numbered read. They do not count towards the pending limit, which
+// only bounds how far the consumer falls behind new writes; a chunk read
+// from the WAL or the events kept in memory bound them instead.
+func (s *ChangeStream) queueBacklog(events []ChangeEvent, read uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range events {
+		if s.matches(event) {
+			s.queue = append(s.queue, event)
+			s.seq = event.Seq
+		}
+	}
+	if read > s.seq {
+		s.seq = read
+	}
+	s.backlog = len(s.queue)
+}
+
+// catchUp continues the replay of a resumed stream whose queue drained.
+// Once the events after the last entry read are all kept in memory, it
+// queues them and joins the feed; until then it queues the next chunk
+// read from the WAL.
+func (s *ChangeStream) catchUp() error {
+	f := s.feed
+	s.mu.Lock()
+	seq := s.seq
+	s.mu.Unlock()
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		s.end(nil)
+		return nil
+	}
+	if events, complete := f.since(seq); complete {
+		select {
+		case <-s.done:
+		default:
+			s.queueBacklog(events, seq)
+			s.mu.Lock()
+			s.replaying = false
+			s.mu.Unlock()
+			f.streams[s] = true
+		}
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.Unlock()
+
+	events, read, err := f.replay(seq)
+	if err != nil {
+		return err
+	}
+	s.queueBacklog(events, read)
+	return nil
+}
+
+// pump hands queued events to the consumer until the stream ends
+func (s *ChangeStream) pump() {
+	defer close(s.events)
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 && s.replaying {
+			s.mu.Unlock()
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if err := s.catchUp(); err != nil {
+				s.end(err)
+				return
+			}
+			continue
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		if s.backlog > 0 {
+			s.backlog--
+		}
+		s.mu.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event of a stream
+func nextEvent(t *testing.T, stream *ChangeStream) ChangeEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-stream.Events():
+		if !ok {
+			t.Fatalf("stream ended: %v", stream.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change event")
+	}
+	return ChangeEvent{}
+}
+
+func watch(t *testing.T, e *Engine, collection string, opts WatchOptions) *ChangeStream {
+	t.Helper()
+
+	stream, err := e.Watch(collection, opts)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	t.Cleanup(stream.Close)
+	return stream
+}
+
+func TestWatchDeliversWrites(t *testing.T) {
+	e := newTestEngine(t, nil)
+	all := watch(t, e, "users", WatchOptions{})
+	deletes := watch(t, e, "", WatchOptions{Ops: []string{ChangeDelete, ChangeDrop}})
+	active := watch(t, e, "users", WatchOptions{Filter: map[string]interface{}{"active": true}})
+
+	mustPut(t, e, "logs", "l1", map[string]interface{}{"line": "started"})
+	mustPut(t, e, "users", "u1", map[string]interface{}{"active": false})
+	mustPut(t, e, "users", "u1", map[string]interface{}{"active": true})
+	if err := e.Delete("users", "u1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := e.DropCollection("users"); err != nil {
+		t.Fatalf("DropCollection: %v", err)
+	}
+
+	want := []struct {
+		op     string
+		before interface{}
+		after  interface{}
+	}{
+		{ChangeInsert, nil, false},
+		{ChangeUpdate, false, true},
+		{ChangeDelete, true, nil},
+		{ChangeDrop, nil, nil},
+	}
+	var last uint64
+	for _, w := range want {
+		event := nextEvent(t, all)
+		if event.Op != w.op || event.Collection != "users" || event.Seq <= last {
+			t.Fatalf("event = %+v, want %s on users after seq %d", event, w.op, last)
+		}
+		last = event.Seq
+		if w.before != nil && (event.Before == nil || event.Before.Data["active"] != w.before) {
+			t.Errorf("%s before = %+v, want active %v", w.op, event.Before, w.before)
+		}
+		if w.after != nil && (event.After == nil || event.After.Data["active"] != w.after) {
+			t.Errorf("%s after = %+v, want active %v", w.op, event.After, w.after)
+		}
+	}
+	if last != e.ChangeSeq() {
+		t.Errorf("last event seq %d, ChangeSeq %d", last, e.ChangeSeq())
+	}
+
+	if event := nextEvent(t, deletes); event.Op != ChangeDelete || event.ID != "u1" {
+		t.Errorf("first delete event = %+v, want u1 deleted", event)
+	}
+	if event := nextEvent(t, deletes); event.Op != ChangeDrop {
+		t.Errorf("second delete event = %+v, want the drop", event)
+	}
+
+	// The filter matches the after image, or the before image of deletes
+	for _, op := range []string{ChangeUpdate, ChangeDelete, ChangeDrop} {
+		if event := nextEvent(t, active); event.Op != op {
+			t.Errorf("filtered event = %+v, want %s", event, op)
+		}
+	}
+
+	if _, err := e.Watch("users", WatchOptions{Filter: map[string]interface{}{"$bad": 1}}); err == nil {
+		t.Error("Watch with an invalid filter succeeded")
+	}
+}
+
+func TestWatchResumes(t *testing.T) {
+	e := newTestEngine(t, nil)
+	for i := 0; i < 5; i++ {
+		mustPut(t, e, "items", fmt.Sprintf("i%d", i), map[string]interface{}{"n": float64(i)})
+	}
+	after := e.ChangeSeq() - 2
+
+	stream := watch(t, e, "items", WatchOptions{Resume: true, After: after})
+	mustPut(t, e, "items", "i5", map[string]interface{}{"n": 5.0})
+	for _, id := range []string{"i3", "i4", "i5"} {
+		if event := nextEvent(t, stream); event.ID != id {
+			t.Fatalf("resumed event = %+v, want %s", event, id)
+		}
+	}
+
+	if _, err := e.Watch("items", WatchOptions{Resume: true, After: e.ChangeSeq() + 1}); !errors.Is(err, ErrInvalidResumeToken) {
+		t.Errorf("resume after an unwritten seq: %v, want ErrInvalidResumeToken", err)
+	}
+
+	// The events are recovered from the WAL on restart
+	e = reopen(t, e)
+	stream = watch(t, e, "items", WatchOptions{Resume: true, After: after})
+	if event := nextEvent(t, stream); event.ID != "i3" || event.Seq != after+1 {
+		t.Errorf("event after reopen = %+v, want i3 at seq %d", event, after+1)
+	}
+}
+
+func TestWatchResumesFromWAL(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "items", "first", map[string]interface{}{})
+	after := e.ChangeSeq()
+
+	// Push the next events out of the in-memory buffer
+	ops := make([]BulkOperation, changeBufferSize+100)
+	for i := range ops {
+		ops[i] = BulkOperation{Op: BulkInsert, ID: fmt.Sprintf("i%05d", i), Document: map[string]interface{}{}}
+	}
+	if _, err := e.Bulk("items", ops, true); err != nil {
+		t.Fatalf("Bulk: %v", err)
+	}
+
+	stream := watch(t, e, "items", WatchOptions{Resume: true, After: after})
+	for i := range ops {
+		event := nextEvent(t, stream)
+		if event.ID != ops[i].ID || event.Seq != after+uint64(i)+1 {
+			t.Fatalf("event %d = %s at seq %d, want %s at seq %d", i, event.ID, event.Seq, ops[i].ID, after+uint64(i)+1)
+		}
+	}
+}
+
+func TestWatchReplaysWALInChunks(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "items", "first", map[string]interface{}{})
+	after := e.ChangeSeq()
+
+	var ids []string
+	insert := func(n int) {
+		ops := make([]BulkOperation, n)
+		for i := range ops {
+			ops[i] = BulkOperation{Op: BulkInsert, ID: fmt.Sprintf("i%05d", len(ids)), Document: map[string]interface{}{}}
+			ids = append(ids, ops[i].ID)
+		}
+		if _, err := e.Bulk("items", ops, true); err != nil {
+			t.Fatalf("Bulk: %v", err)
+		}
+	}
+	for len(ids) < 2*changeBufferSize {
+		insert(500)
+	}
+
+	// The replay holds a chunk at a time, however far behind the stream
+	// starts, until the events kept in memory cover the rest; writes made
+	// meanwhile follow it
+	stream := watch(t, e, "items", WatchOptions{Resume: true, After: after})
+	for i := 0; i < len(ids); i++ {
+		if i%1000 == 0 {
+			stream.mu.Lock()
+			queued, limit := len(stream.queue), changeBufferSize
+			if stream.replaying {
+				limit = replayChunkSize + walIndexInterval
+			}
+			stream.mu.Unlock()
+			if queued > limit {
+				t.Fatalf("%d events queued after %d, want at most %d", queued, i, limit)
+			}
+		}
+		if i == changeBufferSize {
+			insert(10)
+		}
+
+		event := nextEvent(t, stream)
+		if event.ID != ids[i] || event.Seq != after+uint64(i)+1 {
+			t.Fatalf("event %d = %s at seq %d, want %s at seq %d", i, event.ID, event.Seq, ids[i], after+uint64(i)+1)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"coffedb/internal/index"
+)
+
+// ErrCollectionNotFound is returned for operations on a missing collection
+var ErrCollectionNotFound = errors.New("collection not found")
+
+// ErrCollectionExists is returned when creating or renaming to a
+// collection name that is taken
+var ErrCollectionExists = errors.New("collection already exists")
+
+// ErrInvalidCollection is returned for invalid collection names
+var ErrInvalidCollection = errors.New("invalid collection name")
+
+// collectionName is the form of the names CreateCollection and
+// RenameCollection accept
+var collectionName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// CollectionOptions configures a new collection
+type CollectionOptions struct {
+	Validator *Validator              // schema of the documents, if any
+	Indexes   []index.IndexDefinition // indexes created with the collection
+}
+
+// CollectionInfo describes a collection. Size is the JSON size of the
+// documents' data.
+type CollectionInfo struct {
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"created_at"`
+	Documents int               `json:"documents"`
+	Size      int64             `json:"size"`
+	Indexes   []index.IndexInfo `json:"indexes"`
+	Validator *Validator        `json:"validator,omitempty"`
+}
+
+// CreateCollection registers an empty collection with its indexes. If an
+// index cannot be created the collection is dropped again.
+func (e *Engine) CreateCollection(name string, opts CollectionOptions) (*CollectionInfo, error) {
+	if !collectionName.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCollection, name)
+	}
+
+	e.mu.Lock()
+	if e.catalog.collection(name) != nil {
+		e.mu.Unlock()
+		return nil, ErrCollectionExists
+	}
+	e.catalog.addCollection(CollectionDefinition{Name: name, CreatedAt: time.Now(), Validator: opts.Validator})
+	if err := e.catalog.save(); err != nil {
+		e.catalog.removeCollection(name)
+		e.mu.Unlock()
+		return nil, fmt.Errorf("failed to save catalog: %w", err)
+	}
+	e.mu.Unlock()
+
+	for _, def := range opts.Indexes {
+		def.Collection = name
+		if _, err := e.CreateIndex(def); err != nil {
+			e.DropCollection(name)
+			return nil, err
+		}
+	}
+
+	return e.GetCollection(name)
+}
+
+// ListCollections describes every collection, ordered by name
+func (e *Engine) ListCollections() []CollectionInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	infos := make([]CollectionInfo, 0, len(e.catalog.Collections))
+	for _, def := range e.catalog.Collections {
+		infos = append(infos, e.collectionInfoLocked(def))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// GetCollection describes a single collection
+func (e *Engine) GetCollection(name string) (*CollectionInfo, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	def := e.catalog.collection(name)
+	if def == nil {
+		return nil, ErrCollectionNotFound
+	}
+
+	info := e.collectionInfoLocked(*def)
+	return &info, nil
+}
+
+func (e *Engine) collectionInfoLocked(def CollectionDefinition) CollectionInfo {
+	return CollectionInfo{
+		Name:      def.Name,
+		CreatedAt: def.CreatedAt,
+		Documents: def.Documents,
+		Size:      def.Size,
+		Indexes:   e.indexes.List(def.Name),
+		Validator: def.Validator,
+	}
+}
+
+// DropCollection removes a collection with its documents and indexes and
+// returns the number of documents removed. The documents are removed with
+// a single range delete, logged as one WAL entry.
+func (e *Engine) DropCollection(name string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.catalog.collection(name) == nil {
+		return 0, ErrCollectionNotFound
+	}
+
+	entries := []WALEntry{{
+		Type:      WALDeleteRange,
+		Key:       name,
+		Timestamp: time.Now(),
+	}}
+	if err := e.wal.WriteBatch(entries); err != nil {
+		return 0, fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for _, def := range e.catalog.collectionIndexes(name) {
+		e.indexes.Unregister(name, def.Name)
+	}
+	deleted := e.deleteRangeLocked(name)
+	e.changes.publish(entries)
+
+	e.catalog.removeCollection(name)
+	if err := e.catalog.save(); err != nil {
+		return deleted, fmt.Errorf("failed to save catalog: %w", err)
+	}
+	return deleted, nil
+}
+
+// RenameCollection moves the documents and indexes of a collection to a
+// new name. The moved documents and a rename entry are logged as one WAL
+// batch; recovery completes the rename in the catalog if the engine stops
+// before saving it. The indexes are rebuilt under the new name, in the
+// background for large collections.
+func (e *Engine) RenameCollection(name, newName string) error {
+	if !collectionName.MatchString(newName) {
+		return fmt.Errorf("%w: %q", ErrInvalidCollection, newName)
+	}
+
+	e.mu.Lock()
+
+	if e.catalog.collection(name) == nil {
+		e.mu.Unlock()
+		return ErrCollectionNotFound
+	}
+	if e.catalog.collection(newName) != nil {
+		e.mu.Unlock()
+		return ErrCollectionExists
+	}
+
+	docs, err := e.matchAllLocked(name, nil)
+	if err != nil {
+		e.mu.Unlock()
+		return err
+	}
+
+	now := time.Now()
+	entries := make([]WALEntry, 0, len(docs)+1)
+	for _, doc := range docs {
+		entries = append(entries, WALEntry{
+			Type:      WALPut,
+			Key:       fmt.Sprintf("%s:%s", newName, doc.ID),
+			Value:     doc,
+			Timestamp: now,
+		})
+	}
+	entries = append(entries, WALEntry{Type: WALRenameCollection, Key: name, Value: newName, Timestamp: now})
+	if err := e.wal.WriteBatch(entries); err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for _, entry := range entries[:len(docs)] {
+		e.memtable.Put(entry.Key, entry.Value)
+	}
+	rebuild := e.renameCollectionLocked(name, newName, entries[len(docs)].Seq)
+	e.changes.publish(entries)
+	err = e.catalog.save()
+
+	if e.memtable.Size() >= e.config.MemtableSize {
+		go e.flushMemtable()
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to save catalog: %w", err)
+	}
+
+	for _, idx := range rebuild {
+		if err := e.populateIndex(idx); err != nil {
+			log.Printf("failed to rebuild index %s: %v", idx.Definition().Name, err)
+		}
+	}
+	return nil
+}
+
+// renameCollectionLocked removes the documents of a collection whose
+// copies were written under newName, and moves its catalog entry and
+// indexes there as the rename logged at seq. It returns the moved
+// indexes, which are empty until rebuilt. The caller holds e.mu and saves
+// the catalog.
+func (e *Engine) renameCollectionLocked(name, newName string, seq uint64) []*index.Index {
+	def := *e.catalog.collection(name)
+	indexDefs := e.catalog.collectionIndexes(name)
+	for _, indexDef := range indexDefs {
+		e.indexes.Unregister(name, indexDef.Name)
+	}
+	e.deleteRangeLocked(name)
+
+	def.Name = newName
+	e.catalog.removeCollection(name)
+	e.catalog.addCollection(def)
+	e.catalog.Seq = seq
+
+	var moved []*index.Index
+	for _, indexDef := range indexDefs {
+		indexDef.Collection = newName
+		idx, err := e.indexes.Register(indexDef)
+		if err != nil {
+			log.Printf("failed to move index %s: %v", indexDef.Name, err)
+			continue
+		}
+		e.catalog.addIndex(idx.Definition())
+		moved = append(moved, idx)
+	}
+	return moved
+}
+
+// there were
+func (e *Engine) deleteRangeLocked(collection string) int {
+	docs, _ := e.matchAllLocked(collection, nil)
+	for _, doc := range docs {
+		e.indexes.Apply(e.indexes.OnDelete(collection, indexDocument(doc)))
+	}
+
+	prefix := collection + ":"
+	e.memtable.DeleteRange(prefix)
+	e.btree.DeleteRange(prefix)
+	if def := e.catalog.collection(collection); def != nil {
+		def.Documents, def.Size = 0, 0
+	}
+	return len(docs)
+}
+
+// registerCollections adds collections first written to by a batch to the
+// catalog. Collections are created implicitly by their first write; a
+// failed save is retried by the next one.
+func (e *Engine) registerCollections(names map[string]bool) {
+	added := false
+	for name := range names {
+		if e.catalog.collection(name) == nil {
+			e.catalog.addCollection(CollectionDefinition{Name: name, CreatedAt: time.Now()})
+			added = true
+		}
+	}
+
+	if added {
+		if err := e.catalog.save(); err != nil {
+			log.Printf("failed to save catalog: %v", err)
+		}
+	}
+}
+
+// discoverCollections adds collections holding documents or indexes to
+// the catalog, for data written before collections were cataloged, and
+// counts the documents of every collection
+func (e *Engine) discoverCollections() error {
+	found := make(map[string]time.Time)
+	counts := make(map[string]*CollectionDefinition)
+	inMemtable := make(map[string]bool)
+	visit := func(key string, value interface{}) bool {
+		i := strings.Index(key, ":")
+		doc, ok := value.(*Document)
+		if i < 0 || !ok || inMemtable[key] {
+			return true
+		}
+		name := key[:i]
+		if created, seen := found[name]; !seen || doc.CreatedAt.Before(created) {
+			found[name] = doc.CreatedAt
+		}
+		if counts[name] == nil {
+			counts[name] = &CollectionDefinition{}
+		}
+		counts[name].Documents++
+		counts[name].Size += documentSize(doc)
+		return true
+	}
+	e.memtable.Range("", func(key string, value interface{}) bool {
+		visit(key, value)
+		inMemtable[key] = true
+		return true
+	})
+	e.btree.Ascend("", "", visit)
+
+	for _, def := range e.catalog.Indexes {
+		if _, seen := found[def.Collection]; !seen {
+			found[def.Collection] = def.CreatedAt
+		}
+	}
+
+	added := false
+	for name, created := range found {
+		if e.catalog.collection(name) == nil {
+			e.catalog.addCollection(CollectionDefinition{Name: name, CreatedAt: created})
+			added = true
+		}
+	}
+
+	for i := range e.catalog.Collections {
+		def := &e.catalog.Collections[i]
+		def.Documents, def.Size = 0, 0
+		if count := counts[def.Name]; count != nil {
+			def.Documents, def.Size = count.Documents, count.Size
+		}
+	}
+
+	if !added {
+		return nil
+	}
+	return e.catalog.save()
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"coffedb/internal/index"
+)
+
+// checkCollection compares the counters of a collection with its documents
+func checkCollection(t *testing.T, e *Engine, name string, want int) {
+	t.Helper()
+
+	info, err := e.GetCollection(name)
+	if err != nil {
+		t.Fatalf("GetCollection %s: %v", name, err)
+	}
+
+	docs, err := e.matchAllLocked(name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, doc := range docs {
+		data, _ := json.Marshal(doc.Data)
+		size += int64(len(data))
+	}
+
+	if info.Documents != want || len(docs) != want || info.Size != size {
+		t.Errorf("%s: %d documents of size %d, want %d of size %d", name, info.Documents, info.Size, want, size)
+	}
+}
+
+func TestCollectionCountersFollowWrites(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	mustPut(t, e, "users", "a", map[string]interface{}{"name": "Ada"})
+	mustPut(t, e, "users", "b", map[string]interface{}{"name": "Bob"})
+	mustPut(t, e, "users", "a", map[string]interface{}{"name": "Ada Lovelace"})
+	checkCollection(t, e, "users", 2)
+
+	if err := e.Delete("users", "b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	checkCollection(t, e, "users", 1)
+
+	results, err := e.Bulk("users", []BulkOperation{
+		{Op: BulkInsert, ID: "c", Document: map[string]interface{}{"name": "Cy"}},
+		{Op: BulkInsert, ID: "d", Document: map[string]interface{}{"name": "Di"}},
+		{Op: BulkDelete, ID: "c"},
+	}, true)
+	if err != nil {
+		t.Fatalf("Bulk: %v", err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("Bulk %s: %v", result.ID, result.Err)
+		}
+	}
+	checkCollection(t, e, "users", 2)
+
+	if err := e.RenameCollection("users", "people"); err != nil {
+		t.Fatalf("RenameCollection: %v", err)
+	}
+	checkCollection(t, e, "people", 2)
+
+	mustPut(t, e, "people", "e", map[string]interface{}{"name": "Eve"})
+	if _, err := e.DropCollection("people"); err != nil {
+		t.Fatalf("DropCollection: %v", err)
+	}
+	mustPut(t, e, "people", "f", map[string]interface{}{"name": "Fay"})
+	checkCollection(t, e, "people", 1)
+}
+
+func TestCollectionCountersSurviveRestart(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	// Some documents reach the B-tree, later writes stay in the WAL
+	mustPut(t, e, "users", "a", map[string]interface{}{"name": "Ada"})
+	mustPut(t, e, "users", "b", map[string]interface{}{"name": "Bob"})
+	e.flushMemtable()
+	mustPut(t, e, "users", "a", map[string]interface{}{"name": "Ada Lovelace"})
+	mustPut(t, e, "users", "c", map[string]interface{}{"name": "Cy"})
+	if err := e.Delete("users", "b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	e = reopen(t, e)
+	checkCollection(t, e, "users", 2)
+}
+
+func TestDropAndRenameSurviveRestart(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	mustPut(t, e, "users", "a", map[string]interface{}{"name": "Ada"})
+	e.flushMemtable()
+	mustPut(t, e, "users", "b", map[string]interface{}{"name": "Bob"})
+	mustPut(t, e, "logs", "l", map[string]interface{}{"line": "started"})
+
+	if err := e.RenameCollection("users", "people"); err != nil {
+		t.Fatalf("RenameCollection: %v", err)
+	}
+	if _, err := e.DropCollection("logs"); err != nil {
+		t.Fatalf("DropCollection: %v", err)
+	}
+
+	// Replaying the WAL over the flushed documents gives the same result
+	e = reopen(t, e)
+	checkCollection(t, e, "people", 2)
+	for _, name := range []string{"users", "logs"} {
+		if _, err := e.GetCollection(name); !errors.Is(err, ErrCollectionNotFound) {
+			t.Errorf("GetCollection %s: %v, want ErrCollectionNotFound", name, err)
+		}
+	}
+	if doc, err := e.Get("users", "a"); err == nil {
+		t.Errorf("users:a after rename = %v, want it gone", doc)
+	}
+}
+
+func TestRenameCompletesAfterCrashBeforeCatalogSave(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	mustPut(t, e, "users", "a", map[string]interface{}{"email": "ada@example.com"})
+	mustPut(t, e, "users", "b", map[string]interface{}{"email": "bob@example.com"})
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "email", Collection: "users", Fields: []index.IndexField{{Path: "email", Order: 1}}, Unique: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	catalogPath := filepath.Join(e.config.DataDir, catalogFile)
+	before, err := os.ReadFile(catalogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RenameCollection("users", "people"); err != nil {
+		t.Fatalf("RenameCollection: %v", err)
+	}
+
+	// Stop as if the catalog had not been saved after the WAL write
+	closedEngines.Store(e, true)
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := os.WriteFile(catalogPath, before, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestEngine(t, e.config)
+
+	checkCollection(t, e, "people", 2)
+	if _, err := e.GetCollection("users"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("GetCollection users: %v, want ErrCollectionNotFound", err)
+	}
+	info, err := e.GetIndex("people", "email")
+	if err != nil {
+		t.Fatalf("GetIndex: %v", err)
+	}
+	if info.State != index.IndexReady {
+		t.Errorf("index state = %s, want %s", info.State, index.IndexReady)
+	}
+	if err := e.Put("people", "c", map[string]interface{}{"email": "ada@example.com"}); !errors.As(err, new(*index.DuplicateKeyError)) {
+		t.Errorf("Put duplicate email: %v, want a DuplicateKeyError", err)
+	}
+
+	// Later opens find the rename saved and only replay the data
+	e = reopen(t, e)
+	checkCollection(t, e, "people", 2)
+}
+
+func TestDocumentSizeIsStoredWithDocument(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	data := map[string]interface{}{"name": "Ada", "tags": []interface{}{"math"}}
+	mustPut(t, e, "users", "a", data)
+	e.flushMemtable()
+
+	doc, err := e.Get("users", "a")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	encoded, _ := json.Marshal(data)
+	if doc.Size != int64(len(encoded)) {
+		t.Errorf("size = %d, want %d", doc.Size, len(encoded))
+	}
+
+	// The size is internal and not part of the document's JSON
+	out, _ := json.Marshal(doc)
+	var fields map[string]interface{}
+	json.Unmarshal(out, &fields)
+	if _, exists := fields["Size"]; exists {
+		t.Errorf("document JSON %s includes its size", out)
+	}
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"coffedb/internal/query"
+)
+
+// ErrInvalidCursor is returned for cursors that are malformed or belong
+// to a different query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// defaultPageSize is the number of documents in a page when no limit is
+// given
+const defaultPageSize = 100
+
+// QueryOptions controls the order, shape and page of query results
+type QueryOptions struct {
+	Sort   []query.SortField
+	Fields *query.Projection
+	Limit  int
+	Offset int
+	Cursor string // continues after the last document of a previous page
+}
+
+// QueryPage is one page of query results. NextCursor is empty on the last
+// page. Total is -1 when the page was read without counting every match.
+type QueryPage struct {
+	Documents  []*Document `json:"documents"`
+	Total      int         `json:"total"`
+	Limit      int         `json:"limit"` // page size used
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// cursorState is the position a cursor encodes: the sort key and ID of
+// the last document returned, and a fingerprint of the query it pages
+type cursorState struct {
+	Query  string        `json:"q"`
+	Values []interface{} `json:"v"`
+	ID     string        `json:"id"`
+}
+
+// pageEntry is a candidate document with its sort key
+type pageEntry struct {
+	doc *Document
+	key []interface{}
+}
+
+// QueryPage returns one page of the documents matching a filter. Results
+// are ordered by the sort fields, or by distance for a $near query, with
+// the document ID breaking ties so the order is total and stable. A page
+// only keeps offset+limit documents in memory however many match, and a
+// cursor resumes right after the previous page. Without sort fields the
+// order is by ID, and a cursor page seeks to the previous page's last ID
+// and reads no further than its own documents. With sort fields, a cursor
+// page seeks the same way in an ordered index on the first of them where
+// one applies. Cursor pages report no Total. A page larger than the
+// max_documents_returned limit is refused.
+func (e *Engine) QueryPage(ctx context.Context, collection string, filter map[string]interface{}, opts QueryOptions) (*QueryPage, error) {
+	if err := query.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	x, cancel := e.begin(ctx)
+	defer cancel()
+
+	if opts.Limit <= 0 {
+		opts.Limit = defaultPageSize
+		if x.maxReturned > 0 && x.maxReturned < opts.Limit {
+			opts.Limit = x.maxReturned
+		}
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	if err := x.returned(opts.Limit); err != nil {
+		return nil, err
+	}
+
+	fingerprint := queryFingerprint(collection, filter, opts.Sort)
+
+	var after *pageEntry
+	if opts.Cursor != "" {
+		state, err := decodeCursor(opts.Cursor)
+		if err != nil || state.Query != fingerprint {
+			return nil, ErrInvalidCursor
+		}
+		after = &pageEntry{doc: &Document{ID: state.ID}, key: state.Values}
+	}
+
+	// Sort keys and their directions
+	nearPath, near, hasNear := query.FindNear(filter)
+	if after != nil && len(opts.Sort) == 0 && !hasNear {
+		return e.seekPage(x, collection, filter, opts, fingerprint, after.doc.ID)
+	}
+	desc := make([]bool, len(opts.Sort))
+	for i, field := range opts.Sort {
+		desc[i] = field.Desc
+	}
+	if len(opts.Sort) == 0 && hasNear {
+		desc = []bool{false}
+	}
+	keyOf := func(doc *Document) []interface{} {
+		if len(opts.Sort) == 0 && hasNear {
+			distance, _ := query.NearDistance(doc.Data, nearPath, near)
+			return []interface{}{distance}
+		}
+		return query.SortKey(doc.Data, opts.Sort)
+	}
+
+	less := func(a, b pageEntry) bool {
+		for i := range desc {
+			if i >= len(a.key) || i >= len(b.key) {
+				break
+			}
+			if cmp := query.CompareAny(a.key[i], b.key[i]); cmp != 0 {
+				return (cmp < 0) != desc[i]
+			}
+		}
+		return a.doc.ID < b.doc.ID
+	}
+
+	if after != nil && len(opts.Sort) > 0 {
+		page, ok, err := e.indexPage(x, collection, filter, opts, fingerprint, after, keyOf, less)
+		if err != nil || ok {
+			return page, err
+		}
+	}
+
+	// Keep the first offset+limit documents after the cursor
+	window := opts.Offset + opts.Limit
+	candidates := &pageHeap{less: less}
+	total, remaining := 0, 0
+
+	err := e.scanMatching(x, collection, filter, func(doc *Document) bool {
+		total++
+		entry := pageEntry{doc: doc, key: keyOf(doc)}
+		if after != nil && !less(*after, entry) {
+			return true
+		}
+
+		remaining++
+		heap.Push(candidates, entry)
+		if candidates.Len() > window {
+			heap.Pop(candidates)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := candidates.entries
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+	if opts.Offset < len(entries) {
+		entries = entries[opts.Offset:]
+	} else {
+		entries = nil
+	}
+
+	if after != nil {
+		total = -1
+	}
+	return newPage(entries, total, remaining > window, opts, fingerprint), nil
+}
+
+// indexPage reads the sorted page after a cursor from an ordered index on
+// the first sort field, seeking to the cursor's value of the field and
+// stopping at the first value past the page; the other sort fields order
+// the documents sharing a value. Documents are indexed under the values of
+// the field, which is where they sort unless it holds an array, sorting
+// after every other value, or its path crosses one, sorting with the
+// nulls. So only a page that lies between the nulls and the arrays is read
+// from the index; otherwise, or without an index, it returns false.
+func (e *Engine) indexPage(x *execution, collection string, filter map[string]interface{}, opts QueryOptions, fingerprint string, after *pageEntry, keyOf func(*Document) []interface{}, less func(a, b pageEntry) bool) (*QueryPage, bool, error) {
+	if len(after.key) == 0 || after.key[0] == nil || !query.IsScalar(after.key[0]) {
+		return nil, false, nil
+	}
+	first := opts.Sort[0]
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	prefix := collection + ":"
+	window := opts.Offset + opts.Limit
+	var entries []pageEntry
+	var err error
+	full := false
+
+	served := e.indexes.SortedEntries(collection, filter, first.Path, first.Desc, true, after.key[0], func(value interface{}, docIDs []string) bool {
+		if value == nil || !query.IsScalar(value) {
+			return false
+		}
+
+		var group []pageEntry
+		for _, id := range docIDs {
+			if err = x.scan(); err != nil {
+				return false
+			}
+			doc := e.getDocument(prefix + id)
+			if doc == nil || !e.matchesFilter(doc, filter) {
+				continue
+			}
+
+			// Skip documents sorting elsewhere, and those up to the cursor
+			entry := pageEntry{doc: doc, key: keyOf(doc)}
+			if query.CompareAny(entry.key[0], value) != 0 || !less(*after, entry) {
+				continue
+			}
+			group = append(group, entry)
+		}
+
+		sort.Slice(group, func(i, j int) bool { return less(group[i], group[j]) })
+		entries = append(entries, group...)
+		full = len(entries) > window
+		return !full
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	if !served || !full {
+		return nil, false, nil
+	}
+
+	if opts.Offset < len(entries) {
+		entries = entries[opts.Offset:]
+	} else {
+		entries = nil
+	}
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+	}
+	return newPage(entries, -1, true, opts, fingerprint), true, nil
+}
+
+// newPage returns the page of the given entries, with a cursor after the
+// last of them if more follow
+func newPage(entries []pageEntry, total int, more bool, opts QueryOptions, fingerprint string) *QueryPage {
+	page := &QueryPage{Documents: []*Document{}, Total: total, Limit: opts.Limit}
+	for _, entry := range entries {
+		page.Documents = append(page.Documents, projectDocument(entry.doc, opts.Fields))
+	}
+
+	if more && len(entries) > 0 {
+		last := entries[len(entries)-1]
+		page.NextCursor = encodeCursor(cursorState{Query: fingerprint, Values: last.key, ID: last.doc.ID})
+	}
+
+	return page
+}
+
+// seekPage reads the page of documents after the ID of a cursor, in ID
+// order, stopping at the first document past the page
+func (e *Engine) seekPage(x *execution, collection string, filter map[string]interface{}, opts QueryOptions, fingerprint, afterID string) (*QueryPage, error) {
+	if filter == nil {
+		filter = map[string]interface{}{}
+	}
+
+	// The document read past the page only tells whether another page
+	// follows, so it is not held to max_documents_returned
+	probe := *x
+	probe.maxReturned = 0
+	it := e.newScanIterator(&probe, func() {}, collection, ScanOptions{
+		Filter: filter,
+		Fields: opts.Fields,
+		Limit:  opts.Limit + 1,
+		Offset: opts.Offset,
+	})
+	defer it.Close()
+	it.seek(afterID)
+
+	page := &QueryPage{Documents: []*Document{}, Total: -1, Limit: opts.Limit}
+	more := false
+	for it.Next() {
+		if len(page.Documents) == opts.Limit {
+			more = true
+			break
+		}
+		page.Documents = append(page.Documents, it.Document())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	if more && len(page.Documents) > 0 {
+		last := page.Documents[len(page.Documents)-1]
+		page.NextCursor = encodeCursor(cursorState{Query: fingerprint, Values: []interface{}{}, ID: last.ID})
+	}
+
+	return page, nil
+}
+
+// projectDocument returns a copy of a document holding the projected
+// fields
+func projectDocument(doc *Document, fields *query.Projection) *Document {
+	if fields == nil {
+		return doc
+	}
+	projected := *doc
+	projected.Data = fields.Apply(doc.Data)
+	return &projected
+}
+
+// queryFingerprint identifies the filter and order a cursor was issued
+// for, so it cannot resume a different query
+func queryFingerprint(collection string, filter map[string]interface{}, sortFields []query.SortField) string {
+	encoded, _ := json.Marshal([]interface{}{collection, filter, sortFields})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(state cursorState) string {
+	encoded, _ := json.Marshal(state)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeCursor(cursor string) (cursorState, error) {
+	var state cursorState
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return state, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return state, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return state, nil
+}
+
+// pageHeap keeps the best entries seen so far with the worst on top, so
+// it can be trimmed to the page window
+type pageHeap struct {
+	entries []pageEntry
+	less    func(a, b pageEntry) bool
+}
+
+func (h *pageHeap) Len() int           { return len(h.entries) }
+func (h *pageHeap) Less(i, j int) bool { return h.less(h.entries[j], h.entries[i]) }
+func (h *pageHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *pageHeap) Push(x interface{}) { h.entries = append(h.entries, x.(pageEntry)) }
+func (h *pageHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
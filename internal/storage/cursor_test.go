@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/config"
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+// pageAll follows the cursors of a query and returns the IDs of every page
+func pageAll(t *testing.T, e *Engine, filter map[string]interface{}, opts QueryOptions) []string {
+	t.Helper()
+
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatalf("cursor never ends")
+		}
+		page, err := e.QueryPage(context.Background(), "items", filter, opts)
+		if err != nil {
+			t.Fatalf("QueryPage: %v", err)
+		}
+		for _, doc := range page.Documents {
+			ids = append(ids, doc.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func putItems(t *testing.T, e *Engine, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		mustPut(t, e, "items", fmt.Sprintf("i%03d", i), map[string]interface{}{
+			"n":    float64(i),
+			"even": i%2 == 0,
+			"rank": float64(i % 7),
+		})
+	}
+}
+
+func TestQueryPageFollowsCursorInIDOrder(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 50)
+
+	var want []string
+	for i := 0; i < 50; i += 2 {
+		want = append(want, fmt.Sprintf("i%03d", i))
+	}
+
+	filter := map[string]interface{}{"even": true}
+	if got := pageAll(t, e, filter, QueryOptions{Limit: 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	// Pages seek the same way through documents flushed to disk and newer
+	// ones in the memtable
+	e = reopen(t, e)
+	mustPut(t, e, "items", "i050", map[string]interface{}{"even": true})
+	want = append(want, "i050")
+	if got := pageAll(t, e, filter, QueryOptions{Limit: 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages after reopen = %v, want %v", got, want)
+	}
+
+	// Served from an index, candidates are seeked in ID order too
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "by_even", Collection: "items", Fields: []index.IndexField{{Path: "even", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if got := pageAll(t, e, filter, QueryOptions{Limit: 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("indexed pages = %v, want %v", got, want)
+	}
+}
+
+func TestQueryPageCursorSeeksPastPreviousPage(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxScanned = 20
+	})
+	putItems(t, e, 1000)
+
+	// A cursor deep into the collection reads only its own page, where
+	// re-reading the documents before it would go over max_documents_scanned
+	cursor := encodeCursor(cursorState{Query: queryFingerprint("items", nil, nil), Values: []interface{}{}, ID: "i900"})
+	page, err := e.QueryPage(context.Background(), "items", nil, QueryOptions{Limit: 10, Cursor: cursor})
+	if err != nil {
+		t.Fatalf("QueryPage: %v", err)
+	}
+
+	if len(page.Documents) != 10 || page.Documents[0].ID != "i901" || page.Documents[9].ID != "i910" {
+		t.Errorf("page = %v..., want i901 to i910", page.Documents[0].ID)
+	}
+	if page.Total != -1 || page.NextCursor == "" {
+		t.Errorf("total %d, next cursor %q: want -1 and a cursor", page.Total, page.NextCursor)
+	}
+}
+
+func TestQueryPageFollowsCursorInSortOrder(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 30)
+
+	sortFields, err := query.ParseSort([]string{"-rank"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for rank := 6; rank >= 0; rank-- {
+		for i := 0; i < 30; i++ {
+			if i%7 == rank {
+				want = append(want, fmt.Sprintf("i%03d", i))
+			}
+		}
+	}
+
+	if got := pageAll(t, e, nil, QueryOptions{Sort: sortFields, Limit: 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+}
+
+func TestQueryPageCursorSeeksInSortIndex(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxScanned = 30
+	})
+	putItems(t, e, 1000)
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "by_n", Collection: "items", Fields: []index.IndexField{{Path: "n", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	// A sorted cursor deep into the collection reads its page from the
+	// index, in either direction
+	for _, tc := range []struct {
+		sort  string
+		after float64
+		first string
+		last  string
+	}{
+		{"n", 500, "i501", "i510"},
+		{"-n", 500, "i499", "i490"},
+	} {
+		sortFields, err := query.ParseSort([]string{tc.sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor := encodeCursor(cursorState{
+			Query:  queryFingerprint("items", nil, sortFields),
+			Values: []interface{}{tc.after},
+			ID:     fmt.Sprintf("i%03d", int(tc.after)),
+		})
+		page, err := e.QueryPage(context.Background(), "items", nil, QueryOptions{Sort: sortFields, Limit: 10, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("QueryPage sorted by %s: %v", tc.sort, err)
+		}
+		if len(page.Documents) != 10 || page.Documents[0].ID != tc.first || page.Documents[9].ID != tc.last {
+			t.Errorf("page sorted by %s = %v..., want %s to %s", tc.sort, page.Documents[0].ID, tc.first, tc.last)
+		}
+		if page.Total != -1 || page.NextCursor == "" {
+			t.Errorf("total %d, next cursor %q: want -1 and a cursor", page.Total, page.NextCursor)
+		}
+	}
+}
+
+func TestQueryPageSortIndexKeepsOrder(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 40)
+
+	// Documents sorting elsewhere than under their index keys
+	mustPut(t, e, "items", "array", map[string]interface{}{"rank": []interface{}{2.0, 5.0}, "even": true})
+	mustPut(t, e, "items", "crossing", map[string]interface{}{"rank": []interface{}{map[string]interface{}{"x": 3.0}}, "even": true})
+	mustPut(t, e, "items", "missing", map[string]interface{}{"even": false})
+	mustPut(t, e, "items", "word", map[string]interface{}{"rank": "high", "even": true})
+
+	type run struct {
+		opts   QueryOptions
+		filter map[string]interface{}
+		want   []string
+	}
+	var runs []run
+	for _, fields := range [][]string{{"rank"}, {"-rank"}, {"rank", "-n"}, {"-rank", "n"}, {"rank.x"}} {
+		sortFields, err := query.ParseSort(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, filter := range []map[string]interface{}{nil, {"even": true}} {
+			for _, limit := range []int{1, 3, 7} {
+				opts := QueryOptions{Sort: sortFields, Limit: limit}
+				runs = append(runs, run{opts, filter, pageAll(t, e, filter, opts)})
+			}
+		}
+	}
+
+	// Pages read from the indexes match those sorted in memory
+	for _, def := range []index.IndexDefinition{
+		{Name: "by_rank", Collection: "items", Fields: []index.IndexField{{Path: "rank", Order: -1}, {Path: "n", Order: 1}}},
+		{Name: "by_rank_x", Collection: "items", Fields: []index.IndexField{{Path: "rank.x", Order: 1}}},
+	} {
+		if _, err := e.CreateIndex(def); err != nil {
+			t.Fatalf("CreateIndex: %v", err)
+		}
+	}
+	for _, r := range runs {
+		if got := pageAll(t, e, r.filter, r.opts); !reflect.DeepEqual(got, r.want) {
+			t.Errorf("indexed pages sorted by %v with filter %v, limit %d = %v, want %v", r.opts.Sort, r.filter, r.opts.Limit, got, r.want)
+		}
+	}
+}
+
+func TestQueryPageRejectsCursorOfAnotherQuery(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 10)
+
+	page, err := e.QueryPage(context.Background(), "items", nil, QueryOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("QueryPage: %v", err)
+	}
+
+	_, err = e.QueryPage(context.Background(), "items", map[string]interface{}{"even": true}, QueryOptions{Limit: 2, Cursor: page.NextCursor})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor of another filter: %v, want ErrInvalidCursor", err)
+	}
+}
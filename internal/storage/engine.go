@@ -1,15 +1,26 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"coffedb/internal/config"
+	"coffedb/internal/index"
+	"coffedb/internal/query"
 )
 
+// ErrDocumentNotFound is returned for operations on a missing document
+var ErrDocumentNotFound = errors.New("document not found")
+
 // Document represents a JSON document in the database
 type Document struct {
 	ID        string                 `json:"id"`
@@ -17,76 +28,7 @@ type Document struct {
 	CreatedAt time.Time              `json:"created_at"`
 	UpdatedAt time.Time              `json:"updated_at"`
 	Version   int64                  `json:"version"`
-}
-
-// Index represents a secondary index
-type Index struct {
-	field   string
-	entries map[string][]string // value -> []docIDs
-	mu      sync.RWMutex
-}
-
-// NewIndex creates a new index
-func NewIndex(field string) *Index {
-	return &Index{
-		field:   field,
-		entries: make(map[string][]string),
-	}
-}
-
-// Put adds a document ID to the index for a given value
-func (idx *Index) Put(value, docID string) {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
-
-	if _, exists := idx.entries[value]; !exists {
-		idx.entries[value] = []string{}
-	}
-	
-	// Check if docID already exists
-	for _, existingID := range idx.entries[value] {
-		if existingID == docID {
-			return
-		}
-	}
-	
-	idx.entries[value] = append(idx.entries[value], docID)
-}
-
-// Get returns document IDs for a given value
-func (idx *Index) Get(value string) []string {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
-
-	if docIDs, exists := idx.entries[value]; exists {
-		// Return copy to avoid race conditions
-		result := make([]string, len(docIDs))
-		copy(result, docIDs)
-		return result
-	}
-	
-	return []string{}
-}
-
-// Delete removes a document ID from all values in the index
-func (idx *Index) Delete(docID string) {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
-
-	for value, docIDs := range idx.entries {
-		for i, id := range docIDs {
-			if id == docID {
-				// Remove docID from slice
-				idx.entries[value] = append(docIDs[:i], docIDs[i+1:]...)
-				break
-			}
-		}
-		
-		// Remove empty entries
-		if len(idx.entries[value]) == 0 {
-			delete(idx.entries, value)
-		}
-	}
+	Size      int64                  `json:"-"` // encoded size of Data, stored with the document
 }
 
 // Engine is the main storage engine
@@ -95,7 +37,10 @@ type Engine struct {
 	memtable  *Memtable
 	wal       *WAL
 	btree     *BTree
-	indexes   map[string]*Index
+	indexes   *index.IndexManager
+	catalog   *Catalog
+	changes   *changeFeed
+	lastID    int64 // last generated document ID, see NewID
 	mu        sync.RWMutex
 	compacting bool
 }
@@ -119,6 +64,12 @@ func NewEngine(cfg config.StorageConfig) (*Engine, error) {
 		return nil, fmt.Errorf("failed to initialize B-tree: %w", err)
 	}
 
+	// Load catalog
+	catalog, err := loadCatalog(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load catalog: %w", err)
+	}
+
 	// Initialize memtable
 	memtable := NewMemtable(cfg.MemtableSize)
 
@@ -127,13 +78,47 @@ func NewEngine(cfg config.StorageConfig) (*Engine, error) {
 		memtable: memtable,
 		wal:      wal,
 		btree:    btree,
-		indexes:  make(map[string]*Index),
+		indexes:  index.NewIndexManager(filepath.Join(cfg.DataDir, "indexes")),
+		catalog:  catalog,
+		changes:  newChangeFeed(wal),
 	}
 
+	// Restore indexes, collecting those without a usable snapshot
+	rebuild := engine.indexes.Load(catalog.Indexes)
+
 	// Recover from WAL if needed
-	if err := engine.recover(); err != nil {
+	moved, err := engine.recover()
+	if err != nil {
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
+	rebuild = append(rebuild, moved...)
+
+	// Catalog collections written before the catalog tracked them, and
+	// count the documents of each
+	if err := engine.discoverCollections(); err != nil {
+		return nil, fmt.Errorf("failed to save catalog: %w", err)
+	}
+
+	// Rebuild missing indexes in the background, but unique ones before
+	// writes are accepted. Indexes moved by a recovered rename are rebuilt
+	// under their new name only.
+	for _, idx := range rebuild {
+		def := idx.Definition()
+		if current, err := engine.indexes.Get(def.Collection, def.Name); err != nil || current != idx {
+			continue
+		}
+		if idx.Definition().Unique {
+			if err := engine.buildUniqueIndex(idx); err != nil {
+				log.Printf("failed to rebuild index %s: %v", idx.Definition().Name, err)
+			}
+			continue
+		}
+		go func(idx *index.Index) {
+			if err := engine.buildIndex(idx); err != nil {
+				log.Printf("failed to rebuild index %s: %v", idx.Definition().Name, err)
+			}
+		}(idx)
+	}
 
 	// Start background compaction
 	go engine.backgroundCompaction()
@@ -141,51 +126,83 @@ func NewEngine(cfg config.StorageConfig) (*Engine, error) {
 	return engine, nil
 }
 
+// NewID returns an ID for a new document: the current time in
+// nanoseconds, or one more than the last ID returned if that is not
+// later, so IDs grow with time and no two calls return the same one.
+func (e *Engine) NewID() string {
+	for {
+		last := atomic.LoadInt64(&e.lastID)
+		id := time.Now().UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&e.lastID, last, id) {
+			return strconv.FormatInt(id, 10)
+		}
+	}
+}
+
 // Put stores a document in the database
 func (e *Engine) Put(collection, id string, data map[string]interface{}) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	key := fmt.Sprintf("%s:%s", collection, id)
-	doc := &Document{
-		ID:        id,
-		Data:      data,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Version:   1,
-	}
-
-	// Check if document exists and increment version
-	if existing, exists := e.memtable.Get(key); exists {
-		if existingDoc, ok := existing.(*Document); ok {
-			doc.CreatedAt = existingDoc.CreatedAt
-			doc.Version = existingDoc.Version + 1
-		}
-	}
+	_, err := e.putLocked(collection, id, data)
+	return err
+}
 
-	// Write to WAL first
-	if err := e.wal.WriteEntry(WALEntry{
-		Type:      WALPut,
-		Key:       key,
-		Value:     doc,
-		Timestamp: time.Now(),
-	}); err != nil {
-		return fmt.Errorf("failed to write to WAL: %w", err)
+// putLocked stores a document, bumping the version of the one it replaces.
+// The caller must hold the write lock.
+func (e *Engine) putLocked(collection, id string, data map[string]interface{}) (*Document, error) {
+	b := e.newBatch()
+	doc, err := b.put(collection, id, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.commit(); err != nil {
+		return nil, err
 	}
+	return doc, nil
+}
 
-	// Write to memtable
-	e.memtable.Put(key, doc)
+// Patch applies a partial update to a document and returns the new
+// version. The read, the patch and the write happen under the write lock,
+// so concurrent patches of a document never lose each other's changes.
+func (e *Engine) Patch(collection, id string, patch query.Patch) (*Document, error) {
+	return e.modify(collection, id, patch, false)
+}
 
-	// Update indexes
-	e.updateIndexes(collection, id, doc)
+// UpdateOptions controls an update
+type UpdateOptions struct {
+	Upsert bool // create the document from the update if it does not exist
+}
 
-	// Check if memtable needs flushing
-	// if e.memtable.Size() >= e.config.MemtableSize {
-	// 	go e.flushMemtable()
-	// }
-	go e.flushMemtable()
-	fmt.Printf("this will happen hopefully")
-	return nil
+// Update applies update operators to a document and returns the new
+// version. Like Patch it is atomic, so concurrent $inc updates of a
+// document never lose increments. With Upsert a missing document is
+// created by applying the operators to an empty one.
+func (e *Engine) Update(collection, id string, update *query.Update, opts UpdateOptions) (*Document, error) {
+	return e.modify(collection, id, update, opts.Upsert)
+}
+
+// modify applies a patch to a document under the write lock
+func (e *Engine) modify(collection, id string, patch query.Patch, upsert bool) (*Document, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data := map[string]interface{}{}
+	existing := e.getDocument(fmt.Sprintf("%s:%s", collection, id))
+	if existing != nil {
+		data = existing.Data
+	} else if !upsert {
+		return nil, ErrDocumentNotFound
+	}
+
+	data, err := patch.Apply(data)
+	if err != nil {
+		return nil, err
+	}
+	return e.putLocked(collection, id, data)
 }
 
 // Get retrieves a document from the database
@@ -212,7 +229,7 @@ func (e *Engine) Get(collection, id string) (*Document, error) {
 		return doc, nil
 	}
 
-	return nil, fmt.Errorf("document not found")
+	return nil, ErrDocumentNotFound
 }
 
 // Delete removes a document from the database
@@ -220,205 +237,164 @@ func (e *Engine) Delete(collection, id string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	key := fmt.Sprintf("%s:%s", collection, id)
+	b := e.newBatch()
+	b.delete(collection, id)
+	return b.commit()
+}
 
-	// Write to WAL first
-	if err := e.wal.WriteEntry(WALEntry{
-		Type:      WALDelete,
-		Key:       key,
-		Timestamp: time.Now(),
-	}); err != nil {
-		return fmt.Errorf("failed to write to WAL: %w", err)
+// Query performs a query on the collection. Results of a $near query are
+// sorted by distance. The query is aborted with a QueryAbortedError when
+// ctx ends or it goes over the query limits of the config.
+func (e *Engine) Query(ctx context.Context, collection string, filter map[string]interface{}) ([]*Document, error) {
+	if err := query.ValidateFilter(filter); err != nil {
+		return nil, err
 	}
 
-	// Remove from memtable
-	e.memtable.Delete(key)
+	x, cancel := e.begin(ctx)
+	defer cancel()
 
-	// Remove from indexes
-	e.removeFromIndexes(collection, id)
+	results, err := e.queryDocuments(x, collection, filter)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
-}
+	if path, near, ok := query.FindNear(filter); ok {
+		sortByDistance(results, path, near)
+	}
 
-// Query performs a query on the collection
-func (e *Engine) Query(collection string, filter map[string]interface{}) ([]*Document, error) {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
+	return results, nil
+}
 
+// queryDocuments collects the documents matching a validated filter
+func (e *Engine) queryDocuments(x *execution, collection string, filter map[string]interface{}) ([]*Document, error) {
 	var results []*Document
-	prefix := collection + ":"
-
-	// Query memtable
-	e.memtable.Range(prefix, func(key string, value interface{}) bool {
-		if doc, ok := value.(*Document); ok {
-			if e.matchesFilter(doc, filter) {
-				results = append(results, doc)
-			}
+	var limitErr error
+	err := e.scanMatching(x, collection, filter, func(doc *Document) bool {
+		if limitErr = x.returned(len(results) + 1); limitErr != nil {
+			return false
 		}
+		results = append(results, doc)
 		return true
 	})
-
-	// Query disk storage
-	diskResults, err := e.btree.Range(prefix)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		err = limitErr
 	}
+	return results, err
+}
 
-	for _, value := range diskResults {
-		if doc, ok := value.(*Document); ok {
-			if e.matchesFilter(doc, filter) {
-				results = append(results, doc)
-			}
-		}
-	}
+// scanMatching calls fn with every document of the collection matching a
+// validated filter, until fn returns false. It serves the filter from an
+// index when one applies, and otherwise scans the memtable and the disk,
+// where the memtable holds the current version of a document. Every
+// document read counts against the limits of the execution, and the scan
+// fails once they are exceeded.
+func (e *Engine) scanMatching(x *execution, collection string, filter map[string]interface{}, fn func(doc *Document) bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
-	return results, nil
+	return e.scanLocked(x, collection, filter, fn)
 }
 
-// CreateIndex creates a secondary index on a field
-func (e *Engine) CreateIndex(collection, field string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-
-	indexKey := fmt.Sprintf("%s.%s", collection, field)
-	if _, exists := e.indexes[indexKey]; exists {
-		return fmt.Errorf("index already exists")
+// scanLocked is scanMatching for callers holding e.mu
+func (e *Engine) scanLocked(x *execution, collection string, filter map[string]interface{}, fn func(doc *Document) bool) error {
+	if err := x.check(); err != nil {
+		return err
 	}
 
-	index := NewIndex(field)
-	e.indexes[indexKey] = index
-
-	// Build index from existing data
-	return e.buildIndex(collection, field, index)
-}
+	prefix := collection + ":"
 
-// Helper methods
+	// Serve the query from an index when one covers the filter
+	ids, ok := e.indexes.Lookup(collection, filter)
+	if !ok {
+		ids, ok = e.indexes.GeoLookup(collection, filter)
+	}
+	if ok {
+		for _, id := range ids {
+			if err := x.scan(); err != nil {
+				return err
+			}
+			if doc := e.getDocument(prefix + id); doc != nil && e.matchesFilter(doc, filter) {
+				if !fn(doc) {
+					return nil
+				}
+			}
+		}
+		return nil
+	}
 
-// FIXED: matchesFilter now handles type conversions properly
-func (e *Engine) matchesFilter(doc *Document, filter map[string]interface{}) bool {
-	for key, value := range filter {
-		docValue, exists := doc.Data[key]
-		if !exists {
+	// Query memtable
+	var err error
+	seen := make(map[string]bool)
+	stopped := false
+	e.memtable.Range(prefix, func(key string, value interface{}) bool {
+		if err = x.scan(); err != nil {
 			return false
 		}
-		
-		// Handle type conversions for numeric comparisons
-		if !e.valuesEqual(docValue, value) {
-			return false
+		seen[key] = true
+		if doc, ok := value.(*Document); ok && e.matchesFilter(doc, filter) {
+			stopped = !fn(doc)
 		}
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
 	}
-	return true
-}
 
-// NEW: Helper function to handle type conversions
-func (e *Engine) valuesEqual(a, b interface{}) bool {
-	// Direct equality check first
-	if a == b {
-		return true
-	}
-	
-	// Handle numeric type conversions
-	aFloat, aIsNum := toFloat64(a)
-	bFloat, bIsNum := toFloat64(b)
-	
-	if aIsNum && bIsNum {
-		return aFloat == bFloat
-	}
-	
-	// Handle string comparisons
-	aStr, aIsStr := a.(string)
-	bStr, bIsStr := b.(string)
-	
-	if aIsStr && bIsStr {
-		return aStr == bStr
-	}
-	
-	// Handle boolean comparisons
-	aBool, aIsBool := a.(bool)
-	bBool, bIsBool := b.(bool)
-	
-	if aIsBool && bIsBool {
-		return aBool == bBool
-	}
-	
-	return false
+	// Query disk storage, skipping documents superseded in the memtable
+	e.btree.Ascend(prefix, "", func(key string, value interface{}) bool {
+		doc, ok := value.(*Document)
+		if !ok || seen[key] {
+			return true
+		}
+		if err = x.scan(); err != nil {
+			return false
+		}
+		if !e.matchesFilter(doc, filter) {
+			return true
+		}
+		return fn(doc)
+	})
+
+	return err
 }
 
-// NEW: Helper function to convert various numeric types to float64
-func toFloat64(v interface{}) (float64, bool) {
-	switch val := v.(type) {
-	case float64:
-		return val, true
-	case float32:
-		return float64(val), true
-	case int:
-		return float64(val), true
-	case int8:
-		return float64(val), true
-	case int16:
-		return float64(val), true
-	case int32:
-		return float64(val), true
-	case int64:
-		return float64(val), true
-	case uint:
-		return float64(val), true
-	case uint8:
-		return float64(val), true
-	case uint16:
-		return float64(val), true
-	case uint32:
-		return float64(val), true
-	case uint64:
-		return float64(val), true
-	default:
-		return 0, false
-	}
+// matchesFilter reports whether a document satisfies a query filter
+func (e *Engine) matchesFilter(doc *Document, filter map[string]interface{}) bool {
+	return query.MatchFilter(doc.Data, filter)
 }
 
-func (e *Engine) updateIndexes(collection, id string, doc *Document) {
-	for indexKey, index := range e.indexes {
-		if len(indexKey) > len(collection) && indexKey[:len(collection)] == collection {
-			field := indexKey[len(collection)+1:]
-			if value, exists := doc.Data[field]; exists {
-				index.Put(fmt.Sprintf("%v", value), id)
-			}
-		}
+// sortByDistance orders the results of a $near query from the closest
+// location to the farthest
+func sortByDistance(docs []*Document, path string, near query.Near) {
+	distances := make(map[*Document]float64, len(docs))
+	for _, doc := range docs {
+		distances[doc], _ = query.NearDistance(doc.Data, path, near)
 	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return distances[docs[i]] < distances[docs[j]]
+	})
 }
 
-func (e *Engine) removeFromIndexes(collection, id string) {
-	for indexKey, index := range e.indexes {
-		if len(indexKey) > len(collection) && indexKey[:len(collection)] == collection {
-			index.Delete(id)
-		}
+// indexDocument returns the view of a document used for index maintenance
+func indexDocument(doc *Document) *index.Document {
+	if doc == nil {
+		return nil
 	}
+	return &index.Document{ID: doc.ID, Data: doc.Data}
 }
 
-func (e *Engine) buildIndex(collection, field string, index *Index) error {
-	prefix := collection + ":"
-
-	// Build from memtable
-	e.memtable.Range(prefix, func(key string, value interface{}) bool {
+// getDocument looks up the current version of a document by key
+func (e *Engine) getDocument(key string) *Document {
+	if value, exists := e.memtable.Get(key); exists {
 		if doc, ok := value.(*Document); ok {
-			if fieldValue, exists := doc.Data[field]; exists {
-				index.Put(fmt.Sprintf("%v", fieldValue), doc.ID)
-			}
+			return doc
 		}
-		return true
-	})
-
-	// Build from disk
-	diskResults, err := e.btree.Range(prefix)
-	if err != nil {
-		return err
 	}
 
-	for _, value := range diskResults {
+	if value, err := e.btree.Get(key); err == nil {
 		if doc, ok := value.(*Document); ok {
-			if fieldValue, exists := doc.Data[field]; exists {
-				index.Put(fmt.Sprintf("%v", fieldValue), doc.ID)
-			}
+			return doc
 		}
 	}
 
@@ -429,6 +405,11 @@ func (e *Engine) flushMemtable() {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	e.flushMemtableLocked()
+}
+
+// flushMemtableLocked moves the memtable to disk; the caller holds e.mu
+func (e *Engine) flushMemtableLocked() {
 	if e.memtable.IsEmpty() {
 		return
 	}
@@ -470,12 +451,13 @@ func (e *Engine) compact() {
 	// Perform compaction logic here
 }
 
-func (e *Engine) recover() error {
+func (e *Engine) recover() ([]*index.Index, error) {
 	entries, err := e.wal.ReadEntries()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var moved []*index.Index
 	for _, entry := range entries {
 		switch entry.Type {
 		case WALPut:
@@ -484,10 +466,34 @@ func (e *Engine) recover() error {
 			}
 		case WALDelete:
 			e.memtable.Delete(entry.Key)
+			e.btree.Delete(entry.Key)
+		case WALDeleteRange:
+			e.deleteRangeLocked(entry.Key)
+		case WALRenameCollection:
+			// Renames after the catalog's last one were not saved to it
+			newName, _ := entry.Value.(string)
+			if entry.Seq <= e.catalog.Seq || e.catalog.collection(entry.Key) == nil || e.catalog.collection(newName) != nil {
+				e.deleteRangeLocked(entry.Key)
+				break
+			}
+			moved = append(moved, e.renameCollectionLocked(entry.Key, newName, entry.Seq)...)
+			if err := e.catalog.save(); err != nil {
+				return nil, fmt.Errorf("failed to save catalog: %w", err)
+			}
 		}
+
+		// Index mutations converge when replayed over a snapshot
+		e.indexes.Apply(entry.IndexOps)
 	}
 
-	return nil
+	// Number new entries after the replayed ones, and keep the latest
+	// changes for resuming change streams
+	if len(entries) > 0 {
+		e.wal.setSeq(entries[len(entries)-1].Seq)
+	}
+	e.changes.publish(entries)
+
+	return moved, nil
 }
 
 // Close shuts down the storage engine
@@ -495,8 +501,16 @@ func (e *Engine) Close() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// End change streams
+	e.changes.close()
+
 	// Flush memtable
-	e.flushMemtable()
+	e.flushMemtableLocked()
+
+	// Persist ready indexes; building ones are rebuilt on the next open
+	if err := e.indexes.SaveSnapshots(); err != nil {
+		return err
+	}
 
 	// Close WAL
 	if err := e.wal.Close(); err != nil {
@@ -519,7 +533,7 @@ func (e *Engine) Stats() map[string]interface{} {
 	return map[string]interface{}{
 		"memtable_size":    e.memtable.Size(),
 		"memtable_count":   e.memtable.Count(),
-		"indexes_count":    len(e.indexes),
+		"indexes_count":    e.indexes.Count(),
 		"compacting":       e.compacting,
 	}
 }
\ No newline at end of file
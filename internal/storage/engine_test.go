@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"coffedb/internal/query"
+)
+
+func TestNewIDIsUniqueAndIncreasing(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	const workers, each = 8, 1000
+	ids := make([][]string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				ids[w] = append(ids[w], e.NewID())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, list := range ids {
+		var last int64
+		for _, id := range list {
+			if seen[id] {
+				t.Fatalf("ID %s returned twice", id)
+			}
+			seen[id] = true
+
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err != nil || n <= last {
+				t.Fatalf("ID %s does not follow %d", id, last)
+			}
+			last = n
+		}
+	}
+}
+
+func TestConcurrentUpdatesKeepEveryIncrement(t *testing.T) {
+	e := newTestEngine(t, nil)
+	update, err := query.ParseUpdate(map[string]interface{}{"$inc": map[string]interface{}{"views": 1.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Update("pages", "home", update, UpdateOptions{}); !errors.Is(err, ErrDocumentNotFound) {
+		t.Fatalf("update of a missing document: %v, want ErrDocumentNotFound", err)
+	}
+
+	// The first upsert creates the document, and every increment counts
+	const workers, each = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if _, err := e.Update("pages", "home", update, UpdateOptions{Upsert: true}); err != nil {
+					t.Errorf("Update: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	doc, err := e.Get("pages", "home")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if views := doc.Data["views"]; views != float64(workers*each) {
+		t.Errorf("views = %v, want %d", views, workers*each)
+	}
+}
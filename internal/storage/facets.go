@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"coffedb/internal/query"
+)
+
+// FacetSpec describes one histogram of a facets request: the number of
+// documents per value of a field or, with Buckets, per numeric range
+type FacetSpec struct {
+	Field   string    `json:"field"`
+	Buckets []float64 `json:"buckets,omitempty"` // ascending range boundaries
+	Limit   int       `json:"limit,omitempty"`   // most frequent values to return
+}
+
+// FacetValue is the number of documents holding a value
+type FacetValue struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// FacetBucket is the number of documents holding a value in [Min, Max)
+type FacetBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Facet is the result of a FacetSpec. Values are ordered by count, most
+// frequent first. Other counts the documents with a value outside every
+// bucket.
+type Facet struct {
+	Values  []FacetValue  `json:"values,omitempty"`
+	Buckets []FacetBucket `json:"buckets,omitempty"`
+	Other   int           `json:"other,omitempty"`
+}
+
+// validate checks a facet spec
+func (s FacetSpec) validate() error {
+	if s.Field == "" {
+		return fmt.Errorf("%w: facet field is required", query.ErrInvalidOptions)
+	}
+	if s.Limit < 0 {
+		return fmt.Errorf("%w: facet limit must not be negative", query.ErrInvalidOptions)
+	}
+	if s.Buckets != nil {
+		if len(s.Buckets) < 2 {
+			return fmt.Errorf("%w: buckets need at least two boundaries", query.ErrInvalidOptions)
+		}
+		for i := 1; i < len(s.Buckets); i++ {
+			if s.Buckets[i] <= s.Buckets[i-1] {
+				return fmt.Errorf("%w: bucket boundaries must be ascending", query.ErrInvalidOptions)
+			}
+		}
+	}
+	return nil
+}
+
+// Distinct returns the distinct values of a field across the documents
+// matching a filter, in ascending order. Elements of arrays count as
+// values. Without a filter the values are read from an index on the field
+// when there is one.
+func (e *Engine) Distinct(ctx context.Context, collection, field string, filter map[string]interface{}) ([]interface{}, error) {
+	facets, err := e.Facets(ctx, collection, filter, map[string]FacetSpec{"distinct": {Field: field}})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0, len(facets["distinct"].Values))
+	for _, v := range facets["distinct"].Values {
+		values = append(values, v.Value)
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return query.CompareAny(values[i], values[j]) < 0
+	})
+	return values, nil
+}
+
+// Facets computes several histograms over the documents matching a filter.
+// A document counts once per distinct value it holds in a field, with
+// array elements counting as values. Without a filter, a facet is read
+// from the value map of an index on its field when there is one; the
+// remaining facets are computed in a single scan.
+func (e *Engine) Facets(ctx context.Context, collection string, filter map[string]interface{}, specs map[string]FacetSpec) (map[string]*Facet, error) {
+	if err := query.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	x, cancel := e.begin(ctx)
+	defer cancel()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	counters := make(map[string]*facetCounter, len(specs))
+	var scanned []*facetCounter
+	for name, spec := range specs {
+		counter := newFacetCounter(spec)
+		counters[name] = counter
+
+		served := len(filter) == 0 && e.indexes.FieldEntries(collection, spec.Field, counter.addEntry)
+		if !served {
+			scanned = append(scanned, counter)
+		}
+	}
+
+	if len(scanned) > 0 {
+		err := e.scanLocked(x, collection, filter, func(doc *Document) bool {
+			for _, counter := range scanned {
+				counter.addDocument(doc.ID, query.PathValues(doc.Data, counter.spec.Field))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[string]*Facet, len(counters))
+	for name, counter := range counters {
+		result[name] = counter.facet()
+	}
+	return result, nil
+}
+
+// facetCounter accumulates one facet. Documents are tracked per bucket
+// because a document holding several values in one range counts once.
+type facetCounter struct {
+	spec       FacetSpec
+	values     map[string]*FacetValue // by query.ValueKey
+	bucketDocs []map[string]bool
+	otherDocs  map[string]bool
+}
+
+func newFacetCounter(spec FacetSpec) *facetCounter {
+	c := &facetCounter{spec: spec, values: make(map[string]*FacetValue)}
+	if spec.Buckets != nil {
+		c.bucketDocs = make([]map[string]bool, len(spec.Buckets)-1)
+		for i := range c.bucketDocs {
+			c.bucketDocs[i] = make(map[string]bool)
+		}
+		c.otherDocs = make(map[string]bool)
+	}
+	return c
+}
+
+// addDocument counts the values a document holds in the facet field
+func (c *facetCounter) addDocument(docID string, values []interface{}) {
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if num, ok := query.ToFloat64(value); ok {
+			value = num
+		}
+		key := query.ValueKey(value)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		c.addEntry(value, []string{docID})
+	}
+}
+
+// addEntry counts the documents holding a value
+func (c *facetCounter) addEntry(value interface{}, docIDs []string) {
+	if c.bucketDocs == nil {
+		key := query.ValueKey(value)
+		if entry, exists := c.values[key]; exists {
+			entry.Count += len(docIDs)
+		} else {
+			c.values[key] = &FacetValue{Value: value, Count: len(docIDs)}
+		}
+		return
+	}
+
+	docs := c.otherDocs
+	if num, ok := query.ToFloat64(value); ok {
+		// The first boundary above num closes its bucket
+		bounds := c.spec.Buckets
+		if i := sort.Search(len(bounds), func(i int) bool { return bounds[i] > num }); i > 0 && i < len(bounds) {
+			docs = c.bucketDocs[i-1]
+		}
+	}
+	for _, id := range docIDs {
+		docs[id] = true
+	}
+}
+
+func (c *facetCounter) facet() *Facet {
+	facet := &Facet{}
+
+	if c.bucketDocs != nil {
+		facet.Buckets = make([]FacetBucket, len(c.bucketDocs))
+		for i, docs := range c.bucketDocs {
+			facet.Buckets[i] = FacetBucket{Min: c.spec.Buckets[i], Max: c.spec.Buckets[i+1], Count: len(docs)}
+		}
+		facet.Other = len(c.otherDocs)
+		return facet
+	}
+
+	facet.Values = make([]FacetValue, 0, len(c.values))
+	for _, v := range c.values {
+		facet.Values = append(facet.Values, *v)
+	}
+	sort.Slice(facet.Values, func(i, j int) bool {
+		a, b := facet.Values[i], facet.Values[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return query.CompareAny(a.Value, b.Value) < 0
+	})
+	if c.spec.Limit > 0 && len(facet.Values) > c.spec.Limit {
+		facet.Values = facet.Values[:c.spec.Limit]
+	}
+	return facet
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+func putProducts(t *testing.T, e *Engine) {
+	t.Helper()
+
+	mustPut(t, e, "products", "p1", map[string]interface{}{"tags": []interface{}{"red", "sale", "red"}, "price": 5.0})
+	mustPut(t, e, "products", "p2", map[string]interface{}{"tags": "red", "price": 15.0})
+	mustPut(t, e, "products", "p3", map[string]interface{}{"tags": []interface{}{"blue"}, "price": []interface{}{25.0, 29.0}})
+	mustPut(t, e, "products", "p4", map[string]interface{}{"price": 120.0})
+}
+
+func TestFacetsFromScanAndIndexAgree(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putProducts(t, e)
+
+	specs := map[string]FacetSpec{
+		"tags":   {Field: "tags"},
+		"top":    {Field: "tags", Limit: 1},
+		"prices": {Field: "price", Buckets: []float64{0, 10, 50, 100}},
+	}
+	want := map[string]*Facet{
+		"tags":   {Values: []FacetValue{{"red", 2}, {"blue", 1}, {"sale", 1}}},
+		"top":    {Values: []FacetValue{{"red", 2}}},
+		"prices": {Buckets: []FacetBucket{{0, 10, 1}, {10, 50, 2}, {50, 100, 0}}, Other: 1},
+	}
+
+	check := func(name string) {
+		t.Helper()
+		facets, err := e.Facets(context.Background(), "products", nil, specs)
+		if err != nil {
+			t.Fatalf("%s: Facets: %v", name, err)
+		}
+		if !reflect.DeepEqual(facets, want) {
+			for key := range want {
+				t.Errorf("%s: facet %s = %+v, want %+v", name, key, facets[key], want[key])
+			}
+		}
+
+		values, err := e.Distinct(context.Background(), "products", "tags", nil)
+		if err != nil {
+			t.Fatalf("%s: Distinct: %v", name, err)
+		}
+		if !reflect.DeepEqual(values, []interface{}{"blue", "red", "sale"}) {
+			t.Errorf("%s: distinct tags = %v", name, values)
+		}
+	}
+
+	check("scan")
+	for _, field := range []string{"tags", "price"} {
+		if _, err := e.CreateIndex(index.IndexDefinition{Name: field, Collection: "products", Fields: []index.IndexField{{Path: field, Order: 1}}}); err != nil {
+			t.Fatalf("CreateIndex: %v", err)
+		}
+	}
+	check("index")
+}
+
+func TestFacetsWithFilter(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putProducts(t, e)
+
+	values, err := e.Distinct(context.Background(), "products", "price", map[string]interface{}{"tags": "red"})
+	if err != nil {
+		t.Fatalf("Distinct: %v", err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{5.0, 15.0}) {
+		t.Errorf("prices of red products = %v, want [5 15]", values)
+	}
+
+	for _, spec := range []FacetSpec{{}, {Field: "price", Limit: -1}, {Field: "price", Buckets: []float64{10}}, {Field: "price", Buckets: []float64{10, 5}}} {
+		if _, err := e.Facets(context.Background(), "products", nil, map[string]FacetSpec{"f": spec}); !errors.Is(err, query.ErrInvalidOptions) {
+			t.Errorf("spec %+v: %v, want ErrInvalidOptions", spec, err)
+		}
+	}
+}
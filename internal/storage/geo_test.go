@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/index"
+)
+
+func TestNearQueryOrdersByDistance(t *testing.T) {
+	e := newTestEngine(t, nil)
+	cities := map[string][2]float64{
+		"oslo":      {59.9139, 10.7522},
+		"stockholm": {59.3293, 18.0686},
+		"paris":     {48.8566, 2.3522},
+		"tokyo":     {35.6762, 139.6503},
+		"fiji":      {-17.7134, 178.0650},
+	}
+	for id, c := range cities {
+		mustPut(t, e, "places", id, map[string]interface{}{"location": map[string]interface{}{"lat": c[0], "lng": c[1]}})
+	}
+
+	near := map[string]interface{}{"location": map[string]interface{}{"$near": map[string]interface{}{"lat": 59.9139, "lng": 10.7522}, "$maxDistance": 1500e3}}
+	within := map[string]interface{}{"location": map[string]interface{}{"$geoWithin": map[string]interface{}{
+		"$box": []interface{}{[]interface{}{170.0, -30.0}, []interface{}{-170.0, 0.0}}}}}
+
+	check := func(name string) {
+		t.Helper()
+		if ids := queryIDs(t, e, "places", near); !reflect.DeepEqual(ids, []string{"oslo", "stockholm", "paris"}) {
+			t.Errorf("%s: near Oslo -> %v, want [oslo stockholm paris]", name, ids)
+		}
+		if ids := queryIDs(t, e, "places", within); !reflect.DeepEqual(ids, []string{"fiji"}) {
+			t.Errorf("%s: within box over the antimeridian -> %v, want [fiji]", name, ids)
+		}
+	}
+
+	check("scan")
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "location", Collection: "places", Type: index.IndexTypeGeo, Fields: []index.IndexField{{Path: "location", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if ids, ok := e.indexes.GeoLookup("places", near); !ok || len(ids) >= len(cities) {
+		t.Errorf("geo index candidates = %v, %v: want fewer than every place", ids, ok)
+	}
+	check("index")
+}
+
+func queryIDs(t *testing.T, e *Engine, collection string, filter map[string]interface{}) []string {
+	t.Helper()
+
+	docs, err := e.Query(context.Background(), collection, filter)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	ids := []string{}
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	return ids
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+
+	"coffedb/internal/config"
+)
+
+// closedEngines holds the engines closed by reopen, which cleanup skips
+var closedEngines sync.Map
+
+// newTestEngine opens an engine in a temporary directory; configure
+// adjusts the config before it opens
+func newTestEngine(t *testing.T, configure func(*config.StorageConfig)) *Engine {
+	t.Helper()
+
+	cfg := config.Default().Storage
+	cfg.DataDir = t.TempDir()
+	cfg.MemtableSize = 64 * 1024 * 1024
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	return openTestEngine(t, cfg)
+}
+
+func openTestEngine(t *testing.T, cfg config.StorageConfig) *Engine {
+	t.Helper()
+
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, closed := closedEngines.Load(e); !closed {
+			e.Close()
+		}
+	})
+	return e
+}
+
+// reopen closes an engine and opens another over its data directory
+func reopen(t *testing.T, e *Engine) *Engine {
+	t.Helper()
+
+	closedEngines.Store(e, true)
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return openTestEngine(t, e.config)
+}
+
+func mustPut(t *testing.T, e *Engine, collection, id string, data map[string]interface{}) {
+	t.Helper()
+
+	if err := e.Put(collection, id, data); err != nil {
+		t.Fatalf("Put %s/%s: %v", collection, id, err)
+	}
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+
+	"coffedb/internal/index"
+)
+
+// syncIndexBuildLimit is the largest collection CreateIndex indexes
+// before returning; larger ones are built in the background
+const syncIndexBuildLimit = 10000
+
+// CreateIndex creates a secondary index over one or more fields and
+// returns its definition with defaults filled in
+func (e *Engine) CreateIndex(def index.IndexDefinition) (index.IndexDefinition, error) {
+	e.mu.Lock()
+
+	idx, err := e.indexes.Register(def)
+	if err != nil {
+		e.mu.Unlock()
+		return def, err
+	}
+	def = idx.Definition()
+
+	e.catalog.addIndex(def)
+	if e.catalog.collection(def.Collection) == nil {
+		e.catalog.addCollection(CollectionDefinition{Name: def.Collection, CreatedAt: def.CreatedAt})
+	}
+	if err := e.catalog.save(); err != nil {
+		e.catalog.removeIndex(def.Collection, def.Name)
+		e.indexes.Unregister(def.Collection, def.Name)
+		e.mu.Unlock()
+		return def, fmt.Errorf("failed to save catalog: %w", err)
+	}
+	e.mu.Unlock()
+
+	// Build index from existing data, dropping it again if that fails
+	if err := e.populateIndex(idx); err != nil {
+		e.DropIndex(def.Collection, def.Name)
+		return def, err
+	}
+
+	return def, nil
+}
+
+// populateIndex builds a newly registered index from its collection.
+// Large collections are indexed in the background; the index reports the
+// building state until it is ready. Unique indexes are always built before
+// returning, so that duplicates fail the call.
+func (e *Engine) populateIndex(idx *index.Index) error {
+	if idx.Definition().Unique {
+		return e.buildUniqueIndex(idx)
+	}
+
+	docs, err := e.startIndexBuild(idx)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) > syncIndexBuildLimit {
+		go func() {
+			if err := e.finishIndexBuild(idx, docs); err != nil {
+				log.Printf("failed to build index %s: %v", idx.Definition().Name, err)
+			}
+		}()
+		return nil
+	}
+
+	return e.finishIndexBuild(idx, docs)
+}
+
+// ListIndexes describes the indexes of a collection, ordered by name
+func (e *Engine) ListIndexes(collection string) []index.IndexInfo {
+	return e.indexes.List(collection)
+}
+
+// GetIndex describes a single index
+func (e *Engine) GetIndex(collection, name string) (index.IndexInfo, error) {
+	idx, err := e.indexes.Get(collection, name)
+	if err != nil {
+		return index.IndexInfo{}, err
+	}
+
+	return idx.Info(), nil
+}
+
+// DropIndex removes an index and its persisted state. A build in
+// progress is abandoned.
+func (e *Engine) DropIndex(collection, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.indexes.Unregister(collection, name); err != nil {
+		return err
+	}
+
+	e.catalog.removeIndex(collection, name)
+	return e.catalog.save()
+}
+
+// RebuildIndex rebuilds an index from the collection's documents in the
+// background. The index keeps receiving writes, but is not used for
+// queries until the rebuild completes. Unique indexes are rebuilt before
+// returning.
+func (e *Engine) RebuildIndex(collection, name string) error {
+	idx, err := e.indexes.Get(collection, name)
+	if err != nil {
+		return err
+	}
+	if idx.Definition().Unique {
+		return e.buildUniqueIndex(idx)
+	}
+
+	docs, err := e.startIndexBuild(idx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := e.finishIndexBuild(idx, docs); err != nil {
+			log.Printf("failed to rebuild index %s: %v", name, err)
+		}
+	}()
+
+	return nil
+}
+
+// buildIndex populates an index from existing data
+func (e *Engine) buildIndex(idx *index.Index) error {
+	if idx.Definition().Unique {
+		return e.buildUniqueIndex(idx)
+	}
+
+	docs, err := e.startIndexBuild(idx)
+	if err != nil {
+		return err
+	}
+	return e.finishIndexBuild(idx, docs)
+}
+
+// startIndexBuild marks an index as building and takes a consistent
+// snapshot of its collection. Writes arriving from then on are queued on
+// the index and replayed by finishIndexBuild, so builds do not block
+// writers.
+func (e *Engine) startIndexBuild(idx *index.Index) ([]*index.Document, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.startIndexBuildLocked(idx)
+}
+
+// startIndexBuildLocked is startIndexBuild for callers holding e.mu
+func (e *Engine) startIndexBuildLocked(idx *index.Index) ([]*index.Document, error) {
+	prefix := idx.Definition().Collection + ":"
+	var docs []*index.Document
+	seen := make(map[string]bool)
+
+	if err := e.indexes.StartBuild(idx); err != nil {
+		return nil, err
+	}
+
+	e.memtable.Range(prefix, func(key string, value interface{}) bool {
+		if doc, ok := value.(*Document); ok {
+			docs = append(docs, indexDocument(doc))
+			seen[doc.ID] = true
+		}
+		return true
+	})
+
+	diskResults, err := e.btree.Range(prefix)
+	if err != nil {
+		e.indexes.FailBuild(idx, err)
+		return nil, err
+	}
+
+	// Disk versions are stale when the memtable holds a newer one
+	for _, value := range diskResults {
+		if doc, ok := value.(*Document); ok && !seen[doc.ID] {
+			docs = append(docs, indexDocument(doc))
+		}
+	}
+
+	return docs, nil
+}
+
+// buildUniqueIndex builds a unique index with writers excluded. Writes are
+// only checked against ready indexes, and a write made while the index was
+// building could add a duplicate the build cannot reject, so no write may
+// see a unique index building. A duplicate in the collection fails the
+// build with a DuplicateKeyError.
+func (e *Engine) buildUniqueIndex(idx *index.Index) error {
+	e.mu.Lock()
+	docs, err := e.startIndexBuildLocked(idx)
+	if err == nil {
+		err = e.indexes.FinishBuild(idx, e.indexes.Build(idx, docs))
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return e.indexes.SaveSnapshot(idx)
+}
+
+// finishIndexBuild indexes the snapshot taken by startIndexBuild and
+// swaps the result in while writers are excluded
+func (e *Engine) finishIndexBuild(idx *index.Index, docs []*index.Document) error {
+	built := e.indexes.Build(idx, docs)
+
+	e.mu.Lock()
+	err := e.indexes.FinishBuild(idx, built)
+	e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return e.indexes.SaveSnapshot(idx)
+}
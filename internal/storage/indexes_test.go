@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"coffedb/internal/index"
+)
+
+var emailIndex = index.IndexDefinition{
+	Name:       "email",
+	Collection: "users",
+	Fields:     []index.IndexField{{Path: "email", Order: 1}},
+	Unique:     true,
+}
+
+// putUsers writes n users with distinct emails in one batch
+func putUsers(t *testing.T, e *Engine, n int) {
+	t.Helper()
+
+	ops := make([]BulkOperation, n)
+	for i := range ops {
+		ops[i] = BulkOperation{Op: BulkInsert, ID: fmt.Sprintf("u%05d", i), Document: map[string]interface{}{"email": fmt.Sprintf("u%d@example.com", i)}}
+	}
+	results, err := e.Bulk("users", ops, true)
+	if err != nil {
+		t.Fatalf("Bulk: %v", err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("Bulk %s: %v", result.ID, result.Err)
+		}
+	}
+}
+
+func TestUniqueIndexOnLargeCollectionRejectsDuplicates(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putUsers(t, e, syncIndexBuildLimit+1)
+	mustPut(t, e, "users", "dup", map[string]interface{}{"email": "u7@example.com"})
+
+	// Too large to index before returning, but a unique index still is
+	var duplicate *index.DuplicateKeyError
+	if _, err := e.CreateIndex(emailIndex); !errors.As(err, &duplicate) {
+		t.Fatalf("CreateIndex over a duplicate: %v, want a DuplicateKeyError", err)
+	}
+	if _, err := e.GetIndex("users", "email"); !errors.Is(err, index.ErrIndexNotFound) {
+		t.Errorf("failed index is left behind: %v", err)
+	}
+
+	if err := e.Delete("users", "dup"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := e.CreateIndex(emailIndex); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if info, _ := e.GetIndex("users", "email"); info.State != index.IndexReady {
+		t.Errorf("index is %s after CreateIndex, want ready", info.State)
+	}
+	if err := e.Put("users", "dup", map[string]interface{}{"email": "u7@example.com"}); !errors.As(err, &duplicate) {
+		t.Errorf("duplicate write: %v, want a DuplicateKeyError", err)
+	}
+}
+
+func TestUniqueIndexRebuildsBeforeAcceptingWrites(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putUsers(t, e, 100)
+	if _, err := e.CreateIndex(emailIndex); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	if err := e.RebuildIndex("users", "email"); err != nil {
+		t.Fatalf("RebuildIndex: %v", err)
+	}
+	if info, _ := e.GetIndex("users", "email"); info.State != index.IndexReady {
+		t.Errorf("index is %s after RebuildIndex, want ready", info.State)
+	}
+
+	// Without a snapshot the index is rebuilt on open, before any write
+	e.Close()
+	closedEngines.Store(e, true)
+	if err := os.RemoveAll(filepath.Join(e.config.DataDir, "indexes")); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestEngine(t, e.config)
+	if info, _ := e.GetIndex("users", "email"); info.State != index.IndexReady {
+		t.Fatalf("index is %s after open, want ready", info.State)
+	}
+	var duplicate *index.DuplicateKeyError
+	if err := e.Put("users", "dup", map[string]interface{}{"email": "u1@example.com"}); !errors.As(err, &duplicate) {
+		t.Errorf("duplicate write after open: %v, want a DuplicateKeyError", err)
+	}
+}
+
+// crashCopy opens an engine over a copy of the files of a running one, as
+// if it had crashed without closing
+func crashCopy(t *testing.T, e *Engine) *Engine {
+	t.Helper()
+
+	cfg := e.config
+	cfg.DataDir = t.TempDir()
+	err := filepath.WalkDir(e.config.DataDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(cfg.DataDir, strings.TrimPrefix(path, e.config.DataDir))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatalf("copy data dir: %v", err)
+	}
+	return openTestEngine(t, cfg)
+}
+
+func TestIndexFollowsWritesAfterCrash(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "users", "u1", map[string]interface{}{"city": "Oslo"})
+	mustPut(t, e, "users", "u2", map[string]interface{}{"city": "Oslo"})
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "city", Collection: "users", Fields: []index.IndexField{{Path: "city", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	// Writes after the index snapshot are only in the WAL
+	mustPut(t, e, "users", "u1", map[string]interface{}{"city": "Rome"})
+	mustPut(t, e, "users", "u3", map[string]interface{}{"city": "Oslo"})
+	if err := e.Delete("users", "u2"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	for name, e := range map[string]*Engine{"running": e, "recovered": crashCopy(t, e)} {
+		for city, want := range map[string][]string{"Oslo": {"u3"}, "Rome": {"u1"}} {
+			ids, ok := e.indexes.Lookup("users", map[string]interface{}{"city": city})
+			if !ok || !reflect.DeepEqual(ids, want) {
+				t.Errorf("%s: %s -> %v, want %v", name, city, ids, want)
+			}
+		}
+	}
+}
+
+func TestIndexesSurviveRestart(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putUsers(t, e, 10)
+	if _, err := e.CreateIndex(emailIndex); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	city := index.IndexDefinition{Name: "city", Collection: "users", Fields: []index.IndexField{{Path: "city", Order: 1}}}
+	if _, err := e.CreateIndex(city); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if err := e.DropIndex("users", "city"); err != nil {
+		t.Fatalf("DropIndex: %v", err)
+	}
+
+	e = reopen(t, e)
+	infos := e.indexes.List("users")
+	if len(infos) != 1 || infos[0].Name != "email" || !infos[0].Unique {
+		t.Fatalf("indexes after reopen = %+v, want only the unique email index", infos)
+	}
+	if ids, ok := e.indexes.Lookup("users", map[string]interface{}{"email": "u7@example.com"}); !ok || !reflect.DeepEqual(ids, []string{"u00007"}) {
+		t.Errorf("lookup after reopen = %v, %v, want [u00007]", ids, ok)
+	}
+
+	// Without its snapshot the index is rebuilt from the documents
+	dir := e.config.DataDir
+	closedEngines.Store(e, true)
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "indexes", "*"))
+	if len(snapshots) == 0 {
+		t.Fatal("no index snapshot was written")
+	}
+	for _, path := range snapshots {
+		os.RemoveAll(path)
+	}
+	e = openTestEngine(t, e.config)
+	if err := e.Put("users", "dup", map[string]interface{}{"email": "u3@example.com"}); !isDuplicateKey(err) {
+		t.Errorf("duplicate after rebuild: %v, want a DuplicateKeyError", err)
+	}
+}
+
+func isDuplicateKey(err error) bool {
+	var duplicate *index.DuplicateKeyError
+	return errors.As(err, &duplicate)
+}
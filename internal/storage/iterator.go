@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"coffedb/internal/query"
+)
+
+// scanBatchSize is the number of keys an iterator reads per batch
+const scanBatchSize = 256
+
+// Iterator walks the results of a scan one document at a time:
+//
+//	it := engine.Scan(ctx, "users", ScanOptions{Filter: filter})
+//	defer it.Close()
+//	for it.Next() {
+//		doc := it.Document()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator interface {
+	// Next advances to the next document and reports whether there is one
+	Next() bool
+	// Document returns the current document
+	Document() *Document
+	// Err returns the error that ended the iteration, if any
+	Err() error
+	// Close releases the iterator; Next returns false afterwards
+	Close() error
+}
+
+// ScanOptions selects and shapes the documents of a scan
+type ScanOptions struct {
+	Filter map[string]interface{}
+	Fields *query.Projection
+	Limit  int // 0 for no limit
+	Offset int
+}
+
+// Scan returns an iterator over the documents of a collection matching a
+// filter. Documents are read in batches, in key order or in index order
+// when an index serves the filter, and the engine is only locked while a
+// batch is read, so memory use does not grow with the number of results
+// and slow readers do not hold up writers. Each document is returned at
+// most once; a document written during the scan may or may not be seen.
+// A scan ends with a QueryAbortedError when the context is done or it
+// goes over the query limits of the config; the query timeout bounds the
+// time to find each document, not the whole scan, as a scan lasts as long
+// as its consumer takes. $near needs every match to order by distance and
+// is only supported by Query.
+func (e *Engine) Scan(ctx context.Context, collection string, opts ScanOptions) Iterator {
+	x, cancel := e.beginScan(ctx)
+	if opts.Filter == nil {
+		opts.Filter = map[string]interface{}{}
+	}
+
+	if err := query.ValidateFilter(opts.Filter); err != nil {
+		return &scanIterator{cancel: cancel, err: err}
+	}
+	if _, _, near := query.FindNear(opts.Filter); near {
+		return &scanIterator{cancel: cancel, err: fmt.Errorf("%w: $near cannot be streamed", query.ErrInvalidOptions)}
+	}
+
+	return e.newScanIterator(x, cancel, collection, opts)
+}
+
+// newScanIterator starts a scan with a validated filter
+func (e *Engine) newScanIterator(x *execution, cancel context.CancelFunc, collection string, opts ScanOptions) *scanIterator {
+	it := &scanIterator{
+		engine: e,
+		x:      x,
+		cancel: cancel,
+		prefix: collection + ":",
+		opts:   opts,
+	}
+
+	// Index candidates are a list of IDs, read in batches like keys
+	e.mu.RLock()
+	ids, ok := e.indexes.Lookup(collection, it.opts.Filter)
+	if !ok {
+		ids, ok = e.indexes.GeoLookup(collection, it.opts.Filter)
+	}
+	e.mu.RUnlock()
+	if ok {
+		it.ids, it.indexed = ids, true
+	}
+
+	return it
+}
+
+// seek moves a scan that has not started to the documents after id, in ID
+// order. Index candidates are put in ID order for it.
+func (it *scanIterator) seek(id string) {
+	if it.indexed {
+		ids := append([]string(nil), it.ids...)
+		sort.Strings(ids)
+		it.ids = ids[sort.Search(len(ids), func(i int) bool { return ids[i] > id }):]
+		return
+	}
+	it.after = it.prefix + id
+}
+
+type scanIterator struct {
+	engine  *Engine
+	x       *execution
+	cancel  context.CancelFunc
+	prefix  string
+	opts    ScanOptions
+	indexed bool
+	ids     []string // remaining index candidates
+	after   string   // last key read when scanning keys
+	done    bool     // no more batches to read
+	batch   []*Document
+	pos     int
+	doc     *Document
+	skipped int
+	count   int
+	closed  bool
+	err     error
+}
+
+func (it *scanIterator) Next() bool {
+	it.doc = nil
+	it.x.renew()
+	for {
+		if it.err != nil || it.closed {
+			return false
+		}
+		if it.opts.Limit > 0 && it.count >= it.opts.Limit {
+			return false
+		}
+		if err := it.x.check(); err != nil {
+			it.err = err
+			return false
+		}
+
+		if it.pos < len(it.batch) {
+			doc := it.batch[it.pos]
+			it.pos++
+			if err := it.x.scan(); err != nil {
+				it.err = err
+				return false
+			}
+			if !it.engine.matchesFilter(doc, it.opts.Filter) {
+				continue
+			}
+			if it.skipped < it.opts.Offset {
+				it.skipped++
+				continue
+			}
+			if err := it.x.returned(it.count + 1); err != nil {
+				it.err = err
+				return false
+			}
+			it.doc = projectDocument(doc, it.opts.Fields)
+			it.count++
+			return true
+		}
+
+		if it.done {
+			return false
+		}
+		it.readBatch()
+	}
+}
+
+func (it *scanIterator) Document() *Document {
+	return it.doc
+}
+
+func (it *scanIterator) Err() error {
+	return it.err
+}
+
+func (it *scanIterator) Close() error {
+	it.cancel()
+	it.closed = true
+	it.batch, it.ids, it.doc = nil, nil, nil
+	return nil
+}
+
+// readBatch reads the documents of the next batch of keys. Next matches
+// them and counts them as scanned, so a scan that stops early is not
+// charged for the rest of its batch; documents are never changed in place,
+// so that needs no lock.
+func (it *scanIterator) readBatch() {
+	e := it.engine
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	it.batch, it.pos = it.batch[:0], 0
+
+	if it.indexed {
+		n := len(it.ids)
+		if n > scanBatchSize {
+			n = scanBatchSize
+		}
+		for _, id := range it.ids[:n] {
+			if doc := e.getDocument(it.prefix + id); doc != nil {
+				it.batch = append(it.batch, doc)
+			}
+		}
+		it.ids = it.ids[n:]
+		it.done = len(it.ids) == 0
+		return
+	}
+
+	memKeys, memDocs := it.readKeys(e.memtable.Ascend)
+	diskKeys, diskDocs := it.readKeys(e.btree.Ascend)
+
+	// A source that filled its batch may hold more keys past its last one,
+	// so the batch ends at the smaller of those keys
+	memFull, diskFull := len(memKeys) == scanBatchSize, len(diskKeys) == scanBatchSize
+	end := ""
+	if memFull {
+		end = memKeys[len(memKeys)-1]
+	}
+	if diskFull && (end == "" || diskKeys[len(diskKeys)-1] < end) {
+		end = diskKeys[len(diskKeys)-1]
+	}
+	it.done = !memFull && !diskFull
+
+	// Merge in key order; the memtable holds the current version of a key
+	i, j := 0, 0
+	for i < len(memKeys) || j < len(diskKeys) {
+		var key string
+		var doc *Document
+		switch {
+		case j >= len(diskKeys) || (i < len(memKeys) && memKeys[i] <= diskKeys[j]):
+			key, doc = memKeys[i], memDocs[i]
+			if j < len(diskKeys) && diskKeys[j] == key {
+				j++
+			}
+			i++
+		default:
+			key, doc = diskKeys[j], diskDocs[j]
+			j++
+		}
+
+		if end != "" && key > end {
+			break
+		}
+		it.after = key
+		if doc != nil {
+			it.batch = append(it.batch, doc)
+		}
+	}
+}
+
+// readKeys reads up to a batch of keys after the last one read from an
+// ordered source
+func (it *scanIterator) readKeys(ascend func(prefix, after string, fn func(key string, value interface{}) bool)) ([]string, []*Document) {
+	keys := make([]string, 0, scanBatchSize)
+	docs := make([]*Document, 0, scanBatchSize)
+
+	ascend(it.prefix, it.after, func(key string, value interface{}) bool {
+		doc, _ := value.(*Document)
+		keys = append(keys, key)
+		docs = append(docs, doc)
+		return len(keys) < scanBatchSize
+	})
+
+	return keys, docs
+}
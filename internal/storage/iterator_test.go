@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"coffedb/internal/config"
+)
+
+func TestScanOutlivesQueryTimeoutWithSlowConsumer(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.QueryTimeout = 20
+	})
+	putItems(t, e, 5)
+
+	it := e.Scan(context.Background(), "items", ScanOptions{})
+	defer it.Close()
+
+	// The consumer takes longer than the query timeout over the whole
+	// stream, but the scan finds each document in time
+	read := 0
+	for it.Next() {
+		read++
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("scan ended with %v", err)
+	}
+	if read != 5 {
+		t.Errorf("read %d documents, want 5", read)
+	}
+}
+
+func TestScanIdlePeriodTimesOut(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.QueryTimeout = 5
+	})
+
+	x, cancel := e.beginScan(context.Background())
+	defer cancel()
+	if err := x.check(); err != nil {
+		t.Fatalf("check at start: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	var aborted *QueryAbortedError
+	if err := x.check(); !errors.As(err, &aborted) || aborted.Reason != AbortTimeout {
+		t.Fatalf("check after the idle period: %v, want a timeout", err)
+	}
+
+	x.renew()
+	if err := x.check(); err != nil {
+		t.Errorf("check after renew: %v", err)
+	}
+}
+
+func TestScanStopsWithContext(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it := e.Scan(ctx, "items", ScanOptions{})
+	defer it.Close()
+
+	if !it.Next() {
+		t.Fatalf("no first document: %v", it.Err())
+	}
+	cancel()
+	if it.Next() {
+		t.Fatalf("scan went on after its context ended")
+	}
+	if !errors.Is(it.Err(), ErrQueryAborted) {
+		t.Errorf("scan ended with %v, want ErrQueryAborted", it.Err())
+	}
+}
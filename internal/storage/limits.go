@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQueryAborted is matched by every QueryAbortedError
+var ErrQueryAborted = errors.New("query aborted")
+
+// Reasons a query is aborted
+const (
+	AbortTimeout     = "timeout"
+	AbortCanceled    = "canceled"
+	AbortMaxScanned  = "max_documents_scanned"
+	AbortMaxReturned = "max_documents_returned"
+)
+
+// checkInterval is the number of documents scanned between checks of the
+// query context
+const checkInterval = 64
+
+// QueryAbortedError reports a query stopped before it completed, because
+// its context ended or it went over a limit of the storage config
+type QueryAbortedError struct {
+	Reason string
+	Limit  int   // the limit exceeded, for the max_documents reasons
+	Err    error // the context error, for timeout and canceled
+}
+
+func (e *QueryAbortedError) Error() string {
+	switch e.Reason {
+	case AbortMaxScanned:
+		return fmt.Sprintf("query aborted: scanned more than %d documents", e.Limit)
+	case AbortMaxReturned:
+		return fmt.Sprintf("query aborted: returns more than %d documents", e.Limit)
+	case AbortCanceled:
+		return "query aborted: canceled"
+	}
+	return "query aborted: timed out"
+}
+
+func (e *QueryAbortedError) Is(target error) bool {
+	return target == ErrQueryAborted
+}
+
+func (e *QueryAbortedError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the query ran out of time or was canceled, as
+// opposed to going over a document limit
+func (e *QueryAbortedError) Timeout() bool {
+	return e.Reason == AbortTimeout || e.Reason == AbortCanceled
+}
+
+// execution tracks the work of one query against the limits of the
+// engine
+type execution struct {
+	ctx         context.Context
+	maxScanned  int
+	maxReturned int
+	scanned     int
+	idle        time.Duration // for streamed scans, the query timeout between documents
+	deadline    time.Time     // end of the current idle period
+}
+
+// begin starts tracking a query. The context is bounded by the query
+// timeout of the config; the returned cancel function releases it.
+func (e *Engine) begin(ctx context.Context) (*execution, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if e.config.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(e.config.QueryTimeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	return &execution{
+		ctx:         ctx,
+		maxScanned:  e.config.MaxScanned,
+		maxReturned: e.config.MaxReturned,
+	}, cancel
+}
+
+// beginScan starts tracking a streamed scan. A stream runs as long as its
+// consumer reads it, so the query timeout of the config bounds the time
+// taken to produce each document rather than the whole scan.
+func (e *Engine) beginScan(ctx context.Context) (*execution, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	x := &execution{
+		ctx:         ctx,
+		maxScanned:  e.config.MaxScanned,
+		maxReturned: e.config.MaxReturned,
+		idle:        time.Duration(e.config.QueryTimeout) * time.Millisecond,
+	}
+	x.renew()
+	return x, cancel
+}
+
+// renew starts a new idle period of a streamed scan
+func (x *execution) renew() {
+	if x.idle > 0 {
+		x.deadline = time.Now().Add(x.idle)
+	}
+}
+
+// scan counts a document read by the query
+func (x *execution) scan() error {
+	x.scanned++
+	if x.maxScanned > 0 && x.scanned > x.maxScanned {
+		return &QueryAbortedError{Reason: AbortMaxScanned, Limit: x.maxScanned}
+	}
+	if x.scanned%checkInterval == 0 {
+		return x.check()
+	}
+	return nil
+}
+
+// check returns an error once the query context or the idle period of a
+// streamed scan has ended
+func (x *execution) check() error {
+	if err := x.ctx.Err(); err != nil {
+		return abortError(err)
+	}
+	if x.idle > 0 && time.Now().After(x.deadline) {
+		return &QueryAbortedError{Reason: AbortTimeout, Err: context.DeadlineExceeded}
+	}
+	return nil
+}
+
+// returned checks the number of documents a query returns
+func (x *execution) returned(n int) error {
+	if x.maxReturned > 0 && n > x.maxReturned {
+		return &QueryAbortedError{Reason: AbortMaxReturned, Limit: x.maxReturned}
+	}
+	return nil
+}
+
+// abortError turns a context error into a QueryAbortedError and passes
+// other errors through
+func abortError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &QueryAbortedError{Reason: AbortTimeout, Err: err}
+	case errors.Is(err, context.Canceled):
+		return &QueryAbortedError{Reason: AbortCanceled, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"coffedb/internal/config"
+)
+
+func TestQueryStopsWhenContextEnds(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var aborted *QueryAbortedError
+	if _, err := e.Query(ctx, "items", nil); !errors.As(err, &aborted) || aborted.Reason != AbortCanceled || !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled query: %v, want canceled", err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := e.Query(ctx, "items", nil); !errors.As(err, &aborted) || !aborted.Timeout() || aborted.Reason != AbortTimeout {
+		t.Errorf("expired query: %v, want a timeout", err)
+	}
+}
+
+func TestQueryDocumentLimits(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxScanned = 100
+		cfg.MaxReturned = 10
+	})
+	putItems(t, e, 100)
+
+	var aborted *QueryAbortedError
+	if _, err := e.Query(context.Background(), "items", map[string]interface{}{"even": true}); !errors.As(err, &aborted) || aborted.Reason != AbortMaxReturned || aborted.Limit != 10 {
+		t.Errorf("query returning 50: %v, want max_documents_returned", err)
+	}
+	if docs, err := e.Query(context.Background(), "items", map[string]interface{}{"n": map[string]interface{}{"$lt": 5}}); err != nil || len(docs) != 5 {
+		t.Errorf("query returning 5 = %d documents, %v", len(docs), err)
+	}
+
+	mustPut(t, e, "items", "extra", map[string]interface{}{"rank": 99})
+	if _, err := e.Query(context.Background(), "items", map[string]interface{}{"rank": 99}); !errors.As(err, &aborted) || aborted.Reason != AbortMaxScanned || aborted.Limit != 100 {
+		t.Errorf("query scanning 101: %v, want max_documents_scanned", err)
+	}
+	if aborted.Timeout() {
+		t.Errorf("document limit reported as a timeout")
+	}
+}
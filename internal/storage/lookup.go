@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"coffedb/internal/query"
+)
+
+// joinFunc returns the documents of a collection whose field equals a
+// value
+type joinFunc func(value interface{}) ([]map[string]interface{}, error)
+
+// bindLookups sets how each $lookup of a pipeline finds the documents of
+// its foreign collection. Joins run while the pipeline is fed, so they
+// expect e.mu to be held.
+func (e *Engine) bindLookups(x *execution, pipeline *query.Pipeline) {
+	for _, lookup := range pipeline.Lookups() {
+		lookup.Join = e.joiner(x, lookup.From, lookup.ForeignField)
+	}
+}
+
+// joiner answers each value from an index on the foreign field when one
+// applies. Otherwise it scans the foreign collection once, on first use,
+// into a hash table keyed by field value.
+func (e *Engine) joiner(x *execution, collection, field string) joinFunc {
+	prefix := collection + ":"
+	var table map[string][]map[string]interface{}
+
+	return func(value interface{}) ([]map[string]interface{}, error) {
+		// $eq keeps values shaped like operators from being read as ones
+		match := map[string]interface{}{field: map[string]interface{}{"$eq": value}}
+
+		if ids, ok := e.indexes.Lookup(collection, map[string]interface{}{field: value}); ok {
+			docs := []map[string]interface{}{}
+			for _, id := range ids {
+				if err := x.scan(); err != nil {
+					return nil, err
+				}
+				if doc := e.getDocument(prefix + id); doc != nil && e.matchesFilter(doc, match) {
+					docs = append(docs, pipelineDocument(doc))
+				}
+			}
+			return docs, nil
+		}
+
+		if table == nil {
+			built, err := e.hashTable(x, collection, field)
+			if err != nil {
+				return nil, err
+			}
+			table = built
+		}
+		return table[query.ValueKey(value)], nil
+	}
+}
+
+// hashTable groups the documents of a collection by the value of a field.
+// A document holding an array is filed under each element as well.
+func (e *Engine) hashTable(x *execution, collection, field string) (map[string][]map[string]interface{}, error) {
+	table := make(map[string][]map[string]interface{})
+
+	err := e.scanLocked(x, collection, map[string]interface{}{}, func(doc *Document) bool {
+		var values []interface{}
+		if value, exists := query.LookupPath(doc.Data, field); exists {
+			values = append(values, value)
+		}
+		values = append(values, query.PathValues(doc.Data, field)...)
+
+		seen := make(map[string]bool)
+		for _, value := range values {
+			key := query.ValueKey(value)
+			if value == nil || seen[key] {
+				continue
+			}
+			seen[key] = true
+			table[key] = append(table[key], pipelineDocument(doc))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
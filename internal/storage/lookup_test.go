@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+// joinedIDs returns, per order, the IDs of the users joined to it
+func joinedIDs(t *testing.T, e *Engine) map[string][]interface{} {
+	t.Helper()
+
+	pipeline, err := query.ParsePipeline([]byte(`[{"$lookup": {"from": "users", "localField": "buyer", "foreignField": "handle", "as": "buyers"}}]`))
+	if err != nil {
+		t.Fatalf("ParsePipeline: %v", err)
+	}
+	results, err := e.Aggregate(context.Background(), "orders", pipeline)
+	if err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+
+	joined := make(map[string][]interface{})
+	for _, result := range results {
+		ids := []interface{}{}
+		for _, buyer := range result["buyers"].([]interface{}) {
+			ids = append(ids, buyer.(map[string]interface{})["_id"])
+		}
+		joined[result["_id"].(string)] = ids
+	}
+	return joined
+}
+
+func TestLookupJoinsWithAndWithoutIndex(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "users", "u1", map[string]interface{}{"handle": "ada"})
+	mustPut(t, e, "users", "u2", map[string]interface{}{"handle": []interface{}{"bob", "robert"}})
+	mustPut(t, e, "users", "u3", map[string]interface{}{"handle": "ada"})
+	mustPut(t, e, "orders", "o1", map[string]interface{}{"buyer": "ada"})
+	mustPut(t, e, "orders", "o2", map[string]interface{}{"buyer": []interface{}{"bob", "robert", "cy"}})
+	mustPut(t, e, "orders", "o3", map[string]interface{}{})
+	mustPut(t, e, "orders", "o4", map[string]interface{}{"buyer": map[string]interface{}{"$ne": "ada"}})
+
+	want := map[string][]interface{}{
+		"o1": {"u1", "u3"},
+		"o2": {"u2"},
+		"o3": {},
+		"o4": {},
+	}
+	if got := joinedIDs(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("hash join = %v, want %v", got, want)
+	}
+
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "handle", Collection: "users", Fields: []index.IndexField{{Path: "handle", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if got := joinedIDs(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("index join = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+
+	"coffedb/internal/query"
+)
+
+// UpdateResult reports the documents an UpdateMany matched, and how many
+// of them the update changed
+type UpdateResult struct {
+	Matched  int `json:"matched"`
+	Modified int `json:"modified"`
+}
+
+// DeleteResult reports the documents a DeleteMany removed
+type DeleteResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// UpdateMany applies update operators to every document of a collection
+// matching a filter. Documents the update leaves unchanged keep their
+// version. Either every matching document is updated or, if the update
+// fails for one, none is; the writes reach the WAL in a single batch.
+func (e *Engine) UpdateMany(collection string, filter map[string]interface{}, update *query.Update) (*UpdateResult, error) {
+	if err := query.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	matched, err := e.matchAllLocked(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	b := e.newBatch()
+	for _, doc := range matched {
+		data, err := update.Apply(doc.Data)
+		if err != nil {
+			b.rollback()
+			return nil, err
+		}
+		if query.ValuesEqual(data, doc.Data) {
+			continue
+		}
+		if _, err := b.put(collection, doc.ID, data); err != nil {
+			b.rollback()
+			return nil, err
+		}
+	}
+	if err := b.commit(); err != nil {
+		return nil, err
+	}
+
+	return &UpdateResult{Matched: len(matched), Modified: b.len()}, nil
+}
+
+// DeleteMany removes every document of a collection matching a filter,
+// with a single WAL batch. An empty filter removes them all.
+func (e *Engine) DeleteMany(collection string, filter map[string]interface{}) (*DeleteResult, error) {
+	if err := query.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	matched, err := e.matchAllLocked(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	b := e.newBatch()
+	for _, doc := range matched {
+		b.delete(collection, doc.ID)
+	}
+	if err := b.commit(); err != nil {
+		return nil, err
+	}
+
+	return &DeleteResult{Deleted: b.len()}, nil
+}
+
+// matchAllLocked collects the documents matching a filter. Writes are not
+// bound by the query limits.
+func (e *Engine) matchAllLocked(collection string, filter map[string]interface{}) ([]*Document, error) {
+	var matched []*Document
+	err := e.scanLocked(&execution{ctx: context.Background()}, collection, filter, func(doc *Document) bool {
+		matched = append(matched, doc)
+		return true
+	})
+	return matched, err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"coffedb/internal/config"
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+func mustUpdate(t *testing.T, spec map[string]interface{}) *query.Update {
+	t.Helper()
+
+	update, err := query.ParseUpdate(spec)
+	if err != nil {
+		t.Fatalf("ParseUpdate: %v", err)
+	}
+	return update
+}
+
+func TestUpdateManyCountsAndVersions(t *testing.T) {
+	e := newTestEngine(t, func(cfg *config.StorageConfig) {
+		cfg.MaxScanned = 5
+	})
+	putItems(t, e, 20)
+
+	// Writes are not bound by the query limits; odd items already match
+	result, err := e.UpdateMany("items", map[string]interface{}{"rank": map[string]interface{}{"$lt": 2}},
+		mustUpdate(t, map[string]interface{}{"$set": map[string]interface{}{"even": false}}))
+	if err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	if result.Matched != 6 || result.Modified != 3 {
+		t.Errorf("result = %+v, want 6 matched and 3 modified", result)
+	}
+
+	for id, version := range map[string]int64{"i000": 2, "i001": 1, "i007": 1, "i014": 2} {
+		doc, err := e.Get("items", id)
+		if err != nil {
+			t.Fatalf("Get %s: %v", id, err)
+		}
+		if doc.Version != version || doc.Data["even"] != false {
+			t.Errorf("%s = version %d, %v, want version %d and not even", id, doc.Version, doc.Data, version)
+		}
+	}
+}
+
+func TestUpdateManyIsAllOrNothing(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "users", "u1", map[string]interface{}{"email": "a@example.com", "n": 1.0})
+	mustPut(t, e, "users", "u2", map[string]interface{}{"email": "b@example.com", "n": "two"})
+	mustPut(t, e, "users", "u3", map[string]interface{}{"email": "c@example.com", "n": 3.0})
+
+	// The second document fails the update after the first was changed
+	_, err := e.UpdateMany("users", nil, mustUpdate(t, map[string]interface{}{"$inc": map[string]interface{}{"n": 1.0}}))
+	if !errors.Is(err, query.ErrPatchFailed) {
+		t.Fatalf("UpdateMany over a string: %v, want ErrPatchFailed", err)
+	}
+	if doc, _ := e.Get("users", "u1"); doc.Data["n"] != 1.0 || doc.Version != 1 {
+		t.Errorf("u1 = %v version %d after the failed update, want it unchanged", doc.Data, doc.Version)
+	}
+
+	// A unique index rejects the whole update as well
+	if _, err := e.CreateIndex(emailIndex); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	var duplicate *index.DuplicateKeyError
+	_, err = e.UpdateMany("users", nil, mustUpdate(t, map[string]interface{}{"$set": map[string]interface{}{"email": "same@example.com"}}))
+	if !errors.As(err, &duplicate) {
+		t.Fatalf("UpdateMany to one address: %v, want a DuplicateKeyError", err)
+	}
+	for id, email := range map[string]string{"u1": "a@example.com", "u2": "b@example.com", "u3": "c@example.com"} {
+		if doc, _ := e.Get("users", id); doc.Data["email"] != email {
+			t.Errorf("%s email = %v after the failed update, want %s", id, doc.Data["email"], email)
+		}
+		if ids, _ := e.indexes.Lookup("users", map[string]interface{}{"email": email}); len(ids) != 1 || ids[0] != id {
+			t.Errorf("index has %s -> %v, want [%s]", email, ids, id)
+		}
+	}
+}
+
+func TestDeleteManyWritesOneBatch(t *testing.T) {
+	e := newTestEngine(t, nil)
+	putItems(t, e, 20)
+	before := e.ChangeSeq()
+
+	result, err := e.DeleteMany("items", map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	if result.Deleted != 10 {
+		t.Errorf("deleted %d, want 10", result.Deleted)
+	}
+	if seq := e.ChangeSeq(); seq != before+10 {
+		t.Errorf("WAL advanced by %d entries, want 10", seq-before)
+	}
+
+	// The deletes survive a restart
+	e = reopen(t, e)
+	if info, err := e.GetCollection("items"); err != nil || info.Documents != 10 {
+		t.Errorf("collection after reopen = %+v, %v, want 10 documents", info, err)
+	}
+	if doc, err := e.Get("items", "i000"); err == nil {
+		t.Errorf("deleted item after reopen = %v, want an error", doc)
+	}
+}
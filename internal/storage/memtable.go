@@ -157,20 +157,50 @@ func (mt *Memtable) Delete(key string) bool {
 	return false
 }
 
+// DeleteRange removes every key with the given prefix and returns how
+// many were removed
+func (mt *Memtable) DeleteRange(prefix string) int {
+	var keys []string
+	mt.Ascend(prefix, "", func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	for _, key := range keys {
+		mt.Delete(key)
+	}
+	return len(keys)
+}
+
 // Range iterates over keys with given prefix
 func (mt *Memtable) Range(prefix string, fn func(key string, value interface{}) bool) {
+	mt.Ascend(prefix, "", fn)
+}
+
+// Ascend iterates in key order over the keys with the given prefix that
+// sort after the given key, until fn returns false
+func (mt *Memtable) Ascend(prefix, after string, fn func(key string, value interface{}) bool) {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
 	
-	current := mt.header.forward[0]
+	// Skip to the first key at or past the start of the range
+	start := prefix
+	if after > start {
+		start = after
+	}
+	current := mt.header
+	for i := mt.level; i >= 0; i-- {
+		for current.forward[i] != nil && current.forward[i].key < start {
+			current = current.forward[i]
+		}
+	}
+	current = current.forward[0]
 	
-	for current != nil {
-		if strings.HasPrefix(current.key, prefix) {
-			// Check TTL
-			if current.ttl == nil || time.Now().Before(*current.ttl) {
-				if !fn(current.key, current.value) {
-					break
-				}
+	for current != nil && strings.HasPrefix(current.key, prefix) {
+		// Check TTL
+		if current.key > after && (current.ttl == nil || time.Now().Before(*current.ttl)) {
+			if !fn(current.key, current.value) {
+				break
 			}
 		}
 		current = current.forward[0]
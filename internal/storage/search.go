@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+
+	"coffedb/internal/index"
+	"coffedb/internal/query"
+)
+
+// SearchResult is a document matched by a full-text search
+type SearchResult struct {
+	Document   *Document         `json:"document"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// Search runs a full-text query against a text index of the collection
+// and returns up to limit results, best first. indexName may be empty if
+// the collection has a single text index.
+func (e *Engine) Search(collection, indexName, q string, limit int) ([]SearchResult, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	idx, err := e.indexes.TextIndex(collection, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	def := idx.Definition()
+	parsed := index.ParseTextQuery(q, def.Language)
+	results := []SearchResult{}
+	if parsed.Empty() {
+		return results, nil
+	}
+
+	prefix := collection + ":"
+	for _, hit := range idx.SearchText(parsed) {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+
+		doc := e.getDocument(prefix + hit.DocID)
+		if doc == nil {
+			continue
+		}
+
+		// Candidates hold every phrase term; check they are adjacent
+		if len(parsed.Phrases) > 0 && !index.MatchPhrases(doc.Data, def, parsed.Phrases) {
+			continue
+		}
+
+		results = append(results, SearchResult{
+			Document:   doc,
+			Score:      hit.Score,
+			Highlights: index.Highlight(doc.Data, def, parsed),
+		})
+	}
+
+	return results, nil
+}
+
+// vectorOversample is how many more nearest neighbours than requested are
+// fetched when a filter may reject some of them
+const vectorOversample = 10
+
+// VectorQuery is a k-nearest-neighbour search, optionally restricted to
+// documents matching a filter
+type VectorQuery struct {
+	Index  string                 `json:"index"`
+	Vector []float64              `json:"vector"`
+	K      int                    `json:"k"`
+	Filter map[string]interface{} `json:"filter"`
+	Probes int                    `json:"probes"` // lists scanned; 0 picks a default
+	Exact  bool                   `json:"exact"`  // compare with every vector
+}
+
+// VectorResult is a document matched by a vector search
+type VectorResult struct {
+	Document *Document `json:"document"`
+	Score    float64   `json:"score"`
+}
+
+// VectorSearch returns the k documents closest to the query vector that
+// match its filter, closest first. The approximate search is completed
+// with an exact one when it finds fewer than k matches.
+func (e *Engine) VectorSearch(collection string, q VectorQuery) ([]VectorResult, error) {
+	if err := query.ValidateFilter(q.Filter); err != nil {
+		return nil, err
+	}
+	if q.K <= 0 {
+		q.K = 10
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	idx, err := e.indexes.VectorIndex(collection, q.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	vector, ok := index.ParseVector(q.Vector, idx.Definition().Dimensions)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected %d dimensions, got %d", index.ErrInvalidVector, idx.Definition().Dimensions, len(q.Vector))
+	}
+
+	prefix := collection + ":"
+	collect := func(hits []index.VectorHit) []VectorResult {
+		results := []VectorResult{}
+		for _, hit := range hits {
+			if len(results) >= q.K {
+				break
+			}
+			doc := e.getDocument(prefix + hit.DocID)
+			if doc == nil || !e.matchesFilter(doc, q.Filter) {
+				continue
+			}
+			results = append(results, VectorResult{Document: doc, Score: hit.Score})
+		}
+		return results
+	}
+
+	want := q.K
+	if len(q.Filter) > 0 {
+		want *= vectorOversample
+	}
+	hits, err := idx.SearchVector(vector, want, q.Probes, q.Exact)
+	if err != nil {
+		return nil, err
+	}
+	results := collect(hits)
+
+	if len(results) < q.K && !q.Exact {
+		if hits, err = idx.SearchVector(vector, 0, 0, true); err != nil {
+			return nil, err
+		}
+		results = collect(hits)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"coffedb/internal/index"
+)
+
+// searchIDs runs a full-text search and returns the IDs of the results
+func searchIDs(t *testing.T, e *Engine, q string) []string {
+	t.Helper()
+
+	results, err := e.Search("posts", "", q, 0)
+	if err != nil {
+		t.Fatalf("Search %q: %v", q, err)
+	}
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Document.ID)
+	}
+	return ids
+}
+
+func TestSearchMatchesPhrasesAndHighlights(t *testing.T) {
+	e := newTestEngine(t, nil)
+	if _, err := e.Search("posts", "", "fox", 0); !errors.Is(err, index.ErrNoTextIndex) {
+		t.Fatalf("Search without an index: %v, want ErrNoTextIndex", err)
+	}
+
+	mustPut(t, e, "posts", "p1", map[string]interface{}{"title": "The quick brown fox"})
+	mustPut(t, e, "posts", "p2", map[string]interface{}{"title": "A brown and quick fox"})
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "text", Collection: "posts", Type: index.IndexTypeText, Fields: []index.IndexField{{Path: "title", Order: 1}}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	if ids := searchIDs(t, e, "fox"); len(ids) != 2 {
+		t.Errorf("fox -> %v, want both posts", ids)
+	}
+	if ids := searchIDs(t, e, `"quick brown"`); len(ids) != 1 || ids[0] != "p1" {
+		t.Errorf("phrase -> %v, want [p1]", ids)
+	}
+
+	results, err := e.Search("posts", "text", "foxes", 1)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 1 || results[0].Highlights["title"] == "" {
+		t.Fatalf("results = %+v, want one with a highlight", results)
+	}
+	if got := results[0].Highlights["title"]; got != "The quick brown <em>fox</em>" && got != "A brown and quick <em>fox</em>" {
+		t.Errorf("highlight = %q", got)
+	}
+
+	// The index follows writes
+	mustPut(t, e, "posts", "p1", map[string]interface{}{"title": "A slow red hen"})
+	if ids := searchIDs(t, e, `"quick brown"`); len(ids) != 0 {
+		t.Errorf("phrase after update -> %v, want nothing", ids)
+	}
+	if ids := searchIDs(t, e, "hen"); len(ids) != 1 || ids[0] != "p1" {
+		t.Errorf("hen -> %v, want [p1]", ids)
+	}
+}
+
+func TestVectorSearchFiltersResults(t *testing.T) {
+	e := newTestEngine(t, nil)
+	for i := 0; i < 20; i++ {
+		mustPut(t, e, "items", fmt.Sprintf("i%02d", i), map[string]interface{}{
+			"embedding": []interface{}{float64(i), 1.0},
+			"even":      i%2 == 0,
+		})
+	}
+	if _, err := e.CreateIndex(index.IndexDefinition{Name: "embedding", Collection: "items", Type: index.IndexTypeVector,
+		Fields: []index.IndexField{{Path: "embedding", Order: 1}}, Dimensions: 2, Metric: index.MetricL2}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	results, err := e.VectorSearch("items", VectorQuery{Vector: []float64{6.9, 1}, K: 3, Filter: map[string]interface{}{"even": false}})
+	if err != nil {
+		t.Fatalf("VectorSearch: %v", err)
+	}
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.Document.ID)
+	}
+	if want := []string{"i07", "i05", "i09"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("odd items nearest 6.9 = %v, want %v", ids, want)
+	}
+
+	if _, err := e.VectorSearch("items", VectorQuery{Vector: []float64{1, 2, 3}}); !errors.Is(err, index.ErrInvalidVector) {
+		t.Errorf("search with 3 dimensions: %v, want ErrInvalidVector", err)
+	}
+}
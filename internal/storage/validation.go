@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"coffedb/internal/query"
+)
+
+// ErrSchemaNotFound is returned for a collection without a schema
+var ErrSchemaNotFound = errors.New("collection has no schema")
+
+// Validation actions: reject invalid writes, or accept them and log a
+// warning
+const (
+	ValidationActionError = "error"
+	ValidationActionWarn  = "warn"
+)
+
+// Validator is the schema a collection's documents are checked against
+// on every write
+type Validator struct {
+	Schema map[string]interface{} `json:"schema"`
+	Action string                 `json:"validationAction"`
+
+	schema *query.Schema
+}
+
+// NewValidator compiles a schema; the action defaults to error
+func NewValidator(schema map[string]interface{}, action string) (*Validator, error) {
+	if action == "" {
+		action = ValidationActionError
+	}
+	if action != ValidationActionError && action != ValidationActionWarn {
+		return nil, fmt.Errorf("%w: validationAction must be %q or %q", query.ErrInvalidSchema, ValidationActionError, ValidationActionWarn)
+	}
+
+	compiled, err := query.ParseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{Schema: schema, Action: action, schema: compiled}, nil
+}
+
+// compile prepares a validator loaded from the catalog
+func (v *Validator) compile() error {
+	compiled, err := query.ParseSchema(v.Schema)
+	if err != nil {
+		return err
+	}
+	v.schema = compiled
+	return nil
+}
+
+// ValidationReport lists the documents of a collection that do not match
+// a schema. Invalid counts them all; Documents holds the first of them.
+type ValidationReport struct {
+	Checked   int               `json:"checked"`
+	Invalid   int               `json:"invalid"`
+	Documents []InvalidDocument `json:"documents"`
+}
+
+// InvalidDocument is a document failing a schema, with the reasons
+type InvalidDocument struct {
+	ID         string            `json:"id"`
+	Violations []query.Violation `json:"violations"`
+}
+
+// SetSchema sets the schema of a collection, which is created if needed.
+// Only later writes are checked; use ValidateCollection to find existing
+// documents that do not match.
+func (e *Engine) SetSchema(collection string, validator *Validator) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	def := e.catalog.collection(collection)
+	if def == nil {
+		e.catalog.addCollection(CollectionDefinition{Name: collection, CreatedAt: time.Now()})
+		def = e.catalog.collection(collection)
+	}
+
+	previous := def.Validator
+	def.Validator = validator
+	if err := e.catalog.save(); err != nil {
+		def.Validator = previous
+		return fmt.Errorf("failed to save catalog: %w", err)
+	}
+	return nil
+}
+
+// GetSchema returns the schema of a collection
+func (e *Engine) GetSchema(collection string) (*Validator, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	def := e.catalog.collection(collection)
+	if def == nil {
+		return nil, ErrCollectionNotFound
+	}
+	if def.Validator == nil {
+		return nil, ErrSchemaNotFound
+	}
+	return def.Validator, nil
+}
+
+// RemoveSchema stops validating the documents of a collection
+func (e *Engine) RemoveSchema(collection string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	def := e.catalog.collection(collection)
+	if def == nil {
+		return ErrCollectionNotFound
+	}
+	if def.Validator == nil {
+		return ErrSchemaNotFound
+	}
+
+	previous := def.Validator
+	def.Validator = nil
+	if err := e.catalog.save(); err != nil {
+		def.Validator = previous
+		return fmt.Errorf("failed to save catalog: %w", err)
+	}
+	return nil
+}
+
+// ValidateCollection checks the documents of a collection against a
+// schema, the collection's own when validator is nil, and reports up to
+// limit invalid documents. It is not bound by the query limits, only by
+// the context.
+func (e *Engine) ValidateCollection(ctx context.Context, collection string, validator *Validator, limit int) (*ValidationReport, error) {
+	if validator == nil {
+		var err error
+		if validator, err = e.GetSchema(collection); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ValidationReport{Documents: []InvalidDocument{}}
+	err := e.scanMatching(&execution{ctx: ctx}, collection, nil, func(doc *Document) bool {
+		report.Checked++
+		if violations := validator.schema.Validate(doc.Data); violations != nil {
+			report.Invalid++
+			if len(report.Documents) < limit {
+				report.Documents = append(report.Documents, InvalidDocument{ID: doc.ID, Violations: violations})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// validate checks a document write against the schema of its collection.
+// Under the warn action invalid documents are logged and accepted.
+func (e *Engine) validate(collection, id string, data map[string]interface{}) error {
+	def := e.catalog.collection(collection)
+	if def == nil || def.Validator == nil {
+		return nil
+	}
+
+	violations := def.Validator.schema.Validate(data)
+	if violations == nil {
+		return nil
+	}
+
+	err := &query.ValidationError{Violations: violations}
+	if def.Validator.Action == ValidationActionWarn {
+		log.Printf("document %s in %s: %v", id, collection, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"coffedb/internal/query"
+)
+
+var ageSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"age"},
+	"properties": map[string]interface{}{
+		"age": map[string]interface{}{"type": "integer", "minimum": 0.0},
+	},
+}
+
+func TestSchemaChecksWrites(t *testing.T) {
+	e := newTestEngine(t, nil)
+	mustPut(t, e, "users", "old", map[string]interface{}{"name": "Ada"})
+
+	validator, err := NewValidator(ageSchema, "")
+	if err != nil {
+		t.Fatalf("NewValidator: %v", err)
+	}
+	if err := e.SetSchema("users", validator); err != nil {
+		t.Fatalf("SetSchema: %v", err)
+	}
+
+	var invalid *query.ValidationError
+	if err := e.Put("users", "u1", map[string]interface{}{"age": -1.0}); !errors.As(err, &invalid) || len(invalid.Violations) != 1 {
+		t.Errorf("Put of an invalid document: %v, want one violation", err)
+	}
+	if _, err := e.Get("users", "u1"); err == nil {
+		t.Error("the invalid document was written")
+	}
+	mustPut(t, e, "users", "u2", map[string]interface{}{"age": 30.0})
+
+	// Updates and bulk writes are checked as well
+	update, _ := query.ParseUpdate(map[string]interface{}{"$unset": map[string]interface{}{"age": ""}})
+	if _, err := e.Update("users", "u2", update, UpdateOptions{}); !errors.As(err, &invalid) {
+		t.Errorf("Update removing a required field: %v, want a ValidationError", err)
+	}
+	results, err := e.Bulk("users", []BulkOperation{{Op: BulkInsert, ID: "u3", Document: map[string]interface{}{"age": "x"}}}, true)
+	if err != nil || !errors.As(results[0].Err, &invalid) {
+		t.Errorf("Bulk insert of an invalid document: %v, %v, want a ValidationError", results, err)
+	}
+
+	// Existing documents are only reported
+	report, err := e.ValidateCollection(context.Background(), "users", nil, 10)
+	if err != nil {
+		t.Fatalf("ValidateCollection: %v", err)
+	}
+	if report.Checked != 2 || report.Invalid != 1 || report.Documents[0].ID != "old" {
+		t.Errorf("report = %+v, want old as the one invalid document of 2", report)
+	}
+
+	// The schema is kept in the catalog
+	e = reopen(t, e)
+	if err := e.Put("users", "u4", map[string]interface{}{}); !errors.As(err, &invalid) {
+		t.Errorf("Put after reopen: %v, want a ValidationError", err)
+	}
+
+	if err := e.RemoveSchema("users"); err != nil {
+		t.Fatalf("RemoveSchema: %v", err)
+	}
+	mustPut(t, e, "users", "u4", map[string]interface{}{})
+	if _, err := e.GetSchema("users"); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("GetSchema after removal: %v, want ErrSchemaNotFound", err)
+	}
+	if err := e.RemoveSchema("users"); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("second RemoveSchema: %v, want ErrSchemaNotFound", err)
+	}
+}
+
+func TestWarnActionAcceptsInvalidWrites(t *testing.T) {
+	e := newTestEngine(t, nil)
+
+	validator, err := NewValidator(ageSchema, ValidationActionWarn)
+	if err != nil {
+		t.Fatalf("NewValidator: %v", err)
+	}
+	if err := e.SetSchema("users", validator); err != nil {
+		t.Fatalf("SetSchema: %v", err)
+	}
+	mustPut(t, e, "users", "u1", map[string]interface{}{"age": -1.0})
+
+	if _, err := NewValidator(ageSchema, "ignore"); !errors.Is(err, query.ErrInvalidSchema) {
+		t.Errorf("NewValidator with an unknown action: %v, want ErrInvalidSchema", err)
+	}
+}
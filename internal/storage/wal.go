@@ -2,17 +2,27 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"sync"
 	"time"
+
+	"coffedb/internal/fileutil"
+	"coffedb/internal/index"
 )
 
 // Add this function
 func init() {
     // Register the Document type with gob
     gob.Register(&Document{})
+    gob.Register(map[string]interface{}{})
+    gob.Register([]interface{}{})
 }
 
 
@@ -23,26 +33,67 @@ const (
 	WALPut WALEntryType = iota
 	WALDelete
 	WALTransaction
+	WALDeleteRange      // removes every document of the collection named by Key
+	WALRenameCollection // moves the collection named by Key to the name in Value
 )
 
-// WALEntry represents an entry in the write-ahead log
+// WALEntry represents an entry in the write-ahead log. Seq numbers the
+// entries in write order; Previous is the document a put or delete
+// replaced, which makes the log a change feed. More marks an entry that
+// more entries of its batch follow, so the last entry of a batch commits
+// it.
 type WALEntry struct {
+	Seq       uint64        `json:"seq"`
+	More      bool          `json:"more,omitempty"`
 	Type      WALEntryType  `json:"type"`
 	Key       string        `json:"key"`
 	Value     interface{}   `json:"value,omitempty"`
+	Previous  *Document     `json:"previous,omitempty"`
 	Timestamp time.Time     `json:"timestamp"`
 	TxnID     string        `json:"txn_id,omitempty"`
+	IndexOps  []index.IndexOp `json:"index_ops,omitempty"`
+}
+
+// ErrCorruptWAL is returned when an entry before the end of the log cannot
+// be read. Only the last entry may be incomplete, from a torn write.
+var ErrCorruptWAL = errors.New("WAL is corrupt")
+
+// walMagic starts every log. Each entry after it is a self-contained gob
+// stream prefixed with its length, so entries written by different
+// encoders can be read back in order. Logs without it hold a single gob
+// stream, as written before entries were framed, and are rewritten in the
+// framed format when opened.
+var walMagic = []byte("CDBWAL\x00\x01")
+
+// walIndexInterval is the number of entries between the positions the WAL
+// keeps to find entries by sequence number
+const walIndexInterval = 1024
+
+// walMark is the position in the log of the entry numbered seq
+type walMark struct {
+	seq    uint64
+	offset int64
 }
 
 // WAL represents the write-ahead log
 type WAL struct {
 	file   *os.File
 	writer *bufio.Writer
+	seq    uint64    // sequence number of the last entry written
+	size   int64     // end of the last entry written
+	marks  []walMark // positions of every walIndexInterval-th entry
 	mu     sync.Mutex
 }
 
-// NewWAL creates a new write-ahead log
+// NewWAL creates a new write-ahead log, or opens an existing one. Logs in
+// an older format are upgraded, and a torn last entry is cut off so that
+// new entries follow the complete ones.
 func NewWAL(filename string) (*WAL, error) {
+	marks, size, err := prepareWAL(filename)
+	if err != nil {
+		return nil, err
+	}
+
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
@@ -51,33 +102,307 @@ func NewWAL(filename string) (*WAL, error) {
 	return &WAL{
 		file:   file,
 		writer: bufio.NewWriter(file),
+		size:   size,
+		marks:  marks,
 	}, nil
 }
 
+// prepareWAL leaves the log at filename in the current format and ending
+// with a complete entry, creating it if it does not exist. It returns the
+// positions of the entries to keep and the size of the log.
+func prepareWAL(filename string) ([]walMark, int64, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+	if info.Size() == 0 {
+		if _, err := file.Write(walMagic); err != nil {
+			return nil, 0, fmt.Errorf("failed to write WAL header: %w", err)
+		}
+		return nil, int64(len(walMagic)), file.Sync()
+	}
+
+	header := make([]byte, len(walMagic))
+	if n, _ := io.ReadFull(file, header); n < len(header) || !bytes.Equal(header, walMagic) {
+		if err := upgradeWAL(filename, file); err != nil {
+			return nil, 0, err
+		}
+		return prepareWAL(filename)
+	}
+
+	var marks []walMark
+	start := int64(len(walMagic))
+	end, err := readFrames(bufio.NewReader(file), info.Size()-start, func(entry WALEntry, offset int64) {
+		if len(marks) == 0 || entry.Seq%walIndexInterval == 1 {
+			marks = append(marks, walMark{seq: entry.Seq, offset: start + offset})
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if end += start; end < info.Size() {
+		if err := file.Truncate(end); err != nil {
+			return nil, 0, fmt.Errorf("failed to truncate torn WAL entry: %w", err)
+		}
+		return marks, end, file.Sync()
+	}
+	return marks, end, nil
+}
+
+// upgradeWAL rewrites a log without a header in the current format. The
+// log is either a single gob stream, from before entries were framed, or
+// framed entries from before the header was added; a frame starts with the
+// high byte of its length, which is zero, and a gob stream never does.
+func upgradeWAL(filename string, file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read WAL: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+
+	var entries []WALEntry
+	collect := func(entry WALEntry, offset int64) {
+		entries = append(entries, entry)
+	}
+
+	reader := bufio.NewReader(file)
+	if first, err := reader.Peek(1); err == nil && first[0] == 0 {
+		if _, err := readFrames(reader, info.Size(), collect); err != nil {
+			return err
+		}
+	} else if err := readGobStream(reader, collect); err != nil {
+		return err
+	}
+	numberEntries(entries)
+
+	err = fileutil.WriteAtomic(filename, func(w io.Writer) error {
+		writer := bufio.NewWriter(w)
+		if _, err := writer.Write(walMagic); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if _, err := writeFrame(writer, entry); err != nil {
+				return err
+			}
+		}
+		return writer.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upgrade WAL: %w", err)
+	}
+	return nil
+}
+
+// readGobStream decodes a log written as a single gob stream. A stream cut
+// short ends it; any other decoding error is corruption.
+func readGobStream(r io.Reader, fn func(WALEntry, int64)) error {
+	decoder := gob.NewDecoder(r)
+	for {
+		var entry WALEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptWAL, err)
+		}
+		fn(entry, 0)
+	}
+}
+
+// readFrames decodes the framed entries in the size bytes of r, calling fn
+// for each with its offset in r, and returns the number of bytes of
+// complete batches. An entry cut short by the end of the log is a torn
+// write and ends it, dropping the rest of its batch; an entry that cannot
+// be decoded before the end of the log is corruption.
+func readFrames(r *bufio.Reader, size int64, fn func(WALEntry, int64)) (int64, error) {
+	type frame struct {
+		entry  WALEntry
+		offset int64
+	}
+	var batch []frame
+	var offset, committed int64
+
+	for n := 1; ; n++ {
+		var header [4]byte
+		if offset+int64(len(header)) > size {
+			return committed, nil
+		}
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return committed, nil
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:]))
+		next := offset + int64(len(header)) + length
+		if next > size {
+			return committed, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return committed, nil
+		}
+
+		var entry WALEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+			if next == size {
+				return committed, nil
+			}
+			return committed, fmt.Errorf("%w: entry %d: %v", ErrCorruptWAL, n, err)
+		}
+		batch = append(batch, frame{entry, offset})
+		offset = next
+
+		if entry.More {
+			continue
+		}
+		for _, f := range batch {
+			fn(f.entry, f.offset)
+		}
+		batch = batch[:0]
+		committed = offset
+	}
+}
+
+// writeFrame writes an entry as a gob stream prefixed with its length and
+// returns the number of bytes written
+func writeFrame(w io.Writer, entry WALEntry) (int64, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return 0, fmt.Errorf("failed to encode WAL entry: %w", err)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(buf.Len()))
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, fmt.Errorf("failed to write WAL entry: %w", err)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write WAL entry: %w", err)
+	}
+	return int64(len(header) + buf.Len()), nil
+}
+
+// numberEntries numbers by position the entries written before entries
+// were numbered
+func numberEntries(entries []WALEntry) {
+	for i := range entries {
+		if entries[i].Seq == 0 {
+			entries[i].Seq = 1
+			if i > 0 {
+				entries[i].Seq = entries[i-1].Seq + 1
+			}
+		}
+	}
+}
+
 // WriteEntry writes an entry to the WAL
 func (w *WAL) WriteEntry(entry WALEntry) error {
+	return w.WriteBatch([]WALEntry{entry})
+}
+
+// WriteBatch writes several entries to the WAL with a single sync,
+// numbering them in place. After a crash a batch is replayed whole or not
+// at all. A batch that fails leaves nothing behind, so that no later
+// write can make it durable.
+func (w *WAL) WriteBatch(entries []WALEntry) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	encoder := gob.NewEncoder(w.writer)
-	if err := encoder.Encode(entry); err != nil {
-		return fmt.Errorf("failed to encode WAL entry: %w", err)
+	seq := w.seq
+	size, marks, err := w.appendBatch(entries)
+	if err != nil {
+		w.seq = seq
+		w.writer.Reset(w.file)
+		if truncErr := w.file.Truncate(w.size); truncErr != nil {
+			return fmt.Errorf("%w; failed to roll back WAL: %v", err, truncErr)
+		}
+		return err
+	}
+
+	w.size, w.marks = size, marks
+	return nil
+}
+
+// appendBatch writes and syncs the entries of a batch after the last
+// entry, returning the new end of the log and its positions
+func (w *WAL) appendBatch(entries []WALEntry) (int64, []walMark, error) {
+	size, marks := w.size, w.marks
+	for i := range entries {
+		w.seq++
+		entries[i].Seq = w.seq
+		entries[i].More = i < len(entries)-1
+		if len(marks) == 0 || w.seq%walIndexInterval == 1 {
+			marks = append(marks, walMark{seq: w.seq, offset: size})
+		}
+
+		n, err := writeFrame(w.writer, entries[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		size += n
 	}
 
 	// Flush to ensure durability
 	if err := w.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush WAL: %w", err)
+		return 0, nil, fmt.Errorf("failed to flush WAL: %w", err)
 	}
 
 	if err := w.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync WAL: %w", err)
+		return 0, nil, fmt.Errorf("failed to sync WAL: %w", err)
 	}
 
-	return nil
+	return size, marks, nil
 }
 
-// ReadEntries reads all entries from the WAL for recovery
+// ReadEntries reads all entries from the WAL, for recovery
 func (w *WAL) ReadEntries() ([]WALEntry, error) {
+	return w.ReadEntriesAfter(0, 0)
+}
+
+// ReadEntriesAfter reads the entries numbered after seq, to replay
+// changes. Reading starts from the closest position the WAL keeps before
+// them rather than from the start of the log. With a positive limit,
+// reading stops at the first kept position past limit more entries, so
+// that a long log can be replayed a chunk at a time; a batch is never
+// split, and at least one is read if any follows seq.
+func (w *WAL) ReadEntriesAfter(seq uint64, limit int) ([]WALEntry, error) {
+	w.mu.Lock()
+	start := int64(len(walMagic))
+	if i := sort.Search(len(w.marks), func(i int) bool { return w.marks[i].seq > seq+1 }); i > 0 {
+		start = w.marks[i-1].offset
+	}
+	var ends []int64
+	if limit > 0 {
+		i := sort.Search(len(w.marks), func(i int) bool { return w.marks[i].seq > seq+uint64(limit) })
+		for _, mark := range w.marks[i:] {
+			ends = append(ends, mark.offset)
+		}
+	}
+	ends = append(ends, w.size)
+	w.mu.Unlock()
+
+	// A batch running past an end is left out, so read on to the next one
+	// until a whole batch is read
+	for _, end := range ends {
+		entries, err := w.readRange(start, end, seq)
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+	}
+	return nil, nil
+}
+
+// readRange reads the entries numbered after seq from the complete
+// batches between the offsets start and end of the log
+func (w *WAL) readRange(start, end int64, seq uint64) ([]WALEntry, error) {
 	// Open file for reading
 	file, err := os.Open(w.file.Name())
 	if err != nil {
@@ -85,20 +410,35 @@ func (w *WAL) ReadEntries() ([]WALEntry, error) {
 	}
 	defer file.Close()
 
-	var entries []WALEntry
-	decoder := gob.NewDecoder(file)
+	header := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header, walMagic) {
+		return nil, fmt.Errorf("%w: missing header", ErrCorruptWAL)
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read WAL: %w", err)
+	}
 
-	for {
-		var entry WALEntry
-		if err := decoder.Decode(&entry); err != nil {
-			break // EOF or error
+	var entries []WALEntry
+	_, err = readFrames(bufio.NewReader(file), end-start, func(entry WALEntry, offset int64) {
+		if entry.Seq > seq {
+			entries = append(entries, entry)
 		}
-		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return entries, nil
 }
 
+// setSeq continues numbering after the last entry read on recovery
+func (w *WAL) setSeq(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq = seq
+}
+
 // Close closes the WAL
 func (w *WAL) Close() error {
 	w.mu.Lock()
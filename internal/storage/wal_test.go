@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func putEntry(id string) WALEntry {
+	return WALEntry{
+		Type:      WALPut,
+		Key:       "users:" + id,
+		Value:     &Document{ID: id, Data: map[string]interface{}{"name": id}},
+		Timestamp: time.Now(),
+	}
+}
+
+// readWAL reopens the log at filename and returns its entries
+func readWAL(t *testing.T, filename string) []WALEntry {
+	t.Helper()
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	defer wal.Close()
+
+	entries, err := wal.ReadEntries()
+	if err != nil {
+		t.Fatalf("ReadEntries: %v", err)
+	}
+	return entries
+}
+
+func checkKeys(t *testing.T, entries []WALEntry, keys ...string) {
+	t.Helper()
+
+	if len(entries) != len(keys) {
+		t.Fatalf("read %d entries, want %d", len(entries), len(keys))
+	}
+	for i, entry := range entries {
+		if entry.Key != keys[i] || entry.Seq != uint64(i+1) {
+			t.Errorf("entry %d = %s seq %d, want %s seq %d", i, entry.Key, entry.Seq, keys[i], i+1)
+		}
+	}
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	if err := wal.WriteBatch([]WALEntry{putEntry("a"), putEntry("b")}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+
+	entries := readWAL(t, filename)
+	checkKeys(t, entries, "users:a", "users:b")
+	if doc, ok := entries[1].Value.(*Document); !ok || doc.Data["name"] != "b" {
+		t.Errorf("value = %#v, want document b", entries[1].Value)
+	}
+}
+
+// unregistered cannot be encoded as an entry value, as gob does not know
+// the type
+type unregistered struct{ N int }
+
+func TestWALDiscardsFailedBatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	if err := wal.WriteEntry(putEntry("a")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+
+	bad := putEntry("x")
+	bad.Value = unregistered{1}
+	if err := wal.WriteBatch([]WALEntry{putEntry("b"), bad}); err == nil {
+		t.Fatal("WriteBatch with an unencodable entry succeeded")
+	}
+	if err := wal.WriteEntry(putEntry("c")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	wal.Close()
+
+	checkKeys(t, readWAL(t, filename), "users:a", "users:c")
+}
+
+func TestWALUpgradesGobStream(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	// Logs used to be one gob stream of unnumbered entries
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := gob.NewEncoder(file)
+	for _, id := range []string{"a", "b", "c"} {
+		entry := putEntry(id)
+		if err := encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	wal.setSeq(3)
+	if err := wal.WriteEntry(putEntry("d")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	wal.Close()
+
+	checkKeys(t, readWAL(t, filename), "users:a", "users:b", "users:c", "users:d")
+}
+
+func TestWALUpgradesFramesWithoutHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := bufio.NewWriter(file)
+	for i, id := range []string{"a", "b"} {
+		entry := putEntry(id)
+		entry.Seq = uint64(i + 1)
+		if _, err := writeFrame(writer, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Flush()
+	file.Close()
+
+	checkKeys(t, readWAL(t, filename), "users:a", "users:b")
+}
+
+func TestWALCutsTornTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := wal.WriteEntry(putEntry(id)); err != nil {
+			t.Fatalf("WriteEntry: %v", err)
+		}
+	}
+	wal.Close()
+
+	// Cut the last entry short, as a crash mid-write would
+	info, _ := os.Stat(filename)
+	if err := os.Truncate(filename, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL after torn write: %v", err)
+	}
+	wal.setSeq(1)
+	if err := wal.WriteEntry(putEntry("c")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	wal.Close()
+
+	// The new entry follows the last complete one
+	checkKeys(t, readWAL(t, filename), "users:a", "users:c")
+}
+
+func TestWALDropsTornBatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	if err := wal.WriteEntry(putEntry("a")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	if err := wal.WriteBatch([]WALEntry{putEntry("b"), putEntry("c"), putEntry("d")}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+
+	// Cut the last entry of the batch short; the complete ones before it
+	// must not be replayed either
+	info, _ := os.Stat(filename)
+	if err := os.Truncate(filename, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, readWAL(t, filename), "users:a")
+
+	wal, err = NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	wal.setSeq(1)
+	if err := wal.WriteBatch([]WALEntry{putEntry("e"), putEntry("f")}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+
+	checkKeys(t, readWAL(t, filename), "users:a", "users:e", "users:f")
+}
+
+func TestWALReportsCorruption(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	if err := wal.WriteBatch([]WALEntry{putEntry("a"), putEntry("b"), putEntry("c")}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+
+	// Garble the payload of the first entry
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(walMagic) + 4; i < len(walMagic)+12; i++ {
+		data[i] = 0xff
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewWAL(filename); !errors.Is(err, ErrCorruptWAL) {
+		t.Fatalf("NewWAL on corrupt log: %v, want ErrCorruptWAL", err)
+	}
+}
+
+func TestWALReadsEntriesAfterSeq(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	entries := make([]WALEntry, 3*walIndexInterval)
+	for i := range entries {
+		entries[i] = putEntry(fmt.Sprintf("u%05d", i))
+	}
+	if err := wal.WriteBatch(entries); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+
+	wal, err = NewWAL(filename)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	defer wal.Close()
+	if len(wal.marks) != 3 {
+		t.Fatalf("%d marks after reopen, want 3", len(wal.marks))
+	}
+
+	// Garble an entry before the last mark: reading after it must start
+	// from the mark and never decode the entries before
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(walMagic) + 4; i < len(walMagic)+12; i++ {
+		data[i] = 0xff
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seq := uint64(2*walIndexInterval + 10)
+	after, err := wal.ReadEntriesAfter(seq, 0)
+	if err != nil {
+		t.Fatalf("ReadEntriesAfter: %v", err)
+	}
+	if len(after) != len(entries)-int(seq) || after[0].Seq != seq+1 || after[len(after)-1].Seq != uint64(len(entries)) {
+		t.Errorf("read %d entries from seq %d, want %d from %d", len(after), after[0].Seq, len(entries)-int(seq), seq+1)
+	}
+
+	// Entries written since opening are found the same way
+	wal.setSeq(uint64(len(entries)))
+	if err := wal.WriteEntry(putEntry("last")); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	after, err = wal.ReadEntriesAfter(uint64(len(entries)), 0)
+	if err != nil {
+		t.Fatalf("ReadEntriesAfter: %v", err)
+	}
+	if len(after) != 1 || after[0].Key != "users:last" {
+		t.Errorf("read %v after the batch, want users:last", after)
+	}
+}
+
+func TestWALReadsEntriesInChunks(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	defer wal.Close()
+
+	const batchSize, batches = 64, 3 * walIndexInterval / 64
+	for b := 0; b < batches; b++ {
+		batch := make([]WALEntry, batchSize)
+		for i := range batch {
+			batch[i] = putEntry(fmt.Sprintf("u%05d", b*batchSize+i))
+		}
+		if err := wal.WriteBatch(batch); err != nil {
+			t.Fatalf("WriteBatch: %v", err)
+		}
+	}
+
+	// Chunks end at the first position kept past the limit and together
+	// hold every entry once
+	var seq uint64
+	for chunks := 0; ; chunks++ {
+		chunk, err := wal.ReadEntriesAfter(seq, 100)
+		if err != nil {
+			t.Fatalf("ReadEntriesAfter(%d): %v", seq, err)
+		}
+		if len(chunk) == 0 {
+			if chunks != 3 || seq != batchSize*batches {
+				t.Errorf("read %d entries in %d chunks, want %d in 3", seq, chunks, batchSize*batches)
+			}
+			break
+		}
+		if len(chunk) > walIndexInterval {
+			t.Errorf("chunk after %d holds %d entries, want at most %d", seq, len(chunk), walIndexInterval)
+		}
+		for _, entry := range chunk {
+			if entry.Seq != seq+1 {
+				t.Fatalf("read entry %d after %d", entry.Seq, seq)
+			}
+			seq = entry.Seq
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package triggers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned for deliveries that would connect to a
+// loopback, link-local or private address of a host not allowed to have
+// one
+var ErrBlockedAddress = errors.New("address is not allowed for webhooks")
+
+// errRedirect fails deliveries answered with a redirect
+var errRedirect = errors.New("receiver redirected the delivery")
+
+// blockedIP reports whether ip is an address webhooks may not reach
+// without their host being allowed: one of this machine, of its local
+// networks or of cloud metadata services.
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast()
+}
+
+// hostSet indexes host names case-insensitively
+func hostSet(hosts []string) map[string]bool {
+	set := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		set[strings.ToLower(host)] = true
+	}
+	return set
+}
+
+// newClient returns the client deliveries are posted with. Redirects are
+// not followed, and the address of every connection is checked after the
+// host name is resolved, so that neither a redirect nor DNS can point a
+// trigger at a blocked address.
+func newClient(timeout time.Duration, allowed map[string]bool) *http.Client {
+	open := &net.Dialer{Timeout: 30 * time.Second}
+	guarded := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err == nil && allowed[strings.ToLower(host)] {
+				return open.DialContext(ctx, network, address)
+			}
+			return guarded.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errRedirect
+		},
+	}
+}
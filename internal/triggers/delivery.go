@@ -0,0 +1,377 @@
+package triggers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"coffedb/internal/storage"
+)
+
+const (
+	queueDir = "queue" // pending deliveries, one file each
+	deadDir  = "dead"  // deliveries that ran out of attempts
+)
+
+// Delivery statuses
+const (
+	DeliveryPending = "pending"
+	DeliveryDead    = "dead"
+)
+
+// Delivery is a change event to post to a trigger's URL. Its ID, derived
+// from the trigger and the event, is sent with every attempt so that
+// receivers can discard repeats.
+type Delivery struct {
+	ID          string              `json:"id"`
+	TriggerID   string              `json:"trigger_id"`
+	Event       storage.ChangeEvent `json:"event"`
+	Attempts    int                 `json:"attempts"`
+	NextAttempt time.Time           `json:"next_attempt"`
+	LastError   string              `json:"last_error,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+}
+
+// payload is the body of a delivery request
+type payload struct {
+	ID      string              `json:"id"`
+	Trigger string              `json:"trigger"`
+	Attempt int                 `json:"attempt"`
+	Event   storage.ChangeEvent `json:"event"`
+}
+
+// Sign computes the signature of a delivery request, sent in the
+// X-CoffeDB-Signature header as "sha256=" followed by the hex digest.
+// Receivers recompute it from the X-CoffeDB-Timestamp header and the raw
+// body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries lists the pending or dead deliveries of a trigger, oldest
+// first
+func (m *Manager) Deliveries(collection, id, status string) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getLocked(collection, id); err != nil {
+		return nil, err
+	}
+
+	source := m.queue
+	if status == DeliveryDead {
+		source = m.dead
+	}
+
+	deliveries := []Delivery{}
+	for _, d := range source {
+		if d.TriggerID == id {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Event.Seq < deliveries[j].Event.Seq
+	})
+	return deliveries, nil
+}
+
+// Retry moves a dead delivery back to the queue with fresh attempts
+func (m *Manager) Retry(collection, id, deliveryID string) (*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getLocked(collection, id); err != nil {
+		return nil, err
+	}
+	d, exists := m.dead[deliveryID]
+	if !exists || d.TriggerID != id {
+		return nil, ErrDeliveryNotFound
+	}
+
+	retried := *d
+	retried.Attempts = 0
+	retried.NextAttempt = time.Now()
+	if err := writeJSON(m.deliveryPath(queueDir, deliveryID), &retried); err != nil {
+		return nil, fmt.Errorf("failed to queue delivery: %w", err)
+	}
+	os.Remove(m.deliveryPath(deadDir, deliveryID))
+	delete(m.dead, deliveryID)
+	m.queue[deliveryID] = &retried
+
+	m.signal()
+	result := retried
+	return &result, nil
+}
+
+// enqueue stores a delivery per event and advances the trigger's position
+// past them
+func (m *Manager) enqueue(t *trigger, events []storage.ChangeEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.deleted {
+		return nil
+	}
+
+	now := time.Now()
+	for _, event := range events {
+		d := &Delivery{
+			ID:          fmt.Sprintf("%s-%d", t.def.ID, event.Seq),
+			TriggerID:   t.def.ID,
+			Event:       event,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+		if err := writeJSON(m.deliveryPath(queueDir, d.ID), d); err != nil {
+			return err
+		}
+		m.queue[d.ID] = d
+		t.def.Seq = event.Seq
+	}
+
+	if err := m.saveTriggersLocked(); err != nil {
+		// The queued deliveries keep the position across a restart
+		log.Printf("trigger %s: %v", t.def.ID, err)
+	}
+	m.signal()
+	return nil
+}
+
+// signal wakes the scheduler
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands due deliveries to a pool of workers
+func (m *Manager) schedule() {
+	defer m.wg.Done()
+
+	jobs := make(chan *Delivery)
+	for i := 0; i < m.config.Workers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for d := range jobs {
+				m.attempt(d)
+			}
+		}()
+	}
+	defer close(jobs)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		due, next := m.due()
+		for _, d := range due {
+			select {
+			case jobs <- d:
+			case <-m.done:
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next > 0 {
+			timer.Reset(next)
+		}
+
+		select {
+		case <-timer.C:
+		case <-m.wake:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// due claims the deliveries whose next attempt has come, returning them
+// with the time until the next one that has not
+func (m *Manager) due() ([]*Delivery, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []*Delivery
+	var next time.Duration
+	for id, d := range m.queue {
+		if m.inflight[id] {
+			continue
+		}
+		if wait := d.NextAttempt.Sub(now); wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		m.inflight[id] = true
+		copied := *d
+		due = append(due, &copied)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Event.Seq < due[j].Event.Seq
+	})
+	return due, next
+}
+
+// attempt posts a delivery and records the outcome
+func (m *Manager) attempt(d *Delivery) {
+	m.mu.Lock()
+	t, exists := m.triggers[d.TriggerID]
+	var def Trigger
+	if exists {
+		def = t.def
+	}
+	m.mu.Unlock()
+
+	var err error
+	if exists {
+		d.Attempts++
+		err = m.post(def, d)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.signal()
+	delete(m.inflight, d.ID)
+
+	if _, queued := m.queue[d.ID]; !queued || !exists || t.deleted {
+		return
+	}
+
+	now := time.Now()
+	if err == nil {
+		delete(m.queue, d.ID)
+		os.Remove(m.deliveryPath(queueDir, d.ID))
+		t.status.Delivered++
+		t.status.LastDelivery = &now
+		return
+	}
+
+	t.status.Failures++
+	t.status.LastError = err.Error()
+	d.LastError = err.Error()
+
+	if d.Attempts >= m.config.MaxAttempts {
+		log.Printf("trigger %s: delivery %s failed after %d attempts: %v", def.ID, d.ID, d.Attempts, err)
+		if err := writeJSON(m.deliveryPath(deadDir, d.ID), d); err != nil {
+			log.Printf("trigger %s: failed to dead-letter delivery %s: %v", def.ID, d.ID, err)
+			return
+		}
+		delete(m.queue, d.ID)
+		os.Remove(m.deliveryPath(queueDir, d.ID))
+		m.dead[d.ID] = d
+		return
+	}
+
+	d.NextAttempt = now.Add(m.backoff(d.Attempts))
+	if err := writeJSON(m.deliveryPath(queueDir, d.ID), d); err != nil {
+		log.Printf("trigger %s: failed to save delivery %s: %v", def.ID, d.ID, err)
+	}
+	m.queue[d.ID] = d
+}
+
+// backoff returns the delay after a delivery's nth failed attempt
+func (m *Manager) backoff(attempts int) time.Duration {
+	delay := time.Duration(m.config.BackoffMs) * time.Millisecond
+	limit := time.Duration(m.config.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// post sends a delivery to the trigger's URL. Any 2xx response is a
+// success.
+func (m *Manager) post(def Trigger, d *Delivery) error {
+	body, err := json.Marshal(payload{ID: d.ID, Trigger: def.ID, Attempt: d.Attempts, Event: d.Event})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, def.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CoffeDB-Webhook")
+	req.Header.Set("X-CoffeDB-Delivery", d.ID)
+	req.Header.Set("X-CoffeDB-Trigger", def.ID)
+	req.Header.Set("X-CoffeDB-Event", d.Event.Op)
+	req.Header.Set("X-CoffeDB-Timestamp", timestamp)
+	req.Header.Set("X-CoffeDB-Signature", "sha256="+Sign(def.Secret, timestamp, body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// loadDeliveries reads the deliveries stored in a subdirectory
+func (m *Manager) loadDeliveries(sub string) (map[string]*Delivery, error) {
+	files, err := os.ReadDir(filepath.Join(m.dir, sub))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	deliveries := make(map[string]*Delivery)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(m.dir, sub, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delivery: %w", err)
+		}
+		var d Delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			log.Printf("skipping unreadable delivery %s: %v", path, err)
+			continue
+		}
+		deliveries[d.ID] = &d
+	}
+	return deliveries, nil
+}
+
+func (m *Manager) deliveryPath(sub, id string) string {
+	return filepath.Join(m.dir, sub, id+".json")
+}
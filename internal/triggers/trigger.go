@@ -0,0 +1,495 @@
+package triggers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"coffedb/internal/config"
+	"coffedb/internal/fileutil"
+	"coffedb/internal/query"
+	"coffedb/internal/storage"
+)
+
+// ErrTriggerNotFound is returned for operations on a missing trigger
+var ErrTriggerNotFound = errors.New("trigger not found")
+
+// ErrDeliveryNotFound is returned for operations on a missing delivery
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// ErrInvalidTrigger is returned for malformed trigger definitions
+var ErrInvalidTrigger = errors.New("invalid trigger")
+
+const triggersFile = "triggers.json"
+
+// Trigger delivers the changes to a collection to a URL. Events selects
+// the kinds of changes, all of them when empty, and Filter the documents.
+// Seq is the sequence number of the last change queued for delivery.
+type Trigger struct {
+	ID         string                 `json:"id"`
+	Collection string                 `json:"collection"`
+	Events     []string               `json:"events"`
+	Filter     map[string]interface{} `json:"filter,omitempty"`
+	URL        string                 `json:"url"`
+	Secret     string                 `json:"secret,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	Seq        uint64                 `json:"seq"`
+}
+
+// Status reports the deliveries of a trigger. Delivered, Failures and
+// LastError cover the time since the server started.
+type Status struct {
+	Pending      int        `json:"pending"`
+	Dead         int        `json:"dead"`
+	Delivered    int64      `json:"delivered"`
+	Failures     int64      `json:"failures"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// TriggerInfo describes a trigger with its delivery status. The secret is
+// only returned when the trigger is created.
+type TriggerInfo struct {
+	Trigger
+	Status Status `json:"status"`
+}
+
+// trigger is a registered trigger with the stream feeding it
+type trigger struct {
+	def     Trigger
+	stream  *storage.ChangeStream
+	status  Status
+	deleted bool
+}
+
+// Manager runs the triggers of a database: it follows their change
+// streams, queues a delivery per change on disk and posts the deliveries,
+// retrying failed ones with exponential backoff until they succeed or are
+// dead-lettered. Deliveries are made at least once and, across
+// deliveries, in no particular order.
+type Manager struct {
+	engine  *storage.Engine
+	dir     string
+	config  config.TriggersConfig
+	client  *http.Client
+	allowed map[string]bool // hosts that may have blocked addresses
+
+	mu       sync.Mutex
+	triggers map[string]*trigger
+	queue    map[string]*Delivery // pending deliveries by ID
+	dead     map[string]*Delivery // dead letters by ID
+	inflight map[string]bool
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewManager loads the triggers and delivery queue kept in dir and starts
+// delivering. Zero config values take their defaults.
+func NewManager(engine *storage.Engine, dir string, cfg config.TriggersConfig) (*Manager, error) {
+	defaults := config.Default().Triggers
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaults.Workers
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = defaults.TimeoutMs
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaults.MaxAttempts
+	}
+	if cfg.BackoffMs <= 0 {
+		cfg.BackoffMs = defaults.BackoffMs
+	}
+	if cfg.MaxBackoffMs <= 0 {
+		cfg.MaxBackoffMs = defaults.MaxBackoffMs
+	}
+
+	allowed := hostSet(cfg.AllowedHosts)
+	m := &Manager{
+		engine:   engine,
+		dir:      dir,
+		config:   cfg,
+		client:   newClient(time.Duration(cfg.TimeoutMs)*time.Millisecond, allowed),
+		allowed:  allowed,
+		triggers: make(map[string]*trigger),
+		inflight: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	for _, sub := range []string{queueDir, deadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create trigger directory: %w", err)
+		}
+	}
+
+	defs, err := m.loadTriggers()
+	if err != nil {
+		return nil, err
+	}
+	if m.queue, err = m.loadDeliveries(queueDir); err != nil {
+		return nil, err
+	}
+	if m.dead, err = m.loadDeliveries(deadDir); err != nil {
+		return nil, err
+	}
+
+	for _, def := range defs {
+		m.triggers[def.ID] = &trigger{def: def}
+	}
+
+	// Changes queued after the last saved position are not queued again
+	for _, deliveries := range []map[string]*Delivery{m.queue, m.dead} {
+		for _, d := range deliveries {
+			if t, exists := m.triggers[d.TriggerID]; exists && d.Event.Seq > t.def.Seq {
+				t.def.Seq = d.Event.Seq
+			}
+		}
+	}
+
+	for _, t := range m.triggers {
+		m.startWatch(t)
+	}
+
+	m.wg.Add(1)
+	go m.schedule()
+
+	return m, nil
+}
+
+// Create registers a trigger on a collection, delivering the changes made
+// from now on. A secret to sign deliveries is generated unless given.
+func (m *Manager) Create(collection string, def Trigger) (*Trigger, error) {
+	def.Collection = collection
+	if err := m.validateTrigger(&def); err != nil {
+		return nil, err
+	}
+
+	def.ID = randomHex(8)
+	if def.Secret == "" {
+		def.Secret = randomHex(32)
+	}
+	def.CreatedAt = time.Now()
+	def.Seq = m.engine.ChangeSeq()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed() {
+		return nil, errors.New("trigger manager is closed")
+	}
+	t := &trigger{def: def}
+	m.triggers[def.ID] = t
+	if err := m.saveTriggersLocked(); err != nil {
+		delete(m.triggers, def.ID)
+		return nil, err
+	}
+	m.startWatch(t)
+
+	created := def
+	return &created, nil
+}
+
+// validateTrigger checks a trigger definition. URLs naming a blocked
+// address are rejected here; host names resolving to one fail when
+// delivered to.
+func (m *Manager) validateTrigger(def *Trigger) error {
+	target, err := url.Parse(def.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%w: url must be an http or https URL", ErrInvalidTrigger)
+	}
+	if host := strings.ToLower(target.Hostname()); !m.allowed[host] {
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && blockedIP(ip)) {
+			return fmt.Errorf("%w: url must not point to a loopback, link-local or private address", ErrInvalidTrigger)
+		}
+	}
+
+	for _, event := range def.Events {
+		switch event {
+		case storage.ChangeInsert, storage.ChangeUpdate, storage.ChangeDelete, storage.ChangeDrop:
+		default:
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidTrigger, event)
+		}
+	}
+
+	if err := query.ValidateFilter(def.Filter); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTrigger, err)
+	}
+	return nil
+}
+
+// List describes the triggers of a collection, oldest first
+func (m *Manager) List(collection string) []TriggerInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := []TriggerInfo{}
+	for _, t := range m.triggers {
+		if t.def.Collection == collection {
+			infos = append(infos, m.infoLocked(t))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// Get describes a single trigger
+func (m *Manager) Get(collection, id string) (*TriggerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.getLocked(collection, id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := m.infoLocked(t)
+	return &info, nil
+}
+
+func (m *Manager) getLocked(collection, id string) (*trigger, error) {
+	t, exists := m.triggers[id]
+	if !exists || t.def.Collection != collection {
+		return nil, ErrTriggerNotFound
+	}
+	return t, nil
+}
+
+func (m *Manager) infoLocked(t *trigger) TriggerInfo {
+	info := TriggerInfo{Trigger: t.def, Status: t.status}
+	info.Secret = ""
+	for _, d := range m.queue {
+		if d.TriggerID == t.def.ID {
+			info.Status.Pending++
+		}
+	}
+	for _, d := range m.dead {
+		if d.TriggerID == t.def.ID {
+			info.Status.Dead++
+		}
+	}
+	return info
+}
+
+// Delete removes a trigger along with its pending and dead deliveries
+func (m *Manager) Delete(collection, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.getLocked(collection, id)
+	if err != nil {
+		return err
+	}
+
+	delete(m.triggers, id)
+	if err := m.saveTriggersLocked(); err != nil {
+		m.triggers[id] = t
+		return err
+	}
+	t.deleted = true
+	if t.stream != nil {
+		t.stream.Close()
+	}
+
+	for deliveryID, d := range m.queue {
+		if d.TriggerID == id {
+			delete(m.queue, deliveryID)
+			os.Remove(m.deliveryPath(queueDir, deliveryID))
+		}
+	}
+	for deliveryID, d := range m.dead {
+		if d.TriggerID == id {
+			delete(m.dead, deliveryID)
+			os.Remove(m.deliveryPath(deadDir, deliveryID))
+		}
+	}
+	return nil
+}
+
+// Close stops following changes and waits for deliveries in progress
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed() {
+		m.mu.Unlock()
+		return nil
+	}
+	close(m.done)
+	for _, t := range m.triggers {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveTriggersLocked()
+}
+
+func (m *Manager) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWatch follows the changes of a trigger from its saved position
+func (m *Manager) startWatch(t *trigger) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for m.watch(t) {
+			// Back off before resuming a stream that failed
+			select {
+			case <-time.After(time.Second):
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// watch queues the changes of one stream, reporting whether it should be
+// resumed
+func (m *Manager) watch(t *trigger) bool {
+	m.mu.Lock()
+	if t.deleted {
+		m.mu.Unlock()
+		return false
+	}
+	def := t.def
+	m.mu.Unlock()
+
+	stream, err := m.engine.Watch(def.Collection, storage.WatchOptions{
+		Resume: true,
+		After:  def.Seq,
+		Ops:    def.Events,
+		Filter: def.Filter,
+	})
+	if errors.Is(err, storage.ErrInvalidResumeToken) {
+		// The log was reset; follow it from its end
+		log.Printf("trigger %s: %v, following new changes", def.ID, err)
+		m.mu.Lock()
+		t.def.Seq = m.engine.ChangeSeq()
+		m.mu.Unlock()
+		return true
+	}
+	if err != nil {
+		log.Printf("trigger %s: failed to watch changes: %v", def.ID, err)
+		return true
+	}
+
+	m.mu.Lock()
+	if t.deleted || m.closed() {
+		m.mu.Unlock()
+		stream.Close()
+		return false
+	}
+	t.stream = stream
+	m.mu.Unlock()
+	defer stream.Close()
+
+	for event := range stream.Events() {
+		// Queue the changes that are ready together, saving the position
+		// once
+		events := []storage.ChangeEvent{event}
+	more:
+		for len(events) < 100 {
+			select {
+			case next, ok := <-stream.Events():
+				if !ok {
+					break more
+				}
+				events = append(events, next)
+			default:
+				break more
+			}
+		}
+
+		if err := m.enqueue(t, events); err != nil {
+			log.Printf("trigger %s: failed to queue delivery: %v", def.ID, err)
+			return true
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		log.Printf("trigger %s: %v, resuming", def.ID, err)
+		return true
+	}
+	return false
+}
+
+// loadTriggers reads the trigger definitions
+func (m *Manager) loadTriggers() ([]Trigger, error) {
+	data, err := os.ReadFile(filepath.Join(m.dir, triggersFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read triggers: %w", err)
+	}
+
+	var defs []Trigger
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("failed to decode triggers: %w", err)
+	}
+	return defs, nil
+}
+
+// saveTriggersLocked writes the trigger definitions with their positions
+func (m *Manager) saveTriggersLocked() error {
+	defs := make([]Trigger, 0, len(m.triggers))
+	for _, t := range m.triggers {
+		defs = append(defs, t.def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].CreatedAt.Before(defs[j].CreatedAt)
+	})
+
+	if err := writeJSON(filepath.Join(m.dir, triggersFile), defs); err != nil {
+		return fmt.Errorf("failed to save triggers: %w", err)
+	}
+	return nil
+}
+
+// writeJSON atomically replaces a file with the JSON encoding of v
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
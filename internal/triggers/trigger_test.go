@@ -0,0 +1,277 @@
+package triggers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"coffedb/internal/config"
+	"coffedb/internal/storage"
+)
+
+// receiver is a webhook endpoint recording the deliveries it accepts
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	received []payload
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		w.WriteHeader(r.status)
+		if r.status != http.StatusOK {
+			return
+		}
+		var p payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("undecodable delivery %q", body)
+		}
+		r.received = append(r.received, p)
+		r.headers = append(r.headers, req.Header)
+		r.bodies = append(r.bodies, body)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.received)
+}
+
+// eventually fails the test unless cond becomes true within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func newTestEngine(t *testing.T) *storage.Engine {
+	t.Helper()
+
+	cfg := config.Default().Storage
+	cfg.DataDir = t.TempDir()
+	engine, err := storage.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+func newTestManager(t *testing.T, engine *storage.Engine, dir string) *Manager {
+	t.Helper()
+
+	m, err := NewManager(engine, dir, config.TriggersConfig{MaxAttempts: 2, BackoffMs: 1, MaxBackoffMs: 5, AllowedHosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestTriggerDeliversSignedEvents(t *testing.T) {
+	engine := newTestEngine(t)
+	r := newReceiver(t)
+	m := newTestManager(t, engine, t.TempDir())
+
+	engine.Put("users", "before", map[string]interface{}{"active": true})
+	created, err := m.Create("users", Trigger{
+		URL:    r.URL,
+		Events: []string{storage.ChangeInsert, storage.ChangeUpdate},
+		Filter: map[string]interface{}{"active": true},
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if created.Secret == "" {
+		t.Fatal("no secret was generated")
+	}
+
+	// Only later writes matching the events and filter are delivered
+	engine.Put("users", "u1", map[string]interface{}{"active": false})
+	engine.Put("users", "u2", map[string]interface{}{"active": true})
+	engine.Delete("users", "u2")
+	engine.Put("logs", "l1", map[string]interface{}{"active": true})
+	engine.Put("users", "u1", map[string]interface{}{"active": true})
+
+	eventually(t, "two deliveries", func() bool { return r.count() == 2 })
+	r.mu.Lock()
+	// Deliveries are made in no particular order
+	order := []int{0, 1}
+	if r.received[0].Event.Seq > r.received[1].Event.Seq {
+		order = []int{1, 0}
+	}
+	for i, want := range []string{storage.ChangeInsert, storage.ChangeUpdate} {
+		j := order[i]
+		p, header := r.received[j], r.headers[j]
+		if p.Event.Op != want || p.Trigger != created.ID || p.ID != header.Get("X-CoffeDB-Delivery") {
+			t.Errorf("delivery %d = %+v, want %s from trigger %s", i, p, want, created.ID)
+		}
+		signature := "sha256=" + Sign(created.Secret, header.Get("X-CoffeDB-Timestamp"), r.bodies[j])
+		if header.Get("X-CoffeDB-Signature") != signature {
+			t.Errorf("delivery %d signature %q, want %q", i, header.Get("X-CoffeDB-Signature"), signature)
+		}
+	}
+	r.mu.Unlock()
+
+	eventually(t, "the delivered count", func() bool {
+		info, _ := m.Get("users", created.ID)
+		return info.Status.Delivered == 2 && info.Status.Pending == 0
+	})
+	if info, _ := m.Get("users", created.ID); info.Secret != "" {
+		t.Errorf("trigger info shows the secret %q", info.Secret)
+	}
+}
+
+func TestFailedDeliveriesAreRetriedAndDeadLettered(t *testing.T) {
+	engine := newTestEngine(t)
+	r := newReceiver(t)
+	r.setStatus(http.StatusServiceUnavailable)
+	m := newTestManager(t, engine, t.TempDir())
+
+	created, err := m.Create("users", Trigger{URL: r.URL})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	engine.Put("users", "u1", map[string]interface{}{})
+
+	var dead []Delivery
+	eventually(t, "a dead letter", func() bool {
+		dead, _ = m.Deliveries("users", created.ID, DeliveryDead)
+		return len(dead) == 1
+	})
+	if dead[0].Attempts != 2 || dead[0].LastError == "" {
+		t.Errorf("dead letter = %+v, want 2 attempts and the last error", dead[0])
+	}
+
+	r.setStatus(http.StatusOK)
+	if _, err := m.Retry("users", created.ID, dead[0].ID); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	eventually(t, "the retried delivery", func() bool { return r.count() == 1 })
+	if _, err := m.Retry("users", created.ID, dead[0].ID); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("second Retry: %v, want ErrDeliveryNotFound", err)
+	}
+}
+
+func TestDeliveriesSurviveRestart(t *testing.T) {
+	engine := newTestEngine(t)
+	r := newReceiver(t)
+	r.setStatus(http.StatusServiceUnavailable)
+	dir := t.TempDir()
+
+	m, err := NewManager(engine, dir, config.TriggersConfig{BackoffMs: 50, AllowedHosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	created, err := m.Create("users", Trigger{URL: r.URL})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	engine.Put("users", "u1", map[string]interface{}{})
+	eventually(t, "a queued delivery", func() bool {
+		pending, _ := m.Deliveries("users", created.ID, DeliveryPending)
+		return len(pending) == 1
+	})
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A change made while the manager is down is delivered once it is
+	// back, along with the queued one
+	engine.Put("users", "u2", map[string]interface{}{})
+	r.setStatus(http.StatusOK)
+	m = newTestManager(t, engine, dir)
+
+	eventually(t, "both deliveries", func() bool { return r.count() >= 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := r.count(); n != 2 {
+		t.Errorf("%d deliveries, want 2", n)
+	}
+}
+
+func TestCreateRejectsInvalidTriggers(t *testing.T) {
+	m := newTestManager(t, newTestEngine(t), t.TempDir())
+
+	for _, def := range []Trigger{
+		{URL: "ftp://example.com/hook"},
+		{URL: "http://"},
+		{URL: "http://example.com/hook", Events: []string{"merge"}},
+		{URL: "http://example.com/hook", Filter: map[string]interface{}{"$bad": 1}},
+		{URL: "http://localhost:8080/hook"},
+		{URL: "http://10.0.0.7/hook"},
+		{URL: "http://169.254.169.254/latest/meta-data/"},
+		{URL: "http://[::1]:8080/hook"},
+	} {
+		if _, err := m.Create("users", def); !errors.Is(err, ErrInvalidTrigger) {
+			t.Errorf("Create(%+v): %v, want ErrInvalidTrigger", def, err)
+		}
+	}
+
+	if err := m.Delete("users", "missing"); !errors.Is(err, ErrTriggerNotFound) {
+		t.Errorf("Delete of a missing trigger: %v, want ErrTriggerNotFound", err)
+	}
+}
+
+func TestDeliveriesCannotReachBlockedAddresses(t *testing.T) {
+	r := newReceiver(t)
+
+	m, err := NewManager(newTestEngine(t), t.TempDir(), config.TriggersConfig{})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	if _, err := m.Create("users", Trigger{URL: r.URL}); !errors.Is(err, ErrInvalidTrigger) {
+		t.Errorf("Create with a loopback URL: %v, want ErrInvalidTrigger", err)
+	}
+
+	// Host names are checked by the address they resolve to
+	client := newClient(time.Second, nil)
+	if _, err := client.Post(strings.Replace(r.URL, "127.0.0.1", "localhost", 1), "application/json", nil); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Post to localhost: %v, want ErrBlockedAddress", err)
+	}
+	if n := r.count(); n != 0 {
+		t.Errorf("%d deliveries reached the receiver, want 0", n)
+	}
+}
+
+func TestDeliveriesDoNotFollowRedirects(t *testing.T) {
+	r := newReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(r.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	client := newClient(time.Second, hostSet([]string{"127.0.0.1"}))
+	if _, err := client.Post(redirect.URL, "application/json", strings.NewReader("{}")); !errors.Is(err, errRedirect) {
+		t.Errorf("Post to a redirect: %v, want errRedirect", err)
+	}
+	if n := r.count(); n != 0 {
+		t.Errorf("%d deliveries followed the redirect, want 0", n)
+	}
+}